@@ -0,0 +1,171 @@
+package main
+
+// This file contains the loading of the configuration file supplying the
+// defaults of the flags.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var configFile = flag.String("config", "", "Configuration file mapping flag names to values, used for the flags not given on the command line. Defaults to the .implgen.json, .implgen.yaml or .implgen.yml file of the source directory, or of the current directory.")
+
+// configNames are the names of the configuration files looked up when
+// -config isn't given, in order.
+var configNames = []string{".implgen.json", ".implgen.yaml", ".implgen.yml"}
+
+// findConfig returns the configuration file: path if it isn't empty, else
+// the first of configNames found in dir, or the empty string if there's
+// none.
+func findConfig(path, dir string) string {
+	if path != "" {
+		return path
+	}
+	for _, name := range configNames {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err == nil && !fi.IsDir() {
+			return filepath.Join(dir, name)
+		}
+	}
+	return ""
+}
+
+// applyConfig sets the flags of fs that weren't set on the command line to
+// their values in the configuration file.
+func applyConfig(fs *flag.FlagSet, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values, err := parseConfig(path, data)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("%v: unknown flag %v", path, name)
+		}
+		if set[name] || name == "config" {
+			continue
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			return fmt.Errorf("%v: bad %v: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// parseConfig parses the configuration file at path, a JSON object if its
+// extension is .json, else a YAML mapping, from flag names to values.
+func parseConfig(path string, data []byte) (map[string]string, error) {
+	if filepath.Ext(path) == ".json" {
+		return parseJSONConfig(data)
+	}
+	return parseYAMLConfig(data)
+}
+
+// parseJSONConfig parses a JSON object of strings, numbers and booleans.
+func parseJSONConfig(data []byte) (map[string]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw map[string]interface{}
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(raw))
+	for name, v := range raw {
+		switch v := v.(type) {
+		case string:
+			values[name] = v
+		case json.Number, bool:
+			values[name] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("%v isn't a string, a number or a boolean", name)
+		}
+	}
+	return values, nil
+}
+
+// parseYAMLConfig parses the subset of YAML of a flat mapping of plain,
+// single-quoted or double-quoted scalars, e.g.
+//
+//	package: mocks
+//	body: "zero"
+//	assert: true # comment
+func parseYAMLConfig(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if trimmed := strings.TrimSpace(line); trimmed == "" || trimmed == "---" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon <= 0 || line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("line %d: want name: value, got %q", i+1, line)
+		}
+		name, value := strings.TrimSpace(line[:colon]), strings.TrimSpace(line[colon+1:])
+		switch {
+		case strings.HasPrefix(value, `"`):
+			end := closingQuote(value)
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated string %v", i+1, value)
+			}
+			unquoted, err := strconv.Unquote(value[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad string %v: %v", i+1, value, err)
+			}
+			if rest := strings.TrimSpace(value[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+				return nil, fmt.Errorf("line %d: unexpected %q after the string", i+1, rest)
+			}
+			value = unquoted
+		case strings.HasPrefix(value, "'"):
+			end := strings.Index(strings.Replace(value[1:], "''", "  ", -1), "'")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated string %v", i+1, value)
+			}
+			rest := strings.TrimSpace(value[end+2:])
+			if rest != "" && !strings.HasPrefix(rest, "#") {
+				return nil, fmt.Errorf("line %d: unexpected %q after the string", i+1, rest)
+			}
+			value = strings.Replace(value[1:end+1], "''", "'", -1)
+		default:
+			if hash := strings.Index(value, " #"); hash >= 0 {
+				value = strings.TrimSpace(value[:hash])
+			}
+		}
+		if _, ok := values[name]; ok {
+			return nil, fmt.Errorf("line %d: duplicate %v", i+1, name)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// closingQuote returns the index of the double quote closing the string s
+// starts with, or -1.
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
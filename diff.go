@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines around the changes of a hunk.
+const diffContext = 3
+
+// diffLine is a line of a diff: kind is ' ' for an unchanged line, '-' for
+// a deleted one and '+' for an inserted one.
+type diffLine struct {
+	kind byte
+	text string // with its trailing newline, if any
+}
+
+// unifiedDiff returns the unified diff turning a, named nameA, into b,
+// named nameB, like diff -u, or the empty string if they are equal.
+func unifiedDiff(nameA, nameB string, a, b []byte) string {
+	lines := diffLines(splitLines(string(a)), splitLines(string(b)))
+
+	var out strings.Builder
+	aLine, bLine := 1, 1 // numbers of the next lines of a and b
+	for i := 0; i < len(lines); {
+		if lines[i].kind == ' ' {
+			aLine++
+			bLine++
+			i++
+			continue
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %v\n+++ %v\n", nameA, nameB)
+		}
+
+		// The hunk starts diffContext lines before the change and ends
+		// diffContext lines after the last change closer than twice that.
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end, unchanged := i, 0
+		for j := i; j < len(lines) && unchanged <= 2*diffContext; j++ {
+			if lines[j].kind == ' ' {
+				unchanged++
+				continue
+			}
+			end, unchanged = j+1, 0
+		}
+		if end += diffContext; end > len(lines) {
+			end = len(lines)
+		}
+
+		aStart, bStart := aLine-(i-start), bLine-(i-start)
+		var aCount, bCount int
+		for _, l := range lines[start:end] {
+			if l.kind != '+' {
+				aCount++
+			}
+			if l.kind != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%v +%v @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+		for _, l := range lines[start:end] {
+			out.WriteByte(l.kind)
+			out.WriteString(l.text)
+			if !strings.HasSuffix(l.text, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		for _, l := range lines[i:end] {
+			if l.kind != '+' {
+				aLine++
+			}
+			if l.kind != '-' {
+				bLine++
+			}
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// hunkRange formats the range of a hunk, whose first line is start, as
+// start,count. An empty range starts at the line before it.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		start--
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// splitLines splits s after its newlines.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the lines of a and b in the order of a diff turning a
+// into b, keeping a longest common subsequence unchanged.
+func diffLines(a, b []string) []diffLine {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	return lines
+}
@@ -2,33 +2,160 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"go/ast"
 	"go/format"
+	"go/parser"
 	"go/token"
-	"log"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/ssoor/implgen/model"
 )
 
+// Method body modes, selected by -body or a //implgen:body=<mode> directive.
+const (
+	bodyPanic        = "panic"         // panic with a "Not implemented" message
+	bodyZero         = "zero"          // return the zero values of the results
+	bodyLiteral      = "literal"       // like bodyZero, with composite literals for the structs
+	bodyTrace        = "trace"         // like bodyPanic, with the location of the caller
+	bodyError        = "error"         // like bodyZero, with a "Not implemented" error as the last result if it is an error
+	bodyErrorWrapped = "error_wrapped" // like bodyError, with the method name wrapping an errNotImplemented sentinel as the error
+	bodyContext      = "context"       // like bodyPanic, returning the error of the leading context first if it is done
+)
+
 type generator struct {
-	buf                       bytes.Buffer
-	head                      bool
-	dstFileName               string
-	indent                    string
-	mockNames                 map[string]string // may be empty
-	filename                  string            // may be empty
-	srcPackage, srcInterfaces string            // may be empty
-	copyrightHeader           string
+	buf         bytes.Buffer
+	head        bool
+	dstFileName string
+	indent      string
+
+	selectOptions
+	structOptions
+	bodyOptions
+	decoratorOptions
+	declOptions
+	outputOptions
+
+	inPackage                 bool               // output goes to the package of the interfaces
+	partial                   map[string]bool    // interfaces lacking excluded methods, may be nil
+	filename                  string             // may be empty
+	srcPackage, srcInterfaces string             // may be empty
+	errSentinel               string             // name of the error wrapped by bodyErrorWrapped, set by generate
+	structs                   map[string]bool    // "importpath.Type" of the structs of the source package, set by generate
+	srcPackagePath            string             // import path of the implemented interfaces, may be empty
+	stderr                    io.Writer          // warnings output, may be nil, meaning os.Stderr
+	stdout                    io.Writer          // output other than a file, may be nil, meaning os.Stdout
+	tested                    []*model.Interface // interfaces implemented by Generate, for GenerateTests
+	report                    *genReport         // collects the -report summary, may be nil
+
+	typeNames identifierAllocator // package level type names, may be nil
 
 	packageMap map[string]string // map from import path to package name
 }
 
+// selectOptions select the interfaces to implement and the warnings about
+// them.
+type selectOptions struct {
+	mockInterfaces     map[string]bool // interfaces to implement, may be empty
+	excludeInterfaces  map[string]bool // interfaces not to implement, may be empty
+	excludeMethods     map[string]bool // "Interface.Method" => method not to implement, may be empty
+	interfacesRegex    *regexp.Regexp  // interfaces to implement, may be nil
+	tagMarker          string          // only implement the interfaces whose doc contains it, may be empty
+	sortInterfaces     bool            // implement the interfaces in alphabetical order rather than in source order
+	allowEmpty         bool            // don't warn about interfaces without methods
+	warnMissingContext bool            // warn about methods without a leading context.Context
+}
+
+// structOptions shape the implementations: their names, their fields and
+// their constructors.
+type structOptions struct {
+	mockNames            map[string]string // may be empty
+	nameTrims            []nameTrim        // affixes stripped from the default names, nil means defaultNameTrims
+	exported, unexported bool              // export the implementations, or not, whatever the interfaces
+	docStructs           bool              // document the implementations as such
+	mutex                bool              // guard every method with a sync.Mutex
+	record               bool              // record the calls of every method
+	count                bool              // count the calls of every method, without their arguments
+	recordParamNames     bool              // with record, name the argument fields as the parameters rather than exporting them
+	structGuard          bool              // make the implementations non-comparable with a _ [0]func() field
+	forwardCompat        bool              // embed the interface in its implementation, which then implements the methods added later
+	constructorError     bool              // constructors also return an error
+	optionsConstructor   bool              // constructors take functional options setting the fields
+}
+
+// bodyOptions select the bodies of the methods not implemented yet.
+type bodyOptions struct {
+	bodyMode         string                 // may be empty, meaning bodyPanic
+	errorCtor        *model.NamedType       // function creating the errors of bodyError, may be nil, meaning errors.New
+	valueTypes       map[string]bool        // "importpath.Type" => zero value is Type{}, may be empty
+	typedErrors      bool                   // return T{} for a last result of a named error struct T, nil for *T
+	friendlyStringer bool                   // String() string methods return the implementation name rather than a stub body
+	noopCloser       bool                   // Close() error methods return nil rather than a stub body
+	closedChans      bool                   // return closed channels instead of nil ones
+	initContainers   bool                   // return empty maps and slices instead of nil ones
+	bodies           map[string]*methodBody // "Interface_Method" => spliced method body, may be empty
+	todoComments     bool                   // start the stub bodies with a TODO comment of their signature
+}
+
+// decoratorOptions make the implementations forward the calls to another
+// implementation or to functions rather than stub them.
+type decoratorOptions struct {
+	wrap      bool            // generate logging decorators instead of stubs
+	tracing   bool            // with wrap, generate tracing decorators instead of logging ones
+	metrics   bool            // with wrap, generate metrics decorators instead of logging ones
+	logger    *loggerType     // logger of the logging decorators, nil for a *log.Logger
+	funcs     bool            // delegate every method to a function field of the struct
+	overrides map[string]bool // method name => stubbed method, the others forwarding to a fallback, may be empty
+	nilGuard  bool            // panic with a clear message when forwarding to a nil wrapped or fallback implementation
+}
+
+// declOptions select the declarations of the output other than one
+// implementation per interface.
+type declOptions struct {
+	mergeInterface            string // name of the interface merging all the others, may be empty
+	emitInterface             bool   // also declare the implemented interfaces in the output
+	assert                    bool   // check at compile time that the implementations satisfy their interfaces
+	assertEmbeds              bool   // check at compile time that the implementations satisfy the interfaces their interfaces embed
+	registry                  string // name of the interface name => constructor map, may be empty
+	accessors                 bool   // generate getters and setters for the struct fields
+	funcTypes                 bool   // generate a stub function of every named function type
+	fillStruct, fillInterface string // struct missing methods of the interface, may be empty
+	convertFrom, convertTo    string // structs to generate a conversion method between, may be empty
+	emitTests                 bool   // also write a skeleton test of every generated method
+	testMain                  bool   // with emitTests, also declare a TestMain and helpers constructing the implementations
+}
+
+// outputOptions select how the output is formatted and written.
+type outputOptions struct {
+	force           bool     // regenerate the destination file even if it exists
+	diff            bool     // print a diff against the destination file instead of writing it
+	check           bool     // only compare the output with the destination file
+	region          bool     // replace the marked region of the destination file rather than the file
+	noFormat        bool     // write the output as generated, without gofmt
+	crlf            bool     // end the output lines with \r\n instead of \n
+	lineLength      int      // wrap the parameters of longer method signatures, may be 0, meaning never
+	lineDirectives  bool     // attribute the methods to their declarations in the source with //line
+	postProcess     []string // command and arguments filtering the output, may be empty
+	importGroups    bool     // separate the standard library imports from the others
+	importGuards    bool     // declare a blank variable of a type of every import the output doesn't use otherwise
+	marker          string   // comment line starting the output, for tools detecting generated files, may be empty
+	copyrightHeader string
+	noComments      bool // don't copy the doc comments of the interfaces and their methods
+}
+
 func (g *generator) p(format string, args ...interface{}) {
 	fmt.Fprintf(&g.buf, g.indent+format+"\n", args...)
 }
@@ -36,6 +163,19 @@ func (g *generator) pf(format string, args ...interface{}) {
 	fmt.Fprintf(&g.buf, g.indent+format, args...)
 }
 
+// warnf prints an advisory warning, which doesn't fail the generation,
+// unless -quiet is set.
+func (g *generator) warnf(format string, args ...interface{}) {
+	if *quiet {
+		return
+	}
+	w := g.stderr
+	if w == nil {
+		w = os.Stderr
+	}
+	fmt.Fprintf(w, "warning: "+format+"\n", args...)
+}
+
 func (g *generator) in() {
 	g.indent += "\t"
 }
@@ -47,11 +187,66 @@ func (g *generator) out() {
 }
 
 func (g *generator) Generate(pkg *model.Package, outputPkgName string, outputPackagePath string) error {
-	dstPkg, err := sourceMode(g.dstFileName)
+	if g.fillStruct != "" {
+		if g.mutex || g.record || g.count || g.wrap || g.funcs {
+			return fmt.Errorf("-fill can't add fields to the existing %v, don't use -mutex, -record, -count, -wrap or -funcs", g.fillStruct)
+		}
+		if !samePackage(pkg, outputPkgName, outputPackagePath) {
+			return fmt.Errorf("-fill declares methods, which must be in package %v (use -package %v or -self_package)", pkg.Name, pkg.Name)
+		}
+		missing, err := missingMethods(pkg, g.fillStruct, g.fillInterface)
+		if err != nil {
+			return err
+		}
+		pkg.Interfaces = []*model.Interface{missing}
+	} else {
+		pkg.Interfaces = g.selectInterfaces(pkg.Interfaces)
+		if err := g.dropExcludedMethods(pkg.Interfaces); err != nil {
+			return err
+		}
+		if g.sortInterfaces {
+			sort.SliceStable(pkg.Interfaces, func(i, j int) bool { return pkg.Interfaces[i].Name < pkg.Interfaces[j].Name })
+		}
+	}
+	if g.mergeInterface != "" && g.fillStruct == "" {
+		merged, err := mergeInterfaces(g.mergeInterface, pkg)
+		if err != nil {
+			return err
+		}
+		pkg.Interfaces = []*model.Interface{merged}
+	}
+	if err := checkUnexportedMethods(pkg, outputPkgName, outputPackagePath); err != nil {
+		return err
+	}
+	var dstPkg *model.Package
+	if !g.force && g.writesFile() {
+		if p, err := sourceMode(g.dstFileName); err == nil {
+			dstPkg = p
+		}
+	}
+
+	if dstPkg == nil && g.writesFile() && !g.force {
+		// The destination exists but isn't an implementation we can append to.
+		if _, err := os.Stat(g.dstFileName); err == nil {
+			return fmt.Errorf("refusing to overwrite %v, use -force to overwrite it", g.dstFileName)
+		}
+	}
+
+	inPackage := samePackage(pkg, outputPkgName, outputPackagePath)
+	if err := g.checkOptions(pkg, dstPkg, inPackage); err != nil {
+		return err
+	}
+	// An implementation in the package of its interface can't share the
+	// interface's name, so name it like -in_place does.
+	// -inline interfaces aren't declared in any package.
+	g.inPackage = g.inPackage || inPackage && g.srcPackage != "-inline"
 
 	g.generatePackageMap(pkg, outputPkgName, outputPackagePath)
+	if outputPackagePath != "" {
+		g.warnImportCycles(outputPackagePath)
+	}
 
-	if err != nil {
+	if dstPkg == nil {
 		g.head = true
 		g.generateHead(pkg, outputPkgName, outputPackagePath)
 	} else {
@@ -73,9 +268,14 @@ func (g *generator) Generate(pkg *model.Package, outputPkgName string, outputPac
 				}
 
 				if 0 != len(newMethods) {
+					g.report.implement(intf.Name)
 					intf.Methods = newMethods
-					mockType := g.mockName(intf.Name)
-					g.GenerateMockMethods(mockType, intf, outputPackagePath)
+					s := g.newImplStruct(g.mockName(intf.Name), intf, outputPackagePath)
+					if err := g.GenerateMockMethods(s, intf, outputPackagePath); err != nil {
+						return err
+					}
+				} else {
+					g.report.skip(intf.Name, "up to date in "+g.dstFileName)
 				}
 			} else {
 				newInterfaces = append(newInterfaces, intf)
@@ -85,12 +285,199 @@ func (g *generator) Generate(pkg *model.Package, outputPkgName string, outputPac
 		pkg.Interfaces = newInterfaces
 	}
 
-	return g.generate(pkg, outputPkgName, outputPackagePath)
+	if err := g.generate(pkg, outputPkgName, outputPackagePath); err != nil {
+		return err
+	}
+	if g.importGuards && g.head {
+		return g.generateImportGuards(pkg, outputPackagePath)
+	}
+	return nil
+}
+
+// checkOptions returns an error if options of g conflict with each other, or
+// can't apply to pkg or to dstPkg, the existing destination, which may be
+// nil. samePkg tells whether the output goes to the package of pkg.
+func (g *generator) checkOptions(pkg, dstPkg *model.Package, samePkg bool) error {
+	if err := g.checkDecoratorOptions(pkg, dstPkg); err != nil {
+		return err
+	}
+	if err := g.checkStructOptions(pkg, dstPkg); err != nil {
+		return err
+	}
+	return g.checkDeclOptions(pkg, dstPkg, samePkg)
+}
+
+// checkDecoratorOptions checks the decoratorOptions, see checkOptions.
+func (g *generator) checkDecoratorOptions(pkg, dstPkg *model.Package) error {
+	if len(g.overrides) > 0 {
+		if g.wrap || g.funcs || g.fillStruct != "" {
+			return fmt.Errorf("-override can't be combined with -wrap, -funcs or -fill")
+		}
+		if dstPkg != nil {
+			return fmt.Errorf("-override can't add the fallback field to the existing %v, use -force to regenerate it", g.dstFileName)
+		}
+		declared := make(map[string]bool)
+		for _, intf := range pkg.Interfaces {
+			for _, m := range intf.Methods {
+				declared[m.Name] = true
+			}
+		}
+		for name := range g.overrides {
+			if !declared[name] {
+				return fmt.Errorf("-override: no interface has a method %v", name)
+			}
+		}
+	}
+
+	if g.funcs {
+		if g.wrap {
+			return fmt.Errorf("-funcs and -wrap are exclusive")
+		}
+		if dstPkg != nil {
+			return fmt.Errorf("-funcs can't add the function fields of the missing methods to the existing %v, use -force to regenerate it", g.dstFileName)
+		}
+	}
+	return nil
+}
+
+// checkStructOptions checks the structOptions, see checkOptions.
+func (g *generator) checkStructOptions(pkg, dstPkg *model.Package) error {
+	if g.count && g.record {
+		return fmt.Errorf("-count and -record are exclusive, -record also counts the calls")
+	}
+
+	if g.forwardCompat {
+		if g.wrap || len(g.overrides) > 0 || g.fillStruct != "" {
+			return fmt.Errorf("-forward_compat can't be combined with -wrap, -override or -fill")
+		}
+		if dstPkg != nil {
+			return fmt.Errorf("-forward_compat can't add the embedded interfaces to the existing %v, use -force to regenerate it", g.dstFileName)
+		}
+		for _, intf := range pkg.Interfaces {
+			for _, m := range intf.Methods {
+				if m.Name == intf.Name {
+					return fmt.Errorf("-forward_compat: method %v.%v clashes with the embedded %v", intf.Name, m.Name, intf.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkDeclOptions checks the declOptions, see checkOptions.
+func (g *generator) checkDeclOptions(pkg, dstPkg *model.Package, samePkg bool) error {
+	if g.emitInterface && samePkg {
+		return fmt.Errorf("-emit_interface declares the interfaces, which already are in package %v", pkg.Name)
+	}
+
+	if g.registry != "" {
+		if g.wrap || g.fillStruct != "" {
+			return fmt.Errorf("-emit_registry needs the New<Impl>(context.Context) constructors, don't use -wrap or -fill")
+		}
+		if dstPkg != nil {
+			return fmt.Errorf("-emit_registry can't append to the existing %v, use -force to regenerate it", g.dstFileName)
+		}
+	}
+
+	if g.accessors {
+		if !samePkg {
+			return fmt.Errorf("-accessors declares methods, which must be in package %v (use -package %v or -self_package)", pkg.Name, pkg.Name)
+		}
+		if dstPkg != nil {
+			return fmt.Errorf("-accessors can't append to the existing %v, use -force to regenerate it", g.dstFileName)
+		}
+	}
+
+	if g.convertFrom != "" {
+		if !samePkg {
+			return fmt.Errorf("-convert declares a method, which must be in package %v (use -package %v or -self_package)", pkg.Name, pkg.Name)
+		}
+		if dstPkg != nil {
+			return fmt.Errorf("-convert can't append to the existing %v, use -force to regenerate it", g.dstFileName)
+		}
+	}
+	return nil
 }
 
 func (g *generator) generatePackageMap(pkg *model.Package, outputPkgName string, outputPackagePath string) {
 	// Get all required imports, and generate unique names for them all.
 	im := pkg.Imports()
+	if g.mutex {
+		im["sync"] = true
+	}
+	if g.registry != "" && !g.optionsConstructor {
+		im["context"] = true
+	}
+	if g.usesBodyMode(pkg, bodyTrace) {
+		im["fmt"] = true
+		im["runtime"] = true
+	}
+	if g.usesBodyMode(pkg, bodyError) {
+		im[g.errorConstructor().Package] = true
+	}
+	if g.usesBodyMode(pkg, bodyErrorWrapped) {
+		im["fmt"] = true
+		im[g.errorConstructor().Package] = true
+	}
+	if g.accessors {
+		for _, s := range pkg.StructNames {
+			for pth := range s.FieldImports() {
+				im[pth] = true
+			}
+		}
+	}
+	if g.funcTypes {
+		for _, f := range pkg.FuncTypes {
+			for pth := range f.Imports() {
+				im[pth] = true
+			}
+		}
+	}
+	asserts := false
+	for _, intf := range pkg.Interfaces {
+		asserts = asserts || g.assert && g.asserted(intf)
+	}
+	if (g.wrap || len(g.overrides) > 0 || (asserts || g.forwardCompat) && g.mergeInterface == "") && !g.emitInterface && pkg.PkgPath != "" {
+		im[pkg.PkgPath] = true
+	}
+	if g.assertEmbeds && g.mergeInterface == "" {
+		for _, intf := range pkg.Interfaces {
+			if !g.asserted(intf) {
+				continue
+			}
+			for _, embed := range g.assertedEmbeds(intf, outputPackagePath) {
+				for pth := range embed.Imports() {
+					im[pth] = true
+				}
+			}
+		}
+	}
+	if g.wrap && g.tracing {
+		im[traceImportPath] = true
+		for _, intf := range pkg.Interfaces {
+			for _, m := range intf.Methods {
+				if !m.HasContext() {
+					// the spans of the methods without context are roots
+					im["context"] = true
+				}
+			}
+		}
+	} else if g.wrap && g.metrics {
+		im[prometheusImportPath] = true
+		im["time"] = true
+	} else if g.wrap {
+		im[g.loggerType().pkg] = true
+	} else {
+		for _, intf := range pkg.Interfaces {
+			for _, m := range intf.Methods {
+				if body, ok := g.bodies[intf.Name+"_"+m.Name]; ok {
+					for pth := range body.imports {
+						im[pth] = true
+					}
+				}
+			}
+		}
+	}
 
 	// Only import reflect if it's used. We only use reflect in mocked methods
 	// so only import if any of the mocked interfaces have methods.
@@ -132,7 +519,11 @@ func (g *generator) generatePackageMap(pkg *model.Package, outputPkgName string,
 		}
 
 		// Avoid importing package if source pkg == output pkg
-		if pth == pkg.PkgPath && outputPkgName == pkg.Name {
+		if pth == pkg.PkgPath && samePackage(pkg, outputPkgName, outputPackagePath) {
+			continue
+		}
+		// The types of the output package itself are never qualified.
+		if pth == outputPackagePath {
 			continue
 		}
 
@@ -140,12 +531,35 @@ func (g *generator) generatePackageMap(pkg *model.Package, outputPkgName string,
 		localNames[pkgName] = true
 	}
 }
-func (g *generator) generateHead(pkg *model.Package, outputPkgName string, outputPackagePath string) {
-	if outputPkgName != pkg.Name && *selfPackage == "" {
-		// reset outputPackagePath if it's not passed in through -self_package
-		outputPackagePath = ""
+
+// warnImportCycles warns about the imports of the output depending on the
+// output package itself, which make it fail to compile. It is only advisory
+// since outputPackagePath may be a guess.
+func (g *generator) warnImportCycles(outputPackagePath string) {
+	imports := make([]string, 0, len(g.packageMap))
+	for pth := range g.packageMap {
+		imports = append(imports, pth)
+	}
+	sort.Strings(imports)
+	for _, pth := range dependentImports(imports, outputPackagePath) {
+		g.warnf("%v imports %v, which imports it back: the output won't compile", outputPackagePath, pth)
 	}
+}
+
+// markerComment returns the -marker comment line: marker itself if it is a
+// comment, e.g. "// @generated", else marker commented out.
+func markerComment(marker string) string {
+	if strings.HasPrefix(marker, "//") {
+		return marker
+	}
+	return "// " + marker
+}
 
+func (g *generator) generateHead(pkg *model.Package, outputPkgName string, outputPackagePath string) {
+	if g.marker != "" {
+		g.p("%v", markerComment(g.marker))
+		g.p("")
+	}
 	if g.copyrightHeader != "" {
 		lines := strings.Split(g.copyrightHeader, "\n")
 		for _, line := range lines {
@@ -169,160 +583,1958 @@ func (g *generator) generateHead(pkg *model.Package, outputPkgName string, outpu
 	g.p("")
 	g.p("import (")
 	g.in()
-	for pkgPath, pkgName := range g.packageMap {
-		if pkgPath == outputPackagePath {
-			continue
+	// Sort the imports so the output doesn't depend on map iteration order.
+	pkgPaths := make([]string, 0, len(g.packageMap))
+	for pkgPath := range g.packageMap {
+		pkgPaths = append(pkgPaths, pkgPath)
+	}
+	sort.Strings(pkgPaths)
+	// With -import_groups, the standard library imports go first, in a
+	// block of their own.
+	var std, others []string
+	addImport := func(name, pkgPath string) {
+		spec := fmt.Sprintf("%v %q", name, pkgPath)
+		if g.importGroups && isStdLib(pkgPath) {
+			std = append(std, spec)
+		} else {
+			others = append(others, spec)
 		}
-		g.p("%v %q", pkgName, pkgPath)
+	}
+	for _, pkgPath := range pkgPaths {
+		addImport(g.packageMap[pkgPath], pkgPath)
 	}
 	for _, pkgPath := range pkg.DotImports {
-		g.p(". %q", pkgPath)
+		addImport(".", pkgPath)
+	}
+	for _, imp := range std {
+		g.p("%v", imp)
+	}
+	if len(std) > 0 && len(others) > 0 {
+		g.p("")
+	}
+	for _, imp := range others {
+		g.p("%v", imp)
 	}
 	g.out()
 	g.p(")")
 }
 
+// isStdLib reports whether pkgPath is a package of the standard library,
+// whose first path element, unlike the one of a module path, has no dot.
+func isStdLib(pkgPath string) bool {
+	return !strings.Contains(strings.SplitN(pkgPath, "/", 2)[0], ".")
+}
+
 func (g *generator) generate(pkg *model.Package, outputPkgName string, outputPackagePath string) error {
+	g.srcPackagePath = pkg.PkgPath
+	g.structs = make(map[string]bool)
+	for _, s := range pkg.StructNames {
+		g.structs[pkg.PkgPath+"."+s.Name] = true
+	}
+	intfs, err := g.groupByImpl(pkg)
+	if err != nil {
+		return err
+	}
+	if g.emitInterface {
+		for _, intf := range pkg.Interfaces {
+			g.generateInterface(intf, outputPackagePath)
+		}
+	}
+	if g.fillStruct == "" {
+		g.tested = intfs
+	}
 	for _, intf := range pkg.Interfaces {
+		g.report.implement(intf.Name)
+	}
+	if g.usesBodyMode(pkg, bodyErrorWrapped) {
+		g.errSentinel = g.allocateTypeName("errNotImplemented")
+		g.p("")
+		g.p("// %v is wrapped by the errors of the methods not implemented yet.", g.errSentinel)
+		g.p("var %v = %v(%q)", g.errSentinel, g.errorConstructor().String(g.packageMap, outputPackagePath), "not implemented")
+	}
+	for _, intf := range intfs {
+		if g.fillStruct != "" {
+			// The struct exists, only its missing methods are generated.
+			if err := g.GenerateMockMethods(g.newImplStruct(g.fillStruct, intf, outputPackagePath), intf, outputPackagePath); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(intf.Methods) == 0 {
+			if !g.allowEmpty {
+				g.warnf("interface %v has no methods", intf.Name)
+			}
+			g.report.emptyInterface(intf.Name)
+		}
+		if intf.Name == g.mergeInterface {
+			g.generateInterface(intf, outputPackagePath)
+		}
 		if err := g.GenerateMockInterface(intf, outputPackagePath); err != nil {
 			return err
 		}
 	}
+	if g.accessors {
+		for _, s := range pkg.StructNames {
+			g.generateAccessors(s, outputPackagePath)
+		}
+	}
+	if g.funcTypes {
+		for _, f := range pkg.FuncTypes {
+			if err := g.generateFuncStub(f, outputPackagePath); err != nil {
+				return err
+			}
+		}
+	}
+	if g.convertFrom != "" {
+		if err := g.generateConversion(pkg); err != nil {
+			return err
+		}
+	}
+	if g.assert || g.assertEmbeds {
+		g.generateAssertions(pkg.Interfaces, outputPackagePath)
+	}
+	if g.registry != "" {
+		g.generateRegistry(pkg.Interfaces)
+	}
 
 	return nil
 }
 
-// The name of the mock type to use for the given interface identifier.
-func (g *generator) mockName(typeName string) string {
-	if mockName, ok := g.mockNames[typeName]; ok {
-		return mockName
+// groupByImpl returns the interfaces of pkg, merging the ones implemented by
+// the same struct, e.g. when -impl_names maps several interfaces to one
+// name, so that the struct is declared once with all their methods.
+func (g *generator) groupByImpl(pkg *model.Package) ([]*model.Interface, error) {
+	var names []string
+	groups := make(map[string][]*model.Interface) // implementation name => interfaces
+	for _, intf := range pkg.Interfaces {
+		name := g.mockName(intf.Name)
+		if _, ok := groups[name]; !ok {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], intf)
 	}
 
-	suffix := "Interface"
-	if suffix == typeName[len(typeName)-len(suffix):] {
-		return typeName[:len(typeName)-len(suffix)]
+	intfs := make([]*model.Interface, 0, len(names))
+	for _, name := range names {
+		group := groups[name]
+		if len(group) == 1 {
+			intfs = append(intfs, group[0])
+			continue
+		}
+		merged, err := mergeInterfaces(group[0].Name, &model.Package{PkgPath: pkg.PkgPath, Interfaces: group})
+		if err != nil {
+			return nil, fmt.Errorf("%v implements several interfaces: %v", name, err)
+		}
+		// The struct is documented like the first interface.
+		merged.Doc = group[0].Doc
+		merged.Comment = group[0].Comment
+		merged.Directives = group[0].Directives
+		intfs = append(intfs, merged)
 	}
-
-	return typeName
+	return intfs, nil
 }
 
-func (g *generator) GenerateMockInterface(intf *model.Interface, outputPackagePath string) error {
-	mockType := g.mockName(intf.Name)
-
-	g.p("")
-
-	for _, doc := range intf.Doc {
-		if strings.HasPrefix(strings.ToLower(doc), "//go:generate ") { // 生成语句不复制到实现文件中
+// generateAssertions declares, in one block, the compile-time checks that
+// the implementations satisfy their interfaces with -assert, and each of the
+// interfaces these embed with -assert_embeds. Generic interfaces are left
+// out, since they can't be named without type arguments, and so are the
+// ones whose implementations lack the -exclude_methods methods.
+func (g *generator) generateAssertions(intfs []*model.Interface, outputPackagePath string) {
+	var asserts []string
+	for _, intf := range intfs {
+		if !g.asserted(intf) {
 			continue
 		}
-
-		g.p("%v", doc)
-	}
-
-	if 0 == len(intf.Comment) {
-		g.p("type %v struct {", mockType)
-	} else {
-		g.p("type %v struct { // %v", mockType, intf.Comment)
+		if g.assert {
+			intfType := g.interfaceType(intf, outputPackagePath)
+			asserts = append(asserts, fmt.Sprintf("_ %v = (*%v)(nil)", intfType, g.mockName(intf.Name)))
+		}
+		if g.assertEmbeds {
+			for _, embed := range g.assertedEmbeds(intf, outputPackagePath) {
+				asserts = append(asserts, fmt.Sprintf("_ %v = (*%v)(nil)", embed.String(g.packageMap, outputPackagePath), g.mockName(intf.Name)))
+			}
+		}
 	}
-	g.in()
-	g.out()
-	g.p("}")
-	g.p("")
-
-	// TODO: Re-enable this if we can import the interface reliably.
-	// g.p("// Verify that the mock satisfies the interface at compile time.")
-	// g.p("var _ %v = (*%v)(nil)", typeName, mockType)
-	// g.p("")
-
-	g.p("// New%v create a new %v object", mockType, mockType)
-	if 0 == len(intf.Comment) {
-		g.p("func New%v(_ context.Context) *%v {", mockType, mockType)
-	} else {
-		g.p("func New%v(_ context.Context) *%v { // %v", mockType, mockType, intf.Comment)
+	if len(asserts) == 0 {
+		return
 	}
 
-	g.in()
-	g.p("obj := &%v{}", mockType)
 	g.p("")
-	g.p("// TODO: New%v(_ context.Context) Not implemented", mockType)
-	g.p("")
-	g.p("return obj")
+	g.p("// Verify that the implementations satisfy their interfaces at compile time.")
+	g.p("var (")
+	g.in()
+	for _, assert := range asserts {
+		g.p("%v", assert)
+	}
 	g.out()
-	g.p("}")
-	g.p("")
-
-	g.GenerateMockMethods(mockType, intf, outputPackagePath)
+	g.p(")")
+}
 
-	return nil
+// asserted reports whether generateAssertions checks the implementation of
+// intf.
+func (g *generator) asserted(intf *model.Interface) bool {
+	return len(intf.TypeParams) == 0 && !g.partial[intf.Name]
 }
 
-func (g *generator) GenerateMockMethods(mockType string, intf *model.Interface, pkgOverride string) {
-	for _, m := range intf.Methods {
-		g.p("")
-		_ = g.GenerateMockMethod(mockType, m, pkgOverride)
+// assertedEmbeds returns the interfaces embedded by intf checked by
+// -assert_embeds: the predeclared ones are left out, and so are the
+// unexported ones of another package than the output.
+func (g *generator) assertedEmbeds(intf *model.Interface, outputPackagePath string) []*model.NamedType {
+	var embeds []*model.NamedType
+	for _, embed := range intf.Embeds {
+		if embed.Package == "" || embed.Package != outputPackagePath && !ast.IsExported(embed.Type) {
+			continue
+		}
+		embeds = append(embeds, embed)
 	}
+	return embeds
 }
 
-// GenerateMockMethod generates a mock method implementation.
-// If non-empty, pkgOverride is the package in which unqualified types reside.
-func (g *generator) GenerateMockMethod(mockType string, m *model.Method, pkgOverride string) error {
-	argNames := g.getArgNames(m)
-	argTypes := g.getArgTypes(m, pkgOverride)
-	argString := makeArgString(argNames, argTypes)
-
-	rets := make([]string, len(m.Out))
-	for i, p := range m.Out {
-		rets[i] = p.Type.String(g.packageMap, pkgOverride)
-	}
-	retString := strings.Join(rets, ", ")
-	if len(rets) > 1 {
-		retString = "(" + retString + ")"
-	}
-	if retString != "" {
-		retString = " " + retString
+// generateImportGuards declares a blank variable of a type of every import
+// of the output it doesn't refer to, should a combination of options leave
+// out the only reference to it, so that the output still compiles. The type
+// is one of the interfaces or one of the types their methods refer to.
+func (g *generator) generateImportGuards(pkg *model.Package, outputPackagePath string) error {
+	file, err := parser.ParseFile(token.NewFileSet(), "", g.buf.Bytes(), 0)
+	if err != nil {
+		return fmt.Errorf("-import_guards: %v", err)
 	}
+	used := make(map[string]bool) // package names
+	ast.Inspect(file, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok {
+				used[id.Name] = true
+			}
+		}
+		return true
+	})
 
-	ia := newIdentifierAllocator(argNames)
-	idRecv := ia.allocateIdentifier("m")
+	// A type of every import, leaving out the generic ones, whose type
+	// arguments may be type parameters.
+	typeOf := make(map[string]model.Type) // import path => type
+	for _, intf := range pkg.Interfaces {
+		if _, ok := typeOf[pkg.PkgPath]; !ok && len(intf.TypeParams) == 0 && !intf.Constraint {
+			typeOf[pkg.PkgPath] = &model.NamedType{Package: pkg.PkgPath, Type: intf.Name}
+		}
+	}
+	model.Walk(pkg, func(t model.Type) bool {
+		if nt, ok := t.(*model.NamedType); ok && len(nt.TypeArgs) == 0 && typeOf[nt.Package] == nil {
+			typeOf[nt.Package] = nt
+		}
+		return true
+	})
 
-	for _, doc := range m.Doc {
-		if strings.HasPrefix(strings.ToLower(doc), "//go:generate ") { // 生成语句不复制到实现文件中
+	var guards []string
+	for _, spec := range file.Imports {
+		if spec.Name == nil || spec.Name.Name == "_" || spec.Name.Name == "." || used[spec.Name.Name] {
 			continue
 		}
-
-		g.p("%v", doc)
+		pth, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			return err
+		}
+		t, ok := typeOf[pth]
+		if !ok {
+			g.warnf("-import_guards: no type of %v to refer to, the output may not compile", pth)
+			continue
+		}
+		guards = append(guards, "_ "+t.String(g.packageMap, outputPackagePath))
 	}
-	if 0 == len(m.Comment) {
-		g.p("func (%v *%v) %v(%v)%v {", idRecv, mockType, m.Name, argString, retString)
-	} else {
-		g.pf("func (%v *%v) %v(%v)%v { // %v", idRecv, mockType, m.Name, argString, retString, m.Comment)
+	if len(guards) == 0 {
+		return nil
 	}
-
-	g.in()
-
-	g.p("// TODO: %v.%v(%v)%v Not implemented", mockType, m.Name, argString, retString)
 	g.p("")
-	g.p("panic(\"%v.%v(%v)%v Not implemented\")", mockType, m.Name, argString, retString)
+	g.p("// Refer to the imports the code above doesn't use.")
+	g.p("var (")
+	g.in()
+	for _, guard := range guards {
+		g.p("%v", guard)
+	}
+	g.out()
+	g.p(")")
+	return nil
+}
+
+// generateRegistry declares the map from interface name to the constructor
+// of its implementation. Generic implementations, which can't be built
+// without type arguments, are left out.
+func (g *generator) generateRegistry(intfs []*model.Interface) {
+	ctor := "func() interface{}"
+	if g.constructorError {
+		ctor = "func() (interface{}, error)"
+	}
+
+	g.p("")
+	g.p("// %v maps the names of the interfaces to the constructors of their implementations.", g.registry)
+	g.p("var %v = map[string]%v{", g.registry, ctor)
+	g.in()
+	for _, intf := range intfs {
+		if len(intf.TypeParams) > 0 {
+			continue
+		}
+		ctx := g.packageMap["context"] + ".Background()"
+		if g.optionsConstructor {
+			ctx = ""
+		}
+		g.p("%q: %v { return New%v(%v) },", intf.Name, ctor, g.mockName(intf.Name), ctx)
+	}
+	g.out()
+	g.p("}")
+}
+
+// missingMethods returns the interface intfName of pkg reduced to the methods
+// the struct structName doesn't have.
+func missingMethods(pkg *model.Package, structName, intfName string) (*model.Interface, error) {
+	var s *model.Struct
+	for _, sn := range pkg.StructNames {
+		if sn.Name == structName {
+			s = sn
+		}
+	}
+	if s == nil {
+		return nil, fmt.Errorf("-fill: no struct %v in package %v", structName, pkg.Name)
+	}
+	for _, intf := range pkg.Interfaces {
+		if intf.Name != intfName {
+			continue
+		}
+		missing := &model.Interface{Name: intf.Name, Directives: intf.Directives}
+		for _, m := range intf.Methods {
+			if _, ok := s.Methods[m.Name]; !ok {
+				missing.Methods = append(missing.Methods, m)
+			}
+		}
+		return missing, nil
+	}
+	return nil, fmt.Errorf("-fill: no interface %v in package %v", intfName, pkg.Name)
+}
+
+// mergeInterfaces returns the interface called name whose method set is the
+// union of the ones of the interfaces of pkg. A method may be in several
+// interfaces as long as its signature is the same in all of them.
+func mergeInterfaces(name string, pkg *model.Package) (*model.Interface, error) {
+	// Render the types with their full package paths to compare them.
+	pm := make(map[string]string)
+	for pth := range pkg.Imports() {
+		pm[pth] = pth
+	}
+	pm[pkg.PkgPath] = pkg.PkgPath
+
+	names := make([]string, len(pkg.Interfaces))
+	for i, intf := range pkg.Interfaces {
+		names[i] = intf.Name
+	}
+	merged := &model.Interface{
+		Name: name,
+		Doc:  []string{fmt.Sprintf("// %v merges the %v interfaces.", name, strings.Join(names, ", "))},
+	}
+	signatures := make(map[string]string) // method name => signature
+	from := make(map[string]string)       // method name => first interface declaring it
+	for _, intf := range pkg.Interfaces {
+		if len(intf.TypeParams) > 0 {
+			return nil, fmt.Errorf("can't merge the generic interface %v", intf.Name)
+		}
+		for _, m := range intf.Methods {
+			g := generator{packageMap: pm}
+			signature := "(" + strings.Join(g.getArgTypes(m, ""), ", ") + ") (" + strings.Join(g.getRetTypes(m, ""), ", ") + ")"
+			if other, ok := signatures[m.Name]; ok {
+				if other != signature {
+					return nil, fmt.Errorf("can't merge %v.%v%v with %v.%v%v",
+						from[m.Name], m.Name, other, intf.Name, m.Name, signature)
+				}
+				continue
+			}
+			signatures[m.Name] = signature
+			from[m.Name] = intf.Name
+			merged.Methods = append(merged.Methods, m)
+		}
+	}
+	return merged, nil
+}
+
+// interfaceType returns the name of intf in the output package, which
+// declares the merged interface and the ones of -emit_interface.
+func (g *generator) interfaceType(intf *model.Interface, outputPackagePath string) string {
+	intfPackage := g.srcPackagePath
+	if intf.Name == g.mergeInterface || g.emitInterface {
+		// declared by the generated code
+		intfPackage = outputPackagePath
+	}
+	return (&model.NamedType{Package: intfPackage, Type: intf.Name}).String(g.packageMap, outputPackagePath)
+}
+
+// generateInterface declares intf.
+func (g *generator) generateInterface(intf *model.Interface, pkgOverride string) {
+	typeParams := ""
+	if len(intf.TypeParams) > 0 {
+		params := make([]string, len(intf.TypeParams))
+		for i, tp := range intf.TypeParams {
+			params[i] = tp.Name + " " + tp.ConstraintString(g.packageMap, pkgOverride)
+		}
+		typeParams = "[" + strings.Join(params, ", ") + "]"
+	}
+
+	g.p("")
+	g.printDoc(intf.Doc)
+	g.p("type %v%v interface {", intf.Name, typeParams)
+	g.in()
+	for _, m := range intf.Methods {
+		g.printDoc(m.Doc)
+		retString := g.getRetString(m, pkgOverride)
+		if retString != "" {
+			retString = " " + retString
+		}
+		g.p("%v(%v)%v", m.Name, makeArgString(g.getParamNames(m), g.getArgTypes(m, pkgOverride)), retString)
+	}
+	g.out()
+	g.p("}")
+}
+
+// samePackage returns whether the output goes to the package of pkg. The
+// import paths tell it when both are known, since the name of a package
+// needn't match its directory, otherwise the package names do.
+func samePackage(pkg *model.Package, outputPkgName, outputPackagePath string) bool {
+	if outputPackagePath != "" && pkg.PkgPath != "" {
+		return outputPackagePath == pkg.PkgPath
+	}
+	return outputPkgName == pkg.Name
+}
+
+// checkUnexportedMethods returns an error if an interface has unexported
+// methods, which can't be implemented outside of the package of pkg.
+func checkUnexportedMethods(pkg *model.Package, outputPkgName, outputPackagePath string) error {
+	if samePackage(pkg, outputPkgName, outputPackagePath) {
+		return nil
+	}
+	for _, intf := range pkg.Interfaces {
+		for _, m := range intf.Methods {
+			if !token.IsExported(m.Name) {
+				return fmt.Errorf("interface %v has the unexported method %v, which can only be implemented in package %v (use -package %v or -self_package)",
+					intf.Name, m.Name, pkg.Name, pkg.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// selectInterfaces returns the interfaces to implement: those listed in
+// mockInterfaces or matching interfacesRegex, or all of them if neither is
+// set, minus those listed in excludeInterfaces and, if tagMarker is set,
+// those whose doc comment lacks it.
+func (g *generator) selectInterfaces(intfs []*model.Interface) []*model.Interface {
+	selected := make([]*model.Interface, 0, len(intfs))
+	for _, intf := range intfs {
+		if reason := g.skipReason(intf); reason != "" {
+			g.report.skip(intf.Name, reason)
+			continue
+		}
+		if intf.Constraint {
+			g.warnf("interface %v is a type constraint, not an implementable interface", intf.Name)
+			g.report.skip(intf.Name, "type constraint")
+			continue
+		}
+		selected = append(selected, intf)
+	}
+	return selected
+}
+
+// selects reports whether the interface is to be implemented according to
+// mockInterfaces, interfacesRegex, excludeInterfaces and tagMarker.
+func (g *generator) selects(intf *model.Interface) bool {
+	return g.skipReason(intf) == ""
+}
+
+// skipReason returns why the interface isn't to be implemented according to
+// mockInterfaces, interfacesRegex, excludeInterfaces and tagMarker, or the
+// empty string if it is.
+func (g *generator) skipReason(intf *model.Interface) string {
+	if g.excludeInterfaces[intf.Name] {
+		return "excluded"
+	}
+	if g.tagMarker != "" && !hasTag(intf.Doc, g.tagMarker) {
+		return "not tagged " + g.tagMarker
+	}
+	all := len(g.mockInterfaces) == 0 && g.interfacesRegex == nil
+	if all || g.mockInterfaces[intf.Name] || g.interfacesRegex != nil && g.interfacesRegex.MatchString(intf.Name) {
+		return ""
+	}
+	return "not selected"
+}
+
+// dropExcludedMethods removes the -exclude_methods methods from the
+// interfaces, which are then only partially implemented.
+func (g *generator) dropExcludedMethods(intfs []*model.Interface) error {
+	if len(g.excludeMethods) == 0 {
+		return nil
+	}
+	if g.wrap {
+		return fmt.Errorf("-exclude_methods can't be used with -wrap, whose decorators must implement whole interfaces")
+	}
+	if g.emitInterface {
+		return fmt.Errorf("-exclude_methods can't be used with -emit_interface, which declares whole interfaces")
+	}
+	dropped := make(map[string]bool, len(g.excludeMethods))
+	for _, intf := range intfs {
+		methods := make([]*model.Method, 0, len(intf.Methods))
+		for _, m := range intf.Methods {
+			if name := intf.Name + "." + m.Name; g.excludeMethods[name] {
+				dropped[name] = true
+				continue
+			}
+			methods = append(methods, m)
+		}
+		if len(methods) == len(intf.Methods) {
+			continue
+		}
+		intf.Methods = methods
+		if g.partial == nil {
+			g.partial = make(map[string]bool)
+		}
+		g.partial[intf.Name] = true
+	}
+	for _, intf := range intfs {
+		for name := range g.excludeMethods {
+			if strings.HasPrefix(name, intf.Name+".") && !dropped[name] {
+				return fmt.Errorf("-exclude_methods: interface %v has no method %v", intf.Name, name[len(intf.Name)+1:])
+			}
+		}
+	}
+	return nil
+}
+
+// hasTag returns whether one of the doc comment lines contains the marker,
+// e.g. "// implgen:generate" or the directive "//implgen:generate".
+func hasTag(doc []string, marker string) bool {
+	for _, line := range doc {
+		if strings.Contains(line, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// The name of the mock type to use for the given interface identifier, as
+// exported as the interface unless -exported or -unexported is set.
+// Only the type names are derived, the methods always keep the names of the
+// interface methods as is: an unexported method exported by mistake would
+// leave the interface unimplemented.
+func (g *generator) mockName(typeName string) string {
+	if mockName, ok := g.mockNames[typeName]; ok {
+		return mockName
+	}
+	if g.fillStruct != "" && typeName == g.fillInterface {
+		return g.fillStruct
+	}
+	intfName := typeName
+
+	typeName = g.trimName(typeName)
+	name := typeName
+	if g.wrap && g.tracing {
+		name = "Tracing" + upperFirst(typeName)
+	} else if g.wrap && g.metrics {
+		name = "Metrics" + upperFirst(typeName)
+	} else if g.wrap {
+		name = "Logging" + upperFirst(typeName)
+	} else if (g.inPackage || intfName == g.mergeInterface || g.emitInterface) && typeName == intfName {
+		// The struct can't have the name of the interface in its package.
+		name = typeName + "Impl"
+	}
+
+	// The implementation is exported if the interface is, unless -exported
+	// or -unexported say otherwise.
+	exported := token.IsExported(intfName)
+	if g.exported || g.unexported {
+		exported = g.exported
+	}
+	if exported {
+		return upperFirst(name)
+	}
+	return lowerFirst(name)
+}
+
+// nameTrim is a prefix or a suffix stripped from the interface names to
+// derive the default implementation names.
+type nameTrim struct {
+	prefix bool
+	affix  string
+}
+
+var defaultNameTrims = []nameTrim{{affix: "Interface"}}
+
+// trimName strips the first matching prefix and the first matching suffix
+// of nameTrims from the interface name. A prefix is only stripped before an
+// upper case letter, so that the prefix I turns IFoo into Foo but leaves
+// Index alone, and nothing is stripped that would leave the name empty.
+func (g *generator) trimName(name string) string {
+	trims := g.nameTrims
+	if trims == nil {
+		trims = defaultNameTrims
+	}
+	var prefixed, suffixed bool
+	for _, trim := range trims {
+		if len(name) <= len(trim.affix) {
+			continue
+		}
+		if trim.prefix {
+			rest := strings.TrimPrefix(name, trim.affix)
+			if r, _ := utf8.DecodeRuneInString(rest); !prefixed && rest != name && unicode.IsUpper(r) {
+				name, prefixed = rest, true
+			}
+		} else if !suffixed && strings.HasSuffix(name, trim.affix) {
+			name, suffixed = name[:len(name)-len(trim.affix)], true
+		}
+	}
+	return name
+}
+
+// implStruct holds the names of the fields generated on an implementation
+// struct. Field names are allocated so they don't collide with the methods.
+type implStruct struct {
+	name     string
+	intfName string // name of the implemented interface
+	mutex    string // may be empty
+	next     string // wrapped implementation, may be empty
+	log      string // logger of the wrapper, may be empty
+	tracer   string // tracer of the wrapper, may be empty
+
+	durations, counts string // call metrics of the wrapper, may be empty
+
+	funcs    map[string]string // method name => function field the method calls, may be nil
+	fallback string            // implementation the methods not overridden forward to, may be empty
+
+	nolint     string // //nolint comment of the struct declarations, may be empty
+	typeParams string // type parameter list of a generic struct, e.g. "[K comparable, V any]"
+	typeArgs   string // type arguments of the receiver, e.g. "[K, V]"
+
+	calls    map[string]string // method name => recorded calls field, may be nil
+	argsType map[string]string // method name => recorded arguments type, may be nil
+
+	bodies map[string]*methodBody // method name => spliced body, may be nil
+}
+
+func (g *generator) newImplStruct(name string, intf *model.Interface, pkgOverride string) *implStruct {
+	methodNames := make([]string, len(intf.Methods))
+	for i, m := range intf.Methods {
+		methodNames[i] = m.Name
+	}
+	ia := newIdentifierAllocator(methodNames)
+
+	s := &implStruct{name: name, intfName: intf.Name, nolint: nolintComment(intf.Directives)}
+	if len(intf.TypeParams) > 0 {
+		params := make([]string, len(intf.TypeParams))
+		args := make([]string, len(intf.TypeParams))
+		for i, tp := range intf.TypeParams {
+			params[i] = tp.Name + " " + tp.ConstraintString(g.packageMap, pkgOverride)
+			args[i] = tp.Name
+		}
+		s.typeParams = "[" + strings.Join(params, ", ") + "]"
+		s.typeArgs = "[" + strings.Join(args, ", ") + "]"
+	}
+	if g.mutex {
+		s.mutex = ia.allocateIdentifier("mu")
+	}
+	if g.wrap {
+		s.next = ia.allocateIdentifier("next")
+		if g.tracing {
+			s.tracer = ia.allocateIdentifier("tracer")
+		} else if g.metrics {
+			s.durations = ia.allocateIdentifier("durations")
+			s.counts = ia.allocateIdentifier("counts")
+		} else {
+			s.log = ia.allocateIdentifier("log")
+		}
+	}
+	if len(g.overrides) > 0 {
+		s.fallback = ia.allocateIdentifier("Fallback")
+	}
+	if g.funcs {
+		s.funcs = make(map[string]string, len(intf.Methods))
+		for _, m := range intf.Methods {
+			s.funcs[m.Name] = ia.allocateIdentifier(m.Name + "Func")
+		}
+	}
+	if g.count {
+		s.calls = make(map[string]string, len(intf.Methods))
+		for _, m := range intf.Methods {
+			s.calls[m.Name] = ia.allocateIdentifier(m.Name + "CallCount")
+		}
+	} else if g.record {
+		s.calls = make(map[string]string, len(intf.Methods))
+		s.argsType = make(map[string]string, len(intf.Methods))
+		for _, m := range intf.Methods {
+			s.calls[m.Name] = ia.allocateIdentifier(m.Name + "Calls")
+			if len(m.In) > 0 || m.Variadic != nil {
+				s.argsType[m.Name] = g.allocateTypeName(lowerFirst(name) + upperFirst(m.Name) + "Args")
+			}
+		}
+	}
+	for _, m := range intf.Methods {
+		if body, ok := g.bodies[intf.Name+"_"+m.Name]; ok {
+			if s.bodies == nil {
+				s.bodies = make(map[string]*methodBody)
+			}
+			s.bodies[m.Name] = body
+		}
+	}
+	return s
+}
+
+// allocateTypeName allocates a unique package level type name.
+func (g *generator) allocateTypeName(want string) string {
+	if g.typeNames == nil {
+		g.typeNames = newIdentifierAllocator(nil)
+	}
+	return g.typeNames.allocateIdentifier(want)
+}
+
+// generateFuncsFields declares the function fields the methods of intf
+// call, of the types of the methods.
+func (g *generator) generateFuncsFields(s *implStruct, intf *model.Interface, pkgOverride string) {
+	for _, m := range intf.Methods {
+		if field, ok := s.funcs[m.Name]; ok {
+			g.p("%v %v", field, g.funcFieldType(m, pkgOverride))
+		}
+	}
+}
+
+// funcFieldType returns the type of the function field of m.
+func (g *generator) funcFieldType(m *model.Method, pkgOverride string) string {
+	retString := g.getRetString(m, pkgOverride)
+	if retString != "" {
+		retString = " " + retString
+	}
+	return fmt.Sprintf("func(%v)%v", makeArgString(g.getParamNames(m), g.getArgTypes(m, pkgOverride)), retString)
+}
+
+// implOption is a field of an implementation set by the With<name> option
+// function of -options_constructor, from its parameter param of type typ.
+type implOption struct {
+	name, field, param, typ string
+}
+
+// generateOptions declares the functional option type of s, and an option
+// function setting each of the options, named With<name>, or
+// <Struct>With<name> if another implementation took the name. It returns
+// the name of the option type.
+func (g *generator) generateOptions(s *implStruct, options []implOption) string {
+	optionType := g.allocateTypeName(s.name + "Option")
+	g.p("// %v configures the %v built by New%v.", optionType, s.name, s.name)
+	g.printNolint(s.nolint)
+	g.p("type %v%v func(*%v%v)", optionType, s.typeParams, s.name, s.typeArgs)
+	g.p("")
+	for _, o := range options {
+		name := "With" + o.name
+		if _, taken := g.typeNames[name]; taken {
+			name = s.name + name
+		}
+		name = g.allocateTypeName(name)
+		g.p("// %v sets the %v field of the %v.", name, o.field, s.name)
+		g.printNolint(s.nolint)
+		g.p("func %v%v(%v %v) %v%v {", name, s.typeParams, o.param, o.typ, optionType, s.typeArgs)
+		g.in()
+		g.p("return func(obj *%v%v) {", s.name, s.typeArgs)
+		g.in()
+		g.p("obj.%v = %v", o.field, o.param)
+		g.out()
+		g.p("}")
+		g.out()
+		g.p("}")
+		g.p("")
+	}
+	return optionType
+}
+
+// generateApplyOptions applies the opts of a constructor to its obj.
+func (g *generator) generateApplyOptions() {
+	g.p("for _, opt := range opts {")
+	g.in()
+	g.p("opt(obj)")
+	g.out()
+	g.p("}")
+}
+
+// generateCallsFields declares the fields recording the calls of intf.
+// Methods without arguments only count their calls.
+func (g *generator) generateCallsFields(s *implStruct, intf *model.Interface) {
+	for _, m := range intf.Methods {
+		if argsType, ok := s.argsType[m.Name]; ok {
+			g.p("%v []%v%v", s.calls[m.Name], argsType, s.typeArgs)
+		} else if calls, ok := s.calls[m.Name]; ok {
+			g.p("%v int", calls)
+		}
+	}
+}
+
+// generateArgsTypes declares the types holding the arguments of a recorded
+// call. A variadic argument is recorded as a slice.
+func (g *generator) generateArgsTypes(s *implStruct, intf *model.Interface, pkgOverride string) {
+	for _, m := range intf.Methods {
+		argsType, ok := s.argsType[m.Name]
+		if !ok {
+			continue
+		}
+		argFields := g.getArgFields(m)
+		argTypes := g.getArgTypes(m, pkgOverride)
+		if m.Variadic != nil {
+			argTypes[len(argTypes)-1] = "[]" + m.Variadic.Type.String(g.packageMap, pkgOverride)
+		}
+
+		g.p("// %v holds the arguments of a %v.%v call.", argsType, s.name, m.Name)
+		g.p("type %v%v struct {", argsType, s.typeParams)
+		g.in()
+		for i, name := range argFields {
+			g.p("%v %v", name, argTypes[i])
+		}
+		g.out()
+		g.p("}")
+		g.p("")
+	}
+}
+
+// getArgFields returns the names of the fields recording the arguments of
+// m. They are exported, so tests of an external _test package can read
+// them, unless recordParamNames is set.
+func (g *generator) getArgFields(m *model.Method) []string {
+	fields := g.getArgNames(m)
+	if g.recordParamNames {
+		return fields
+	}
+	ia := newIdentifierAllocator(nil)
+	for i, name := range fields {
+		fields[i] = ia.allocateIdentifier(upperFirst(name))
+	}
+	return fields
+}
+
+// generateRecordCall records the call of m, whose arguments are argNames, on
+// the receiver idRecv. A variadic argument is recorded as a copy.
+func (g *generator) generateRecordCall(s *implStruct, m *model.Method, idRecv string, argNames []string, pkgOverride string) {
+	calls, ok := s.calls[m.Name]
+	if !ok {
+		return
+	}
+	argsType, ok := s.argsType[m.Name]
+	if !ok {
+		g.p("%v.%v++", idRecv, calls)
+		g.p("")
+		return
+	}
+	fields := g.getArgFields(m)
+	for i, name := range fields {
+		arg := argNames[i]
+		if m.Variadic != nil && i == len(fields)-1 {
+			// The variadic slice may be the caller's, which may modify it
+			// later, so a copy is recorded.
+			arg = fmt.Sprintf("append([]%v(nil), %v...)", m.Variadic.Type.String(g.packageMap, pkgOverride), arg)
+		}
+		fields[i] = name + ": " + arg
+	}
+	g.p("%v.%v = append(%v.%v, %v%v{%v})", idRecv, calls, idRecv, calls, argsType, s.typeArgs, strings.Join(fields, ", "))
+	g.p("")
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	r, n := utf8.DecodeRuneInString(s)
+	return string(unicode.ToLower(r)) + s[n:]
+}
+
+func upperFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	r, n := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[n:]
+}
+
+func (g *generator) GenerateMockInterface(intf *model.Interface, outputPackagePath string) error {
+	mockType := g.mockName(intf.Name)
+	s := g.newImplStruct(mockType, intf, outputPackagePath)
+	if g.wrap {
+		return g.generateWrapper(s, intf, outputPackagePath)
+	}
+
+	g.p("")
+
+	g.printStructDoc(s, intf)
+	g.printNolint(s.nolint)
+
+	if 0 == len(intf.Comment) {
+		g.p("type %v%v struct {", mockType, s.typeParams)
+	} else {
+		g.p("type %v%v struct { // %v", mockType, s.typeParams, intf.Comment)
+	}
+	g.in()
+	if g.structGuard {
+		// First, since a trailing zero-size field is padded.
+		g.p("_ [0]func() // forbids comparing implementations with ==")
+	}
+	if g.forwardCompat {
+		g.p("%v%v // implements the methods added later, which panic", g.interfaceType(intf, outputPackagePath), s.typeArgs)
+	}
+	if s.mutex != "" {
+		g.p("%v %v.Mutex", s.mutex, g.packageMap["sync"])
+	}
+	if s.fallback != "" {
+		g.p("%v %v%v // implements the methods not overridden", s.fallback, g.interfaceType(intf, outputPackagePath), s.typeArgs)
+	}
+	g.generateFuncsFields(s, intf, outputPackagePath)
+	g.generateCallsFields(s, intf)
+	g.out()
+	g.p("}")
+	g.p("")
+
+	g.generateArgsTypes(s, intf, outputPackagePath)
+
+	params := "_ context.Context"
+	if g.optionsConstructor {
+		var options []implOption
+		if s.fallback != "" {
+			options = append(options, implOption{"Fallback", s.fallback, "fallback", g.interfaceType(intf, outputPackagePath) + s.typeArgs})
+		}
+		for _, m := range intf.Methods {
+			if field, ok := s.funcs[m.Name]; ok {
+				options = append(options, implOption{m.Name + "Func", field, "fn", g.funcFieldType(m, outputPackagePath)})
+			}
+		}
+		params = "opts ..." + g.generateOptions(s, options) + s.typeArgs
+	}
+
+	g.p("// New%v create a new %v object", mockType, mockType)
+	g.printNolint(s.nolint)
+	results := fmt.Sprintf("*%v%v", mockType, s.typeArgs)
+	if g.constructorError {
+		results = "(" + results + ", error)"
+	}
+	if 0 == len(intf.Comment) {
+		g.p("func New%v%v(%v) %v {", mockType, s.typeParams, params, results)
+	} else {
+		g.p("func New%v%v(%v) %v { // %v", mockType, s.typeParams, params, results, intf.Comment)
+	}
+
+	g.in()
+	g.p("obj := &%v%v{}", mockType, s.typeArgs)
+	if g.optionsConstructor {
+		g.generateApplyOptions()
+	}
+	if g.todoComments {
+		g.p("")
+		g.p("// TODO: New%v(%v) Not implemented", mockType, params)
+		g.p("")
+	}
+	if g.constructorError {
+		g.p("return obj, nil")
+	} else {
+		g.p("return obj")
+	}
+	g.out()
+	g.p("}")
+	g.p("")
+
+	return g.GenerateMockMethods(s, intf, outputPackagePath)
+}
+
+// generateWrapper generates a decorator of intf logging every call before
+// forwarding it to the wrapped implementation.
+func (g *generator) generateWrapper(s *implStruct, intf *model.Interface, outputPackagePath string) error {
+	intfType := g.interfaceType(intf, outputPackagePath) + s.typeArgs
+	// The fields of the decorator, set from the parameters of the constructor.
+	fields, params, paramTypes := []string{s.log}, []string{"logger"}, []string{g.loggerType().String(g.packageMap)}
+	does := "logging"
+	if s.tracer != "" {
+		fields, params, paramTypes = []string{s.tracer}, []string{"tracer"}, []string{g.packageMap[traceImportPath] + ".Tracer"}
+		does = "tracing"
+	} else if s.durations != "" {
+		prometheus := g.packageMap[prometheusImportPath]
+		fields, params = []string{s.durations, s.counts}, []string{"durations", "counts"}
+		paramTypes = []string{prometheus + ".ObserverVec", "*" + prometheus + ".CounterVec"}
+		does = "measuring"
+	}
+	paramList := make([]string, len(params))
+	inits := make([]string, len(params))
+	for i, param := range params {
+		paramList[i] = param + " " + paramTypes[i]
+		inits[i] = fields[i] + ": " + param
+	}
+
+	g.p("")
+	g.printStructDoc(s, intf)
+	g.printNolint(s.nolint)
+	g.p("type %v%v struct {", s.name, s.typeParams)
+	g.in()
+	g.p("%v %v", s.next, intfType)
+	for i, field := range fields {
+		g.p("%v %v", field, paramTypes[i])
+	}
+	if s.mutex != "" {
+		g.p("%v %v.Mutex", s.mutex, g.packageMap["sync"])
+	}
+	g.generateCallsFields(s, intf)
+	g.out()
+	g.p("}")
+	g.p("")
+
+	g.generateArgsTypes(s, intf, outputPackagePath)
+
+	if g.optionsConstructor {
+		options := []implOption{{"Next", s.next, "next", intfType}}
+		for i, field := range fields {
+			options = append(options, implOption{upperFirst(params[i]), field, params[i], paramTypes[i]})
+		}
+		optionType := g.generateOptions(s, options) + s.typeArgs
+
+		g.p("// New%v create a new %v object %v the calls to next", s.name, s.name, does)
+		g.printNolint(s.nolint)
+		g.p("func New%v%v(opts ...%v) *%v%v {", s.name, s.typeParams, optionType, s.name, s.typeArgs)
+		g.in()
+		g.p("obj := &%v%v{}", s.name, s.typeArgs)
+		g.generateApplyOptions()
+		g.p("return obj")
+		g.out()
+		g.p("}")
+		g.p("")
+
+		g.p("// %vMiddleware returns a function decorating next with a %v, to chain", s.name, s.name)
+		g.p("// it with other decorators of %v.", intf.Name)
+		g.printNolint(s.nolint)
+		g.p("func %vMiddleware%v(opts ...%v) func(next %v) %v {", s.name, s.typeParams, optionType, intfType, intfType)
+		g.in()
+		g.p("return func(next %v) %v {", intfType, intfType)
+		g.in()
+		g.p("return New%v%v(append(opts[:len(opts):len(opts)], func(obj *%v%v) { obj.%v = next })...)", s.name, s.typeArgs, s.name, s.typeArgs, s.next)
+		g.out()
+		g.p("}")
+		g.out()
+		g.p("}")
+		g.p("")
+
+		return g.GenerateMockMethods(s, intf, outputPackagePath)
+	}
+
+	g.p("// New%v create a new %v object %v the calls to next", s.name, s.name, does)
+	g.printNolint(s.nolint)
+	g.p("func New%v%v(next %v, %v) *%v%v {", s.name, s.typeParams, intfType, strings.Join(paramList, ", "), s.name, s.typeArgs)
+	g.in()
+	g.p("return &%v%v{%v: next, %v}", s.name, s.typeArgs, s.next, strings.Join(inits, ", "))
+	g.out()
+	g.p("}")
+	g.p("")
+
+	g.p("// %vMiddleware returns a function decorating next with a %v, to chain", s.name, s.name)
+	g.p("// it with other decorators of %v.", intf.Name)
+	g.printNolint(s.nolint)
+	g.p("func %vMiddleware%v(%v) func(next %v) %v {", s.name, s.typeParams, strings.Join(paramList, ", "), intfType, intfType)
+	g.in()
+	g.p("return func(next %v) %v {", intfType, intfType)
+	g.in()
+	g.p("return New%v%v(next, %v)", s.name, s.typeArgs, strings.Join(params, ", "))
+	g.out()
+	g.p("}")
+	g.out()
+	g.p("}")
+	g.p("")
+
+	return g.GenerateMockMethods(s, intf, outputPackagePath)
+}
+
+func (g *generator) GenerateMockMethods(s *implStruct, intf *model.Interface, pkgOverride string) error {
+	for _, m := range intf.Methods {
+		if g.warnMissingContext && !m.HasContext() {
+			g.warnf("%v.%v has no leading context.Context parameter", intf.Name, m.Name)
+		}
+		g.p("")
+		if err := g.GenerateMockMethod(s, m, pkgOverride); err != nil {
+			return err
+		}
+		g.report.method()
+	}
+	return nil
+}
+
+// printDoc prints the doc comment lines, leaving out go:generate lines and
+// implgen directives, which only make sense in the source file. It prints
+// nothing with noComments.
+func (g *generator) printDoc(doc []string) {
+	if g.noComments {
+		return
+	}
+	for _, line := range docLines(doc) {
+		g.p("%v", line)
+	}
+}
+
+// docLines returns the lines of doc to copy to the generated code.
+func docLines(doc []string) []string {
+	var lines []string
+	for _, line := range doc {
+		if strings.HasPrefix(strings.ToLower(line), "//go:generate ") { // 生成语句不复制到实现文件中
+			continue
+		}
+		if strings.HasPrefix(line, directivePrefix) {
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// printStructDoc prints the doc comment of the implementation s of intf,
+// the one of intf, preceded with -doc_structs by a sentence naming both, so
+// that linters asking for the docs of exported types are satisfied.
+func (g *generator) printStructDoc(s *implStruct, intf *model.Interface) {
+	if g.docStructs {
+		g.p("// %v is a generated implementation of %v.", s.name, intf.Name)
+		if len(docLines(intf.Doc)) > 0 && !g.noComments {
+			g.p("//")
+		}
+	}
+	g.printDoc(intf.Doc)
+}
+
+// generateAccessors generates a GetX and a SetX method for every field x of
+// s, leaving out the ones clashing with a field or a method of s.
+func (g *generator) generateAccessors(s *model.Struct, pkgOverride string) {
+	taken := make(map[string]bool)
+	for _, f := range s.Fields {
+		taken[f.Name] = true
+	}
+	for name := range s.Methods {
+		taken[name] = true
+	}
+
+	for _, f := range s.Fields {
+		if f.Name == "_" {
+			continue
+		}
+		getter, setter := "Get"+upperFirst(f.Name), "Set"+upperFirst(f.Name)
+		if taken[getter] || taken[setter] {
+			continue
+		}
+		taken[getter], taken[setter] = true, true
+
+		ia := newIdentifierAllocator([]string{"v"})
+		idRecv := ia.allocateIdentifier("m")
+		t := f.Type.String(g.packageMap, pkgOverride)
+
+		g.p("")
+		g.p("// %v returns the %v field.", getter, f.Name)
+		g.p("func (%v *%v) %v() %v {", idRecv, s.Name, getter, t)
+		g.in()
+		g.p("return %v.%v", idRecv, f.Name)
+		g.out()
+		g.p("}")
+		g.p("")
+		g.p("// %v sets the %v field.", setter, f.Name)
+		g.p("func (%v *%v) %v(v %v) {", idRecv, s.Name, setter, t)
+		g.in()
+		g.p("%v.%v = v", idRecv, f.Name)
+		g.out()
+		g.p("}")
+	}
+}
+
+// generateFuncStub generates the function <Type>Stub of the signature of the
+// named function type f, with its type parameters, e.g.
+//
+//	func MapperStub[T any, U any](arg0 T) U
+//
+// for type Mapper[T, U any] func(T) U, whose body is the one of a method not
+// implemented yet.
+func (g *generator) generateFuncStub(f *model.FuncTypeDecl, pkgOverride string) error {
+	m := f.Signature
+	name := g.allocateTypeName(f.Name + "Stub")
+	var typeParams string
+	if len(f.TypeParams) > 0 {
+		params := make([]string, len(f.TypeParams))
+		for i, tp := range f.TypeParams {
+			params[i] = tp.Name + " " + tp.ConstraintString(g.packageMap, pkgOverride)
+		}
+		typeParams = "[" + strings.Join(params, ", ") + "]"
+	}
+	argNames := g.getParamNames(m)
+	if g.checksContext(m) {
+		argNames = g.getArgNames(m)
+	}
+	argString := makeArgString(argNames, g.getArgTypes(m, pkgOverride))
+	retString := g.getRetString(m, pkgOverride)
+	if retString != "" {
+		retString = " " + retString
+	}
+	ia := newIdentifierAllocator(argNames)
+	for _, p := range m.Out {
+		if p.Name != "" && p.Name != "_" {
+			ia.allocateIdentifier(p.Name)
+		}
+	}
+
+	g.p("")
+	g.p("// %v is a stub of %v.", name, f.Name)
+	g.p("func %v%v(%v)%v {", name, typeParams, argString, retString)
+	g.in()
+	if err := g.generateBody(name, m, ia, argNames, argString, retString, pkgOverride); err != nil {
+		return err
+	}
+	g.out()
+	g.p("}")
+	return nil
+}
+
+// generateConversion generates the method To<convertTo> of the struct
+// convertFrom, which copies the fields of the same name and type to a new
+// convertTo and leaves a TODO comment for the other fields of convertTo.
+func (g *generator) generateConversion(pkg *model.Package) error {
+	var from, to *model.Struct
+	for _, s := range pkg.StructNames {
+		switch s.Name {
+		case g.convertFrom:
+			from = s
+		case g.convertTo:
+			to = s
+		}
+	}
+	if from == nil || to == nil {
+		return fmt.Errorf("-convert: no struct %v or %v in package %v", g.convertFrom, g.convertTo, pkg.Name)
+	}
+	method := "To" + upperFirst(to.Name)
+	if _, ok := from.Methods[method]; ok {
+		return fmt.Errorf("-convert: %v already has a %v method", from.Name, method)
+	}
+
+	fromFields := make(map[string]model.Type, len(from.Fields))
+	for _, f := range from.Fields {
+		fromFields[f.Name] = f.Type
+	}
+
+	g.p("")
+	g.p("// %v converts a %v to a %v, copying the fields of the same name and type.", method, from.Name, to.Name)
+	g.p("func (m %v) %v() %v {", from.Name, method, to.Name)
+	g.in()
+	g.p("return %v{", to.Name)
+	g.in()
+	for _, f := range to.Fields {
+		if f.Name == "_" {
+			continue
+		}
+		if t, ok := fromFields[f.Name]; ok && reflect.DeepEqual(t, f.Type) {
+			g.p("%v: m.%v,", f.Name, f.Name)
+		} else {
+			g.p("// TODO: map field %v", f.Name)
+		}
+	}
+	g.out()
+	g.p("}")
+	g.out()
+	g.p("}")
+	return nil
+}
+
+// nolintComment returns the //nolint comment asked for by an
+// //implgen:nolint=<linters> directive, or the empty string if there is none.
+// A directive without linters disables all of them. A bare //nolint isn't
+// used, since gofmt turns it into a "// nolint" doc comment.
+func nolintComment(directives map[string]string) string {
+	linters, ok := directives["nolint"]
+	if !ok {
+		return ""
+	}
+	if linters == "" {
+		linters = "all"
+	}
+	return "//nolint:" + linters
+}
+
+func (g *generator) printNolint(nolint string) {
+	if nolint != "" {
+		g.p("%v", nolint)
+	}
+}
+
+// GenerateMockMethod generates a mock method implementation.
+// If non-empty, pkgOverride is the package in which unqualified types reside.
+func (g *generator) GenerateMockMethod(s *implStruct, m *model.Method, pkgOverride string) error {
+	mockType := s.name
+	argNames := g.getParamNames(m)
+	if g.referencesArgs(s, m) || g.checksContext(m) {
+		argNames = g.getArgNames(m)
+	}
+	body, hasBody := s.bodies[m.Name]
+	if hasBody && s.next == "" && len(body.params) == len(argNames) {
+		// The body refers to the arguments by the names of its function.
+		argNames = body.params
+	}
+	argTypes := g.getArgTypes(m, pkgOverride)
+	argString := makeArgString(argNames, argTypes)
+
+	retString := g.getRetString(m, pkgOverride)
+	if retString != "" {
+		retString = " " + retString
+	}
+
+	ia := newIdentifierAllocator(argNames)
+	for _, p := range m.Out {
+		if p.Name != "" && p.Name != "_" {
+			ia.allocateIdentifier(p.Name)
+		}
+	}
+	idRecv := ia.allocateIdentifier("m")
+
+	g.printDoc(m.Doc)
+	if _, ok := m.Directives["nolint"]; ok {
+		g.printNolint(nolintComment(m.Directives))
+	} else {
+		g.printNolint(s.nolint)
+	}
+	if g.lineDirectives && m.File != "" {
+		g.p("//line %v:%v", g.lineDirectiveFile(m.File), m.Line)
+	}
+	sigArgs := argString
+	if g.lineLength > 0 && len(argNames) > 0 {
+		sig := fmt.Sprintf("func (%v *%v%v) %v(%v)%v {", idRecv, mockType, s.typeArgs, m.Name, argString, retString)
+		if utf8.RuneCountInString(sig) > g.lineLength {
+			sigArgs = wrapArgs(argNames, argTypes)
+		}
+	}
+	if 0 == len(m.Comment) {
+		g.p("func (%v *%v%v) %v(%v)%v {", idRecv, mockType, s.typeArgs, m.Name, sigArgs, retString)
+	} else {
+		g.pf("func (%v *%v%v) %v(%v)%v { // %v", idRecv, mockType, s.typeArgs, m.Name, sigArgs, retString, m.Comment)
+	}
+
+	g.in()
+
+	if g.nilGuard {
+		g.generateNilGuard(s, m, idRecv)
+	}
+	if s.mutex != "" {
+		g.p("%v.%v.Lock()", idRecv, s.mutex)
+		g.p("defer %v.%v.Unlock()", idRecv, s.mutex)
+		g.p("")
+	}
+	g.generateRecordCall(s, m, idRecv, argNames, pkgOverride)
+	if s.tracer != "" {
+		g.generateTracedForward(s, m, idRecv, argNames, ia)
+		g.out()
+		g.p("}")
+		return nil
+	}
+	if s.durations != "" {
+		g.generateMeasuredForward(s, m, idRecv, argNames, ia)
+		g.out()
+		g.p("}")
+		return nil
+	}
+	if s.next != "" {
+		g.generateForward(s, m, idRecv, argNames, ia)
+		g.out()
+		g.p("}")
+		return nil
+	}
+	if s.fallback != "" && !g.overrides[m.Name] {
+		call := fmt.Sprintf("%v.%v.%v(%v)", idRecv, s.fallback, m.Name, callArgs(m, argNames))
+		if len(m.Out) == 0 {
+			g.p("%v", call)
+		} else {
+			g.p("return %v", call)
+		}
+		g.out()
+		g.p("}")
+		return nil
+	}
+	if field, ok := s.funcs[m.Name]; ok {
+		g.p("if %v.%v == nil {", idRecv, field)
+		g.in()
+		g.p("panic(%q)", fmt.Sprintf("%v.%v called with a nil %v", mockType, m.Name, field))
+		g.out()
+		g.p("}")
+		call := fmt.Sprintf("%v.%v(%v)", idRecv, field, callArgs(m, argNames))
+		if len(m.Out) == 0 {
+			g.p("%v", call)
+		} else {
+			g.p("return %v", call)
+		}
+		g.out()
+		g.p("}")
+		return nil
+	}
+	if hasBody {
+		g.p("%v", body.stmts)
+		g.out()
+		g.p("}")
+		return nil
+	}
+	if g.friendlyString(m) {
+		g.p("return %q", mockType+"{}")
+		g.out()
+		g.p("}")
+		return nil
+	}
+	if g.noopClose(m) {
+		g.p("return nil")
+		g.out()
+		g.p("}")
+		return nil
+	}
+	if err := g.generateBody(mockType+"."+m.Name, m, ia, argNames, argString, retString, pkgOverride); err != nil {
+		return err
+	}
 	g.out()
 	g.p("}")
 	return nil
 }
 
-func (g *generator) getArgNames(m *model.Method) []string {
-	argNames := make([]string, len(m.In))
-	for i, p := range m.In {
-		name := p.Name
-		if name == "" || name == "_" {
-			name = fmt.Sprintf("arg%d", i)
+// generateBody generates the body of the method m, or of the function, not
+// implemented yet according to its body mode. name is the name of the
+// method, Type.Method, or of the function, and argNames the names of its
+// parameters.
+func (g *generator) generateBody(name string, m *model.Method, ia identifierAllocator, argNames []string, argString, retString, pkgOverride string) error {
+	if g.todoComments {
+		g.p("// TODO: %v(%v)%v Not implemented", name, argString, retString)
+		g.p("")
+	}
+	switch mode := g.methodBodyMode(m); mode {
+	case bodyPanic:
+		g.p("panic(%q)", fmt.Sprintf("%v(%v)%v Not implemented", name, argString, retString))
+	case bodyZero:
+		g.generateZeroReturn(m, ia, false, pkgOverride)
+	case bodyLiteral:
+		g.generateZeroReturn(m, ia, true, pkgOverride)
+	case bodyTrace:
+		file, line := ia.allocateIdentifier("file"), ia.allocateIdentifier("line")
+		g.p("_, %v, %v, _ := %v.Caller(1)", file, line, g.packageMap["runtime"])
+		g.p("panic(%v.Sprintf(\"%v not implemented, called from %%v:%%v\", %v, %v))", g.packageMap["fmt"], name, file, line)
+	case bodyError:
+		msg := fmt.Sprintf("%v(%v)%v Not implemented", name, argString, retString)
+		if len(m.Out) == 0 || m.Out[len(m.Out)-1].Type != model.PredeclaredType("error") {
+			// nowhere to return the error
+			g.generateZeroReturn(m, ia, false, pkgOverride)
+			break
+		}
+		g.generateErrorReturn(m, ia, fmt.Sprintf("%v(%q)", g.errorConstructor().String(g.packageMap, pkgOverride), msg), pkgOverride)
+	case bodyErrorWrapped:
+		if len(m.Out) == 0 || m.Out[len(m.Out)-1].Type != model.PredeclaredType("error") {
+			// nowhere to return the error
+			g.generateZeroReturn(m, ia, false, pkgOverride)
+			break
+		}
+		g.generateErrorReturn(m, ia, fmt.Sprintf("%v.Errorf(\"%%s: %%w\", %q, %v)", g.packageMap["fmt"], name, g.errSentinel), pkgOverride)
+	case bodyContext:
+		if g.checksContext(m) {
+			err := ia.allocateIdentifier("err")
+			g.p("if %v := %v.Err(); %v != nil {", err, argNames[0], err)
+			g.in()
+			g.generateErrorReturn(m, ia, err, pkgOverride)
+			g.out()
+			g.p("}")
+		}
+		g.p("panic(%q)", fmt.Sprintf("%v(%v)%v Not implemented", name, argString, retString))
+	default:
+		return fmt.Errorf("%v: unknown body mode %q", name, mode)
+	}
+	return nil
+}
+
+// generateNilGuard panics, naming the field, if the method forwards the call
+// to the wrapped implementation or to the fallback one and it is nil, rather
+// than with a nil pointer dereference.
+func (g *generator) generateNilGuard(s *implStruct, m *model.Method, idRecv string) {
+	delegate := s.next
+	if delegate == "" && s.fallback != "" && !g.overrides[m.Name] {
+		delegate = s.fallback
+	}
+	if delegate == "" {
+		return
+	}
+	g.p("if %v.%v == nil {", idRecv, delegate)
+	g.in()
+	g.p("panic(%q)", fmt.Sprintf("%v.%v called with a nil %v", s.name, m.Name, delegate))
+	g.out()
+	g.p("}")
+}
+
+// lineDirectiveFile returns the name of the source file in a //line
+// directive of the output: relative to the directory of the destination
+// file, against which the compiler resolves it, if there is one.
+func (g *generator) lineDirectiveFile(file string) string {
+	if !g.writesFile() {
+		return file
+	}
+	dir, err := filepath.Abs(filepath.Dir(g.dstFileName))
+	if err != nil {
+		return file
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return file
+	}
+	rel, err := filepath.Rel(dir, abs)
+	if err != nil {
+		return file
+	}
+	return filepath.ToSlash(rel)
+}
+
+// generateForward logs the call of m with its arguments, forwards it to the
+// wrapped implementation and logs its results.
+func (g *generator) generateForward(s *implStruct, m *model.Method, idRecv string, argNames []string, ia identifierAllocator) {
+	logger := g.loggerType()
+	call := fmt.Sprintf("%v.%v.%v(%v)", idRecv, s.next, m.Name, callArgs(m, argNames))
+
+	if logger.structured {
+		g.p("%v.%v.%v(%q%v)", idRecv, s.log, logger.method, s.name+"."+m.Name, keyValueArgs(argNames))
+	} else {
+		verbs := strings.TrimSuffix(strings.Repeat("%v, ", len(argNames)), ", ")
+		g.p("%v.%v.%v(%q%v)", idRecv, s.log, logger.method, s.name+"."+m.Name+"("+verbs+")", prefixArgs(argNames))
+	}
+	if len(m.Out) == 0 {
+		g.p("%v", call)
+		g.p("%v.%v.%v(%q)", idRecv, s.log, logger.method, s.name+"."+m.Name+" returned")
+		return
+	}
+
+	rets := make([]string, len(m.Out))
+	for i := range m.Out {
+		rets[i] = ia.allocateIdentifier(fmt.Sprintf("ret%d", i))
+	}
+	g.p("%v := %v", strings.Join(rets, ", "), call)
+	if logger.structured {
+		g.p("%v.%v.%v(%q%v)", idRecv, s.log, logger.method, s.name+"."+m.Name+" returned", keyValueArgs(rets))
+	} else {
+		retVerbs := strings.TrimSuffix(strings.Repeat("%v, ", len(rets)), ", ")
+		g.p("%v.%v.%v(%q%v)", idRecv, s.log, logger.method, s.name+"."+m.Name+" returned "+retVerbs, prefixArgs(rets))
+	}
+	g.p("return %v", strings.Join(rets, ", "))
+}
+
+// keyValueArgs returns the names, each preceded by itself as a key, as the
+// trailing arguments of a structured logging call, e.g. `, "id", id`.
+func keyValueArgs(names []string) string {
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, ", %q, %v", name, name)
+	}
+	return b.String()
+}
+
+// loggerType is the logger of the logging decorators, with its method
+// logging a line.
+type loggerType struct {
+	pkg, name  string // import path and name of the type
+	pointer    bool   // the decorators hold a pointer to the type
+	method     string // the method logging a line
+	structured bool   // the method takes a message and key-value pairs, rather than a format and its arguments
+}
+
+// loggerTypes are the loggers -logger_type knows the method of, by name.
+var loggerTypes = map[string]*loggerType{
+	"log":  {pkg: "log", name: "Logger", pointer: true, method: "Printf"},
+	"slog": {pkg: "log/slog", name: "Logger", pointer: true, method: "Info", structured: true},
+	"zap":  {pkg: "go.uber.org/zap", name: "SugaredLogger", pointer: true, method: "Infow", structured: true},
+}
+
+// parseLoggerType parses the -logger_type spec: the name of one of
+// loggerTypes, the import path and name of one of them, or those of another
+// type, optionally preceded by *, with an slog-like Info method taking a
+// message and key-value pairs.
+func parseLoggerType(spec string) (*loggerType, error) {
+	if l, ok := loggerTypes[spec]; ok {
+		return l, nil
+	}
+	pointer := strings.HasPrefix(spec, "*")
+	qualified := strings.TrimPrefix(spec, "*")
+	dot := strings.LastIndex(qualified, ".")
+	if dot <= 0 || dot < strings.LastIndex(qualified, "/") || !token.IsIdentifier(qualified[dot+1:]) {
+		return nil, fmt.Errorf("want log, slog, zap or [*]importpath.Type, got %v", spec)
+	}
+	pkg, name := qualified[:dot], qualified[dot+1:]
+	for _, l := range loggerTypes {
+		if l.pkg == pkg && l.name == name {
+			return l, nil
+		}
+	}
+	return &loggerType{pkg: pkg, name: name, pointer: pointer, method: "Info", structured: true}, nil
+}
+
+// String returns the type of the logger field, qualified by the name of its
+// package in packageMap.
+func (l *loggerType) String(packageMap map[string]string) string {
+	t := packageMap[l.pkg] + "." + l.name
+	if l.pointer {
+		return "*" + t
+	}
+	return t
+}
+
+// loggerType returns the logger of the logging decorators.
+func (g *generator) loggerType() *loggerType {
+	if g.logger == nil {
+		return loggerTypes["log"]
+	}
+	return g.logger
+}
+
+// callArgs returns the arguments argNames of a call forwarding the one of
+// m, spreading the variadic argument, if any.
+func callArgs(m *model.Method, argNames []string) string {
+	args := make([]string, len(argNames))
+	copy(args, argNames)
+	if m.Variadic != nil {
+		args[len(args)-1] += "..."
+	}
+	return strings.Join(args, ", ")
+}
+
+// generateTracedForward forwards the call of m to the wrapped implementation
+// in a span named after the method, recording the error returned last, if
+// any. The span is a child of the one of the context argument, if any.
+func (g *generator) generateTracedForward(s *implStruct, m *model.Method, idRecv string, argNames []string, ia identifierAllocator) {
+	span := ia.allocateIdentifier("span")
+	ctx := g.packageMap["context"] + ".Background()"
+	if m.HasContext() {
+		ctx = argNames[0]
+		g.p("%v, %v := %v.%v.Start(%v, %q)", ctx, span, idRecv, s.tracer, ctx, s.intfName+"."+m.Name)
+	} else {
+		g.p("_, %v := %v.%v.Start(%v, %q)", span, idRecv, s.tracer, ctx, s.intfName+"."+m.Name)
+	}
+	g.p("defer %v.End()", span)
+	g.p("")
+
+	call := fmt.Sprintf("%v.%v.%v(%v)", idRecv, s.next, m.Name, callArgs(m, argNames))
+	if len(m.Out) == 0 {
+		g.p("%v", call)
+		return
+	}
+
+	rets := make([]string, len(m.Out))
+	for i := range m.Out {
+		rets[i] = ia.allocateIdentifier(fmt.Sprintf("ret%d", i))
+	}
+	g.p("%v := %v", strings.Join(rets, ", "), call)
+	if last := m.Out[len(m.Out)-1]; last.Type == model.PredeclaredType("error") {
+		err := rets[len(rets)-1]
+		g.p("if %v != nil {", err)
+		g.in()
+		g.p("%v.RecordError(%v)", span, err)
+		g.out()
+		g.p("}")
+	}
+	g.p("return %v", strings.Join(rets, ", "))
+}
+
+// generateMeasuredForward forwards the call of m to the wrapped
+// implementation, then observes its duration and counts it, labeled with
+// the method name and a status, "error" if the error returned last isn't
+// nil, "success" otherwise.
+func (g *generator) generateMeasuredForward(s *implStruct, m *model.Method, idRecv string, argNames []string, ia identifierAllocator) {
+	start := ia.allocateIdentifier("start")
+	g.p("%v := %v.Now()", start, g.packageMap["time"])
+
+	call := fmt.Sprintf("%v.%v.%v(%v)", idRecv, s.next, m.Name, callArgs(m, argNames))
+	rets := make([]string, len(m.Out))
+	for i := range m.Out {
+		rets[i] = ia.allocateIdentifier(fmt.Sprintf("ret%d", i))
+	}
+	if len(rets) == 0 {
+		g.p("%v", call)
+	} else {
+		g.p("%v := %v", strings.Join(rets, ", "), call)
+	}
+
+	status := `"success"`
+	if len(m.Out) > 0 && m.Out[len(m.Out)-1].Type == model.PredeclaredType("error") {
+		status = ia.allocateIdentifier("status")
+		g.p("%v := \"success\"", status)
+		g.p("if %v != nil {", rets[len(rets)-1])
+		g.in()
+		g.p("%v = \"error\"", status)
+		g.out()
+		g.p("}")
+	}
+	g.p("%v.%v.WithLabelValues(%q, %v).Observe(%v.Since(%v).Seconds())", idRecv, s.durations, m.Name, status, g.packageMap["time"], start)
+	g.p("%v.%v.WithLabelValues(%q, %v).Inc()", idRecv, s.counts, m.Name, status)
+	if len(rets) > 0 {
+		g.p("return %v", strings.Join(rets, ", "))
+	}
+}
+
+// prefixArgs joins args for appending them to an argument list.
+func prefixArgs(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return ", " + strings.Join(args, ", ")
+}
+
+// usesBodyMode reports whether a stub of pkg has the given body mode.
+func (g *generator) usesBodyMode(pkg *model.Package, mode string) bool {
+	if g.wrap {
+		return false
+	}
+	for _, intf := range pkg.Interfaces {
+		for _, m := range intf.Methods {
+			if _, spliced := g.bodies[intf.Name+"_"+m.Name]; !spliced && !g.friendlyString(m) && !g.noopClose(m) && g.methodBodyMode(m) == mode {
+				return true
+			}
+		}
+	}
+	if g.funcTypes {
+		for _, f := range pkg.FuncTypes {
+			if g.methodBodyMode(f.Signature) == mode {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// friendlyString reports whether m is a String() string method, as in
+// fmt.Stringer, returning the name of the implementation with
+// friendlyStringer, e.g. "FooImpl{}", for readable debugging output.
+func (g *generator) friendlyString(m *model.Method) bool {
+	return g.friendlyStringer && m.Name == "String" && len(m.In) == 0 && m.Variadic == nil &&
+		len(m.Out) == 1 && m.Out[0].Type == model.PredeclaredType("string")
+}
+
+// noopClose reports whether m is a Close() error method, as in io.Closer,
+// returning nil with noopCloser, so that deferred calls don't panic.
+func (g *generator) noopClose(m *model.Method) bool {
+	return g.noopCloser && m.Name == "Close" && len(m.In) == 0 && m.Variadic == nil &&
+		len(m.Out) == 1 && m.Out[0].Type == model.PredeclaredType("error")
+}
+
+// checksContext reports whether the body of m returns the error of its
+// leading context first if it is done, with bodyContext: only the methods
+// returning an error have somewhere to return it.
+func (g *generator) checksContext(m *model.Method) bool {
+	return g.methodBodyMode(m) == bodyContext && m.HasContext() &&
+		len(m.Out) > 0 && m.Out[len(m.Out)-1].Type == model.PredeclaredType("error")
+}
+
+// methodBodyMode returns the body mode of the method, which is its
+// //implgen:body directive if present, falling back to the generator's mode.
+func (g *generator) methodBodyMode(m *model.Method) string {
+	if mode, ok := m.Directives["body"]; ok {
+		return mode
+	}
+	if g.bodyMode == "" {
+		return bodyPanic
+	}
+	return g.bodyMode
+}
+
+// generateZeroReturn returns the zero values of the method results. Results
+// whose zero value has no literal form are declared as variables first.
+// If closedChans is set, channels that can be received from are returned
+// closed instead.
+// If literals is true, the structs, see structLiteral, are returned as T{},
+// and pointers to them as &T{}. Otherwise only the named types listed in
+// -value_types are returned as T{}.
+// If typedErrors is set, a last result of a named error type, see
+// isErrorType, is returned as T{} for a struct T, see structLiteral, and nil
+// for a pointer.
+func (g *generator) generateZeroReturn(m *model.Method, ia identifierAllocator, literals bool, pkgOverride string) {
+	if len(m.Out) == 0 {
+		return
+	}
+	rets := make([]string, len(m.Out))
+	for i, p := range m.Out {
+		if ct, ok := p.Type.(*model.ChanType); ok && g.closedChans && ct.Dir != model.SendDir {
+			// Receiving from a closed channel doesn't block, unlike from nil.
+			rets[i] = ia.allocateIdentifier(fmt.Sprintf("ret%d", i))
+			g.p("%v := make(chan %v)", rets[i], ct.Type.String(g.packageMap, pkgOverride))
+			g.p("close(%v)", rets[i])
+			continue
+		}
+		if g.typedErrors && i == len(m.Out)-1 && isErrorType(p.Type) {
+			if _, ok := p.Type.(*model.PointerType); ok {
+				rets[i] = "nil"
+				continue
+			}
+			// Only a struct has a literal, e.g. not the interface net.Error.
+			if rets[i] = g.structLiteral(p.Type, pkgOverride); rets[i] != "" {
+				continue
+			}
+		}
+		if nt, ok := p.Type.(*model.NamedType); literals || ok && g.valueTypes[nt.Package+"."+nt.Type] {
+			rets[i] = g.structLiteral(p.Type, pkgOverride)
+		}
+		if rets[i] == "" && g.initContainers {
+			rets[i] = emptyContainer(p.Type, g.packageMap, pkgOverride)
+		}
+		if rets[i] == "" {
+			rets[i] = p.Type.ZeroValue(g.packageMap, pkgOverride)
+		}
+		if rets[i] == "" {
+			rets[i] = ia.allocateIdentifier(fmt.Sprintf("ret%d", i))
+			g.p("var %v %v", rets[i], p.Type.String(g.packageMap, pkgOverride))
+		}
+	}
+	g.p("return %v", strings.Join(rets, ", "))
+}
+
+// generateErrorReturn returns the zero values of the method results but the
+// last one, the error expression err.
+func (g *generator) generateErrorReturn(m *model.Method, ia identifierAllocator, err string, pkgOverride string) {
+	rets := make([]string, len(m.Out))
+	for i, p := range m.Out[:len(m.Out)-1] {
+		if g.initContainers {
+			rets[i] = emptyContainer(p.Type, g.packageMap, pkgOverride)
+		}
+		if rets[i] == "" {
+			rets[i] = p.Type.ZeroValue(g.packageMap, pkgOverride)
+		}
+		if rets[i] == "" {
+			rets[i] = ia.allocateIdentifier(fmt.Sprintf("ret%d", i))
+			g.p("var %v %v", rets[i], p.Type.String(g.packageMap, pkgOverride))
+		}
+	}
+	rets[len(rets)-1] = err
+	g.p("return %v", strings.Join(rets, ", "))
+}
+
+// errorConstructor returns the function creating the errors of bodyError.
+func (g *generator) errorConstructor() *model.NamedType {
+	if g.errorCtor == nil {
+		return &model.NamedType{Package: "errors", Type: "New"}
+	}
+	return g.errorCtor
+}
+
+// emptyContainer returns the empty but non-nil literal of a map or slice
+// type t, e.g. map[string][]int{}, or the empty string for any other type.
+func emptyContainer(t model.Type, pm map[string]string, pkgOverride string) string {
+	switch t := t.(type) {
+	case *model.MapType:
+		return t.String(pm, pkgOverride) + "{}"
+	case *model.ArrayType:
+		if t.Len == -1 {
+			return t.String(pm, pkgOverride) + "{}"
+		}
+	}
+	return ""
+}
+
+// isErrorType reports whether t is a named type, or a pointer to one, that
+// is an error by convention: its name ends with Error, e.g. apierr.Error or
+// *ValidationError.
+func isErrorType(t model.Type) bool {
+	if pt, ok := t.(*model.PointerType); ok {
+		t = pt.Type
+	}
+	nt, ok := t.(*model.NamedType)
+	return ok && strings.HasSuffix(nt.Type, "Error")
+}
+
+// structLiteral returns T{} for a struct T and &T{} for a pointer to it, or
+// the empty string for any other type. The structs are the ones of the
+// source package and the -value_types, the only named types known not to be
+// interfaces or basic types, whose composite literals don't compile.
+func (g *generator) structLiteral(t model.Type, pkgOverride string) string {
+	nt, ok := t.(*model.NamedType)
+	if pt, isPointer := t.(*model.PointerType); isPointer {
+		nt, ok = pt.Type.(*model.NamedType)
+	}
+	if !ok || !g.structs[nt.Package+"."+nt.Type] && !g.valueTypes[nt.Package+"."+nt.Type] {
+		return ""
+	}
+	return compositeLiteral(t, g.packageMap, pkgOverride)
+}
+
+// compositeLiteral returns T{} for a named type T and &T{} for a pointer to
+// it, or the empty string for any other type.
+func compositeLiteral(t model.Type, pm map[string]string, pkgOverride string) string {
+	switch t := t.(type) {
+	case *model.NamedType:
+		return t.String(pm, pkgOverride) + "{}"
+	case *model.PointerType:
+		if nt, ok := t.Type.(*model.NamedType); ok {
+			return "&" + nt.String(pm, pkgOverride) + "{}"
+		}
+	}
+	return ""
+}
+
+// getRetString returns the result list of m, e.g. "(int, error)". Named
+// results sharing a type are collapsed, e.g. "(x, y int, err error)".
+func (g *generator) getRetString(m *model.Method, pkgOverride string) string {
+	retTypes := g.getRetTypes(m, pkgOverride)
+	if len(m.Out) > 0 && m.Out[0].Name != "" {
+		retNames := make([]string, len(m.Out))
+		for i, p := range m.Out {
+			retNames[i] = p.Name
+		}
+		return "(" + makeArgString(retNames, retTypes) + ")"
+	}
+	retString := strings.Join(retTypes, ", ")
+	if len(retTypes) > 1 {
+		retString = "(" + retString + ")"
+	}
+	return retString
+}
+
+// wrapArgs returns the parameters argNames of types argTypes one per line,
+// each followed by a comma, as gofmt lays out a parameter list it wraps.
+func wrapArgs(argNames, argTypes []string) string {
+	var b strings.Builder
+	b.WriteString("\n")
+	for i, name := range argNames {
+		b.WriteString("\t")
+		if name != "" {
+			b.WriteString(name + " ")
 		}
-		argNames[i] = name
+		b.WriteString(argTypes[i] + ",\n")
+	}
+	return b.String()
+}
+
+func (g *generator) getRetTypes(m *model.Method, pkgOverride string) []string {
+	retTypes := make([]string, len(m.Out))
+	for i, p := range m.Out {
+		retTypes[i] = p.Type.String(g.packageMap, pkgOverride)
+	}
+	return retTypes
+}
+
+// referencesArgs reports whether the body of the implementation of m refers
+// to its arguments, which then need names.
+func (g *generator) referencesArgs(s *implStruct, m *model.Method) bool {
+	_, recorded := s.argsType[m.Name]
+	_, spliced := s.bodies[m.Name]
+	_, delegated := s.funcs[m.Name]
+	fallsBack := s.fallback != "" && !g.overrides[m.Name]
+	return s.next != "" || recorded || spliced || delegated || fallsBack
+}
+
+// getParamNames returns the parameter names of m as declared, the empty
+// string for anonymous parameters.
+func (g *generator) getParamNames(m *model.Method) []string {
+	names := make([]string, len(m.In))
+	for i, p := range m.In {
+		names[i] = p.Name
 	}
 	if m.Variadic != nil {
-		name := m.Variadic.Name
-		if name == "" {
-			name = fmt.Sprintf("arg%d", len(m.In))
+		names = append(names, m.Variadic.Name)
+	}
+	return names
+}
+
+// getArgNames returns the parameter names of m, naming anonymous and blank
+// parameters arg0, arg1, ... without colliding with the named ones.
+func (g *generator) getArgNames(m *model.Method) []string {
+	argNames := g.getParamNames(m)
+	var taken []string
+	for _, name := range argNames {
+		if name != "" && name != "_" {
+			taken = append(taken, name)
+		}
+	}
+	ia := newIdentifierAllocator(taken)
+	for i, name := range argNames {
+		if name == "" || name == "_" {
+			argNames[i] = ia.allocateIdentifier(fmt.Sprintf("arg%d", i))
 		}
-		argNames = append(argNames, name)
 	}
 	return argNames
 }
@@ -338,31 +2550,282 @@ func (g *generator) getArgTypes(m *model.Method, pkgOverride string) []string {
 	return argTypes
 }
 
-// Output returns the generator's output, formatted in the standard Go style.
-func (g *generator) Output() (n int, err error) {
-	src, err := format.Source(g.buf.Bytes())
+// postProcess pipes src to the command, whose standard output replaces it.
+func postProcess(command []string, src []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(src)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("post-processor %v failed: %v\n%s", command[0], err, stderr.Bytes())
+	}
+	return stdout.Bytes(), nil
+}
+
+// testFileName returns the test file written next to the destination file
+// with -emit_tests: foo_test.go for foo.go.
+func (g *generator) testFileName() string {
+	return strings.TrimSuffix(g.dstFileName, ".go") + "_test.go"
+}
+
+// GenerateTests returns the formatted test file of package outputPkgName
+// with a skipped test of every method of the implementations declared by
+// Generate, to be filled in. With testMain, it also declares a TestMain
+// running setup and teardown hooks, and a new<Impl>ForTest helper per
+// implementation, using its constructor when it has one taking only a
+// context, or only options.
+func (g *generator) GenerateTests(outputPkgName string) ([]byte, error) {
+	t := &generator{}
+	t.p("// Code generated by ImplGen. Fill in the tests and remove their t.Skip calls.")
+	t.p("")
+	t.p("package %v", outputPkgName)
+	t.p("")
+
+	imports := []string{"testing"}
+	if g.testMain {
+		imports = append(imports, "os")
+		for _, intf := range g.tested {
+			if len(intf.TypeParams) == 0 && !g.wrap && !g.optionsConstructor {
+				imports = append(imports, "context")
+				break
+			}
+		}
+	}
+	sort.Strings(imports)
+	t.p("import (")
+	t.in()
+	for _, imp := range imports {
+		t.p("%q", imp)
+	}
+	t.out()
+	t.p(")")
+
+	if g.testMain {
+		t.p("")
+		t.p("// setup runs before the tests.")
+		t.p("func setup() {}")
+		t.p("")
+		t.p("// teardown runs after the tests.")
+		t.p("func teardown() {}")
+		t.p("")
+		t.p("func TestMain(m *testing.M) {")
+		t.in()
+		t.p("setup()")
+		t.p("code := m.Run()")
+		t.p("teardown()")
+		t.p("os.Exit(code)")
+		t.out()
+		t.p("}")
+	}
+
+	for _, intf := range g.tested {
+		name := g.mockName(intf.Name)
+		// Generic implementations can't be constructed without type arguments.
+		helper := g.testMain && len(intf.TypeParams) == 0
+		if helper {
+			t.p("")
+			t.p("// new%vForTest returns the %v under test.", upperFirst(name), name)
+			t.p("func new%vForTest(t *testing.T) *%v {", upperFirst(name), name)
+			t.in()
+			t.p("t.Helper()")
+			ctx := "context.Background()"
+			if g.optionsConstructor {
+				ctx = ""
+			}
+			switch {
+			case g.wrap:
+				// The constructor of a decorator needs what it decorates.
+				t.p("return &%v{}", name)
+			case g.constructorError:
+				t.p("impl, err := New%v(%v)", name, ctx)
+				t.p("if err != nil {")
+				t.in()
+				t.p("t.Fatalf(\"New%v: %%v\", err)", name)
+				t.out()
+				t.p("}")
+				t.p("return impl")
+			default:
+				t.p("return New%v(%v)", name, ctx)
+			}
+			t.out()
+			t.p("}")
+		}
+		for _, m := range intf.Methods {
+			t.p("")
+			t.p("func Test%v_%v(t *testing.T) {", upperFirst(name), m.Name)
+			t.in()
+			if helper {
+				t.p("impl := new%vForTest(t)", upperFirst(name))
+				t.p("_ = impl")
+			}
+			t.p("t.Skip(\"TODO: test %v.%v\")", name, m.Name)
+			t.out()
+			t.p("}")
+		}
+	}
+
+	src, err := format.Source(t.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to format generated tests: %v\n%s", err, t.buf.String())
+	}
+	return src, nil
+}
+
+// OutputTests writes the tests of GenerateTests next to the destination
+// file, unless the test file exists and force isn't set, since it's meant
+// to be edited.
+func (g *generator) OutputTests(outputPkgName string) error {
+	name := g.testFileName()
+	if _, err := os.Stat(name); err == nil && !g.force {
+		g.warnf("%v exists, not overwriting it; use -force to regenerate it", name)
+		return nil
+	}
+	src, err := g.GenerateTests(outputPkgName)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(name, src, 0666); err != nil {
+		return err
+	}
+	g.report.wrote(name)
+	return nil
+}
+
+// writesFile reports whether the output goes to a file rather than to the
+// standard output, which an empty or "-" destination stands for.
+func (g *generator) writesFile() bool {
+	return g.dstFileName != "" && g.dstFileName != "-"
+}
+
+// errStale is returned by Output with -diff or -check when the destination
+// file differs from the output.
+var errStale = errors.New("destination is out of date")
+
+// WriteTo writes the generator's output to w, formatted in the standard Go
+// style unless -no_gofmt is set, filtered by the -post_process command and
+// with the -line_ending line endings, e.g. to capture it in memory.
+func (g *generator) WriteTo(w io.Writer) (int64, error) {
+	src := g.buf.Bytes()
+	var err error
+	if !g.noFormat {
+		if src, err = format.Source(src); err != nil {
+			return 0, fmt.Errorf("failed to format generated source code: %v\n%s", err, g.buf.String())
+		}
+	}
+	if len(g.postProcess) > 0 {
+		if src, err = postProcess(g.postProcess, src); err != nil {
+			return 0, err
+		}
+	}
+	if g.crlf {
+		src = bytes.Replace(src, []byte("\n"), []byte("\r\n"), -1)
+	}
+	n, err := w.Write(src)
+	return int64(n), err
+}
+
+// GenerateFromSource generates the implementations of the interfaces
+// declared by src, the source of a file of the package importPath, which may
+// be empty, in the package outputPkgName. It returns the output of WriteTo
+// and the model of src the output was generated from, as Generate left it,
+// so that callers needing both don't parse src a second time.
+func (g *generator) GenerateFromSource(src []byte, importPath, outputPkgName string) (code []byte, pkg *model.Package, err error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed getting current directory: %v", err)
+	}
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, "source.go", src, parser.ParseComments)
 	if err != nil {
-		log.Fatalf("Failed to format generated source code: %s\n%s", err, g.buf.String())
+		return nil, nil, fmt.Errorf("failed parsing source: %v", err)
+	}
+	p := newFileParser(fs, wd)
+	p.addAuxInterfacesFromFile(importPath, file)
+	if pkg, err = p.parseFile(importPath, file); err != nil {
+		return nil, nil, err
+	}
+	if err := g.Generate(pkg, outputPkgName, ""); err != nil {
+		return nil, nil, err
+	}
+	var out bytes.Buffer
+	if _, err := g.WriteTo(&out); err != nil {
+		return nil, nil, err
+	}
+	return out.Bytes(), pkg, nil
+}
+
+// Output writes the output of WriteTo to the destination file, or to the
+// standard output. With -diff it writes the diff from the destination file
+// to the output instead, and returns errStale if there is one. With -check
+// it writes nothing, and only returns errStale if the destination file
+// differs.
+func (g *generator) Output() (n int, err error) {
+	var out bytes.Buffer
+	if _, err := g.WriteTo(&out); err != nil {
+		return 0, err
+	}
+	src := out.Bytes()
+	if g.region {
+		// Only the marked region of the destination file is replaced.
+		old, err := ioutil.ReadFile(g.dstFileName)
+		if err != nil {
+			return 0, err
+		}
+		lf := func(b []byte) []byte { return bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1) }
+		if src, err = spliceRegion(lf(old), lf(src)); err != nil {
+			return 0, fmt.Errorf("%v: %v", g.dstFileName, err)
+		}
+		if !g.noFormat {
+			if src, err = format.Source(src); err != nil {
+				return 0, fmt.Errorf("failed to format %v: %v", g.dstFileName, err)
+			}
+		}
+		if g.crlf {
+			src = bytes.Replace(src, []byte("\n"), []byte("\r\n"), -1)
+		}
 	}
 
-	dst := os.Stdout
-	if len(g.dstFileName) > 0 {
-		if err := os.MkdirAll(filepath.Dir(*destination), os.ModePerm); err != nil {
-			log.Fatalf("Unable to create directory: %v", err)
+	var dst io.Writer = os.Stdout
+	if g.stdout != nil {
+		dst = g.stdout
+	}
+	if g.diff || g.check {
+		old, err := ioutil.ReadFile(g.dstFileName)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		if err == nil && bytes.Equal(old, src) {
+			return 0, nil
+		}
+		if g.check {
+			return 0, errStale
+		}
+		name := filepath.ToSlash(g.dstFileName)
+		d := unifiedDiff("a/"+name, "b/"+name, old, src)
+		if n, err = io.WriteString(dst, d); err != nil {
+			return n, err
+		}
+		return n, errStale
+	}
+	if g.writesFile() {
+		if err := os.MkdirAll(filepath.Dir(g.dstFileName), os.ModePerm); err != nil {
+			return 0, fmt.Errorf("unable to create directory: %v", err)
 		}
 		var f *os.File
 		var err error
 		if g.head {
-			f, err = os.Create(*destination)
+			f, err = os.Create(g.dstFileName)
 		} else {
-			f, err = os.OpenFile(*destination, os.O_RDWR|os.O_APPEND, 0666)
+			f, err = os.OpenFile(g.dstFileName, os.O_RDWR|os.O_APPEND, 0666)
 		}
 
 		if err != nil {
-			log.Fatalf("Failed opening destination file: %v", err)
+			return 0, fmt.Errorf("failed opening destination file: %v", err)
 		}
-		defer dst.Close()
+		defer f.Close()
 		dst = f
+		g.report.wrote(g.dstFileName)
 	}
 
 	return dst.Write(src)
@@ -0,0 +1,3653 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/ssoor/implgen/model"
+)
+
+// generateSource parses src and returns the formatted output of g for it.
+func generateSource(t *testing.T, g *generator, src string) string {
+	t.Helper()
+	pkg, err := parseSource(t, src)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	g.generatePackageMap(pkg, "foo", "")
+	g.generateHead(pkg, "foo", "")
+	if err := g.generate(pkg, "foo", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	out, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to format generated source code: %v\n%s", err, g.buf.String())
+	}
+	return string(out)
+}
+
+func TestGenerateHead_Marker(t *testing.T) {
+	const src = `package foo
+
+type Foo interface {
+	Bar()
+}
+`
+	for _, test := range []struct {
+		marker, want string
+	}{
+		{"@generated", "// @generated\n\n// Code generated by ImplGen."},
+		{"//lint:file-ignore U1000 generated", "//lint:file-ignore U1000 generated\n\n// Code generated by ImplGen."},
+		{"", "// Code generated by ImplGen."},
+	} {
+		out := generateSource(t, &generator{outputOptions: outputOptions{marker: test.marker}}, src)
+		if !strings.HasPrefix(out, test.want) {
+			t.Errorf("-marker=%q: output doesn't start with %q:\n%s", test.marker, test.want, out)
+		}
+	}
+
+	out := generateSource(t, &generator{outputOptions: outputOptions{marker: "@generated", copyrightHeader: "Copyright 2020"}}, src)
+	if want := "// @generated\n\n// Copyright 2020\n"; !strings.HasPrefix(out, want) {
+		t.Errorf("output doesn't start with %q:\n%s", want, out)
+	}
+}
+
+func TestGenerateMockMethod_BodyMode(t *testing.T) {
+	const src = `package foo
+
+import "time"
+
+type Foo interface {
+	Bar() (int, error)
+	//implgen:body=panic
+	Baz(s string) string
+	//implgen:body=zero
+	Qux() time.Time
+	Quux(d time.Duration)
+}
+`
+	for _, test := range []struct {
+		name     string
+		bodyMode string
+		want     []string
+		notWant  []string
+	}{
+		{
+			name: "default panic",
+			want: []string{
+				`panic("Foo.Bar() (int, error) Not implemented")`,
+				`panic("Foo.Baz(s string) string Not implemented")`,
+				"var ret0 time.Time\n\treturn ret0\n}",
+				`panic("Foo.Quux(d time.Duration) Not implemented")`,
+			},
+		},
+		{
+			name:     "global zero",
+			bodyMode: bodyZero,
+			want: []string{
+				"return 0, nil\n}",
+				`panic("Foo.Baz(s string) string Not implemented")`,
+				"var ret0 time.Time\n\treturn ret0\n}",
+				"func (m *Foo) Quux(d time.Duration) {\n}",
+			},
+			notWant: []string{
+				`panic("Foo.Bar() (int, error) Not implemented")`,
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			out := generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: test.bodyMode}}, src)
+			for _, want := range test.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("output doesn't contain %q:\n%s", want, out)
+				}
+			}
+			for _, notWant := range test.notWant {
+				if strings.Contains(out, notWant) {
+					t.Errorf("output contains %q:\n%s", notWant, out)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateMockMethod_ZeroComposite(t *testing.T) {
+	out := generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyZero}}, `package foo
+
+type Foo interface {
+	Get() ([3]*Item, []*Item, map[string][]*Item, *[2]Item)
+	Grid() [2][]Item
+}
+
+type Item struct{}
+`)
+	for _, want := range []string{
+		"return [3]*Item{}, nil, nil, nil\n}",
+		"return [2][]Item{}\n}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerateMockMethod_ClosedChan(t *testing.T) {
+	const src = `package foo
+
+type Foo interface {
+	Events() <-chan string
+	Pipe() (chan int, error)
+	Sink() chan<- int
+}
+`
+	out := generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyZero, closedChans: true}}, src)
+	for _, want := range []string{
+		"ret0 := make(chan string)\n\tclose(ret0)\n\treturn ret0\n}",
+		"ret0 := make(chan int)\n\tclose(ret0)\n\treturn ret0, nil\n}",
+		"Sink() chan<- int {\n\treturn nil\n}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	out = generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyZero}}, src)
+	if strings.Contains(out, "close(") {
+		t.Errorf("output closes channels without closedChans:\n%s", out)
+	}
+}
+
+func TestGenerateMockMethod_TypedError(t *testing.T) {
+	const src = `package foo
+
+import (
+	"net"
+
+	"unknown.invalid/apierr"
+)
+
+type Foo interface {
+	Get(id string) (Item, apierr.Error)
+	Put(item Item) *ValidationError
+	Check() (ValidationError, Item)
+	Validate(item Item) ValidationError
+	Dial() net.Error
+}
+
+type Item struct{}
+
+type ValidationError struct{}
+
+func (ValidationError) Error() string { return "invalid" }
+`
+	out := generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyZero, typedErrors: true}}, src)
+	for _, want := range []string{
+		// apierr.Error isn't known to be a struct.
+		"var ret1 apierr.Error\n\treturn ret0, ret1",
+		"func (m *Foo) Put(item Item) *ValidationError {\n\treturn nil\n}",
+		"func (m *Foo) Validate(item Item) ValidationError {\n\treturn ValidationError{}\n}",
+		// Only the last result is the error.
+		"var ret0 ValidationError\n\tvar ret1 Item\n\treturn ret0, ret1",
+		// An interface has no literal.
+		"var ret0 net.Error\n\treturn ret0",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	out = generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyZero}}, src)
+	if want := "var ret1 apierr.Error\n\treturn ret0, ret1"; !strings.Contains(out, want) {
+		t.Errorf("output without -typed_error doesn't contain %q:\n%s", want, out)
+	}
+}
+
+func TestGenerateMockInterface_ForwardCompat(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+import "context"
+
+type Foo interface {
+	Get(ctx context.Context, id string) (string, error)
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	g := generator{structOptions: structOptions{forwardCompat: true}}
+	if err := g.Generate(pkg, "foo_impl", "example.com/foo_impl"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to format generated source code: %v\n%s", err, g.buf.String())
+	}
+	for _, want := range []string{
+		"type Foo struct {\n\tfoo.Foo // implements the methods added later, which panic\n}",
+		"func (m *Foo) Get(ctx context.Context, id string) (string, error) {",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	// The stub still implements the interface once a method is added to it.
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, "foo.go", `package foo
+
+import "context"
+
+type Foo interface {
+	Get(ctx context.Context, id string) (string, error)
+	Put(ctx context.Context, id, v string) error
+}
+`, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	std := importer.ForCompiler(fs, "source", nil)
+	foo, err := (&types.Config{Importer: std}).Check("example.com/foo", fs, []*ast.File{file}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	impl, err := parser.ParseFile(fs, "foo_impl.go", string(out)+"\nvar _ foo.Foo = (*Foo)(nil)\n", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	conf := types.Config{Importer: importerFunc(func(path string) (*types.Package, error) {
+		if path == "example.com/foo" {
+			return foo, nil
+		}
+		return std.Import(path)
+	})}
+	if _, err := conf.Check("example.com/foo_impl", fs, []*ast.File{impl}, nil); err != nil {
+		t.Errorf("output doesn't implement the extended interface: %v\n%s", err, out)
+	}
+
+	pkg, err = parseSource(t, "package foo\n\ntype Foo interface {\n\tFoo()\n}\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	g = generator{structOptions: structOptions{forwardCompat: true}}
+	if err := g.Generate(pkg, "foo_impl", "example.com/foo_impl"); err == nil || !strings.Contains(err.Error(), "clashes with the embedded Foo") {
+		t.Errorf("expected a clash error, got %v", err)
+	}
+}
+
+func TestGenerateMockInterface_StructGuard(t *testing.T) {
+	const src = `package foo
+
+type Foo interface {
+	Bar() error
+}
+`
+	out := generateSource(t, &generator{structOptions: structOptions{structGuard: true}}, src)
+	if want := "type Foo struct {\n\t_ [0]func() // forbids comparing implementations with ==\n}"; !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+
+	out = generateSource(t, &generator{}, src)
+	if want := "type Foo struct {\n}"; !strings.Contains(out, want) {
+		t.Errorf("output without -struct_guard doesn't contain %q:\n%s", want, out)
+	}
+	if strings.Contains(out, "[0]func()") {
+		t.Errorf("output without -struct_guard contains the guard field:\n%s", out)
+	}
+}
+
+func TestGenerateMockMethod_FriendlyStringer(t *testing.T) {
+	const src = `package foo
+
+import "fmt"
+
+type Foo interface {
+	fmt.Stringer
+	Name() string
+	Format(verbose bool) string
+}
+`
+	out := generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyTrace, friendlyStringer: true}}, src)
+	if want := "func (m *Foo) String() string {\n\treturn \"Foo{}\"\n}"; !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+	// Only String() string is special.
+	for _, want := range []string{
+		"func (m *Foo) Name() string {\n\t_, file, line, _ := runtime.Caller(1)",
+		"func (m *Foo) Format(verbose bool) string {\n\t_, file, line, _ := runtime.Caller(1)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	out = generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyZero}}, src)
+	if want := "func (m *Foo) String() string {\n\treturn \"\"\n}"; !strings.Contains(out, want) {
+		t.Errorf("output without -friendly_stringer doesn't contain %q:\n%s", want, out)
+	}
+}
+
+func TestGenerateMockMethod_NoopClose(t *testing.T) {
+	const src = `package foo
+
+import "io"
+
+type Foo interface {
+	io.Closer
+	Shutdown() error
+	CloseWithError(err error) error
+}
+`
+	out := generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyPanic, noopCloser: true}}, src)
+	if want := "func (m *Foo) Close() error {\n\treturn nil\n}"; !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+	// Only Close() error is special.
+	for _, want := range []string{
+		`panic("Foo.Shutdown() error Not implemented")`,
+		`panic("Foo.CloseWithError(err error) error Not implemented")`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	out = generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyPanic}}, src)
+	if want := `panic("Foo.Close() error Not implemented")`; !strings.Contains(out, want) {
+		t.Errorf("output without -noop_close doesn't contain %q:\n%s", want, out)
+	}
+}
+
+func TestGenerateMockMethod_SliceResultAndVariadic(t *testing.T) {
+	const src = `package foo
+
+type Foo interface {
+	Tags() []string
+	SetTags(tags ...string)
+	Retag(tags ...string) []string
+	Joiner() func(sep string, parts ...string) []string
+}
+`
+	for _, mode := range []string{bodyPanic, bodyZero} {
+		out := generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: mode}}, src)
+		for _, want := range []string{
+			"func (m *Foo) Tags() []string {",
+			"func (m *Foo) SetTags(tags ...string) {",
+			"func (m *Foo) Retag(tags ...string) []string {",
+			"func (m *Foo) Joiner() func(string, ...string) []string {",
+		} {
+			if !strings.Contains(out, want) {
+				t.Errorf("%v output doesn't contain %q:\n%s", mode, want, out)
+			}
+		}
+		for _, dontWant := range []string{") ...string", "(...string)", "...string {"} {
+			if strings.Contains(out, dontWant) {
+				t.Errorf("%v output contains %q:\n%s", mode, dontWant, out)
+			}
+		}
+	}
+}
+
+func TestGenerateMockMethod_InitContainers(t *testing.T) {
+	const src = `package foo
+
+type Foo interface {
+	Index() map[string][]*Item
+	List() ([]Item, error)
+	Other() (chan int, *Item, [2]Item, Set)
+}
+
+type Item struct{}
+
+type Set map[string]bool
+`
+	out := generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyZero, initContainers: true}}, src)
+	for _, want := range []string{
+		"return map[string][]*Item{}\n}",
+		"return []Item{}, nil\n}",
+		"var ret3 Set\n\treturn nil, nil, [2]Item{}, ret3\n}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	out = generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyError, initContainers: true}}, src)
+	if want := "return []Item{}, errors.New("; !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+
+	out = generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyZero}}, src)
+	if want := "return nil, nil\n}"; !strings.Contains(out, want) {
+		t.Errorf("without initContainers, output doesn't contain %q:\n%s", want, out)
+	}
+}
+
+func TestGenerateMockMethod_InlineStruct(t *testing.T) {
+	out := generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyZero}}, `package foo
+
+import (
+	"fmt"
+	"time"
+)
+
+type Foo interface {
+	Configure(opts struct {
+		Timeout time.Duration
+		Retries, Backoff int `+"`json:\"r\"`"+`
+		fmt.Stringer
+	}) struct{ OK bool }
+}
+`)
+
+	for _, want := range []string{
+		`"time"`,
+		"func (m *Foo) Configure(opts struct {\n\tTimeout time.Duration\n\tRetries int `json:\"r\"`\n\tBackoff int `json:\"r\"`\n\tfmt.Stringer\n}) struct{ OK bool } {",
+		"return struct{ OK bool }{}\n}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	// The tags are quoted in the panic message.
+	out = generateSource(t, &generator{}, `package foo
+
+type Foo interface {
+	Configure(opts struct {
+		Retries int `+"`json:\"r\"`"+`
+	})
+}
+`)
+	if want := `panic("Foo.Configure(opts struct{ Retries int ` + "`json:\\\"r\\\"`" + ` }) Not implemented")`; !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+}
+
+func TestGenerateMockMethod_VariadicSameType(t *testing.T) {
+	out := generateSource(t, &generator{structOptions: structOptions{record: true}}, `package foo
+
+type Foo interface {
+	Join(sep string, parts ...string) string
+}
+`)
+
+	for _, want := range []string{
+		"func (m *Foo) Join(sep string, parts ...string) string {",
+		"m.JoinCalls = append(m.JoinCalls, fooJoinArgs{Sep: sep, Parts: append([]string(nil), parts...)})",
+		"type fooJoinArgs struct {\n\tSep   string\n\tParts []string\n}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerateMockMethod_LineDirectives(t *testing.T) {
+	const src = `package foo
+
+type Foo interface {
+	// Get gets.
+	Get(id string) error
+	Close()
+}
+`
+	out := generateSource(t, &generator{outputOptions: outputOptions{lineDirectives: true}}, src)
+	for _, want := range []string{
+		"// Get gets.\n//\n//line input.go:5\nfunc (m *Foo) Get(id string) error {",
+		"//line input.go:6\nfunc (m *Foo) Close() {",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	if out := generateSource(t, &generator{}, src); strings.Contains(out, "//line") {
+		t.Errorf("output contains //line directives without -line_directives:\n%s", out)
+	}
+
+	// The directives are relative to the destination file.
+	g := &generator{dstFileName: filepath.Join("impl", "foo_impl.go"), outputOptions: outputOptions{lineDirectives: true}}
+	if got, want := g.lineDirectiveFile("input.go"), "../input.go"; got != want {
+		t.Errorf("lineDirectiveFile() = %q, want %q", got, want)
+	}
+}
+
+func TestGenerateMockMethod_LineLength(t *testing.T) {
+	const src = `package foo
+
+type Foo interface {
+	Create(name, owner string, size int, quota int64, mode uint32, tags []string, labels map[string]string, opts ...Option) error
+	Close() error
+}
+
+type Option struct{}
+`
+	out := generateSource(t, &generator{outputOptions: outputOptions{lineLength: 80}}, src)
+	for _, want := range []string{
+		"func (m *Foo) Create(\n\tname string,\n\towner string,\n\tsize int,\n\tquota int64,\n\tmode uint32,\n\ttags []string,\n\tlabels map[string]string,\n\topts ...Option,\n) error {\n",
+		"func (m *Foo) Close() error {\n",
+		// The messages keep the signature on one line.
+		`panic("Foo.Create(name, owner string, size int, quota int64, mode uint32, tags []string, labels map[string]string, opts ...Option) error Not implemented")`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	out = generateSource(t, &generator{}, src)
+	if want := "func (m *Foo) Create(name, owner string, size int, quota int64, mode uint32, tags []string, labels map[string]string, opts ...Option) error {\n"; !strings.Contains(out, want) {
+		t.Errorf("without -line_length, output doesn't contain %q:\n%s", want, out)
+	}
+}
+
+func TestGenerateMockMethod_VariadicAny(t *testing.T) {
+	const src = `package foo
+
+type Foo interface {
+	Log(args ...any)
+	Logf(format string, args ...interface{}) error
+}
+`
+	pkg, err := parseSource(t, src)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i, want := range []model.Type{model.PredeclaredType("any"), model.PredeclaredType("interface{}")} {
+		if m := pkg.Interfaces[0].Methods[i]; m.Variadic == nil || m.Variadic.Type != want {
+			t.Errorf("%v variadic parameter = %v, want %v", m.Name, m.Variadic, want)
+		}
+	}
+
+	for _, test := range []struct {
+		name string
+		g    *generator
+		want []string
+	}{
+		{
+			name: "record",
+			g:    &generator{structOptions: structOptions{record: true}},
+			want: []string{
+				"func (m *Foo) Log(args ...any) {",
+				"func (m *Foo) Logf(format string, args ...interface{}) error {",
+				"type fooLogArgs struct {\n\tArgs []any\n}",
+				"\tArgs   []interface{}\n}",
+			},
+		},
+		{
+			name: "wrap",
+			g:    &generator{decoratorOptions: decoratorOptions{wrap: true}},
+			want: []string{
+				"func (m *LoggingFoo) Log(args ...any) {",
+				"m.next.Log(args...)",
+				"ret0 := m.next.Logf(format, args...)",
+			},
+		},
+		{
+			name: "funcs",
+			g:    &generator{decoratorOptions: decoratorOptions{funcs: true}},
+			want: []string{
+				"LogFunc  func(args ...any)",
+				"LogfFunc func(format string, args ...interface{}) error",
+				"m.LogFunc(args...)",
+				"return m.LogfFunc(format, args...)",
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			out := generateSource(t, test.g, src)
+			for _, want := range test.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("output doesn't contain %q:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateMockMethod_ErrorBodyMode(t *testing.T) {
+	const src = `package foo
+
+type Foo interface {
+	Get(id string) (map[string]int, Item, error)
+	Close() error
+	Count() int
+}
+
+type Item struct{}
+`
+	out := generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyError}}, src)
+	for _, want := range []string{
+		`"errors"`,
+		"var ret1 Item\n\treturn nil, ret1, errors.New(\"Foo.Get(id string) (map[string]int, Item, error) Not implemented\")",
+		"return errors.New(\"Foo.Close() error Not implemented\")",
+		// Nowhere to return the error, like error_wrapped.
+		"func (m *Foo) Count() int {\n\treturn 0\n}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	out = generateSource(t, &generator{bodyOptions: bodyOptions{
+		bodyMode:  bodyError,
+		errorCtor: &model.NamedType{Package: "github.com/pkg/errors", Type: "New"},
+	}}, src)
+	for _, want := range []string{
+		`"github.com/pkg/errors"`,
+		"return errors.New(\"Foo.Close() error Not implemented\")",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `"errors"`) {
+		t.Errorf("output imports the standard errors package:\n%s", out)
+	}
+}
+
+func TestGenerateMockMethod_ErrorWrappedBodyMode(t *testing.T) {
+	out := generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyErrorWrapped}}, `package foo
+
+type Foo interface {
+	Get(id string) (map[string]int, Item, error)
+	Close() error
+	Count() int
+	Reset()
+}
+
+type Item struct{}
+`)
+	for _, want := range []string{
+		`"errors"`,
+		`"fmt"`,
+		"// errNotImplemented is wrapped by the errors of the methods not implemented yet.\nvar errNotImplemented = errors.New(\"not implemented\")",
+		"var ret1 Item\n\treturn nil, ret1, fmt.Errorf(\"%s: %w\", \"Foo.Get\", errNotImplemented)",
+		"return fmt.Errorf(\"%s: %w\", \"Foo.Close\", errNotImplemented)",
+		"func (m *Foo) Count() int {\n\treturn 0\n}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "panic(") {
+		t.Errorf("output panics:\n%s", out)
+	}
+}
+
+func TestGenerateMockMethod_ContextBodyMode(t *testing.T) {
+	out := generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyContext}}, `package foo
+
+import "context"
+
+type Foo interface {
+	Get(ctx context.Context, id string) (Item, error)
+	Put(context.Context, Item) error
+	Wait(ctx context.Context) int
+	Close() error
+}
+
+type Item struct{}
+`)
+	for _, want := range []string{
+		"func (m *Foo) Get(ctx context.Context, id string) (Item, error) {\n" +
+			"\tif err := ctx.Err(); err != nil {\n\t\tvar ret0 Item\n\t\treturn ret0, err\n\t}\n" +
+			"\tpanic(\"Foo.Get(ctx context.Context, id string) (Item, error) Not implemented\")\n}",
+		"func (m *Foo) Put(arg0 context.Context, arg1 Item) error {",
+		"\tif err := arg0.Err(); err != nil {\n\t\treturn err\n\t}\n",
+		"func (m *Foo) Wait(ctx context.Context) int {\n\tpanic(",
+		"func (m *Foo) Close() error {\n\tpanic(",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	if n := strings.Count(out, ".Err()"); n != 2 {
+		t.Errorf("output checks the context %d times, want twice:\n%s", n, out)
+	}
+}
+
+func TestGenerateMockMethod_FuncResults(t *testing.T) {
+	out := generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyZero}}, `package foo
+
+type Foo interface {
+	Logger() func(format string, args ...interface{})
+	Validator() (func(int, ...string) (bool, error), error)
+}
+`)
+
+	for _, want := range []string{
+		"func (m *Foo) Logger() func(string, ...interface{}) {\n\treturn nil\n}",
+		"func (m *Foo) Validator() (func(int, ...string) (bool, error), error) {",
+		"\treturn nil, nil\n}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerateMockMethod_LiteralBodyMode(t *testing.T) {
+	out := generateSource(t, &generator{bodyOptions: bodyOptions{valueTypes: map[string]bool{"time.Location": true}}}, `package foo
+
+import (
+	"io"
+	"time"
+)
+
+type Config struct{}
+
+type Level int
+
+type Store interface {
+	Get() Config
+}
+
+type Foo interface {
+	//implgen:body=literal
+	Value() (Config, error)
+	//implgen:body=literal
+	Pointer() (*Config, *time.Location, *int)
+	//implgen:body=literal
+	Named() (Level, *Level, time.Duration)
+	//implgen:body=literal
+	Interface() (Store, io.Reader)
+	//implgen:body=zero
+	Zero() (Config, *Config)
+}
+`)
+
+	for _, want := range []string{
+		"return Config{}, nil\n}",
+		"return &Config{}, &time.Location{}, nil\n}",
+		// Only the structs have composite literals.
+		"var ret0 Level\n\tvar ret2 time.Duration\n\treturn ret0, nil, ret2\n}",
+		"var ret0 Store\n\tvar ret1 io.Reader\n\treturn ret0, ret1\n}",
+		"var ret0 Config\n\treturn ret0, nil\n}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"Level{}", "Duration{}", "return Store{}", "Reader{}"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("output contains %q:\n%s", unwanted, out)
+		}
+	}
+}
+
+func TestGenerator_Deterministic(t *testing.T) {
+	const src = `package foo
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+type Foo interface {
+	Zed(ctx context.Context, d time.Duration) (*http.Request, error)
+	Alpha(r io.Reader) *bytes.Buffer
+	Mid()
+}
+`
+	first := generateSource(t, &generator{}, src)
+	for i := 0; i < 3; i++ {
+		if out := generateSource(t, &generator{}, src); out != first {
+			t.Fatalf("output differs between runs:\n%s\n---\n%s", first, out)
+		}
+	}
+	if zed, alpha := strings.Index(first, ") Zed("), strings.Index(first, ") Alpha("); zed > alpha {
+		t.Errorf("methods are not in interface order:\n%s", first)
+	}
+}
+
+func TestGenerateMockInterface_Nolint(t *testing.T) {
+	out := generateSource(t, &generator{}, `package foo
+
+// Foo is linted leniently.
+//implgen:nolint=unused
+type Foo interface {
+	Bar() error
+	//implgen:nolint=errcheck,gosec
+	Baz()
+	Qux() //implgen:nolint
+}
+
+type Other interface {
+	Quux()
+}
+`)
+
+	for _, want := range []string{
+		"// Foo is linted leniently.\n//\n//nolint:unused\ntype Foo struct {",
+		"// NewFoo create a new Foo object\n//\n//nolint:unused\nfunc NewFoo(",
+		"//nolint:unused\nfunc (m *Foo) Bar() error {",
+		"//nolint:errcheck,gosec\nfunc (m *Foo) Baz() {",
+		"//nolint:all\nfunc (m *Foo) Qux() {",
+		"\ntype Other struct {",
+		"object\nfunc NewOther(",
+		"\nfunc (m *Other) Quux() {",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "implgen:") {
+		t.Errorf("output contains directives:\n%s", out)
+	}
+}
+
+func TestGenerateMockMethod_ValueTypes(t *testing.T) {
+	const src = `package foo
+
+import "embed"
+
+type Config struct{}
+
+type Foo interface {
+	Assets() (embed.FS, *embed.FS, error)
+	Config() Config
+}
+`
+	out := generateSource(t, &generator{bodyOptions: bodyOptions{
+		bodyMode:   bodyZero,
+		valueTypes: map[string]bool{"embed.FS": true, "example.com/foo.Config": true},
+	}}, src)
+	for _, want := range []string{
+		"return embed.FS{}, nil, nil\n}",
+		"return Config{}\n}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	out = generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyZero}}, src)
+	if want := "var ret0 embed.FS\n\treturn ret0, nil, nil\n}"; !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+}
+
+func TestGenerateMockMethod_NamedResults(t *testing.T) {
+	out := generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyZero}}, `package foo
+
+type Foo interface {
+	Bar(m int) (x, y int, err error)
+	Baz() (_ string)
+}
+`)
+
+	for _, want := range []string{
+		"func (m_2 *Foo) Bar(m int) (x, y int, err error) {",
+		"return 0, 0, nil\n}",
+		"func (m *Foo) Baz() (_ string) {",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerateMockMethod_TodoComment(t *testing.T) {
+	const src = `package foo
+
+import "context"
+
+type Foo interface {
+	Bar(ctx context.Context, id int, names ...string) (Result, error)
+}
+
+type Result struct{}
+`
+	out := generateSource(t, &generator{structOptions: structOptions{mutex: true, record: true}, bodyOptions: bodyOptions{todoComments: true}}, src)
+
+	// The TODO comment summarizes the whole signature, after the lines
+	// locking the mutex and recording the call.
+	want := "m.BarCalls = append(m.BarCalls, fooBarArgs{Ctx: ctx, Id: id, Names: append([]string(nil), names...)})\n\n" +
+		"\t// TODO: Foo.Bar(ctx context.Context, id int, names ...string) (Result, error) Not implemented\n"
+	if !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+	if want := "\t// TODO: NewFoo(_ context.Context) Not implemented\n"; !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+
+	out = generateSource(t, &generator{structOptions: structOptions{mutex: true, record: true}}, src)
+	if strings.Contains(out, "TODO") {
+		t.Errorf("output without -todo_comments contains a TODO comment:\n%s", out)
+	}
+}
+
+func TestGenerateMockMethod_UnknownBodyMode(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+type Foo interface {
+	//implgen:body=explode
+	Bar()
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	g := generator{}
+	err = g.generate(pkg, "foo", "")
+	if err == nil || !strings.Contains(err.Error(), `unknown body mode "explode"`) {
+		t.Fatalf("expected unknown body mode error, got %v", err)
+	}
+}
+
+func TestGenerateMockInterface_Mutex(t *testing.T) {
+	out := generateSource(t, &generator{structOptions: structOptions{mutex: true}}, `package foo
+
+type Foo interface {
+	Bar(m int)
+	mu()
+}
+`)
+
+	for _, want := range []string{
+		`"sync"`,
+		"mu_2 sync.Mutex",
+		"m_2.mu_2.Lock()\n\tdefer m_2.mu_2.Unlock()",
+		"m.mu_2.Lock()\n\tdefer m.mu_2.Unlock()",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerateMockInterface_Record(t *testing.T) {
+	out := generateSource(t, &generator{structOptions: structOptions{record: true}}, `package foo
+
+type Foo interface {
+	Bar(x int, y string)
+	Baz(format string, args ...interface{})
+	Qux()
+}
+`)
+
+	for _, want := range []string{
+		"BarCalls []fooBarArgs",
+		"BazCalls []fooBazArgs",
+		"QuxCalls int",
+		"type fooBarArgs struct {\n\tX int\n\tY string\n}",
+		"type fooBazArgs struct {\n\tFormat string\n\tArgs   []interface{}\n}",
+		"m.BarCalls = append(m.BarCalls, fooBarArgs{X: x, Y: y})",
+		"m.BazCalls = append(m.BazCalls, fooBazArgs{Format: format, Args: append([]interface{}(nil), args...)})",
+		"m.QuxCalls++",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	out = generateSource(t, &generator{structOptions: structOptions{record: true, recordParamNames: true}}, `package foo
+
+type Foo interface {
+	Bar(x int, y string)
+}
+`)
+	for _, want := range []string{
+		"type fooBarArgs struct {\n\tx int\n\ty string\n}",
+		"m.BarCalls = append(m.BarCalls, fooBarArgs{x: x, y: y})",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output with -record_param_names doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerateMockInterface_Count(t *testing.T) {
+	const src = `package foo
+
+import "context"
+
+type FooInterface interface {
+	Bar(ctx context.Context, x int)
+	Baz(format string, args ...interface{}) error
+	BarCallCount() int
+}
+`
+	out := generateSource(t, &generator{structOptions: structOptions{count: true}}, src)
+	for _, want := range []string{
+		// The fields don't clash with the methods.
+		"BarCallCount_2        int",
+		"BazCallCount          int",
+		"BarCallCountCallCount int",
+		"m.BarCallCount_2++",
+		"m.BazCallCount++",
+		"m.BarCallCountCallCount++",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "Args") {
+		t.Errorf("output records the arguments:\n%s", out)
+	}
+
+	fs := token.NewFileSet()
+	var files []*ast.File
+	for name, src := range map[string]string{"input.go": src, "output.go": out} {
+		file, err := parser.ParseFile(fs, name, src, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		files = append(files, file)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fs, "source", nil)}
+	if _, err := conf.Check("foo", fs, files, nil); err != nil {
+		t.Fatalf("output doesn't type check: %v\n%s", err, out)
+	}
+}
+
+func TestGenerateMockInterface_RecordVariadicCopy(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go not found")
+	}
+	const src = `package foo
+
+import "context"
+
+type FooInterface interface {
+	Bar(ctx context.Context, names ...string)
+}
+`
+	out := generateSource(t, &generator{structOptions: structOptions{record: true}, bodyOptions: bodyOptions{bodyMode: bodyZero}}, src)
+
+	dir, err := ioutil.TempDir("", "record_variadic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"go.mod":    "module foo\n",
+		"input.go":  src,
+		"output.go": out,
+		// The caller reuses its slice after the call.
+		"foo_test.go": `package foo
+
+import "testing"
+
+func TestRecorded(t *testing.T) {
+	stub := &Foo{}
+	names := []string{"a", "b"}
+	stub.Bar(nil, names...)
+	names[0] = "changed"
+	if got := stub.BarCalls[0].Names[0]; got != "a" {
+		t.Errorf("recorded %q, want a", got)
+	}
+}
+`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(goTool, "test", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO111MODULE=on", "GOFLAGS=", "GOWORK=off")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("go test failed: %v\n%s\n%s", err, output, out)
+	}
+}
+
+// importerFunc imports the packages with a function.
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) { return f(path) }
+
+func TestGenerateMockInterface_RecordExternalTest(t *testing.T) {
+	const src = `package foo
+
+import "context"
+
+type FooInterface interface {
+	Bar(context.Context, int, string)
+	Baz(x, X int)
+}
+`
+	out := generateSource(t, &generator{structOptions: structOptions{record: true}}, src)
+	for _, want := range []string{
+		"type fooBarArgs struct {\n\tArg0 context.Context\n\tArg1 int\n\tArg2 string\n}",
+		"type fooBazArgs struct {\n\tX   int\n\tX_2 int\n}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	fs := token.NewFileSet()
+	var files []*ast.File
+	for name, src := range map[string]string{"input.go": src, "output.go": out} {
+		file, err := parser.ParseFile(fs, name, src, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		files = append(files, file)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fs, "source", nil)}
+	foo, err := conf.Check("foo", fs, files, nil)
+	if err != nil {
+		t.Fatalf("output doesn't type check: %v\n%s", err, out)
+	}
+
+	// A test of package foo_test reads the recorded arguments.
+	file, err := parser.ParseFile(fs, "foo_test.go", `package foo_test
+
+import "foo"
+
+func recorded(stub *foo.Foo) (int, string, int, int) {
+	bar, baz := stub.BarCalls[0], stub.BazCalls[0]
+	return bar.Arg1, bar.Arg2, baz.X, baz.X_2
+}
+`, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	conf = types.Config{Importer: importerFunc(func(path string) (*types.Package, error) {
+		if path == "foo" {
+			return foo, nil
+		}
+		return nil, fmt.Errorf("unexpected import %v", path)
+	})}
+	if _, err := conf.Check("foo_test", fs, []*ast.File{file}, nil); err != nil {
+		t.Errorf("recorded arguments aren't accessible from package foo_test: %v\n%s", err, out)
+	}
+}
+
+func TestGenerator_SelectInterfaces(t *testing.T) {
+	var intfs []*model.Interface
+	for _, name := range []string{"UserService", "OrderService", "Store", "Cache"} {
+		intfs = append(intfs, &model.Interface{Name: name})
+	}
+
+	for _, test := range []struct {
+		name string
+		g    generator
+		want []string
+	}{
+		{
+			name: "all",
+			want: []string{"UserService", "OrderService", "Store", "Cache"},
+		},
+		{
+			name: "list",
+			g:    generator{selectOptions: selectOptions{mockInterfaces: map[string]bool{"Store": true}}},
+			want: []string{"Store"},
+		},
+		{
+			name: "regex and list",
+			g: generator{selectOptions: selectOptions{
+				mockInterfaces:  map[string]bool{"Cache": true},
+				interfacesRegex: regexp.MustCompile(".*Service$"),
+			}},
+			want: []string{"UserService", "OrderService", "Cache"},
+		},
+		{
+			name: "exclude",
+			g: generator{selectOptions: selectOptions{
+				interfacesRegex:   regexp.MustCompile(".*Service$"),
+				excludeInterfaces: map[string]bool{"OrderService": true},
+			}},
+			want: []string{"UserService"},
+		},
+		{
+			name: "exclude only",
+			g:    generator{selectOptions: selectOptions{excludeInterfaces: map[string]bool{"Store": true}}},
+			want: []string{"UserService", "OrderService", "Cache"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, intf := range test.g.selectInterfaces(intfs) {
+				got = append(got, intf.Name)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGenerateMockInterface_Wrap(t *testing.T) {
+	out := generateSource(t, &generator{decoratorOptions: decoratorOptions{wrap: true}}, `package foo
+
+import "context"
+
+type FooInterface interface {
+	Bar(ctx context.Context, format string, args ...interface{}) (int, error)
+	Baz()
+	log(next int)
+}
+`)
+
+	for _, want := range []string{
+		`"log"`,
+		"next  FooInterface\n\tlog_2 *log.Logger",
+		"func NewLoggingFoo(next FooInterface, logger *log.Logger) *LoggingFoo {\n\treturn &LoggingFoo{next: next, log_2: logger}",
+		"m.log_2.Printf(\"LoggingFoo.Bar(%v, %v, %v)\", ctx, format, args)\n" +
+			"\tret0, ret1 := m.next.Bar(ctx, format, args...)\n" +
+			"\tm.log_2.Printf(\"LoggingFoo.Bar returned %v, %v\", ret0, ret1)\n" +
+			"\treturn ret0, ret1\n",
+		"m.next.Baz()\n\tm.log_2.Printf(\"LoggingFoo.Baz returned\")\n}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerateMockInterface_WrapSlog(t *testing.T) {
+	const src = `package foo
+
+import "context"
+
+type FooInterface interface {
+	Bar(ctx context.Context, id string, opts ...int) (int, error)
+	Baz()
+}
+`
+	logger, err := parseLoggerType("log/slog.Logger")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out := generateSource(t, &generator{decoratorOptions: decoratorOptions{wrap: true, logger: logger}}, src)
+	for _, want := range []string{
+		`slog "log/slog"`,
+		"next FooInterface\n\tlog  *slog.Logger",
+		"func NewLoggingFoo(next FooInterface, logger *slog.Logger) *LoggingFoo {",
+		"m.log.Info(\"LoggingFoo.Bar\", \"ctx\", ctx, \"id\", id, \"opts\", opts)\n" +
+			"\tret0, ret1 := m.next.Bar(ctx, id, opts...)\n" +
+			"\tm.log.Info(\"LoggingFoo.Bar returned\", \"ret0\", ret0, \"ret1\", ret1)\n",
+		"m.log.Info(\"LoggingFoo.Baz\")\n\tm.next.Baz()\n\tm.log.Info(\"LoggingFoo.Baz returned\")\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `"log"`) {
+		t.Errorf("output imports log:\n%s", out)
+	}
+
+	fs := token.NewFileSet()
+	var files []*ast.File
+	for name, content := range map[string]string{"foo.go": src, "foo_impl.go": out} {
+		file, err := parser.ParseFile(fs, name, content, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		files = append(files, file)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fs, "source", nil)}
+	if _, err := conf.Check("example.com/foo", fs, files, nil); err != nil {
+		t.Errorf("output doesn't compile: %v\n%s", err, out)
+	}
+
+	for spec, want := range map[string]loggerType{
+		"slog":                    *loggerTypes["slog"],
+		"zap":                     {pkg: "go.uber.org/zap", name: "SugaredLogger", pointer: true, method: "Infow", structured: true},
+		"example.com/log.Logger":  {pkg: "example.com/log", name: "Logger", method: "Info", structured: true},
+		"*example.com/log.Logger": {pkg: "example.com/log", name: "Logger", pointer: true, method: "Info", structured: true},
+	} {
+		if got, err := parseLoggerType(spec); err != nil || *got != want {
+			t.Errorf("parseLoggerType(%q) = %+v, %v, want %+v", spec, got, err, want)
+		}
+	}
+	for _, spec := range []string{"logrus", "example.com/log", "example.com/log.", "*"} {
+		if _, err := parseLoggerType(spec); err == nil {
+			t.Errorf("parseLoggerType(%q): expected an error", spec)
+		}
+	}
+}
+
+func TestGenerateMockInterface_OptionsConstructor(t *testing.T) {
+	const src = `package foo
+
+import "context"
+
+type FooInterface interface {
+	Bar(ctx context.Context) error
+}
+
+type QuxInterface interface {
+	Quux()
+}
+`
+	out := generateSource(t, &generator{structOptions: structOptions{optionsConstructor: true}, decoratorOptions: decoratorOptions{wrap: true}}, src)
+	for _, want := range []string{
+		"type LoggingFooOption func(*LoggingFoo)",
+		"func WithNext(next FooInterface) LoggingFooOption {\n\treturn func(obj *LoggingFoo) {\n\t\tobj.next = next\n\t}\n}",
+		"func WithLogger(logger *log.Logger) LoggingFooOption {\n\treturn func(obj *LoggingFoo) {\n\t\tobj.log = logger\n\t}\n}",
+		"func NewLoggingFoo(opts ...LoggingFooOption) *LoggingFoo {\n\tobj := &LoggingFoo{}\n\tfor _, opt := range opts {\n\t\topt(obj)\n\t}\n\treturn obj\n}",
+		"func LoggingFooMiddleware(opts ...LoggingFooOption) func(next FooInterface) FooInterface {",
+		// The names the first implementation took are prefixed.
+		"func LoggingQuxWithNext(next QuxInterface) LoggingQuxOption {",
+		"func LoggingQuxWithLogger(logger *log.Logger) LoggingQuxOption {",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	// The options and the middleware compile and set the fields.
+	fs := token.NewFileSet()
+	var files []*ast.File
+	for name, content := range map[string]string{
+		"foo.go":      src,
+		"foo_impl.go": out,
+		"use.go": `package foo
+
+func use(next FooInterface) *LoggingFoo {
+	var _ FooInterface = LoggingFooMiddleware(WithLogger(nil))(next)
+	return NewLoggingFoo(WithNext(next), WithLogger(nil))
+}
+`,
+	} {
+		file, err := parser.ParseFile(fs, name, content, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		files = append(files, file)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fs, "source", nil)}
+	if _, err := conf.Check("example.com/foo", fs, files, nil); err != nil {
+		t.Errorf("output doesn't compile: %v\n%s", err, out)
+	}
+
+	out = generateSource(t, &generator{structOptions: structOptions{optionsConstructor: true}, decoratorOptions: decoratorOptions{funcs: true}}, src)
+	for _, want := range []string{
+		"func WithBarFunc(fn func(ctx context.Context) error) FooOption {\n\treturn func(obj *Foo) {\n\t\tobj.BarFunc = fn\n\t}\n}",
+		"func NewFoo(opts ...FooOption) *Foo {\n\tobj := &Foo{}\n\tfor _, opt := range opts {\n\t\topt(obj)\n\t}\n",
+		"func WithQuuxFunc(fn func()) QuxOption {",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerator_SortInterfaces(t *testing.T) {
+	const src = `package foo
+
+type Zebra interface {
+	Stripes() int
+}
+
+type Ant interface {
+	Legs() int
+}
+
+type Mole interface {
+	Dig()
+}
+`
+	for _, test := range []struct {
+		sort bool
+		want []string
+	}{
+		{false, []string{"ZebraImpl", "AntImpl", "MoleImpl"}},
+		{true, []string{"AntImpl", "MoleImpl", "ZebraImpl"}},
+	} {
+		pkg, err := parseSource(t, src)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		g := generator{inPackage: true, selectOptions: selectOptions{sortInterfaces: test.sort}}
+		if err := g.Generate(pkg, "foo", "example.com/foo"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var got []string
+		for _, m := range regexp.MustCompile(`(?m)^type (\w+) struct`).FindAllStringSubmatch(g.buf.String(), -1) {
+			got = append(got, m[1])
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("-sort_interfaces=%v: got structs %v, want %v", test.sort, got, test.want)
+		}
+	}
+}
+
+func TestGenerator_SelfReferentialGeneric(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+type Cloner[T any] interface {
+	Clone() T
+}
+
+type Node interface {
+	Cloner[Node]
+	Children() []Node
+}
+
+type Tree[T any] interface {
+	Cloner[Tree[T]]
+	Value() T
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	g := generator{
+		selectOptions: selectOptions{mockInterfaces: map[string]bool{"Node": true, "Tree": true}},
+		bodyOptions:   bodyOptions{bodyMode: bodyZero},
+	}
+	if err := g.Generate(pkg, "foo_impl", "example.com/foo_impl"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to format generated source code: %v\n%s", err, g.buf.String())
+	}
+	for _, want := range []string{
+		"func (m *Node) Clone() foo.Node {",
+		"func (m *Node) Children() []foo.Node {",
+		"func (m *Tree[T]) Clone() foo.Tree[T] {",
+		"func (m *Tree[T]) Value() T {",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerator_ImportGuards(t *testing.T) {
+	const src = `package foo
+
+import "context"
+
+type Foo interface {
+	Get(ctx context.Context) error
+	Skip()
+}
+`
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, "foo.go", src, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	std := importer.ForCompiler(fs, "source", nil)
+	foo, err := (&types.Config{Importer: std}).Check("example.com/foo", fs, []*ast.File{file}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	conf := types.Config{Importer: importerFunc(func(path string) (*types.Package, error) {
+		if path == "example.com/foo" {
+			return foo, nil
+		}
+		return std.Import(path)
+	})}
+
+	pkg, err := parseSource(t, src)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// An output importing the source package without referring to it.
+	const head = `package foo_impl
+
+import (
+	context "context"
+	foo "example.com/foo"
+)
+
+type Foo struct{}
+
+func (m *Foo) Get(ctx context.Context) error { return nil }
+`
+	for _, guards := range []bool{false, true} {
+		g := generator{packageMap: map[string]string{"context": "context", "example.com/foo": "foo"}}
+		g.buf.WriteString(head)
+		if guards {
+			if err := g.generateImportGuards(pkg, "example.com/foo_impl"); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		out, err := format.Source(g.buf.Bytes())
+		if err != nil {
+			t.Fatalf("Failed to format generated source code: %v\n%s", err, g.buf.String())
+		}
+		impl, err := parser.ParseFile(fs, "foo_impl.go", out, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		_, err = conf.Check("example.com/foo_impl", fs, []*ast.File{impl}, nil)
+		if !guards {
+			if err == nil || !strings.Contains(err.Error(), "not used") {
+				t.Errorf("expected an unused import error without -import_guards, got %v\n%s", err, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("output doesn't type check: %v\n%s", err, out)
+		}
+		if want := "var (\n\t_ foo.Foo\n)"; !strings.Contains(string(out), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerator_ForwardReference(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+type Foo interface {
+	Get(id string) (*Later, error)
+	List() []Later
+}
+
+// Later is declared after the interface referring to it.
+type Later struct{}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	g := generator{inPackage: true, bodyOptions: bodyOptions{bodyMode: bodyZero}}
+	if err := g.Generate(pkg, "foo", "example.com/foo"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to format generated source code: %v\n%s", err, g.buf.String())
+	}
+	for _, want := range []string{
+		"func (m *FooImpl) Get(id string) (*Later, error) {",
+		"func (m *FooImpl) List() []Later {",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	for _, dontWant := range []string{"example.com/foo", "foo.Later"} {
+		if strings.Contains(string(out), dontWant) {
+			t.Errorf("output contains %q:\n%s", dontWant, out)
+		}
+	}
+}
+
+func TestGenerator_FuncTypesGeneric(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+import "context"
+
+// Mapper maps a T to a U.
+type Mapper[T, U any] func(T) U
+
+type Loader[K comparable] func(ctx context.Context, key K) ([]byte, error)
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	g := generator{bodyOptions: bodyOptions{bodyMode: bodyZero}, declOptions: declOptions{funcTypes: true}}
+	if err := g.Generate(pkg, "foo_impl", "example.com/foo_impl"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to format generated source code: %v\n%s", err, g.buf.String())
+	}
+	for _, want := range []string{
+		"// MapperStub is a stub of Mapper.",
+		"func MapperStub[T any, U any](T) U {",
+		"func LoaderStub[K comparable](ctx context.Context, key K) ([]byte, error) {",
+		`"context"`,
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerateMockInterface_NilGuard(t *testing.T) {
+	const src = `package foo
+
+import "context"
+
+type Foo interface {
+	Get(ctx context.Context, key string) (string, error)
+	Put(key, value string) error
+}
+`
+	for _, tc := range []struct {
+		name      string
+		g         *generator
+		wants     []string
+		dontWants []string
+	}{
+		{
+			name: "wrap",
+			g:    &generator{decoratorOptions: decoratorOptions{wrap: true, nilGuard: true}},
+			wants: []string{
+				"func (m *LoggingFoo) Get(ctx context.Context, key string) (string, error) {\n" +
+					"\tif m.next == nil {\n\t\tpanic(\"LoggingFoo.Get called with a nil next\")\n\t}\n" +
+					"\tm.log.Printf(",
+				`panic("LoggingFoo.Put called with a nil next")`,
+			},
+		},
+		{
+			name: "tracing",
+			g:    &generator{decoratorOptions: decoratorOptions{wrap: true, tracing: true, nilGuard: true}},
+			wants: []string{
+				`panic("TracingFoo.Get called with a nil next")`,
+				`panic("TracingFoo.Put called with a nil next")`,
+			},
+		},
+		{
+			name: "override",
+			g:    &generator{decoratorOptions: decoratorOptions{overrides: map[string]bool{"Put": true}, nilGuard: true}},
+			wants: []string{
+				"func (m *Foo) Get(ctx context.Context, key string) (string, error) {\n" +
+					"\tif m.Fallback == nil {\n\t\tpanic(\"Foo.Get called with a nil Fallback\")\n\t}\n" +
+					"\treturn m.Fallback.Get(ctx, key)\n}",
+			},
+			// The overridden method doesn't forward.
+			dontWants: []string{"Foo.Put called with a nil Fallback"},
+		},
+		{
+			name:      "without -nil_guard",
+			g:         &generator{decoratorOptions: decoratorOptions{wrap: true}},
+			dontWants: []string{"called with a nil"},
+		},
+	} {
+		out := generateSource(t, tc.g, src)
+		for _, want := range tc.wants {
+			if !strings.Contains(out, want) {
+				t.Errorf("%v: output doesn't contain %q:\n%s", tc.name, want, out)
+			}
+		}
+		for _, dontWant := range tc.dontWants {
+			if strings.Contains(out, dontWant) {
+				t.Errorf("%v: output contains %q:\n%s", tc.name, dontWant, out)
+			}
+		}
+	}
+}
+
+func TestGenerateMockInterface_AnonymousParams(t *testing.T) {
+	src := `package foo
+
+type FooInterface interface {
+	Do(int, string, ...bool) error
+}
+`
+	out := generateSource(t, &generator{decoratorOptions: decoratorOptions{wrap: true}}, src)
+	for _, want := range []string{
+		"func (m *LoggingFoo) Do(arg0 int, arg1 string, arg2 ...bool) error {",
+		"m.log.Printf(\"LoggingFoo.Do(%v, %v, %v)\", arg0, arg1, arg2)\n" +
+			"\tret0 := m.next.Do(arg0, arg1, arg2...)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	out = generateSource(t, &generator{}, src)
+	if want := "func (m *Foo) Do(int, string, ...bool) error {"; !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+}
+
+func TestGenerateMockInterface_TypeParams(t *testing.T) {
+	out := generateSource(t, &generator{structOptions: structOptions{record: true}}, `package foo
+
+type Cache[K comparable, V any] interface {
+	Get(key K) (V, bool)
+}
+`)
+
+	for _, want := range []string{
+		"type Cache[K comparable, V any] struct {\n\tGetCalls []cacheGetArgs[K, V]\n}",
+		"type cacheGetArgs[K comparable, V any] struct {\n\tKey K\n}",
+		"func NewCache[K comparable, V any](_ context.Context) *Cache[K, V] {\n\tobj := &Cache[K, V]{}",
+		"func (m *Cache[K, V]) Get(key K) (V, bool) {\n\tm.GetCalls = append(m.GetCalls, cacheGetArgs[K, V]{Key: key})",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerator_RefuseOverwrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overwrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dst := filepath.Join(dir, "notes.go")
+	if err := ioutil.WriteFile(dst, []byte("hand-written notes, not Go"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pkg := &model.Package{Name: "foo", Interfaces: []*model.Interface{{Name: "Foo"}}}
+	g := generator{dstFileName: dst}
+	err = g.Generate(pkg, "foo", "")
+	if err == nil || !strings.Contains(err.Error(), "refusing to overwrite "+dst) {
+		t.Fatalf("expected an error refusing to overwrite %v, got %v", dst, err)
+	}
+
+	g = generator{dstFileName: dst, outputOptions: outputOptions{force: true}}
+	if err := g.Generate(pkg, "foo", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !g.head {
+		t.Error("expected -force to regenerate the destination from scratch")
+	}
+}
+
+func TestGenerator_UnexportedMethods(t *testing.T) {
+	newPkg := func() *model.Package {
+		return &model.Package{
+			Name:    "bugreport",
+			PkgPath: "example.com/bugreport",
+			Interfaces: []*model.Interface{{
+				Name:    "Example",
+				Methods: []*model.Method{{Name: "someMethod"}},
+			}},
+		}
+	}
+
+	g := generator{}
+	err := g.Generate(newPkg(), "impl_bugreport", "")
+	want := "interface Example has the unexported method someMethod, which can only be implemented in package bugreport"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v, want it to contain %q", err, want)
+	}
+
+	g = generator{}
+	if err := g.Generate(newPkg(), "bugreport", "example.com/other/bugreport"); err == nil {
+		t.Error("expected an error generating into another package of the same name")
+	}
+
+	g = generator{}
+	if err := g.Generate(newPkg(), "bugreport", ""); err != nil {
+		t.Errorf("Unexpected error generating into the source package: %v", err)
+	}
+}
+
+func TestGenerator_UnexportedMethodNames(t *testing.T) {
+	const src = `package foo
+
+type Info struct {
+	name string
+}
+
+type Methods interface {
+	getInfo() Info
+	SetInfo(info Info)
+}
+`
+	for _, test := range []struct {
+		name string
+		g    *generator
+		want []string
+	}{
+		{"stub", &generator{inPackage: true}, []string{
+			"func (m *MethodsImpl) getInfo() Info {",
+			"func (m *MethodsImpl) SetInfo(info Info) {",
+		}},
+		{"trimmed", &generator{inPackage: true, structOptions: structOptions{nameTrims: []nameTrim{{affix: "s"}}}}, []string{
+			"func (m *Method) getInfo() Info {",
+		}},
+		{"record", &generator{inPackage: true, structOptions: structOptions{record: true}}, []string{
+			"getInfoCalls int",
+			"func (m *MethodsImpl) getInfo() Info {\n\tm.getInfoCalls++",
+		}},
+		{"wrap", &generator{decoratorOptions: decoratorOptions{wrap: true}}, []string{
+			"func (m *LoggingMethods) getInfo() Info {",
+			"m.next.getInfo()",
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			pkg, err := parseSource(t, src)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err := test.g.Generate(pkg, "foo", "example.com/foo"); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			out := test.g.buf.String()
+			for _, want := range test.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("output doesn't contain %q:\n%s", want, out)
+				}
+			}
+			if strings.Contains(out, "GetInfo") {
+				t.Errorf("output exports the unexported method getInfo:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestGenerator_SelfPackageGenericType(t *testing.T) {
+	const src = `package foo
+
+import "sync/atomic"
+
+type Box[T any] struct {
+	v T
+}
+
+type Pair[K comparable, V any] struct {
+	k K
+	v V
+}
+
+type Store interface {
+	Get() Box[int]
+	Swap(p *atomic.Pointer[Box[string]]) map[string]Pair[string, Box[int]]
+}
+`
+	for _, test := range []struct {
+		name, pkgName, pkgPath string
+		want                   []string
+	}{
+		{"same package", "foo", "example.com/foo", []string{
+			"func (m *StoreImpl) Get() Box[int] {",
+			"func (m *StoreImpl) Swap(p *atomic.Pointer[Box[string]]) map[string]Pair[string, Box[int]] {",
+		}},
+		{"other package", "impl", "example.com/impl", []string{
+			"func (m *Store) Get() foo.Box[int] {",
+			"func (m *Store) Swap(p *atomic.Pointer[foo.Box[string]]) map[string]foo.Pair[string, foo.Box[int]] {",
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			pkg, err := parseSource(t, src)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			g := generator{inPackage: test.pkgName == "foo"}
+			if err := g.Generate(pkg, test.pkgName, test.pkgPath); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			out := g.buf.String()
+			for _, want := range test.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("output doesn't contain %q:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerator_OnlyTagged(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+// Store keeps the items.
+//
+// implgen:generate
+type Store interface {
+	Get(id string) string
+}
+
+// Cache is implemented by hand.
+type Cache interface {
+	Evict(id string)
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	g := &generator{selectOptions: selectOptions{tagMarker: "implgen:generate"}}
+	var got []string
+	for _, intf := range g.selectInterfaces(pkg.Interfaces) {
+		got = append(got, intf.Name)
+	}
+	if want := []string{"Store"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestGenerator_SkipConstraints(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+type Number interface {
+	~int | ~float64
+}
+
+type Sum interface {
+	Add(x, y int) int
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	g := &generator{stderr: &stderr}
+	var got []string
+	for _, intf := range g.selectInterfaces(pkg.Interfaces) {
+		got = append(got, intf.Name)
+	}
+	if want := []string{"Sum"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := stderr.String(), "warning: interface Number is a type constraint, not an implementable interface\n"; got != want {
+		t.Errorf("got warnings %q, want %q", got, want)
+	}
+}
+
+func TestGenerator_Assert(t *testing.T) {
+	out := generateSource(t, &generator{
+		structOptions: structOptions{mockNames: map[string]string{"Store": "Repo", "Cache": "Repo"}},
+		declOptions:   declOptions{assert: true},
+	}, `package foo
+
+type Store interface {
+	Get(id string) string
+}
+
+type Cache interface {
+	Get(id string) string
+	Evict(id string)
+}
+
+type Clock interface {
+	Now() int64
+}
+`)
+
+	for _, want := range []string{
+		"var (\n\t_ Store = (*Repo)(nil)\n\t_ Cache = (*Repo)(nil)\n\t_ Clock = (*Clock)(nil)\n)",
+		"func (m *Repo) Get(id string) string {",
+		"func (m *Repo) Evict(id string) {",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	if n := strings.Count(out, "type Repo struct"); n != 1 {
+		t.Errorf("Repo is declared %d times, want once:\n%s", n, out)
+	}
+}
+
+func TestGenerator_AssertEmbeds(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+import "io"
+
+type Closer interface {
+	Close() error
+}
+
+type File interface {
+	io.Reader
+	Closer
+	error
+	Name() string
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	g := generator{declOptions: declOptions{assertEmbeds: true}}
+	if err := g.Generate(pkg, "impl", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out := g.buf.String()
+	for _, want := range []string{
+		"var (\n\t_ io.Reader = (*File)(nil)\n\t_ foo.Closer = (*File)(nil)\n)",
+		"\tio \"io\"\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"_ error", "_ foo.File"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("output contains %q:\n%s", unwanted, out)
+		}
+	}
+}
+
+func TestGenerator_ExcludeMethods(t *testing.T) {
+	const src = `package foo
+
+type Store interface {
+	Get(id string) string
+	Close() error
+}
+
+type Cache interface {
+	Evict(id string)
+}
+`
+	pkg, err := parseSource(t, src)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	g := generator{selectOptions: selectOptions{excludeMethods: map[string]bool{"Store.Close": true}}, declOptions: declOptions{assert: true}}
+	if err := g.Generate(pkg, "impl", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out := g.buf.String()
+	for _, want := range []string{
+		"func (m *Store) Get(id string) string {",
+		"_ foo.Cache = (*Cache)(nil)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"Close()", "_ foo.Store"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("output contains %q:\n%s", unwanted, out)
+		}
+	}
+
+	pkg, err = parseSource(t, src)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	g = generator{selectOptions: selectOptions{excludeMethods: map[string]bool{"Store.Close": true, "Cache.Evict": true}}, declOptions: declOptions{assert: true}}
+	if err := g.Generate(pkg, "impl", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Nothing is asserted, so the package of the interfaces must not be
+	// imported unused.
+	if out := g.buf.String(); strings.Contains(out, `"example.com/foo"`) {
+		t.Errorf("output imports the unused example.com/foo:\n%s", out)
+	}
+
+	pkg, err = parseSource(t, src)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	g = generator{selectOptions: selectOptions{excludeMethods: map[string]bool{"Store.Open": true}}}
+	want := "-exclude_methods: interface Store has no method Open"
+	if err := g.Generate(pkg, "impl", ""); err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func TestGenerator_Convert(t *testing.T) {
+	out := generateSource(t, &generator{declOptions: declOptions{convertFrom: "User", convertTo: "UserDTO"}}, `package foo
+
+type User struct {
+	ID    int
+	Name  string
+	Email []byte
+	admin bool
+}
+
+type UserDTO struct {
+	ID    int
+	Name  string
+	Email string
+}
+`)
+
+	want := `// ToUserDTO converts a User to a UserDTO, copying the fields of the same name and type.
+func (m User) ToUserDTO() UserDTO {
+	return UserDTO{
+		ID:   m.ID,
+		Name: m.Name,
+		// TODO: map field Email
+	}
+}`
+	if !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+}
+
+func TestGenerator_MergeInterfaces(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+import "io"
+
+type Reader interface {
+	// Read reads.
+	Read(p []byte) (n int, err error)
+}
+
+type ReadCloser interface {
+	Read(buf []byte) (int, error)
+	io.Closer
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	merged, err := mergeInterfaces("Combined", pkg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pkg.Interfaces = []*model.Interface{merged}
+
+	g := generator{declOptions: declOptions{mergeInterface: "Combined"}}
+	g.generatePackageMap(pkg, "foo", "")
+	if err := g.generate(pkg, "foo", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out := g.buf.String()
+	for _, want := range []string{
+		"// Combined merges the Reader, ReadCloser interfaces.\ntype Combined interface {\n\t// Read reads.\n\tRead(p []byte) (n int, err error)\n\tClose() error\n}",
+		"type CombinedImpl struct {",
+		"func (m *CombinedImpl) Read(p []byte) (n int, err error) {",
+		"func (m *CombinedImpl) Close() error {",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerator_MergeInterfacesConflict(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+type Reader interface {
+	Read(p []byte) (int, error)
+}
+
+type OtherReader interface {
+	Read() error
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	_, err = mergeInterfaces("Combined", pkg)
+	want := "can't merge Reader.Read([]byte) (int, error) with OtherReader.Read() (error)"
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func TestGenerator_Accessors(t *testing.T) {
+	out := generateSource(t, &generator{declOptions: declOptions{accessors: true}}, `package foo
+
+import "time"
+
+type Config struct {
+	time.Duration
+	Name    string
+	Parent  *Config
+	timeout time.Duration
+	Label   string
+}
+
+func (c *Config) GetLabel() string { return c.Label }
+`)
+
+	for _, want := range []string{
+		"func (m *Config) GetName() string {\n\treturn m.Name\n}",
+		"func (m *Config) SetName(v string) {\n\tm.Name = v\n}",
+		"func (m *Config) GetParent() *Config {\n\treturn m.Parent\n}",
+		"func (m *Config) SetParent(v *Config) {\n\tm.Parent = v\n}",
+		"func (m *Config) GetTimeout() time.Duration {",
+		"func (m *Config) SetTimeout(v time.Duration) {\n\tm.timeout = v\n}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	for _, notWant := range []string{"GetDuration", "GetLabel", "SetLabel"} {
+		if strings.Contains(out, notWant) {
+			t.Errorf("output contains %q:\n%s", notWant, out)
+		}
+	}
+
+	pkg := &model.Package{Name: "foo", StructNames: []*model.Struct{{Name: "Config"}}}
+	g := generator{declOptions: declOptions{accessors: true}}
+	if err := g.Generate(pkg, "impl_foo", ""); err == nil || !strings.Contains(err.Error(), "must be in package foo") {
+		t.Errorf("expected an error generating accessors into another package, got %v", err)
+	}
+}
+
+func TestGenerator_AccessorsReflectedStruct(t *testing.T) {
+	// image.Rectangle is reflected as the reflection program does.
+	s, err := model.StructFromStructType(reflect.TypeOf(image.Rectangle{}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s.Name = "Rectangle"
+	if _, ok := s.Methods["Inset"]; !ok {
+		t.Errorf("expected the reflected methods to contain Inset, got %v", s.MethodNames)
+	}
+	pkg := &model.Package{Name: "image", PkgPath: "image", StructNames: []*model.Struct{s}}
+
+	g := generator{declOptions: declOptions{accessors: true}}
+	if err := g.Generate(pkg, "image", "image"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to format generated source code: %v\n%s", err, g.buf.String())
+	}
+	for _, want := range []string{
+		"package image\n",
+		"func (m *Rectangle) GetMin() Point {\n\treturn m.Min\n}",
+		"func (m *Rectangle) SetMax(v Point) {\n\tm.Max = v\n}",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(string(out), `"image"`) {
+		t.Errorf("output imports its own package:\n%s", out)
+	}
+}
+
+func TestGenerator_EmitTests(t *testing.T) {
+	const src = `package foo
+
+import "context"
+
+type Item struct{}
+
+type Store interface {
+	Get(ctx context.Context, id int) (Item, error)
+	Close()
+}
+
+type List[T any] interface {
+	Len() int
+}
+`
+	pkg, err := parseSource(t, src)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, testMain := range []bool{false, true} {
+		g := generator{inPackage: true, declOptions: declOptions{emitTests: true, testMain: testMain}}
+		if err := g.Generate(pkg, "foo", "example.com/foo"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		out, err := format.Source(g.buf.Bytes())
+		if err != nil {
+			t.Fatalf("Failed to format generated source code: %v\n%s", err, g.buf.String())
+		}
+		tests, err := g.GenerateTests("foo")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		wants := []string{
+			"package foo\n",
+			"func TestStoreImpl_Get(t *testing.T) {",
+			"func TestStoreImpl_Close(t *testing.T) {",
+			"func TestListImpl_Len(t *testing.T) {",
+			`t.Skip("TODO: test StoreImpl.Get")`,
+		}
+		dontWants := []string{"TestMain", "newStoreImplForTest"}
+		if testMain {
+			wants, dontWants = append(wants,
+				"func TestMain(m *testing.M) {\n\tsetup()\n\tcode := m.Run()\n\tteardown()\n\tos.Exit(code)\n}",
+				"func newStoreImplForTest(t *testing.T) *StoreImpl {\n\tt.Helper()\n\treturn NewStoreImpl(context.Background())\n}",
+				"impl := newStoreImplForTest(t)",
+			), []string{"newListImplForTest"}
+		}
+		for _, want := range wants {
+			if !strings.Contains(string(tests), want) {
+				t.Errorf("-test_main=%v: tests don't contain %q:\n%s", testMain, want, tests)
+			}
+		}
+		for _, dontWant := range dontWants {
+			if strings.Contains(string(tests), dontWant) {
+				t.Errorf("-test_main=%v: tests contain %q:\n%s", testMain, dontWant, tests)
+			}
+		}
+
+		// The tests compile along with the source and the output.
+		fs := token.NewFileSet()
+		var files []*ast.File
+		for name, content := range map[string]string{"foo.go": src, "foo_impl.go": string(out), "foo_impl_test.go": string(tests)} {
+			file, err := parser.ParseFile(fs, name, content, 0)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			files = append(files, file)
+		}
+		conf := types.Config{Importer: importer.ForCompiler(fs, "source", nil)}
+		if _, err := conf.Check("foo", fs, files, nil); err != nil {
+			t.Errorf("-test_main=%v: tests don't type check: %v\n%s", testMain, err, tests)
+		}
+	}
+}
+
+func TestGenerator_WarnMissingContext(t *testing.T) {
+	var stderr bytes.Buffer
+	generateSource(t, &generator{stderr: &stderr, selectOptions: selectOptions{warnMissingContext: true}}, `package foo
+
+import "context"
+
+type Foo interface {
+	WithContext(ctx context.Context, id int) error
+	WithoutContext(id int) error
+	LateContext(id int, ctx context.Context)
+}
+`)
+
+	want := "warning: Foo.WithoutContext has no leading context.Context parameter\n" +
+		"warning: Foo.LateContext has no leading context.Context parameter\n"
+	if got := stderr.String(); got != want {
+		t.Errorf("got warnings %q, want %q", got, want)
+	}
+}
+
+func TestGenerateMockInterface_ConstructorError(t *testing.T) {
+	out := generateSource(t, &generator{structOptions: structOptions{constructorError: true}}, `package foo
+
+type FooFactory interface {
+	Make() int
+}
+`)
+
+	want := "func NewFooFactory(_ context.Context) (*FooFactory, error) {\n" +
+		"\tobj := &FooFactory{}\n" +
+		"\treturn obj, nil\n}"
+	if !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+}
+
+func TestGenerateMockInterface_GenericTypeArgs(t *testing.T) {
+	out := generateSource(t, &generator{}, `package foo
+
+import "example.com/box"
+
+type Store[K comparable, V any] interface {
+	Put(v *box.Box[int])
+	List() []box.Box[K]
+	Index() map[string]*box.Pair[K, V]
+	local(v *item[V])
+}
+`)
+
+	for _, want := range []string{
+		`"example.com/box"`,
+		"Put(v *box.Box[int]) {",
+		"List() []box.Box[K] {",
+		"Index() map[string]*box.Pair[K, V] {",
+		"local(v *item[V]) {",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerateMockInterface_QualifiedTypeArgs(t *testing.T) {
+	const src = `package foo
+
+import (
+	"unknown.invalid/model"
+	"unknown.invalid/repo"
+)
+
+type Users interface {
+	Store() repo.Store[model.User]
+	Put(s repo.Store[model.User], groups map[string]repo.Pair[int, *model.Group]) error
+}
+`
+	// model is only used by the type arguments.
+	for _, g := range []*generator{
+		{},
+		{structOptions: structOptions{record: true}},
+		{decoratorOptions: decoratorOptions{wrap: true}},
+		{declOptions: declOptions{emitInterface: true}},
+	} {
+		out := generateSource(t, g, src)
+		for _, want := range []string{
+			`model "unknown.invalid/model"`,
+			`repo "unknown.invalid/repo"`,
+			"Store() repo.Store[model.User] {",
+			"Put(s repo.Store[model.User], groups map[string]repo.Pair[int, *model.Group]) error {",
+		} {
+			if !strings.Contains(out, want) {
+				t.Errorf("output doesn't contain %q:\n%s", want, out)
+			}
+		}
+	}
+}
+
+func TestGenerateMockInterface_WrapTracing(t *testing.T) {
+	out := generateSource(t, &generator{decoratorOptions: decoratorOptions{wrap: true, tracing: true}}, `package foo
+
+import "context"
+
+type Foo interface {
+	Get(ctx context.Context, id string) (string, error)
+	Count() int
+	Reset(context.Context)
+}
+`)
+
+	for _, want := range []string{
+		`"go.opentelemetry.io/otel/trace"`,
+		"type TracingFoo struct {\n\tnext   Foo\n\ttracer trace.Tracer\n}",
+		"func NewTracingFoo(next Foo, tracer trace.Tracer) *TracingFoo {\n\treturn &TracingFoo{next: next, tracer: tracer}",
+		"func TracingFooMiddleware(tracer trace.Tracer) func(next Foo) Foo {",
+		"func (m *TracingFoo) Get(ctx context.Context, id string) (string, error) {\n" +
+			"\tctx, span := m.tracer.Start(ctx, \"Foo.Get\")\n" +
+			"\tdefer span.End()\n\n" +
+			"\tret0, ret1 := m.next.Get(ctx, id)\n" +
+			"\tif ret1 != nil {\n\t\tspan.RecordError(ret1)\n\t}\n" +
+			"\treturn ret0, ret1\n}",
+		"func (m *TracingFoo) Count() int {\n" +
+			"\t_, span := m.tracer.Start(context.Background(), \"Foo.Count\")\n" +
+			"\tdefer span.End()\n\n" +
+			"\tret0 := m.next.Count()\n\treturn ret0\n}",
+		"arg0, span := m.tracer.Start(arg0, \"Foo.Reset\")\n\tdefer span.End()\n\n\tm.next.Reset(arg0)\n}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `"log"`) {
+		t.Errorf("output imports log:\n%s", out)
+	}
+}
+
+func TestGenerateMockInterface_WrapMetrics(t *testing.T) {
+	out := generateSource(t, &generator{decoratorOptions: decoratorOptions{wrap: true, metrics: true}}, `package foo
+
+type Foo interface {
+	Get(id string) (string, error)
+	Printf(format string, args ...interface{})
+}
+`)
+
+	for _, want := range []string{
+		`"github.com/prometheus/client_golang/prometheus"`,
+		"type MetricsFoo struct {\n\tnext      Foo\n\tdurations prometheus.ObserverVec\n\tcounts    *prometheus.CounterVec\n}",
+		"func NewMetricsFoo(next Foo, durations prometheus.ObserverVec, counts *prometheus.CounterVec) *MetricsFoo {\n" +
+			"\treturn &MetricsFoo{next: next, durations: durations, counts: counts}",
+		"func MetricsFooMiddleware(durations prometheus.ObserverVec, counts *prometheus.CounterVec) func(next Foo) Foo {",
+		"return NewMetricsFoo(next, durations, counts)",
+		"func (m *MetricsFoo) Get(id string) (string, error) {\n" +
+			"\tstart := time.Now()\n" +
+			"\tret0, ret1 := m.next.Get(id)\n" +
+			"\tstatus := \"success\"\n" +
+			"\tif ret1 != nil {\n\t\tstatus = \"error\"\n\t}\n" +
+			"\tm.durations.WithLabelValues(\"Get\", status).Observe(time.Since(start).Seconds())\n" +
+			"\tm.counts.WithLabelValues(\"Get\", status).Inc()\n" +
+			"\treturn ret0, ret1\n}",
+		"func (m *MetricsFoo) Printf(format string, args ...interface{}) {\n" +
+			"\tstart := time.Now()\n" +
+			"\tm.next.Printf(format, args...)\n" +
+			"\tm.durations.WithLabelValues(\"Printf\", \"success\").Observe(time.Since(start).Seconds())\n" +
+			"\tm.counts.WithLabelValues(\"Printf\", \"success\").Inc()\n}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerateMockInterface_WrapMiddleware(t *testing.T) {
+	const src = `package foo
+
+type Foo interface {
+	Get(id string) (string, error)
+}
+`
+	out := generateSource(t, &generator{decoratorOptions: decoratorOptions{wrap: true}}, src)
+	want := "func LoggingFooMiddleware(logger *log.Logger) func(next Foo) Foo {\n" +
+		"\treturn func(next Foo) Foo {\n" +
+		"\t\treturn NewLoggingFoo(next, logger)\n"
+	if !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+
+	// Two decorators chain, each wrapping the other.
+	chained := out + strings.TrimPrefix(src, "package foo") + `
+func chain(base Foo, logger, audit *log.Logger) Foo {
+	decorators := []func(next Foo) Foo{LoggingFooMiddleware(logger), LoggingFooMiddleware(audit)}
+	for _, decorate := range decorators {
+		base = decorate(base)
+	}
+	return base
+}
+`
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, "output.go", chained, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fs, "source", nil)}
+	if _, err := conf.Check("foo", fs, []*ast.File{file}, nil); err != nil {
+		t.Errorf("chained decorators don't type check: %v\n%s", err, chained)
+	}
+}
+
+func TestGenerateMockInterface_Funcs(t *testing.T) {
+	const src = `package foo
+
+import "context"
+
+type Foo interface {
+	Bar(ctx context.Context, n int) error
+	Join(sep string, parts ...string) string
+	Get(string) int
+	GetFunc() func()
+	Close()
+}
+`
+	out := generateSource(t, &generator{inPackage: true, decoratorOptions: decoratorOptions{funcs: true}}, src)
+	for _, want := range []string{
+		"type FooImpl struct {\n" +
+			"\tBarFunc     func(ctx context.Context, n int) error\n" +
+			"\tJoinFunc    func(sep string, parts ...string) string\n" +
+			"\tGetFunc_2   func(string) int\n" +
+			"\tGetFuncFunc func() func()\n" +
+			"\tCloseFunc   func()\n" +
+			"}",
+		"func (m *FooImpl) Bar(ctx context.Context, n int) error {\n" +
+			"\tif m.BarFunc == nil {\n" +
+			"\t\tpanic(\"FooImpl.Bar called with a nil BarFunc\")\n" +
+			"\t}\n" +
+			"\treturn m.BarFunc(ctx, n)\n" +
+			"}",
+		"return m.JoinFunc(sep, parts...)",
+		"func (m *FooImpl) Get(arg0 string) int {",
+		"return m.GetFunc_2(arg0)",
+		"\tm.CloseFunc()\n}",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	full := out + strings.TrimPrefix(src, "package foo\n\nimport \"context\"") + `
+var _ Foo = &FooImpl{JoinFunc: func(sep string, parts ...string) string { return sep }}
+`
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, "output.go", full, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fs, "source", nil)}
+	if _, err := conf.Check("foo", fs, []*ast.File{file}, nil); err != nil {
+		t.Errorf("output doesn't type check: %v\n%s", err, full)
+	}
+}
+
+func TestGenerator_EmitInterface(t *testing.T) {
+	const src = `package foo
+
+import (
+	"context"
+	"time"
+)
+
+// Foo does things.
+type Foo interface {
+	// Get gets.
+	Get(ctx context.Context, timeout time.Duration) (string, error)
+	Set(values ...string)
+}
+
+// Store stores.
+type Store[K comparable, V any] interface {
+	Load(key K) (V, bool)
+}
+`
+	pkg, err := parseSource(t, src)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	g := generator{declOptions: declOptions{emitInterface: true, assert: true}}
+	if err := g.Generate(pkg, "bar", "example.com/bar"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to format generated source code: %v\n%s", err, g.buf.String())
+	}
+	for _, want := range []string{
+		"// Foo does things.\ntype Foo interface {\n\t// Get gets.\n\tGet(ctx context.Context, timeout time.Duration) (string, error)\n\tSet(values ...string)\n}",
+		"// Store stores.\ntype Store[K comparable, V any] interface {\n\tLoad(key K) (V, bool)\n}",
+		"type FooImpl struct",
+		"type StoreImpl[K comparable, V any] struct",
+		"_ Foo = (*FooImpl)(nil)",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(string(out), "example.com/foo") {
+		t.Errorf("output imports the source package:\n%s", out)
+	}
+
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, "output.go", out, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fs, "source", nil)}
+	if _, err := conf.Check("example.com/bar", fs, []*ast.File{file}, nil); err != nil {
+		t.Errorf("output doesn't type check: %v\n%s", err, out)
+	}
+
+	g = generator{declOptions: declOptions{emitInterface: true}}
+	if err := g.Generate(pkg, "foo", "example.com/foo"); err == nil {
+		t.Errorf("expected an error generating into the package of the interfaces")
+	}
+}
+
+func TestGenerator_Override(t *testing.T) {
+	const src = `package foo
+
+import "context"
+
+type Foo interface {
+	Get(ctx context.Context, key string) (string, error)
+	Put(key, value string) error
+	Append(key string, values ...string)
+}
+`
+	pkg, err := parseSource(t, src)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	g := generator{inPackage: true, decoratorOptions: decoratorOptions{overrides: map[string]bool{"Put": true}}}
+	if err := g.Generate(pkg, "foo", "example.com/foo"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to format generated source code: %v\n%s", err, g.buf.String())
+	}
+	for _, want := range []string{
+		"type FooImpl struct {\n\tFallback Foo // implements the methods not overridden\n}",
+		"func (m *FooImpl) Get(ctx context.Context, key string) (string, error) {\n\treturn m.Fallback.Get(ctx, key)\n}",
+		`panic("FooImpl.Put(key, value string) error Not implemented")`,
+		"func (m *FooImpl) Append(key string, values ...string) {\n\tm.Fallback.Append(key, values...)\n}",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	full := string(out) + strings.TrimPrefix(src, "package foo\n\nimport \"context\"") + "\nvar _ Foo = &FooImpl{}\n"
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, "output.go", full, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fs, "source", nil)}
+	if _, err := conf.Check("foo", fs, []*ast.File{file}, nil); err != nil {
+		t.Errorf("output doesn't type check: %v\n%s", err, full)
+	}
+
+	g = generator{decoratorOptions: decoratorOptions{overrides: map[string]bool{"Delete": true}}}
+	if err := g.Generate(pkg, "foo", "example.com/foo"); err == nil || !strings.Contains(err.Error(), "no interface has a method Delete") {
+		t.Errorf("got error %v, want one about the unknown method Delete", err)
+	}
+}
+
+func TestGenerateMockMethod_Bodies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bodies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bodiesFile := filepath.Join(dir, "bodies.go")
+	if err := ioutil.WriteFile(bodiesFile, []byte(`package foo
+
+import "strings"
+
+func Foo_Get(id string) (string, error) {
+	return strings.ToUpper(id), nil
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bodies, err := parseBodies(bodiesFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out := generateSource(t, &generator{bodyOptions: bodyOptions{bodies: bodies}}, `package foo
+
+type Foo interface {
+	Get(key string) (string, error)
+	Put(key, value string) error
+}
+`)
+
+	for _, want := range []string{
+		`"strings"`,
+		"func (m *Foo) Get(id string) (string, error) {\n\treturn strings.ToUpper(id), nil\n}",
+		"func (m *Foo) Put(key, value string) error {\n\tpanic(\"Foo.Put(key, value string) error Not implemented\")",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerator_Fill(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+type Store interface {
+	Get(key string) (string, error)
+	Put(key, value string) error
+	Delete(key string)
+}
+
+type memStore struct{}
+
+func (s *memStore) Get(key string) (string, error) { return "", nil }
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	g := generator{declOptions: declOptions{fillStruct: "memStore", fillInterface: "Store"}}
+	if err := g.Generate(pkg, "foo", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to format generated source code: %v\n%s", err, g.buf.String())
+	}
+
+	for _, want := range []string{
+		"func (m *memStore) Put(key, value string) error {",
+		"func (m *memStore) Delete(key string) {",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"Get(", "type memStore", "func NewmemStore"} {
+		if strings.Contains(string(out), unwanted) {
+			t.Errorf("output contains %q:\n%s", unwanted, out)
+		}
+	}
+}
+
+func TestGenerator_DocStructs(t *testing.T) {
+	const src = `package foo
+
+// Foo does things.
+//
+//go:generate implgen -source foo.go
+type Foo interface {
+	Bar()
+}
+
+type fooer interface {
+	Baz()
+}
+`
+	out := generateSource(t, &generator{structOptions: structOptions{docStructs: true}}, src)
+	for _, want := range []string{
+		"// Foo is a generated implementation of Foo.\n//\n// Foo does things.\ntype Foo struct",
+		"\n// fooer is a generated implementation of fooer.\ntype fooer struct",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	out = generateSource(t, &generator{structOptions: structOptions{docStructs: true}, decoratorOptions: decoratorOptions{wrap: true}}, src)
+	if want := "// LoggingFoo is a generated implementation of Foo.\n//\n// Foo does things.\n"; !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+}
+
+func TestGenerator_WarnEmptyInterface(t *testing.T) {
+	const src = `package foo
+
+type Marker interface{}
+
+type Foo interface {
+	Bar()
+}
+`
+	var stderr bytes.Buffer
+	generateSource(t, &generator{stderr: &stderr}, src)
+	if got, want := stderr.String(), "warning: interface Marker has no methods\n"; got != want {
+		t.Errorf("got warnings %q, want %q", got, want)
+	}
+
+	stderr.Reset()
+	generateSource(t, &generator{stderr: &stderr, selectOptions: selectOptions{allowEmpty: true}}, src)
+	if got := stderr.String(); got != "" {
+		t.Errorf("got warnings %q with -allow_empty, want none", got)
+	}
+}
+
+func TestGenerator_WarnImportCycles(t *testing.T) {
+	const fixture = "github.com/ssoor/implgen/internal/tests/import_cycle/"
+	pkg := &model.Package{
+		Name:    "api",
+		PkgPath: fixture + "api",
+		Interfaces: []*model.Interface{{
+			Name: "Repo",
+			Methods: []*model.Method{{
+				Name: "Get",
+				In:   []*model.Parameter{{Name: "id", Type: model.PredeclaredType("string")}},
+				Out: []*model.Parameter{
+					{Type: &model.NamedType{Package: fixture + "store", Type: "Item"}},
+					{Type: model.PredeclaredType("error")},
+				},
+			}},
+		}},
+	}
+
+	var stderr bytes.Buffer
+	g := generator{stderr: &stderr}
+	if err := g.Generate(pkg, "impl", fixture+"impl"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := "warning: " + fixture + "impl imports " + fixture + "store, which imports it back: the output won't compile\n"
+	if got := stderr.String(); got != want {
+		t.Errorf("got warnings %q, want %q", got, want)
+	}
+
+	stderr.Reset()
+	g = generator{stderr: &stderr}
+	if err := g.Generate(pkg, "api", fixture+"api"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := stderr.String(); got != "" {
+		t.Errorf("got warnings %q without a cycle, want none", got)
+	}
+}
+
+func TestGenerator_SamePackageName(t *testing.T) {
+	for _, tc := range []struct {
+		name, outputPkgName, outputPackagePath string
+		want                                   string
+	}{
+		{"default package", "foo", "", "type FooImpl struct"},
+		{"self package", "foo", "example.com/foo", "type FooImpl struct"},
+		{"other package", "impl_foo", "", "type Foo struct"},
+		{"other path", "foo", "example.com/other/foo", "type Foo struct"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pkg := &model.Package{Name: "foo", PkgPath: "example.com/foo", Interfaces: []*model.Interface{{
+				Name:    "Foo",
+				Methods: []*model.Method{{Name: "Bar"}},
+			}}}
+			g := generator{}
+			if err := g.Generate(pkg, tc.outputPkgName, tc.outputPackagePath); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if out := g.buf.String(); !strings.Contains(out, tc.want+" {") {
+				t.Errorf("expected %q, got\n%s", tc.want, out)
+			}
+		})
+	}
+}
+
+func TestGenerator_OutputDash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	defer func(old *os.File) { os.Stdout = old }(os.Stdout)
+	os.Stdout = stdout
+
+	pkg := &model.Package{Name: "foo", Interfaces: []*model.Interface{{Name: "Foo"}}}
+	g := generator{dstFileName: "-", selectOptions: selectOptions{allowEmpty: true}}
+	if err := g.Generate(pkg, "foo", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := g.Output(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	out, err := ioutil.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "type FooImpl struct") {
+		t.Errorf("expected the output on the standard output, got %q", out)
+	}
+	if _, err := os.Stat("-"); err == nil {
+		t.Error(`expected no file named "-"`)
+	}
+}
+
+func TestGenerator_FillEmbeddedInterface(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+import "io"
+
+type Store interface {
+	Get(key string) (string, error)
+	Put(key, value string) error
+	io.Closer
+	Read(p []byte) (int, error)
+}
+
+type Getter interface {
+	Get(key string) (string, error)
+}
+
+type fileStore struct {
+	Getter
+	io.ReadCloser
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got, want := pkg.StructNames[0].MethodNames, []string{"Get", "Read", "Close"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fileStore methods = %v, want the ones of its embedded interfaces %v", got, want)
+	}
+
+	g := generator{declOptions: declOptions{fillStruct: "fileStore", fillInterface: "Store"}}
+	if err := g.Generate(pkg, "foo", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out := g.buf.String()
+	if !strings.Contains(out, "func (m *fileStore) Put(key, value string) error {") {
+		t.Errorf("output doesn't contain the missing method Put:\n%s", out)
+	}
+	for _, unwanted := range []string{"Get(", "Read(", "Close("} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("output contains %q, provided by an embedded interface:\n%s", unwanted, out)
+		}
+	}
+}
+
+func TestGenerator_FillEmbeddedStruct(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+import "github.com/ssoor/implgen/internal/tests/fill_embedded/base"
+
+type Store interface {
+	Get(key string) (string, error)
+	Put(key, value string) error
+}
+
+type cachedStore struct {
+	*base.Store
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	g := generator{declOptions: declOptions{fillStruct: "cachedStore", fillInterface: "Store"}}
+	if err := g.Generate(pkg, "foo", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out := g.buf.String()
+	if !strings.Contains(out, "func (m *cachedStore) Put(key, value string) error {") {
+		t.Errorf("output doesn't contain the missing method Put:\n%s", out)
+	}
+	if strings.Contains(out, "Get(") {
+		t.Errorf("output contains the method Get promoted from base.Store:\n%s", out)
+	}
+}
+
+func TestGenerateHead_ImportGroups(t *testing.T) {
+	out := generateSource(t, &generator{outputOptions: outputOptions{importGroups: true}}, `package foo
+
+import (
+	"context"
+	"io"
+
+	"example.com/store"
+)
+
+type Foo interface {
+	Get(ctx context.Context, r io.Reader) store.Item
+}
+`)
+
+	want := "import (\n\tcontext \"context\"\n\tio \"io\"\n\n\tstore \"example.com/store\"\n)"
+	if !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+}
+
+func TestGenerateMockMethod_Deprecated(t *testing.T) {
+	out := generateSource(t, &generator{}, `package foo
+
+type Foo interface {
+	// Get returns the value of key.
+	//
+	// Deprecated: use Fetch, which reports missing keys.
+	//implgen:body=zero
+	Get(key string) string
+}
+`)
+
+	want := "// Get returns the value of key.\n" +
+		"//\n" +
+		"// Deprecated: use Fetch, which reports missing keys.\n" +
+		"func (m *Foo) Get(key string) string {"
+	if !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+
+	out = generateSource(t, &generator{outputOptions: outputOptions{noComments: true}}, `package foo
+
+type Foo interface {
+	// Deprecated: use Fetch.
+	Get(key string) string
+}
+`)
+	if strings.Contains(out, "Deprecated") {
+		t.Errorf("output without -copy_comments contains the method doc:\n%s", out)
+	}
+}
+
+func TestGenerator_Registry(t *testing.T) {
+	const src = `package foo
+
+type FooInterface interface {
+	Foo()
+}
+
+type Bar interface {
+	Bar()
+}
+
+type Cache[K comparable] interface {
+	Get(key K)
+}
+`
+	out := generateSource(t, &generator{declOptions: declOptions{registry: "impls"}}, src)
+	want := "var impls = map[string]func() interface{}{\n" +
+		"\t\"FooInterface\": func() interface{} { return NewFoo(context.Background()) },\n" +
+		"\t\"Bar\":          func() interface{} { return NewBar(context.Background()) },\n" +
+		"}"
+	for _, want := range []string{`"context"`, want} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	out = generateSource(t, &generator{structOptions: structOptions{constructorError: true}, declOptions: declOptions{registry: "impls"}}, src)
+	if want := `"Bar":          func() (interface{}, error) { return NewBar(context.Background()) },`; !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+}
+
+func TestGenerator_SelfPackage(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+import "example.com/ext"
+
+type Methods interface {
+	Put(info Info, r ext.Reader)
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The implementation goes to the package of the interface, under
+	// another name, as when the directory and package names differ.
+	g := generator{}
+	if err := g.Generate(pkg, "core", "example.com/foo"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out := g.buf.String()
+	if want := "Put(info Info, r ext.Reader)"; !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+	if want := `ext "example.com/ext"`; !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+	if strings.Contains(out, `"example.com/foo"`) {
+		t.Errorf("output imports its own package:\n%s", out)
+	}
+}
+
+func TestGenerateMockInterface_DocParagraphs(t *testing.T) {
+	const src = `package foo
+
+// Store keeps values by key.
+//
+// Implementations must be safe for concurrent use.
+type Store interface {
+	Get(key string) string
+}
+`
+	out := generateSource(t, &generator{}, src)
+	want := "// Store keeps values by key.\n" +
+		"//\n" +
+		"// Implementations must be safe for concurrent use.\n" +
+		"type Store struct {"
+	if !strings.Contains(out, want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+
+	out = generateSource(t, &generator{structOptions: structOptions{docStructs: true}}, src)
+	want = "// Store is a generated implementation of Store.\n" +
+		"//\n" +
+		"// Store keeps values by key.\n" +
+		"//\n" +
+		"// Implementations must be safe for concurrent use.\n" +
+		"type Store struct {"
+	if !strings.Contains(out, want) {
+		t.Errorf("output with -doc_structs doesn't contain %q:\n%s", want, out)
+	}
+
+	out = generateSource(t, &generator{structOptions: structOptions{docStructs: true}, outputOptions: outputOptions{noComments: true}}, src)
+	want = "// Store is a generated implementation of Store.\n" +
+		"type Store struct {"
+	if !strings.Contains(out, want) {
+		t.Errorf("output without -copy_comments doesn't contain %q:\n%s", want, out)
+	}
+}
+
+func TestGenerator_SubPackage(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+import "io"
+
+type Store interface {
+	Get(key Key, w io.Writer) (*Item, error)
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The implementation goes to example.com/foo/impl.
+	g := generator{}
+	if err := g.Generate(pkg, "impl", "example.com/foo/impl"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to format generated source code: %v\n%s", err, g.buf.String())
+	}
+	for _, want := range []string{
+		"package impl",
+		`foo "example.com/foo"`,
+		"Get(key foo.Key, w io.Writer) (*foo.Item, error)",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerateMockMethod_TraceBodyMode(t *testing.T) {
+	out := generateSource(t, &generator{bodyOptions: bodyOptions{bodyMode: bodyTrace}}, `package foo
+
+type Foo interface {
+	Bar(file string, line int) error
+}
+`)
+
+	for _, want := range []string{
+		`"fmt"`,
+		`"runtime"`,
+		"\t_, file_2, line_2, _ := runtime.Caller(1)\n" +
+			"\tpanic(fmt.Sprintf(\"Foo.Bar not implemented, called from %v:%v\", file_2, line_2))\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerator_NoFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "no_gofmt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkg := &model.Package{Name: "foo", Interfaces: []*model.Interface{{
+		Name:    "Foo",
+		Methods: []*model.Method{{Name: "Bar"}},
+	}}}
+	g := generator{dstFileName: filepath.Join(dir, "foo.go"), outputOptions: outputOptions{noFormat: true}}
+	if err := g.Generate(pkg, "foo", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := g.Output(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	out, err := ioutil.ReadFile(g.dstFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, g.buf.Bytes()) {
+		t.Errorf("got output\n%s\nwant the unformatted\n%s", out, g.buf.Bytes())
+	}
+	if formatted, _ := format.Source(out); bytes.Equal(out, formatted) {
+		t.Error("expected the output to differ from its formatted version")
+	}
+}
+
+func TestGenerator_WriteTo(t *testing.T) {
+	pkg := &model.Package{Name: "foo", Interfaces: []*model.Interface{{
+		Name:    "Foo",
+		Methods: []*model.Method{{Name: "Bar"}},
+	}}}
+	g := generator{outputOptions: outputOptions{crlf: true}}
+	if err := g.Generate(pkg, "foo", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var w io.WriterTo = &g
+	var buf bytes.Buffer
+	n, err := w.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo() = %v, want the %v bytes written", n, buf.Len())
+	}
+	formatted, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.Replace(formatted, []byte("\n"), []byte("\r\n"), -1); !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("got output\n%q\nwant the formatted\n%q", buf.Bytes(), want)
+	}
+}
+
+func TestGenerator_GenerateFromSource(t *testing.T) {
+	g := generator{}
+	code, pkg, err := g.GenerateFromSource([]byte(`package foo
+
+// Store keeps values by key.
+type Store interface {
+	Get(key string) (string, error)
+	Put(key, value string) error
+}
+
+type Clock interface {
+	Now() int64
+}
+`), "example.com/foo", "impl")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, intf := range pkg.Interfaces {
+		for _, m := range intf.Methods {
+			got = append(got, intf.Name+"."+m.Name)
+		}
+	}
+	if want := []string{"Store.Get", "Store.Put", "Clock.Now"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got the methods %v, want %v", got, want)
+	}
+	if pkg.Name != "foo" || pkg.PkgPath != "example.com/foo" {
+		t.Errorf("got package %v %v, want foo example.com/foo", pkg.Name, pkg.PkgPath)
+	}
+	if formatted, err := format.Source(code); err != nil || !bytes.Equal(code, formatted) {
+		t.Errorf("got unformatted code (%v):\n%s", err, code)
+	}
+	for _, want := range []string{
+		"package impl\n",
+		"// Store keeps values by key.\ntype Store struct {",
+		"func (m *Store) Put(key, value string) error {",
+		"func (m *Clock) Now() int64 {",
+	} {
+		if !strings.Contains(string(code), want) {
+			t.Errorf("code doesn't contain %q:\n%s", want, code)
+		}
+	}
+
+	if _, _, err := (&generator{}).GenerateFromSource([]byte("package foo\n\ntype Foo interface {"), "", "foo"); err == nil {
+		t.Error("expected an error for a source that doesn't parse")
+	}
+}
+
+func TestGenerator_CRLF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "line_ending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkg := &model.Package{Name: "foo", Interfaces: []*model.Interface{{
+		Name:    "Foo",
+		Methods: []*model.Method{{Name: "Bar"}},
+	}}}
+	g := generator{dstFileName: filepath.Join(dir, "foo.go"), outputOptions: outputOptions{crlf: true}}
+	if err := g.Generate(pkg, "foo", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := g.Output(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	out, err := ioutil.ReadFile(g.dstFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Count(out, []byte("\n"))
+	if lines == 0 || bytes.Count(out, []byte("\r\n")) != lines {
+		t.Errorf("expected every line to end with \\r\\n, got\n%q", out)
+	}
+	formatted, err := format.Source(out)
+	if err != nil {
+		t.Fatalf("output doesn't parse: %v", err)
+	}
+	if want := bytes.Replace(formatted, []byte("\n"), []byte("\r\n"), -1); !bytes.Equal(out, want) {
+		t.Errorf("got output\n%q\nwant the formatted\n%q", out, want)
+	}
+}
+
+func TestGenerator_Diff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "foo.go")
+	generate := func(diff bool, methods ...string) (string, error) {
+		pkg := &model.Package{Name: "foo", Interfaces: []*model.Interface{{Name: "Foo"}}}
+		for _, name := range methods {
+			pkg.Interfaces[0].Methods = append(pkg.Interfaces[0].Methods, &model.Method{Name: name})
+		}
+		var stdout bytes.Buffer
+		g := generator{dstFileName: dst, stdout: &stdout, outputOptions: outputOptions{force: true, diff: diff}}
+		if err := g.Generate(pkg, "foo", ""); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		_, err := g.Output()
+		return stdout.String(), err
+	}
+
+	if _, err := generate(false, "Bar"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	written, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := generate(true, "Bar")
+	if err != nil || out != "" {
+		t.Errorf("up to date file: got error %v and diff\n%s\nwant neither", err, out)
+	}
+
+	out, err = generate(true, "Bar", "Baz")
+	if err != errStale {
+		t.Errorf("stale file: got error %v, want %v", err, errStale)
+	}
+	name := filepath.ToSlash(dst)
+	for _, want := range []string{
+		"--- a/" + name + "\n+++ b/" + name + "\n@@ -",
+		"+func (m *FooImpl) Baz() {\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected the diff to contain %q, got\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "\n-") {
+		t.Errorf("expected the diff to only add lines, got\n%s", out)
+	}
+	if after, err := ioutil.ReadFile(dst); err != nil || !bytes.Equal(after, written) {
+		t.Errorf("expected -diff to leave the destination alone, got\n%s", after)
+	}
+}
+
+func TestGenerator_Region(t *testing.T) {
+	dir, err := ioutil.TempDir("", "region")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "foo.go")
+	const handWritten = `package foo
+
+import "strings"
+
+// Shout is written by hand.
+func Shout(s string) string { return strings.ToUpper(s) }
+
+// implgen:start
+type Stale struct{}
+// implgen:end
+
+// Whisper is written by hand too.
+func Whisper(s string) string { return strings.ToLower(s) }
+`
+	if err := ioutil.WriteFile(dst, []byte(handWritten), 0644); err != nil {
+		t.Fatal(err)
+	}
+	generate := func(methods ...string) error {
+		pkg := &model.Package{Name: "foo", Interfaces: []*model.Interface{{Name: "Foo"}}}
+		for _, name := range methods {
+			pkg.Interfaces[0].Methods = append(pkg.Interfaces[0].Methods, &model.Method{
+				Name: name,
+				In:   []*model.Parameter{{Name: "ctx", Type: &model.NamedType{Package: "context", Type: "Context"}}},
+			})
+		}
+		g := generator{dstFileName: dst, outputOptions: outputOptions{force: true, region: true}}
+		if err := g.Generate(pkg, "foo", ""); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		_, err := g.Output()
+		return err
+	}
+
+	if err := generate("Bar"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := generate("Bar", "Baz"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"import \"strings\"\n\nimport (\n\tcontext \"context\"\n)\n",
+		"// Shout is written by hand.\nfunc Shout(",
+		"// implgen:start\n",
+		"func (m *FooImpl) Bar(ctx context.Context) {",
+		"func (m *FooImpl) Baz(ctx context.Context) {",
+		"// implgen:end\n\n// Whisper is written by hand too.\nfunc Whisper(",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("expected the file to contain %q, got\n%s", want, out)
+		}
+	}
+	for _, dontWant := range []string{"Stale", "Code generated", "package foo\n\nimport (\n\tcontext"} {
+		if strings.Contains(string(out), dontWant) {
+			t.Errorf("expected the file not to contain %q, got\n%s", dontWant, out)
+		}
+	}
+	if n := strings.Count(string(out), "\"context\""); n != 1 {
+		t.Errorf("expected context to be imported once, got %v imports:\n%s", n, out)
+	}
+
+	for _, tc := range []struct {
+		file, wantErr string
+	}{
+		{"package foo\n", "no // implgen:start line"},
+		{"package foo\n\n// implgen:start\n", "no // implgen:end line"},
+		{"package foo\n\n// implgen:end\n// implgen:start\n", "the // implgen:end line 3 comes before the // implgen:start line 4"},
+		{"package foo\n\n// implgen:start\n// implgen:start\n// implgen:end\n", "more than one // implgen:start line, at lines 3 and 4"},
+		{"package foo\n\nimport context \"example.com/context\"\n\n// implgen:start\n// implgen:end\n", "imports context as context, which the file uses for example.com/context"},
+	} {
+		if err := ioutil.WriteFile(dst, []byte(tc.file), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := generate("Bar"); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("got error %v for\n%s\nwant %q", err, tc.file, tc.wantErr)
+		}
+	}
+}
+
+func TestGenerator_Check(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "foo.go")
+	generate := func(check bool, methods ...string) (string, error) {
+		pkg := &model.Package{Name: "foo", Interfaces: []*model.Interface{{Name: "Foo"}}}
+		for _, name := range methods {
+			pkg.Interfaces[0].Methods = append(pkg.Interfaces[0].Methods, &model.Method{Name: name})
+		}
+		var stdout bytes.Buffer
+		g := generator{dstFileName: dst, stdout: &stdout, outputOptions: outputOptions{force: true, check: check, crlf: true}}
+		if err := g.Generate(pkg, "foo", ""); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		_, err := g.Output()
+		return stdout.String(), err
+	}
+
+	if _, err := generate(true, "Bar"); err != errStale {
+		t.Errorf("missing file: got error %v, want %v", err, errStale)
+	}
+	if _, err := generate(false, "Bar"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	written, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The comparison is made with the \r\n line endings the file got.
+	if out, err := generate(true, "Bar"); err != nil || out != "" {
+		t.Errorf("up to date file: got error %v and output %q, want neither", err, out)
+	}
+	if out, err := generate(true, "Bar", "Baz"); err != errStale || out != "" {
+		t.Errorf("stale file: got error %v and output %q, want %v and none", err, out, errStale)
+	}
+	if after, err := ioutil.ReadFile(dst); err != nil || !bytes.Equal(after, written) {
+		t.Errorf("expected -check to leave the destination alone, got\n%s", after)
+	}
+}
+
+func TestGenerator_PostProcess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "post_process")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkg := &model.Package{Name: "foo", Interfaces: []*model.Interface{{
+		Name:    "Foo",
+		Methods: []*model.Method{{Name: "Bar"}},
+	}}}
+	output := func(command ...string) ([]byte, []byte, error) {
+		g := generator{dstFileName: filepath.Join(dir, "foo.go"), outputOptions: outputOptions{force: true, postProcess: command}}
+		if err := g.Generate(pkg, "foo", ""); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		formatted, err := format.Source(g.buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := g.Output(); err != nil {
+			return nil, formatted, err
+		}
+		out, err := ioutil.ReadFile(g.dstFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out, formatted, nil
+	}
+
+	out, formatted, err := output("cat")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(out, formatted) {
+		t.Errorf("got output\n%s\nwant it unchanged by cat\n%s", out, formatted)
+	}
+
+	out, formatted, err = output("tr", "a-z", "A-Z")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := bytes.ToUpper(formatted); !bytes.Equal(out, want) {
+		t.Errorf("got output\n%s\nwant\n%s", out, want)
+	}
+
+	_, _, err = output("sh", "-c", "echo bad license >&2; exit 3")
+	if err == nil || !strings.Contains(err.Error(), "post-processor sh failed: exit status 3\nbad license") {
+		t.Errorf("got error %v, want the stderr of the failed post-processor", err)
+	}
+}
+
+func TestGenerator_Report(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+type Foo interface {
+	Get(id string) (string, error)
+	Put(id, v string) error
+}
+
+type Bar interface {
+	Close() error
+}
+
+type Baz interface{}
+
+type Number interface {
+	~int | ~float64
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dst := filepath.Join(dir, "foo_impl.go")
+
+	var stderr bytes.Buffer
+	g := generator{
+		dstFileName:   dst,
+		stderr:        &stderr,
+		report:        newGenReport(),
+		selectOptions: selectOptions{excludeInterfaces: map[string]bool{"Bar": true}},
+	}
+	if err := g.Generate(pkg, "foo_impl", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := g.Output(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var out bytes.Buffer
+	g.report.print(&out)
+	want := "implgen: 2 interfaces, 2 methods, 1 file written\n" +
+		"implgen: wrote " + dst + "\n" +
+		"implgen: skipped Bar: excluded\n" +
+		"implgen: skipped Number: type constraint\n" +
+		"implgen: empty Baz: implemented without methods\n"
+	if out.String() != want {
+		t.Errorf("got report\n%v\nwant\n%v", out.String(), want)
+	}
+}
@@ -0,0 +1,10 @@
+package impl
+
+// Store is re-exported by the store package.
+type Store struct {
+	data map[string]string
+}
+
+func (s *Store) Get(key string) (string, error) {
+	return s.data[key], nil
+}
@@ -0,0 +1,13 @@
+// Package store re-exports the types of its internal implementation.
+package store
+
+import "github.com/ssoor/implgen/internal/tests/alias_reexport/store/internal/impl"
+
+// Store is the implementation of the stores.
+type Store = impl.Store
+
+// Default is an alias of an alias.
+type Default = Store
+
+// Keys isn't a named type.
+type Keys = []string
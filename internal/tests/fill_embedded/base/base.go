@@ -0,0 +1,10 @@
+package base
+
+// Store is embedded by the stores of the fill tests.
+type Store struct {
+	data map[string]string
+}
+
+func (s *Store) Get(key string) (string, error) {
+	return s.data[key], nil
+}
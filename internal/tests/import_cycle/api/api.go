@@ -0,0 +1,8 @@
+// Package api declares the interfaces implemented in package impl.
+package api
+
+import "github.com/ssoor/implgen/internal/tests/import_cycle/store"
+
+type Repo interface {
+	Get(id string) (store.Item, error)
+}
@@ -0,0 +1,3 @@
+package impl
+
+const Version = 1
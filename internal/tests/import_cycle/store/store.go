@@ -0,0 +1,13 @@
+// Package store depends on package impl, so implementations of
+// api.Repo generated into impl would import store and close a cycle.
+package store
+
+import "github.com/ssoor/implgen/internal/tests/import_cycle/impl"
+
+type Item struct {
+	Version int
+}
+
+func Latest() Item {
+	return Item{Version: impl.Version}
+}
@@ -0,0 +1,7 @@
+package left
+
+import "github.com/ssoor/implgen/internal/tests/performance/many_embeds/shared"
+
+type Left interface {
+	shared.A
+}
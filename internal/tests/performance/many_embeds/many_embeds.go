@@ -0,0 +1,15 @@
+package many_embeds
+
+import (
+	"github.com/ssoor/implgen/internal/tests/performance/many_embeds/left"
+	"github.com/ssoor/implgen/internal/tests/performance/many_embeds/right"
+	"github.com/ssoor/implgen/internal/tests/performance/many_embeds/shared"
+)
+
+// All embeds interfaces of the shared package both directly and through the
+// left and right packages.
+type All interface {
+	left.Left
+	right.Right
+	shared.C
+}
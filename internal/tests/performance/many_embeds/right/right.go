@@ -0,0 +1,7 @@
+package right
+
+import "github.com/ssoor/implgen/internal/tests/performance/many_embeds/shared"
+
+type Right interface {
+	shared.B
+}
@@ -0,0 +1,13 @@
+package shared
+
+type A interface {
+	A()
+}
+
+type B interface {
+	B()
+}
+
+type C interface {
+	C()
+}
@@ -30,14 +30,19 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"text/template"
 	"unicode"
 
 	"github.com/ssoor/implgen/model"
 )
 
 const (
-	gomockImportPath = "github.com/golang/mock/gomock"
+	gomockImportPath     = "github.com/golang/mock/gomock"
+	traceImportPath      = "go.opentelemetry.io/otel/trace"                 // tracer of the -wrap=tracing decorators
+	prometheusImportPath = "github.com/prometheus/client_golang/prometheus" // metrics of the -wrap=metrics decorators
 )
 
 var (
@@ -47,15 +52,83 @@ var (
 )
 
 var (
-	source          = flag.String("source", "", "接口定义文件/源文件，工具根据源文件生成输出结果")
-	destination     = flag.String("destination", "", "指定输出文件路径，默认将内容输出到控制台")
-	implNames       = flag.String("impl_names", "", "传参为逗号分隔的 `intefaceName=implementName` 对，用来指定接口生成的结构名。默认名会根据 `interfaceName `生成，如果 `interfaceName` 后缀为 `Interface` 则删除 `Interface` 后缀后作为名称，如果没有 `Interface` 后缀就直接使用 `interfaceName`")
-	packageOut      = flag.String("package", "", "代码生成的包名（package <包名>）")
+	source          = flag.String("source", "", "A file declaring the interfaces to implement, or a directory whose Go files are parsed as one package.")
+	destination     = flag.String("destination", "", "Output file; defaults to stdout, which - also stands for.")
+	implNames       = flag.String("impl_names", "", "Comma-separated list of `Interface=Impl` pairs naming the generated implementations. An interface without one is implemented by a struct of its name, without its Interface suffix if it has one.")
+	nameTrims       = flag.String("name_trim", "suffix:Interface", "Comma-separated list of prefix:<prefix> and suffix:<suffix> elements stripped from the interface names to derive the default implementation names, e.g. suffix:Iface,prefix:I.")
+	exportImpls     = flag.Bool("exported", false, "Export the names of the generated structs, even for unexported interfaces.")
+	unexportImpls   = flag.Bool("unexported", false, "Don't export the names of the generated structs, even for exported interfaces.")
+	implInterfaces  = flag.String("impl_interfaces", "", "Comma-separated list of the interfaces to implement. Defaults to all interfaces.")
+	interfacesRegex = flag.String("impl_interfaces_regex", "", "Implement the interfaces whose names match this regular expression, in addition to -impl_interfaces.")
+	exclude         = flag.String("exclude_interfaces", "", "Comma-separated list of the interfaces not to implement.")
+	sortIntfs       = flag.Bool("sort_interfaces", false, "Implement the interfaces in alphabetical order rather than in source order.")
+	excludeMethods  = flag.String("exclude_methods", "", "Comma-separated list of the methods not to implement, as Interface.Method. The implementations of their interfaces aren't checked by -assert.")
+	onlyTagged      = flag.Bool("only_tagged", false, "(source mode) Only implement the interfaces whose doc comment contains the -tag_marker.")
+	tagMarker       = flag.String("tag_marker", "implgen:generate", "Marker of the interfaces to implement with -only_tagged.")
+	mergeInterface  = flag.String("merge_interface", "", "Declare an interface with this name merging the methods of all the selected interfaces, and implement it instead of them.")
+	packageOut      = flag.String("package", "", "Package of the generated code (package <name>).")
+	implPackages    = flag.String("impl_packages", "", "Comma-separated list of Interface=dir pairs. Write the implementation of each listed interface to dir/<dir>_impl.go, in a package named after dir, instead of to -destination.")
+	split           = flag.Bool("split", false, "Write the implementation of every interface to its own file in the directory of -destination, named by -file_pattern.")
+	filePattern     = flag.String("file_pattern", "{{.Interface | snake}}_impl.go", "Template of the file names of -split, given the .Interface name and the snake, kebab and lower functions.")
+	emitInterface   = flag.Bool("emit_interface", false, "Also declare the implemented interfaces in the output, so its package needn't import the source package.")
 	selfPackage     = flag.String("self_package", "", "The full package import path for the generated code. The purpose of this flag is to prevent import cycles in the generated code by trying to include its own package. This can happen if the mock's package is set to one of its inputs (usually the main one) and the output is stdio so mockgen cannot detect the final output package. Setting this flag will then tell mockgen which import to exclude.")
 	writePkgComment = flag.Bool("write_package_comment", false, "Writes package documentation comment (godoc) if true.")
+	docStructs      = flag.Bool("doc_structs", false, "Start the doc comment of every generated struct with \"<Struct> is a generated implementation of <Interface>.\"")
+	copyComments    = flag.Bool("copy_comments", true, "Copy the doc comments of the interfaces and their methods to the implementations, line by line.")
+	todoComments    = flag.Bool("todo_comments", false, "Start the body of every stub with a TODO comment summarizing its signature.")
 	copyrightFile   = flag.String("copyright_file", "", "Copyright file used to add copyright header")
+	region          = flag.Bool("region", false, "Replace only the lines between the // implgen:start and // implgen:end lines of the existing -destination file with the generated declarations, adding the imports they need.")
+	importGuards    = flag.Bool("import_guards", false, "Declare a blank variable of a type of every import the output doesn't use otherwise, as a safety net against unused imports.")
+	marker          = flag.String("marker", "", "Comment line starting the output, e.g. @generated, for tools recognizing generated files by a marker of their own. Prefixed with // unless it already is a comment.")
+	bodyMode        = flag.String("body", "panic", "Body of the generated methods: panic, zero, literal, trace, error, error_wrapped or context. A method can override it with a //implgen:body=<mode> directive.")
+	errorCtor       = flag.String("error_ctor", "errors.New", "Function creating the errors returned by the error body mode, and the sentinel wrapped by the error_wrapped one, as importpath.Func, e.g. github.com/pkg/errors.New.")
+	valueTypes      = flag.String("value_types", "", "Comma-separated list of named types, as importpath.Type, whose zero value is returned as Type{} by the zero body mode, e.g. embed.FS.")
+	typedError      = flag.Bool("typed_error", false, "Make the zero and literal body modes return Type{} for a last result of an error struct, of the source package or the -value_types, whose name ends with Error, and nil for a pointer to one.")
+	friendlyStr     = flag.Bool("friendly_stringer", false, "Make the String() string methods, as in fmt.Stringer, return the implementation name, e.g. \"FooImpl{}\", whatever the body mode, for readable debugging output.")
+	noopClose       = flag.Bool("noop_close", false, "Make the Close() error methods, as in io.Closer, return nil whatever the body mode, so that deferred calls don't panic.")
+	structGuard     = flag.Bool("struct_guard", false, "Declare a blank _ [0]func() field in the implementation structs, so that comparing them with == doesn't compile.")
+	closedChan      = flag.Bool("closed_chan", false, "Make the zero and literal body modes return closed channels instead of nil ones, so ranging over them ends at once.")
+	initContainers  = flag.Bool("init_containers", false, "Make the zero, literal and error body modes return empty maps and slices instead of nil ones.")
+	mutex           = flag.Bool("mutex", false, "Add a sync.Mutex to the generated structs and hold it for the duration of every method.")
+	record          = flag.Bool("record", false, "Record the arguments of every call in a <Method>Calls field of the generated structs.")
+	count           = flag.Bool("count", false, "Count the calls of every method in a <Method>CallCount field of the generated structs, without recording their arguments.")
+	recordNames     = flag.Bool("record_param_names", false, "Name the fields recording the arguments with -record as the parameters, instead of exporting them.")
+	override        = flag.String("override", "", "Comma-separated list of the methods to stub. The other methods forward to the implementation in a Fallback field of the generated structs.")
+	forwardCompat   = flag.Bool("forward_compat", false, "Embed the interface in its implementation, so that it still implements the interface once methods are added to it, which panic when called.")
+	nilGuard        = flag.Bool("nil_guard", false, "Make the methods forwarding to the implementation wrapped with -wrap, or to the Fallback of -override, panic with a clear message if it is nil.")
+	funcs           = flag.Bool("funcs", false, "Delegate every generated method <Method> to a <Method>Func function field of the generated structs, panicking if it is nil.")
+	inPlace         = flag.Bool("in_place", false, "(source mode) Write the output next to the source as <source>_impl.go, in the package of the source.")
+	force           = flag.Bool("force", false, "Overwrite an existing destination file, instead of appending the missing methods to it or refusing to overwrite a file it can't append to.")
+	diffOnly        = flag.Bool("diff", false, "Print a unified diff from the destination file to the output instead of writing it, and exit with status 1 if they differ, e.g. to check in CI that the file is up to date.")
+	checkOnly       = flag.Bool("check", false, "Compare the output with the destination file instead of writing it, and exit with status 1 if they differ.")
+	emitTests       = flag.Bool("emit_tests", false, "Also write a <destination>_test.go file with a skipped test of every generated method, unless it exists.")
+	testMain        = flag.Bool("test_main", false, "With -emit_tests, also declare a TestMain with setup and teardown hooks, and a new<Impl>ForTest helper constructing every implementation.")
+	accessors       = flag.Bool("accessors", false, "(source and reflect modes) Also generate GetX and SetX methods for the fields of the source or reflected structs. Requires generating into the source package.")
+	funcTypes       = flag.Bool("func_types", false, "(source mode) Also generate a <Type>Stub function, with its type parameters, of every named function type of the source.")
+	report          = flag.Bool("report", false, "Print a summary of the generation to stderr: the number of implemented interfaces, of generated methods and the written files, and the skipped interfaces with the reason.")
+	warnNoContext   = flag.Bool("warn_missing_context", false, "Print a warning for every generated method without a leading context.Context parameter.")
+	fill            = flag.String("fill", "", "(source mode) Struct:Interface pair. Only generate the methods of the interface the existing struct lacks.")
+	convert         = flag.String("convert", "", "(source and reflect modes) A:B pair of structs. Also generate a method A.ToB copying the fields of the same name and type to a B.")
+	bodies          = flag.String("bodies", "", "Go source file of functions named <Interface>_<Method> whose bodies are used as the bodies of the generated methods.")
+	emitRegistry    = flag.Bool("emit_registry", false, "Declare a map from interface name to the constructor of its implementation.")
+	registryName    = flag.String("registry_name", "implRegistry", "Name of the map declared by -emit_registry.")
+	noGofmt         = flag.Bool("no_gofmt", false, "Write the generated code as is, without formatting it, to debug the generator.")
+	lineDirectives  = flag.Bool("line_directives", false, "(source mode) Precede every generated method with a //line directive attributing it to the declaration of the interface method, for debuggers, stack traces and coverage.")
+	lineEnding      = flag.String("line_ending", "lf", "Line endings of the output: lf or crlf.")
+	lineLength      = flag.Int("line_length", 0, "Wrap the parameters of the generated methods one per line when their signature is longer than this many characters; 0 never wraps them.")
+	postProcessCmd  = flag.String("post_process", "", "Command, with arguments, reading the formatted output on its standard input and writing the final output to its standard output.")
+	importGroups    = flag.Bool("import_groups", false, "Group the standard library imports apart from the other imports, like goimports.")
+	quiet           = flag.Bool("quiet", false, "Only print errors, not warnings and other informational messages.")
+	assertImpls     = flag.Bool("assert", false, "Declare compile-time checks that the implementations satisfy their interfaces.")
+	assertEmbeds    = flag.Bool("assert_embeds", false, "Declare compile-time checks that the implementations satisfy the interfaces embedded in their interfaces.")
+	allowEmpty      = flag.Bool("allow_empty", false, "Don't warn about interfaces without methods.")
+	optionsCtor     = flag.Bool("options_constructor", false, "Make the generated New<Impl> constructors take functional options, with a With<Field> option function per field to set, e.g. WithNext and WithLogger with -wrap.")
+	ctorError       = flag.Bool("constructor_error", false, "Make the generated New<Impl> constructors return an error too, as (*<Impl>, error).")
+	loggerTypeSpec  = flag.String("logger_type", "log", "Logger of the -wrap=logging decorators: log for a *log.Logger, slog for a *slog.Logger, zap for a *zap.SugaredLogger, or [*]importpath.Type of another logger with an slog-like Info(msg string, args ...any) method.")
+	wrap            = newWrapFlag("wrap", "Generate decorators forwarding every call to a wrapped implementation instead of stubs: logging (the default without a value), Logging<Interface> decorators logging every call, tracing, Tracing<Interface> decorators opening an OpenTelemetry span per call, or metrics, Metrics<Interface> decorators timing and counting the calls with Prometheus.")
 
-	debugParser = flag.Bool("debug_parser", false, "仅打印解析器解析结果")
+	emit        = flag.String("emit", "", "Print a representation of the parsed interfaces instead of generating code: dot, a Graphviz graph of the interfaces, their embeds and the types they refer to.")
+	debugParser = flag.Bool("debug_parser", false, "Print the result of the parser only.")
 	showVersion = flag.Bool("version", false, "Print version.")
 )
 
@@ -63,6 +136,21 @@ func main() {
 	flag.Usage = usage
 	flag.Parse()
 
+	// The configuration file supplies the flags not on the command line.
+	configDir := "."
+	if *source != "" {
+		if fi, err := os.Stat(*source); err == nil && fi.IsDir() {
+			configDir = *source
+		} else {
+			configDir = filepath.Dir(*source)
+		}
+	}
+	if path := findConfig(*configFile, configDir); path != "" {
+		if err := applyConfig(flag.CommandLine, path); err != nil {
+			log.Fatalf("Bad -config: %v", err)
+		}
+	}
+
 	if *showVersion {
 		printVersion()
 		return
@@ -73,6 +161,13 @@ func main() {
 	var packageName string
 	if *source != "" {
 		pkg, err = sourceMode(*source)
+	} else if *implement != "" {
+		pkg, err = implementMode(*implement)
+		if err == nil {
+			packageName = pkg.PkgPath
+		}
+	} else if *inline != "" {
+		pkg, err = inlineMode(*inline, *inlinePackage)
 	} else {
 		if flag.NArg() != 2 {
 			usage()
@@ -99,12 +194,27 @@ func main() {
 		pkg.Print(os.Stdout)
 		return
 	}
+	switch *emit {
+	case "":
+	case "dot":
+		pkg.PrintDot(os.Stdout)
+		return
+	default:
+		log.Fatalf("Bad -emit: %q, want dot", *emit)
+	}
+
+	if *inPlace {
+		if *source == "" {
+			log.Fatal("-in_place requires -source")
+		}
+		if err := setInPlaceFlags(pkg); err != nil {
+			log.Fatalf("Bad -in_place: %v", err)
+		}
+	}
 
 	outputPackageName := *packageOut
 	if outputPackageName == "" {
-		// pkg.Name in reflect mode is the base name of the import path,
-		// which might have characters that are illegal to have in package names.
-		outputPackageName = "impl_" + sanitize(pkg.Name)
+		outputPackageName = defaultPackageName(pkg, packageName)
 	}
 
 	// outputPackagePath represents the fully qualified name of the package of
@@ -114,16 +224,8 @@ func main() {
 	// "package.X" since "package" is this package). This can happen if the mock
 	// is output into an already existing package.
 	outputPackagePath := *selfPackage
-	if len(outputPackagePath) == 0 && len(*destination) > 0 {
-		dst, _ := filepath.Abs(filepath.Dir(*destination))
-		for _, prefix := range build.Default.SrcDirs() {
-			if strings.HasPrefix(dst, prefix) {
-				if rel, err := filepath.Rel(prefix, dst); err == nil {
-					outputPackagePath = rel
-					break
-				}
-			}
-		}
+	if len(outputPackagePath) == 0 && len(*destination) > 0 && *destination != "-" {
+		outputPackagePath = destinationPackagePath(*destination)
 	}
 
 	g := new(generator)
@@ -132,13 +234,185 @@ func main() {
 	}
 	if *source != "" {
 		g.filename = *source
+	} else if *implement != "" || *inline != "" {
+		g.srcPackage = packageName
+		if *inline != "" {
+			g.srcPackage = "-inline"
+		}
+		names := make([]string, len(pkg.Interfaces))
+		for i, intf := range pkg.Interfaces {
+			names[i] = intf.Name
+		}
+		g.srcInterfaces = strings.Join(names, ",")
 	} else {
 		g.srcPackage = packageName
 		g.srcInterfaces = flag.Arg(1)
 	}
 
 	if *implNames != "" {
-		g.mockNames = parseMockNames(*implNames)
+		if g.mockNames, err = parseMockNames(*implNames); err != nil {
+			log.Fatalf("Bad -impl_names: %v", err)
+		}
+	}
+	if g.nameTrims, err = parseNameTrims(*nameTrims); err != nil {
+		log.Fatalf("Bad -name_trim: %v", err)
+	}
+	if *exportImpls && *unexportImpls {
+		log.Fatalf("-exported and -unexported are exclusive")
+	}
+	g.exported, g.unexported = *exportImpls, *unexportImpls
+	if *implInterfaces != "" {
+		g.mockInterfaces = parseNameSet(*implInterfaces)
+	}
+	if *onlyTagged {
+		g.tagMarker = *tagMarker
+	}
+	g.mergeInterface = *mergeInterface
+	g.emitInterface = *emitInterface
+	g.docStructs = *docStructs
+	g.noComments = !*copyComments
+	g.todoComments = *todoComments
+	if *exclude != "" {
+		g.excludeInterfaces = parseNameSet(*exclude)
+	}
+	if *excludeMethods != "" {
+		g.excludeMethods = parseNameSet(*excludeMethods)
+	}
+	g.sortInterfaces = *sortIntfs
+	if *interfacesRegex != "" {
+		if g.interfacesRegex, err = regexp.Compile(*interfacesRegex); err != nil {
+			log.Fatalf("Bad -impl_interfaces_regex: %v", err)
+		}
+	}
+	g.bodyMode = *bodyMode
+	if dot := strings.LastIndex(*errorCtor, "."); dot > 0 && dot < len(*errorCtor)-1 {
+		g.errorCtor = &model.NamedType{Package: (*errorCtor)[:dot], Type: (*errorCtor)[dot+1:]}
+	} else {
+		log.Fatalf("Bad -error_ctor: want importpath.Func, got %v", *errorCtor)
+	}
+	if *valueTypes != "" {
+		g.valueTypes = parseNameSet(*valueTypes)
+	}
+	g.typedErrors = *typedError
+	g.friendlyStringer = *friendlyStr
+	g.noopCloser = *noopClose
+	g.structGuard = *structGuard
+	g.forwardCompat = *forwardCompat
+	g.closedChans = *closedChan
+	g.initContainers = *initContainers
+	g.mutex = *mutex
+	g.record = *record
+	g.count = *count
+	g.funcs = *funcs
+	if *override != "" {
+		g.overrides = parseNameSet(*override)
+	}
+	g.recordParamNames = *recordNames
+	g.nilGuard = *nilGuard
+	switch *wrap {
+	case "", "false":
+	case "true", "logging":
+		g.wrap = true
+	case "tracing":
+		g.wrap, g.tracing = true, true
+	case "metrics":
+		g.wrap, g.metrics = true, true
+	default:
+		log.Fatalf("Bad -wrap: %q, want logging, tracing or metrics", *wrap)
+	}
+	if *loggerTypeSpec != "log" {
+		if !g.wrap || g.tracing || g.metrics {
+			log.Fatalf("-logger_type is the logger of -wrap=logging")
+		}
+		if g.logger, err = parseLoggerType(*loggerTypeSpec); err != nil {
+			log.Fatalf("Bad -logger_type: %v", err)
+		}
+	}
+	g.force = *force
+	if *diffOnly && *checkOnly {
+		log.Fatalf("-diff and -check are exclusive")
+	}
+	if *diffOnly || *checkOnly {
+		if !g.writesFile() {
+			log.Fatalf("-diff and -check need a -destination to compare the output with")
+		}
+		// The output is compared with the file it would replace.
+		g.force, g.diff, g.check = true, *diffOnly, *checkOnly
+	}
+	if *testMain && !*emitTests {
+		log.Fatalf("-test_main requires -emit_tests")
+	}
+	if *emitTests {
+		if !g.writesFile() {
+			log.Fatalf("-emit_tests needs a -destination file to write the tests next to")
+		}
+		if g.diff || g.check {
+			log.Fatalf("-emit_tests can't be used with -diff or -check")
+		}
+		g.emitTests, g.testMain = true, *testMain
+	}
+	g.inPackage = *inPlace
+	g.accessors = *accessors
+	g.funcTypes = *funcTypes
+	g.warnMissingContext = *warnNoContext
+	g.constructorError = *ctorError
+	g.optionsConstructor = *optionsCtor
+	g.allowEmpty = *allowEmpty
+	g.assert = *assertImpls
+	g.assertEmbeds = *assertEmbeds
+	g.importGroups = *importGroups
+	g.noFormat = *noGofmt
+	if g.postProcess, err = splitFlags(*postProcessCmd); err != nil {
+		log.Fatalf("Bad -post_process: %v", err)
+	}
+	if *lineLength < 0 {
+		log.Fatalf("Bad -line_length: %v, want a non-negative length", *lineLength)
+	}
+	g.lineLength = *lineLength
+	g.lineDirectives = *lineDirectives
+	switch *lineEnding {
+	case "lf":
+	case "crlf":
+		g.crlf = true
+	default:
+		log.Fatalf("Bad -line_ending: %q, want lf or crlf", *lineEnding)
+	}
+	if *emitRegistry {
+		g.registry = *registryName
+	}
+	if *fill != "" {
+		parts := strings.SplitN(*fill, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Fatalf("Bad -fill: want Struct:Interface, got %v", *fill)
+		}
+		g.fillStruct, g.fillInterface = parts[0], parts[1]
+	}
+	if *convert != "" {
+		parts := strings.SplitN(*convert, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Fatalf("Bad -convert: want A:B, got %v", *convert)
+		}
+		g.convertFrom, g.convertTo = parts[0], parts[1]
+	}
+	if *bodies != "" {
+		if g.bodies, err = parseBodies(*bodies); err != nil {
+			log.Fatalf("Bad -bodies: %v", err)
+		}
+	}
+	if strings.ContainsAny(*marker, "\r\n") {
+		log.Fatalf("Bad -marker: want a single line, got %q", *marker)
+	}
+	g.marker = *marker
+	g.importGuards = *importGuards
+	if *region {
+		if !g.writesFile() {
+			log.Fatalf("-region needs the -destination file to replace the region of")
+		}
+		if *implPackages != "" || *split {
+			log.Fatalf("-region can't be used with -impl_packages or -split")
+		}
+		// The region is regenerated as a whole, not appended to.
+		g.region, g.force = true, true
 	}
 	if *copyrightFile != "" {
 		header, err := ioutil.ReadFile(*copyrightFile)
@@ -148,25 +422,357 @@ func main() {
 
 		g.copyrightHeader = string(header)
 	}
-	if err := g.Generate(pkg, outputPackageName, outputPackagePath); err != nil {
-		log.Fatalf("Failed generating mock: %v", err)
+
+	if *report {
+		g.report = newGenReport()
+	}
+
+	outputs := []*implOutput{{g, pkg, outputPackageName, outputPackagePath}}
+	if *implPackages != "" {
+		routes, err := parseImplPackages(*implPackages)
+		if err != nil {
+			log.Fatalf("Bad -impl_packages: %v", err)
+		}
+		if g.mergeInterface != "" || g.fillStruct != "" || g.inPackage {
+			log.Fatalf("-impl_packages can't be used with -merge_interface, -fill or -in_place")
+		}
+		if outputs, err = splitImplPackages(g, pkg, routes, outputPackageName, outputPackagePath); err != nil {
+			log.Fatalf("Bad -impl_packages: %v", err)
+		}
+	}
+	if *split {
+		if !g.writesFile() {
+			log.Fatalf("-split needs a -destination file to write the files next to")
+		}
+		if *implPackages != "" || g.mergeInterface != "" || g.fillStruct != "" {
+			log.Fatalf("-split can't be used with -impl_packages, -merge_interface or -fill")
+		}
+		// These are declared once per output, so the files would redeclare
+		// them.
+		if g.registry != "" || g.accessors || g.funcTypes || g.convertFrom != "" || g.usesBodyMode(pkg, bodyErrorWrapped) {
+			log.Fatalf("-split can't be used with -emit_registry, -accessors, -func_types, -convert or error_wrapped bodies")
+		}
+		if outputs, err = splitInterfaces(g, pkg, *filePattern, outputPackageName, outputPackagePath); err != nil {
+			log.Fatalf("Bad -file_pattern: %v", err)
+		}
+	}
+
+	stale := false
+	for _, o := range outputs {
+		if err := o.g.Generate(o.pkg, o.packageName, o.packagePath); err != nil {
+			log.Fatalf("Failed generating mock: %v", err)
+		}
+		if _, err := o.g.Output(); err == errStale {
+			if o.g.check {
+				log.Printf("%v is out of date, regenerate it", o.g.dstFileName)
+			}
+			stale = true
+		} else if err != nil {
+			log.Fatalf("Failed writing to destination: %v", err)
+		}
+		if o.g.emitTests {
+			if err := o.g.OutputTests(o.packageName); err != nil {
+				log.Fatalf("Failed writing tests: %v", err)
+			}
+		}
+	}
+	if g.report != nil {
+		g.report.print(os.Stderr)
+	}
+	if stale {
+		os.Exit(1)
+	}
+}
+
+// implOutput is an output file of the implementations of interfaces of pkg,
+// and its package.
+type implOutput struct {
+	g                        *generator
+	pkg                      *model.Package // generated from, which Generate modifies
+	packageName, packagePath string
+}
+
+// parseImplPackages parses the -impl_packages Interface=dir pairs into a map
+// from interface name to directory.
+func parseImplPackages(spec string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, kv := range strings.Split(spec, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("want Interface=dir, got %v", kv)
+		}
+		routes[parts[0]] = parts[1]
+	}
+	return routes, nil
+}
+
+// splitImplPackages returns the outputs of g when the interfaces of routes
+// are implemented in the package of their directory, in dir/<dir>_impl.go,
+// and the others in the packageName package at packagePath as usual. The
+// usual output is left out if no other interface is to be implemented. Each
+// output has its own copy of pkg.
+func splitImplPackages(g *generator, pkg *model.Package, routes map[string]string, packageName, packagePath string) ([]*implOutput, error) {
+	known := make(map[string]bool)
+	for _, intf := range pkg.Interfaces {
+		known[intf.Name] = true
+	}
+	byDir := make(map[string]map[string]bool)
+	var dirs []string
+	for name, dir := range routes {
+		if !known[name] {
+			return nil, fmt.Errorf("no interface %v", name)
+		}
+		if byDir[dir] == nil {
+			byDir[dir] = make(map[string]bool)
+			dirs = append(dirs, dir)
+		}
+		byDir[dir][name] = true
+	}
+	sort.Strings(dirs)
+
+	var outputs []*implOutput
+	rest := excluding(g, pkg, func(name string) bool { return routes[name] != "" })
+	for _, intf := range pkg.Interfaces {
+		if rest.selects(intf) {
+			outputs = append(outputs, &implOutput{rest, copyPackage(pkg), packageName, packagePath})
+			break
+		}
+	}
+	for _, dir := range dirs {
+		name := sanitize(filepath.Base(filepath.Clean(dir)))
+		c := excluding(g, pkg, func(intf string) bool { return !byDir[dir][intf] })
+		c.dstFileName = filepath.Join(dir, name+"_impl.go")
+		outputs = append(outputs, &implOutput{c, copyPackage(pkg), name, destinationPackagePath(c.dstFileName)})
+	}
+	return outputs, nil
+}
+
+// splitInterfaces returns the outputs of g when every selected interface of
+// pkg is implemented in its own file of the directory of the destination,
+// named by the -file_pattern template pattern, all in the packageName
+// package at packagePath. Each output has its own copy of pkg.
+func splitInterfaces(g *generator, pkg *model.Package, pattern, packageName, packagePath string) ([]*implOutput, error) {
+	tmpl, err := template.New("file_pattern").Funcs(template.FuncMap{
+		"snake": snakeCase,
+		"lower": strings.ToLower,
+		"kebab": kebabCase,
+	}).Option("missingkey=error").Parse(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var outputs []*implOutput
+	files := make(map[string]string) // file name => interface name
+	for _, intf := range pkg.Interfaces {
+		if !g.selects(intf) || intf.Constraint {
+			continue
+		}
+		var buf strings.Builder
+		if err := tmpl.Execute(&buf, struct{ Interface string }{intf.Name}); err != nil {
+			return nil, err
+		}
+		file := buf.String()
+		if file == "" || file == "." || file == ".." || strings.ContainsAny(file, `/\`) {
+			return nil, fmt.Errorf("%v gives the file name %q of %v, want a name without directories", pattern, file, intf.Name)
+		}
+		if other, ok := files[file]; ok {
+			return nil, fmt.Errorf("%v gives the same file name %v to %v and %v", pattern, file, other, intf.Name)
+		}
+		files[file] = intf.Name
+
+		name := intf.Name
+		c := excluding(g, pkg, func(other string) bool { return other != name })
+		c.dstFileName = filepath.Join(filepath.Dir(g.dstFileName), file)
+		outputs = append(outputs, &implOutput{c, copyPackage(pkg), packageName, packagePath})
 	}
+	return outputs, nil
+}
 
-	if _, err := g.Output(); err != nil {
-		log.Fatalf("Failed writing to destination: %v", err)
+// excluding returns a copy of g which also excludes the interfaces of pkg
+// for which exclude is true.
+func excluding(g *generator, pkg *model.Package, exclude func(name string) bool) *generator {
+	c := *g
+	c.excludeInterfaces = make(map[string]bool)
+	for name := range g.excludeInterfaces {
+		c.excludeInterfaces[name] = true
+	}
+	for _, intf := range pkg.Interfaces {
+		if exclude(intf.Name) {
+			c.excludeInterfaces[intf.Name] = true
+		}
 	}
+	return &c
 }
 
-func parseMockNames(names string) map[string]string {
+// copyPackage returns a copy of pkg whose interfaces Generate can reorder
+// and filter without changing pkg.
+func copyPackage(pkg *model.Package) *model.Package {
+	p := *pkg
+	p.Interfaces = append([]*model.Interface(nil), pkg.Interfaces...)
+	return &p
+}
+
+// snakeCase converts a CamelCase name to snake_case, keeping initialisms
+// together, e.g. HTTPServer to http_server.
+func snakeCase(s string) string {
+	return splitWords(s, '_')
+}
+
+// kebabCase converts a CamelCase name to kebab-case, e.g. UserService to
+// user-service.
+func kebabCase(s string) string {
+	return splitWords(s, '-')
+}
+
+// splitWords lowers the CamelCase name s, separating its words with sep.
+func splitWords(s string, sep rune) string {
+	rs := []rune(s)
+	var b strings.Builder
+	for i, r := range rs {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := rs[i-1]
+			nextLower := i+1 < len(rs) && unicode.IsLower(rs[i+1])
+			if prev != '_' && prev != '-' && (unicode.IsLower(prev) || unicode.IsDigit(prev) || unicode.IsUpper(prev) && nextLower) {
+				b.WriteRune(sep)
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// destinationPackagePath returns the import path of the directory of the
+// destination file, which only depends on the enclosing module or GOPATH,
+// not on the -package name, or the empty string if it is unknown.
+func destinationPackagePath(destination string) string {
+	dst, err := filepath.Abs(filepath.Dir(destination))
+	if err != nil {
+		return ""
+	}
+	if importPath, err := parsePackageImport(dst); err == nil {
+		return importPath
+	}
+	for _, prefix := range build.Default.SrcDirs() {
+		if strings.HasPrefix(dst, prefix) {
+			if rel, err := filepath.Rel(prefix, dst); err == nil {
+				return filepath.ToSlash(rel)
+			}
+		}
+	}
+	return ""
+}
+
+// setInPlaceFlags sets the flags making the output go next to the source,
+// in the package of the source. Flags given explicitly are left alone.
+func setInPlaceFlags(pkg *model.Package) error {
+	dst := inPlaceDestination(*source)
+	if *destination != "" {
+		dst = *destination
+	}
+	absSrc, err := filepath.Abs(*source)
+	if err != nil {
+		return err
+	}
+	absDst, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+	if absSrc == absDst {
+		return fmt.Errorf("destination %v is the source file", dst)
+	}
+	if _, err := os.Stat(dst); err == nil && !*force && !*diffOnly && !*checkOnly && !*region {
+		logf("%v exists, only appending the missing methods to it; use -force to regenerate it", dst)
+	}
+
+	*destination = dst
+	if *packageOut == "" {
+		*packageOut = pkg.Name
+	}
+	if *selfPackage == "" {
+		*selfPackage = pkg.PkgPath
+	}
+	return nil
+}
+
+// inPlaceDestination returns the file written by -in_place: foo_impl.go
+// next to foo.go, or dir/dir_impl.go for a source directory.
+func inPlaceDestination(source string) string {
+	if fi, err := os.Stat(source); err == nil && fi.IsDir() {
+		return filepath.Join(source, filepath.Base(filepath.Clean(source))+"_impl.go")
+	}
+	return strings.TrimSuffix(source, ".go") + "_impl.go"
+}
+
+// defaultPackageName returns the name of the generated package when -package
+// isn't given. In source mode, importPath is empty and it is the package of
+// the source. In reflect mode, importPath is the path of the reflected
+// package, whose actual name is used if go list can tell it. pkg.Name is
+// fixed up to match it.
+func defaultPackageName(pkg *model.Package, importPath string) string {
+	if importPath == "" {
+		return pkg.Name
+	}
+	if name, ok := createPackageMap([]string{importPath})[importPath]; ok {
+		pkg.Name = name
+		return name
+	}
+	// pkg.Name in reflect mode is the base name of the import path,
+	// which might have characters that are illegal to have in package names.
+	return "impl_" + sanitize(pkg.Name)
+}
+
+func parseMockNames(names string) (map[string]string, error) {
 	mocksMap := make(map[string]string)
 	for _, kv := range strings.Split(names, ",") {
 		parts := strings.SplitN(kv, "=", 2)
 		if len(parts) != 2 || parts[1] == "" {
-			log.Fatalf("bad mock names spec: %v", kv)
+			return nil, fmt.Errorf("bad mock names spec: %v", kv)
 		}
 		mocksMap[parts[0]] = parts[1]
 	}
-	return mocksMap
+	return mocksMap, nil
+}
+
+// wrapFlag is the -wrap flag, which may be given without a value like a
+// boolean flag to generate logging decorators.
+type wrapFlag string
+
+func (f *wrapFlag) String() string     { return string(*f) }
+func (f *wrapFlag) Set(v string) error { *f = wrapFlag(v); return nil }
+func (f *wrapFlag) IsBoolFlag() bool   { return true }
+
+func newWrapFlag(name, usage string) *wrapFlag {
+	f := new(wrapFlag)
+	flag.Var(f, name, usage)
+	return f
+}
+
+// parseNameTrims parses a comma-separated list of prefix:<prefix> and
+// suffix:<suffix> elements. The empty list strips nothing.
+func parseNameTrims(spec string) ([]nameTrim, error) {
+	trims := []nameTrim{}
+	for _, elem := range strings.Split(spec, ",") {
+		if elem = strings.TrimSpace(elem); elem == "" {
+			continue
+		}
+		parts := strings.SplitN(elem, ":", 2)
+		if len(parts) != 2 || parts[1] == "" || (parts[0] != "prefix" && parts[0] != "suffix") {
+			return nil, fmt.Errorf("bad name trim spec: %v", elem)
+		}
+		trims = append(trims, nameTrim{prefix: parts[0] == "prefix", affix: parts[1]})
+	}
+	return trims, nil
+}
+
+// parseNameSet parses a comma-separated list of names into a set.
+func parseNameSet(names string) map[string]bool {
+	namesSet := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			namesSet[name] = true
+		}
+	}
+	return namesSet
 }
 
 func usage() {
@@ -174,7 +780,7 @@ func usage() {
 	flag.PrintDefaults()
 }
 
-const usageText = `mockgen has two modes of operation: source and reflect.
+const usageText = `mockgen has three modes of operation: source, implement and reflect.
 
 Source mode generates mock interfaces from a source file.
 It is enabled by using the -source flag. Other flags that
@@ -182,6 +788,12 @@ may be useful in this mode are -imports and -aux_files.
 Example:
 	mockgen -source=foo.go [other options]
 
+Implement mode generates implementations of the interfaces of
+another package from its source. It is enabled by using the
+-implement flag.
+Example:
+	mockgen -implement=io.Reader,io.Writer [other options]
+
 Reflect mode generates mock interfaces by building a program
 that uses reflection to understand interfaces. It is enabled
 by passing two non-flag arguments: an import path, and a
@@ -224,8 +836,11 @@ func sanitize(s string) string {
 func makeArgString(argNames, argTypes []string) string {
 	args := make([]string, len(argNames))
 	for i, name := range argNames {
-		// specify the type only once for consecutive args of the same type
-		if i+1 < len(argTypes) && argTypes[i] == argTypes[i+1] {
+		// anonymous parameters are listed by their types only
+		if name == "" {
+			args[i] = argTypes[i]
+		} else if i+1 < len(argTypes) && argTypes[i] == argTypes[i+1] {
+			// specify the type only once for consecutive args of the same type
 			args[i] = name
 		} else {
 			args[i] = name + " " + argTypes[i]
@@ -234,32 +849,112 @@ func makeArgString(argNames, argTypes []string) string {
 	return strings.Join(args, ", ")
 }
 
+// pseudoPackages are the import paths go list knows nothing about, or
+// needn't be asked about, mapped to their package names. The packages the
+// decorators import may not be in the module yet, and asking go list about
+// them would download them.
+var pseudoPackages = map[string]string{
+	"C":                  "C", // cgo
+	traceImportPath:      "trace",
+	prometheusImportPath: "prometheus",
+}
+
+// listedPackages caches the package names go list found, by import path,
+// since the same imports are looked up for every parsed file.
+var listedPackages = make(map[string]string)
+
 // createPackageMap returns a map of import path to package name
 // for specified importPaths.
 func createPackageMap(importPaths []string) map[string]string {
-	var pkg struct {
+	type goListPackage struct {
 		Name       string
 		ImportPath string
 	}
 	pkgMap := make(map[string]string)
+	var listed []string
+	for _, importPath := range importPaths {
+		if name, ok := pseudoPackages[importPath]; ok {
+			pkgMap[importPath] = name
+		} else if name, ok := listedPackages[importPath]; ok {
+			pkgMap[importPath] = name
+		} else {
+			listed = append(listed, importPath)
+		}
+	}
+	if len(listed) == 0 {
+		return pkgMap
+	}
 	b := bytes.NewBuffer(nil)
-	args := []string{"list", "-json"}
-	args = append(args, importPaths...)
+	args := []string{"list", "-e", "-json"}
+	args = append(args, listed...)
 	cmd := exec.Command("go", args...)
 	cmd.Stdout = b
 	cmd.Run()
 	dec := json.NewDecoder(b)
 	for dec.More() {
+		var pkg goListPackage
 		err := dec.Decode(&pkg)
 		if err != nil {
-			log.Printf("failed to decode 'go list' output: %v", err)
+			logf("failed to decode 'go list' output: %v", err)
+			continue
+		}
+		if pkg.Name == "" {
+			// -e reports packages that failed to load without a name.
 			continue
 		}
 		pkgMap[pkg.ImportPath] = pkg.Name
+		listedPackages[pkg.ImportPath] = pkg.Name
 	}
 	return pkgMap
 }
 
+// dependentImports returns the importPaths depending on pkgPath, directly
+// or transitively, as reported by go list.
+func dependentImports(importPaths []string, pkgPath string) []string {
+	type goListPackage struct {
+		ImportPath string
+		Deps       []string
+	}
+	var listed []string
+	for _, importPath := range importPaths {
+		if _, ok := pseudoPackages[importPath]; !ok {
+			listed = append(listed, importPath)
+		}
+	}
+	if len(listed) == 0 {
+		return nil
+	}
+	b := bytes.NewBuffer(nil)
+	args := []string{"list", "-e", "-json"}
+	args = append(args, listed...)
+	cmd := exec.Command("go", args...)
+	cmd.Stdout = b
+	cmd.Run()
+	var dependent []string
+	dec := json.NewDecoder(b)
+	for dec.More() {
+		var pkg goListPackage
+		if err := dec.Decode(&pkg); err != nil {
+			logf("failed to decode 'go list' output: %v", err)
+			break
+		}
+		for _, dep := range pkg.Deps {
+			if dep == pkgPath {
+				dependent = append(dependent, pkg.ImportPath)
+				break
+			}
+		}
+	}
+	return dependent
+}
+
+// logf logs a message that isn't an error, unless -quiet is set.
+func logf(format string, args ...interface{}) {
+	if !*quiet {
+		log.Printf(format, args...)
+	}
+}
+
 func printVersion() {
 	if version != "" {
 		fmt.Printf("v%s\nCommit: %s\nDate: %s\n", version, commit, date)
@@ -1,11 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
+	"go/build"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/ssoor/implgen/model"
 )
@@ -101,6 +112,17 @@ func TestMakeArgString(t *testing.T) {
 			argTypes:  []string{"int", "int", "bool", "bool", "int"},
 			argString: "arg0, arg1 int, arg2, arg3 bool, arg4 int",
 		},
+		{
+			// the variadic parameter never shares the type of the previous ones
+			argNames:  []string{"sep", "parts"},
+			argTypes:  []string{"string", "...string"},
+			argString: "sep string, parts ...string",
+		},
+		{
+			argNames:  []string{"arg0", "arg1", "arg2"},
+			argTypes:  []string{"string", "string", "...string"},
+			argString: "arg0, arg1 string, arg2 ...string",
+		},
 	}
 
 	for i, tc := range testCases {
@@ -185,19 +207,18 @@ func TestIdentifierAllocator_allocateIdentifier(t *testing.T) {
 	}
 }
 
-func TestGenerateMockInterface_Helper(t *testing.T) {
+func TestGenerateMockInterface_Receiver(t *testing.T) {
 	for _, test := range []struct {
 		Name       string
 		Identifier string
-		HelperLine string
+		Receiver   string
 		Methods    []*model.Method
 	}{
-		{Name: "mock", Identifier: "MockSomename", HelperLine: "m.ctrl.T.Helper()"},
-		{Name: "recorder", Identifier: "MockSomenameMockRecorder", HelperLine: "mr.mock.ctrl.T.Helper()"},
+		{Name: "mock", Identifier: "Somename", Receiver: "m"},
 		{
 			Name:       "mock identifier conflict",
-			Identifier: "MockSomename",
-			HelperLine: "m_2.ctrl.T.Helper()",
+			Identifier: "Somename",
+			Receiver:   "m_2",
 			Methods: []*model.Method{
 				{
 					Name: "MethodA",
@@ -210,22 +231,6 @@ func TestGenerateMockInterface_Helper(t *testing.T) {
 				},
 			},
 		},
-		{
-			Name:       "recorder identifier conflict",
-			Identifier: "MockSomenameMockRecorder",
-			HelperLine: "mr_2.mock.ctrl.T.Helper()",
-			Methods: []*model.Method{
-				{
-					Name: "MethodA",
-					In: []*model.Parameter{
-						{
-							Name: "mr",
-							Type: &model.NamedType{Type: "int"},
-						},
-					},
-				},
-			},
-		},
 	} {
 		t.Run(test.Name, func(t *testing.T) {
 			g := generator{}
@@ -246,10 +251,10 @@ func TestGenerateMockInterface_Helper(t *testing.T) {
 
 			lines := strings.Split(g.buf.String(), "\n")
 
-			// T.Helper() should be the first line
 			for _, method := range test.Methods {
-				if strings.TrimSpace(lines[findMethod(t, test.Identifier, method.Name, lines)+1]) != test.HelperLine {
-					t.Fatalf("method %s.%s did not declare itself a Helper method", test.Identifier, method.Name)
+				line := lines[findMethod(t, test.Identifier, method.Name, lines)]
+				if !strings.HasPrefix(line, "func ("+test.Receiver+" *") {
+					t.Fatalf("method %s.%s has receiver %q, want %q", test.Identifier, method.Name, line, test.Receiver)
 				}
 			}
 		})
@@ -269,6 +274,328 @@ func findMethod(t *testing.T, identifier, methodName string, lines []string) int
 	panic("unreachable")
 }
 
+func TestSplitImplPackages(t *testing.T) {
+	const src = `package foo
+
+type Item struct{}
+
+type Getter interface {
+	Get() Item
+}
+
+type Putter interface {
+	Put(item Item)
+}
+
+type Closer interface {
+	Close() error
+}
+`
+	pkg, err := parseSource(t, src)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "impl_packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	x, y := filepath.Join(dir, "x"), filepath.Join(dir, "y")
+
+	routes, err := parseImplPackages("Getter=" + x + ",Putter=" + y)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var stdout bytes.Buffer
+	outputs, err := splitImplPackages(&generator{stdout: &stdout}, pkg, routes, "foo", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(outputs) != 3 {
+		t.Fatalf("got %v outputs, want 3", len(outputs))
+	}
+	for _, o := range outputs {
+		if err := o.g.Generate(o.pkg, o.packageName, o.packagePath); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if _, err := o.g.Output(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		file      string
+		want      []string
+		dontWants []string
+	}{
+		{
+			file:      filepath.Join(x, "x_impl.go"),
+			want:      []string{"package x\n", "\"example.com/foo\"", "type Getter struct", "Get() foo.Item {"},
+			dontWants: []string{"Putter", "Closer"},
+		},
+		{
+			file:      filepath.Join(y, "y_impl.go"),
+			want:      []string{"package y\n", "\"example.com/foo\"", "type Putter struct", "Put(item foo.Item) {"},
+			dontWants: []string{"Getter", "Closer"},
+		},
+	} {
+		out, err := ioutil.ReadFile(tc.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(string(out), want) {
+				t.Errorf("%v doesn't contain %q:\n%s", tc.file, want, out)
+			}
+		}
+		for _, dontWant := range tc.dontWants {
+			if strings.Contains(string(out), dontWant) {
+				t.Errorf("%v contains %q:\n%s", tc.file, dontWant, out)
+			}
+		}
+	}
+	if out := stdout.String(); !strings.Contains(out, "type CloserImpl struct") || strings.Contains(out, "Getter") || strings.Contains(out, "Putter") {
+		t.Errorf("expected the standard output to implement only Closer, got\n%s", out)
+	}
+
+	if outputs, err := splitImplPackages(&generator{selectOptions: selectOptions{mockInterfaces: map[string]bool{"Getter": true}}}, pkg, routes, "foo", ""); err != nil || len(outputs) != 2 {
+		t.Errorf("got %v outputs and error %v with every selected interface routed, want 2 and none", len(outputs), err)
+	}
+	if _, err := splitImplPackages(&generator{}, pkg, map[string]string{"Missing": x}, "foo", ""); err == nil {
+		t.Error("expected an error for an unknown interface")
+	}
+	if _, err := parseImplPackages("Getter"); err == nil {
+		t.Error("expected an error for a pair without a directory")
+	}
+}
+
+func TestSplitInterfaces(t *testing.T) {
+	const src = `package foo
+
+type UserService interface {
+	User(id int) string
+}
+
+type HTTPServer interface {
+	Serve() error
+}
+
+type Closer interface {
+	Close() error
+}
+`
+	pkg, err := parseSource(t, src)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g := &generator{dstFileName: filepath.Join(dir, "impl.go"), selectOptions: selectOptions{excludeInterfaces: map[string]bool{"Closer": true}}}
+	outputs, err := splitInterfaces(g, pkg, "{{.Interface | snake}}_impl.go", "foo", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var files []string
+	for _, o := range outputs {
+		if err := o.g.Generate(o.pkg, o.packageName, o.packagePath); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if _, err := o.g.Output(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		files = append(files, filepath.Base(o.g.dstFileName))
+	}
+	if want := []string{"user_service_impl.go", "http_server_impl.go"}; !reflect.DeepEqual(files, want) {
+		t.Fatalf("got the files %v, want %v", files, want)
+	}
+	out, err := ioutil.ReadFile(filepath.Join(dir, "http_server_impl.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "type HTTPServerImpl struct") || strings.Contains(string(out), "UserService") {
+		t.Errorf("expected http_server_impl.go to implement only HTTPServer, got\n%s", out)
+	}
+
+	if outputs, err := splitInterfaces(g, pkg, "{{.Interface | kebab}}.go", "foo", ""); err != nil || filepath.Base(outputs[0].g.dstFileName) != "user-service.go" {
+		t.Errorf("expected user-service.go with kebab, got error %v", err)
+	}
+	if _, err := splitInterfaces(&generator{}, pkg, "{{.Interface | lower | snake}}.go", "foo", ""); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := splitInterfaces(&generator{}, pkg, "impl.go", "foo", ""); err == nil || !strings.Contains(err.Error(), "same file name impl.go") {
+		t.Errorf("expected an error for a pattern giving every interface the same file, got %v", err)
+	}
+	if _, err := splitInterfaces(&generator{}, pkg, "impl/{{.Interface}}.go", "foo", ""); err == nil {
+		t.Error("expected an error for a pattern giving a directory")
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"UserService", "user_service"},
+		{"HTTPServer", "http_server"},
+		{"ServeHTTP", "serve_http"},
+		{"io", "io"},
+	} {
+		if got := snakeCase(tc.in); got != tc.want {
+			t.Errorf("snakeCase(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestInPlaceDestination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "in_place")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	api := filepath.Join(dir, "api")
+	if err := os.Mkdir(api, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		source, want string
+	}{
+		{"foo/bar.go", "foo/bar_impl.go"},
+		{"bar.go", "bar_impl.go"},
+		{api, filepath.Join(api, "api_impl.go")},
+		{api + "/", filepath.Join(api, "api_impl.go")},
+	} {
+		if got := inPlaceDestination(test.source); got != test.want {
+			t.Errorf("inPlaceDestination(%q) = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestGenerator_MockNameInPackage(t *testing.T) {
+	g := generator{inPackage: true}
+	for typeName, want := range map[string]string{
+		"Foo":          "FooImpl",
+		"FooInterface": "Foo",
+	} {
+		if got := g.mockName(typeName); got != want {
+			t.Errorf("mockName(%q) = %q, want %q", typeName, got, want)
+		}
+	}
+}
+
+func TestGenerator_MockNameExported(t *testing.T) {
+	for _, test := range []struct {
+		g        generator
+		typeName string
+		want     string
+	}{
+		// By default the implementation is as exported as its interface.
+		{generator{}, "Store", "Store"},
+		{generator{}, "store", "store"},
+		{generator{}, "storeInterface", "store"},
+		{generator{inPackage: true}, "store", "storeImpl"},
+		{generator{decoratorOptions: decoratorOptions{wrap: true}}, "Store", "LoggingStore"},
+		{generator{decoratorOptions: decoratorOptions{wrap: true}}, "store", "loggingStore"},
+		{generator{decoratorOptions: decoratorOptions{wrap: true, tracing: true}}, "store", "tracingStore"},
+		{generator{structOptions: structOptions{exported: true}}, "store", "Store"},
+		{generator{structOptions: structOptions{exported: true}, decoratorOptions: decoratorOptions{wrap: true}}, "store", "LoggingStore"},
+		{generator{structOptions: structOptions{unexported: true}}, "Store", "store"},
+		{generator{inPackage: true, structOptions: structOptions{unexported: true}}, "Store", "storeImpl"},
+		{generator{structOptions: structOptions{unexported: true, mockNames: map[string]string{"Store": "MemStore"}}}, "Store", "MemStore"},
+	} {
+		if got := test.g.mockName(test.typeName); got != test.want {
+			t.Errorf("mockName(%q) with exported %v, unexported %v = %q, want %q",
+				test.typeName, test.g.exported, test.g.unexported, got, test.want)
+		}
+	}
+}
+
+func TestGenerator_MockNameTrims(t *testing.T) {
+	trims, err := parseNameTrims("suffix:Iface,prefix:I,suffix:IF")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	g := generator{structOptions: structOptions{nameTrims: trims}}
+	for typeName, want := range map[string]string{
+		"StoreIface":   "Store",
+		"IStore":       "Store",
+		"IStoreIF":     "Store",
+		"Index":        "Index",
+		"Store":        "Store",
+		"I":            "I",
+		"FooInterface": "FooInterface",
+	} {
+		if got := g.mockName(typeName); got != want {
+			t.Errorf("mockName(%q) = %q, want %q", typeName, got, want)
+		}
+	}
+
+	// The trimmed name still mustn't collide with the interface.
+	g.inPackage = true
+	if got, want := g.mockName("IStore"), "Store"; got != want {
+		t.Errorf("mockName(%q) = %q, want %q", "IStore", got, want)
+	}
+	if got, want := g.mockName("Store"), "StoreImpl"; got != want {
+		t.Errorf("mockName(%q) = %q, want %q", "Store", got, want)
+	}
+
+	if trims, err := parseNameTrims(""); err != nil || len(trims) != 0 {
+		t.Errorf("parseNameTrims(\"\") = %v, %v, want no trims", trims, err)
+	}
+	if _, err := parseNameTrims("infix:Foo"); err == nil || err.Error() != "bad name trim spec: infix:Foo" {
+		t.Errorf("got error %v, want bad name trim spec", err)
+	}
+}
+
+func TestDefaultPackageName(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		pkgName    string
+		importPath string
+		want       string
+	}{
+		{
+			name:    "source mode",
+			pkgName: "greeter",
+			want:    "greeter",
+		},
+		{
+			name:       "reflect mode",
+			pkgName:    "v1",
+			importPath: "github.com/ssoor/implgen/internal/tests/custom_package_name/client/v1",
+			want:       "client",
+		},
+		{
+			name:       "reflect mode unknown package",
+			pkgName:    "go-bad",
+			importPath: "github.com/ssoor/implgen/internal/tests/does/not/exist/go-bad",
+			want:       "impl_go_bad",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			pkg := &model.Package{Name: test.pkgName}
+			if got := defaultPackageName(pkg, test.importPath); got != test.want {
+				t.Errorf("defaultPackageName() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMockNames(t *testing.T) {
+	names, err := parseMockNames("Foo=FooImpl,Bar=BarImpl")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := map[string]string{"Foo": "FooImpl", "Bar": "BarImpl"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+
+	if _, err := parseMockNames("Foo=FooImpl,Bar"); err == nil || err.Error() != "bad mock names spec: Bar" {
+		t.Errorf("got error %v, want bad mock names spec", err)
+	}
+}
+
 func TestGetArgNames(t *testing.T) {
 	for _, testCase := range []struct {
 		name     string
@@ -323,6 +650,22 @@ func TestGetArgNames(t *testing.T) {
 			},
 			expected: []string{"firstArg", "arg1"},
 		},
+		{
+			name: "CollidingName",
+			method: &model.Method{
+				In: []*model.Parameter{
+					{
+						Name: "_",
+						Type: &model.NamedType{Type: "int"},
+					},
+					{
+						Name: "arg0",
+						Type: &model.NamedType{Type: "string"},
+					},
+				},
+			},
+			expected: []string{"arg0_2", "arg0"},
+		},
 	} {
 		t.Run(testCase.name, func(t *testing.T) {
 			g := generator{}
@@ -346,6 +689,7 @@ func Test_createPackageMap(t *testing.T) {
 		{"third party", "golang.org/x/tools/present", "present", true},
 		{"modules", "rsc.io/quote/v3", "quote", true},
 		{"fail", "this/should/not/work", "", false},
+		{"cgo", "C", "C", true},
 	}
 	var importPaths []string
 	for _, t := range tests {
@@ -364,3 +708,347 @@ func Test_createPackageMap(t *testing.T) {
 		})
 	}
 }
+
+func TestQuiet(t *testing.T) {
+	var logs, warnings bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	defer func(old bool) { *quiet = old }(*quiet)
+
+	g := generator{stderr: &warnings}
+	*quiet = true
+	logf("go list failed")
+	g.warnf("Foo has no methods")
+	if logs.Len() != 0 || warnings.Len() != 0 {
+		t.Errorf("expected nothing printed with -quiet, got %q and %q", logs.String(), warnings.String())
+	}
+
+	*quiet = false
+	logf("go list failed")
+	g.warnf("Foo has no methods")
+	if !strings.Contains(logs.String(), "go list failed") || warnings.String() != "warning: Foo has no methods\n" {
+		t.Errorf("expected the messages printed without -quiet, got %q and %q", logs.String(), warnings.String())
+	}
+}
+
+func TestGetRetString(t *testing.T) {
+	param := func(name, typ string) *model.Parameter {
+		return &model.Parameter{Name: name, Type: model.PredeclaredType(typ)}
+	}
+	data := &model.Parameter{Name: "data", Type: &model.ArrayType{Len: -1, Type: model.PredeclaredType("byte")}}
+	for _, tc := range []struct {
+		name string
+		out  []*model.Parameter
+		want string
+	}{
+		{"none", nil, ""},
+		{"single", []*model.Parameter{param("", "error")}, "error"},
+		{"single named", []*model.Parameter{param("err", "error")}, "(err error)"},
+		{"unnamed", []*model.Parameter{param("", "int"), param("", "int")}, "(int, int)"},
+		{"all different", []*model.Parameter{data, param("n", "int"), param("err", "error")}, "(data []byte, n int, err error)"},
+		{"all same", []*model.Parameter{param("x", "int"), param("y", "int"), param("z", "int")}, "(x, y, z int)"},
+		{"same first", []*model.Parameter{param("x", "int"), param("y", "int"), param("err", "error")}, "(x, y int, err error)"},
+		{"same last", []*model.Parameter{param("ok", "bool"), param("x", "int"), param("y", "int")}, "(ok bool, x, y int)"},
+		{"same apart", []*model.Parameter{param("x", "int"), param("ok", "bool"), param("y", "int")}, "(x int, ok bool, y int)"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := generator{}
+			if got := g.getRetString(&model.Method{Out: tc.out}, ""); got != tc.want {
+				t.Errorf("getRetString() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReflectMode_Unexported(t *testing.T) {
+	_, err := reflectMode("example.com/foo", []string{"Foo", "bar"})
+	if err == nil {
+		t.Fatal("expected an error for an unexported interface")
+	}
+	for _, want := range []string{"unexported interface bar of example.com/foo", "-source="} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't contain %q", err, want)
+		}
+	}
+}
+
+func TestRun_Timeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script")
+	}
+	dir, err := ioutil.TempDir("", "reflect_timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prog := filepath.Join(dir, "prog")
+	if err := ioutil.WriteFile(prog, []byte("#!/bin/sh\nexec sleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = run(ctx, prog)
+	if err == nil || !strings.Contains(err.Error(), "timed out, see -reflect_timeout") {
+		t.Errorf("got error %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the program wasn't killed, ran for %v", elapsed)
+	}
+}
+
+func TestBuildCommand(t *testing.T) {
+	cmd, err := buildCommand(context.Background(), `-mod=vendor  -tags "integration linux" -ldflags='-s -w' -gcflags=all=-N\ -l`, "prog.bin", "prog.go")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := []string{"go", "build", "-mod=vendor", "-tags", "integration linux", "-ldflags=-s -w", "-gcflags=all=-N -l", "-o", "prog.bin", "prog.go"}
+	if !reflect.DeepEqual(cmd.Args, want) {
+		t.Errorf("args = %q, want %q", cmd.Args, want)
+	}
+
+	cmd, err = buildCommand(context.Background(), "", "prog.bin", "prog.go")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := []string{"go", "build", "-o", "prog.bin", "prog.go"}; !reflect.DeepEqual(cmd.Args, want) {
+		t.Errorf("args = %q, want %q", cmd.Args, want)
+	}
+
+	if _, err := buildCommand(context.Background(), `-tags "a b`, "prog.bin", "prog.go"); err == nil {
+		t.Error("expected an error for an unterminated quote")
+	}
+}
+
+func TestGoVersionMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go_version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gomod := filepath.Join(dir, "go.mod")
+	if err := ioutil.WriteFile(gomod, []byte("module example.com/foo\n\ngo 1.99\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pkgDir := filepath.Join(dir, "bar")
+	if err := os.Mkdir(pkgDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	warning := goVersionMismatch(pkgDir, "go1.21.3")
+	for _, want := range []string{gomod + " requires go 1.99", "go version is go1.21.3"} {
+		if !strings.Contains(warning, want) {
+			t.Errorf("warning %q doesn't contain %q", warning, want)
+		}
+	}
+	for _, toolchain := range []string{"go1.99", "go1.99.1", "go1.100", "devel go1.23-abc"} {
+		if warning := goVersionMismatch(pkgDir, toolchain); warning != "" {
+			t.Errorf("got warning %q with %v, want none", warning, toolchain)
+		}
+	}
+
+	if err := os.Remove(gomod); err != nil {
+		t.Fatal(err)
+	}
+	if warning := goVersionMismatch(pkgDir, "go1.21.3"); warning != "" {
+		t.Errorf("got warning %q outside of a module, want none", warning)
+	}
+}
+
+func TestCompareGoVersions(t *testing.T) {
+	testCases := []struct {
+		v1, v2 string
+		want   int
+	}{
+		{"1.21", "1.21", 0},
+		{"1.21", "1.21.0", 0},
+		{"1.21", "1.21.3", -1},
+		{"1.22", "1.21.3", 1},
+		{"1.9", "1.13", -1},
+		{"1.22rc1", "1.22", 0},
+		{"2", "1.99", 1},
+	}
+	for _, tc := range testCases {
+		if got := compareGoVersions(tc.v1, tc.v2); got != tc.want {
+			t.Errorf("compareGoVersions(%q, %q) = %v, want %v", tc.v1, tc.v2, got, tc.want)
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configs := map[string]string{
+		".implgen.yaml": "# shared flags\n" +
+			"package: mocks\n" +
+			"body: 'zero' # overridden\n" +
+			"assert: true\n" +
+			"line_length: 80\n" +
+			"name_trim: \"prefix:I, suffix:Interface\"\n",
+		".implgen.json": `{"package": "mocks", "body": "zero", "assert": true, "line_length": 80, "name_trim": "prefix:I, suffix:Interface"}`,
+	}
+	for name, content := range configs {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if got := findConfig("", dir); got != path {
+			t.Errorf("findConfig() = %v, want %v", got, path)
+		}
+
+		fs := flag.NewFlagSet("implgen", flag.ContinueOnError)
+		pkg := fs.String("package", "", "")
+		body := fs.String("body", "panic", "")
+		assert := fs.Bool("assert", false, "")
+		lineLength := fs.Int("line_length", 0, "")
+		trims := fs.String("name_trim", "suffix:Interface", "")
+		if err := fs.Parse([]string{"-body", "literal"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := applyConfig(fs, path); err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if *pkg != "mocks" || !*assert || *lineLength != 80 || *trims != "prefix:I, suffix:Interface" {
+			t.Errorf("%v: got -package=%v -assert=%v -line_length=%v -name_trim=%q, want the configured values", name, *pkg, *assert, *lineLength, *trims)
+		}
+		if *body != "literal" {
+			t.Errorf("%v: got -body=%v, want the command line's literal", name, *body)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(strings.Replace(content, "assert", "asert", 1)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := applyConfig(flag.NewFlagSet("implgen", flag.ContinueOnError), path); err == nil || !strings.Contains(err.Error(), "unknown flag asert") {
+			t.Errorf("%v: got error %v, want an unknown flag", name, err)
+		}
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := findConfig("", dir); got != "" {
+		t.Errorf("findConfig() = %v without a configuration file, want none", got)
+	}
+	if got := findConfig("other.yaml", dir); got != "other.yaml" {
+		t.Errorf("findConfig() = %v, want the -config file", got)
+	}
+}
+
+func TestWriteProgram_BuildIgnore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prog_build_ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, ignore := range []bool{false, true} {
+		program, err := writeProgram("example.com/foo", []string{"Foo"}, ignore)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if got := bytes.Contains(program, []byte("//go:build ignore\n\npackage main\n")); got != ignore {
+			t.Errorf("buildIgnore = %v: program has the constraint = %v:\n%s", ignore, got, program)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "prog.go"), program, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if match, err := build.Default.MatchFile(dir, "prog.go"); err != nil || match == ignore {
+			t.Errorf("buildIgnore = %v: MatchFile() = %v, %v, want %v", ignore, match, err, !ignore)
+		}
+	}
+}
+
+func TestDestinationPackagePath(t *testing.T) {
+	const srv = "github.com/ssoor/implgen/internal/srv"
+	if got := destinationPackagePath(filepath.Join("internal", "srv", "srv_impl.go")); got != srv {
+		t.Fatalf("destinationPackagePath() = %q, want %q", got, srv)
+	}
+
+	// The package clause follows -package, the qualification the directory.
+	pkg := &model.Package{
+		Name:    "srv",
+		PkgPath: srv,
+		Interfaces: []*model.Interface{{
+			Name: "Handler",
+			Methods: []*model.Method{{
+				Name: "Serve",
+				In:   []*model.Parameter{{Name: "req", Type: &model.PointerType{Type: &model.NamedType{Package: srv, Type: "Request"}}}},
+			}, {
+				// only implementable in the same package
+				Name: "close",
+			}},
+		}},
+	}
+	g := generator{}
+	if err := g.Generate(pkg, "server", srv); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out := g.buf.String()
+	for _, want := range []string{
+		"package server\n",
+		"Serve(req *Request) {",
+		"close() {",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, srv) {
+		t.Errorf("output imports its own package %v:\n%s", srv, out)
+	}
+}
+
+func TestMain_StaleExitStatus(t *testing.T) {
+	if args := os.Getenv("IMPLGEN_TEST_MAIN_ARGS"); args != "" {
+		os.Args = append([]string{"implgen"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+
+	dir, err := ioutil.TempDir("", "diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dst := filepath.Join(dir, "foo.go")
+
+	// run runs main in a child process, as it exits.
+	run := func(args ...string) (string, int) {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestMain_StaleExitStatus$")
+		cmd.Env = append(os.Environ(), "IMPLGEN_TEST_MAIN_ARGS="+strings.Join(args, "\n"))
+		var stdout bytes.Buffer
+		cmd.Stdout = &stdout
+		err := cmd.Run()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return stdout.String(), exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return stdout.String(), 0
+	}
+
+	if out, status := run("-inline", "type Foo interface { Bar() }", "-package", "foo", "-destination", dst); status != 0 {
+		t.Fatalf("generating %v: exit status %v, output\n%s", dst, status, out)
+	}
+	if out, status := run("-inline", "type Foo interface { Bar() }", "-package", "foo", "-destination", dst, "-diff"); status != 0 || out != "" {
+		t.Errorf("up to date file: got exit status %v and diff\n%s\nwant 0 and none", status, out)
+	}
+	out, status := run("-inline", "type Foo interface { Bar(); Baz() }", "-package", "foo", "-destination", dst, "-diff")
+	if status != 1 {
+		t.Errorf("stale file: got exit status %v, want 1", status)
+	}
+	if want := "+func (m *Foo) Baz() {\n"; !strings.Contains(out, want) {
+		t.Errorf("expected the diff to contain %q, got\n%s", want, out)
+	}
+
+	if out, status := run("-inline", "type Foo interface { Bar() }", "-package", "foo", "-destination", dst, "-check"); status != 0 || out != "" {
+		t.Errorf("up to date file: got exit status %v and output\n%s\nwant 0 and none", status, out)
+	}
+	if out, status := run("-inline", "type Foo interface { Bar(); Baz() }", "-package", "foo", "-destination", dst, "-check"); status != 1 || out != "" {
+		t.Errorf("stale file: got exit status %v and output\n%s\nwant 1 and none", status, out)
+	}
+}
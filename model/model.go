@@ -32,15 +32,71 @@ type Package struct {
 	PkgPath     string
 	Interfaces  []*Interface
 	StructNames []*Struct
+	FuncTypes   []*FuncTypeDecl
 	DotImports  []string
 }
 
-// Print writes the package name and its exported interfaces.
+// Print writes the package name, its exported interfaces and its structs.
 func (pkg *Package) Print(w io.Writer) {
 	_, _ = fmt.Fprintf(w, "package %s\n", pkg.Name)
 	for _, intf := range pkg.Interfaces {
 		intf.Print(w)
 	}
+	for _, s := range pkg.StructNames {
+		s.Print(w)
+	}
+}
+
+// PrintDot writes a Graphviz graph of the interfaces and the structs of the
+// package, with an edge from every interface to the interfaces it embeds and
+// a dashed edge from every interface and struct to the named types its
+// methods and fields refer to.
+func (pkg *Package) PrintDot(w io.Writer) {
+	name := func(nt *NamedType) string {
+		if nt.Package == "" || nt.Package == pkg.PkgPath {
+			return nt.Type
+		}
+		return nt.Package + "." + nt.Type
+	}
+	printRefs := func(from string, walk func(visitor func(Type) bool)) {
+		seen := make(map[string]bool)
+		walk(func(t Type) bool {
+			if nt, ok := t.(*NamedType); ok {
+				if to := name(nt); to != from && !seen[to] {
+					seen[to] = true
+					_, _ = fmt.Fprintf(w, "\t%q -> %q [style=dashed];\n", from, to)
+				}
+			}
+			return true
+		})
+	}
+
+	_, _ = fmt.Fprintf(w, "digraph %q {\n", pkg.Name)
+	for _, intf := range pkg.Interfaces {
+		_, _ = fmt.Fprintf(w, "\t%q [shape=box];\n", intf.Name)
+	}
+	for _, s := range pkg.StructNames {
+		_, _ = fmt.Fprintf(w, "\t%q [shape=ellipse];\n", s.Name)
+	}
+	for _, intf := range pkg.Interfaces {
+		for _, embed := range intf.Embeds {
+			_, _ = fmt.Fprintf(w, "\t%q -> %q [label=\"embeds\"];\n", intf.Name, name(embed))
+		}
+		printRefs(intf.Name, func(visitor func(Type) bool) {
+			for _, m := range intf.Methods {
+				m.walk(visitor)
+			}
+		})
+	}
+	for _, s := range pkg.StructNames {
+		printRefs(s.Name, func(visitor func(Type) bool) {
+			walkParams(s.Fields, visitor)
+			for _, name := range s.MethodNames {
+				s.Methods[name].walk(visitor)
+			}
+		})
+	}
+	_, _ = fmt.Fprintf(w, "}\n")
 }
 
 // Imports returns the imports needed by the Package as a set of import paths.
@@ -52,43 +108,157 @@ func (pkg *Package) Imports() map[string]bool {
 	return im
 }
 
-// Interface is a Go interface.
+// Walk calls visitor for every type of the package, in depth-first order:
+// the type parameter constraints and the method signatures of its
+// interfaces, then the fields and the method signatures of its structs.
+// If visitor returns false, the types nested in the visited one are skipped.
+func Walk(pkg *Package, visitor func(Type) bool) {
+	for _, intf := range pkg.Interfaces {
+		for _, tp := range intf.TypeParams {
+			if tp.Constraint != nil {
+				tp.Constraint.walk(visitor)
+			}
+		}
+		for _, m := range intf.Methods {
+			m.walk(visitor)
+		}
+	}
+	for _, s := range pkg.StructNames {
+		for _, f := range s.Fields {
+			f.Type.walk(visitor)
+		}
+		for _, name := range s.MethodNames {
+			s.Methods[name].walk(visitor)
+		}
+	}
+}
+
+// FuncTypeDecl is a named function type, e.g.
+// type Mapper[T, U any] func(T) U.
+type FuncTypeDecl struct {
+	Name       string
+	Doc        []string
+	TypeParams []*TypeParam
+	Signature  *Method // named like the type
+}
+
+// Imports returns the imports needed by the type parameter constraints and
+// the signature of the function type as a set of import paths.
+func (f *FuncTypeDecl) Imports() map[string]bool {
+	im := make(map[string]bool)
+	for _, tp := range f.TypeParams {
+		if tp.Constraint != nil {
+			tp.Constraint.addImports(im)
+		}
+	}
+	f.Signature.addImports(im)
+	return im
+}
+
+// Struct is a Go struct with its methods.
 type Struct struct {
-	Name    string
-	Doc     []string
-	Comment string
-	Methods map[string]*Method
+	Name        string
+	Doc         []string
+	Comment     string
+	Fields      []*Parameter // named fields of a type implgen understands, in source order
+	Methods     map[string]*Method
+	MethodNames []string // in source order
+}
+
+// FieldImports returns the imports needed by the types of the fields of the
+// struct as a set of import paths.
+func (s *Struct) FieldImports() map[string]bool {
+	im := make(map[string]bool)
+	for _, f := range s.Fields {
+		f.Type.addImports(im)
+	}
+	return im
+}
+
+// Print writes the struct name, its fields and its methods in source order.
+func (s *Struct) Print(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "struct %s\n", s.Name)
+	if len(s.Fields) > 0 {
+		_, _ = fmt.Fprintf(w, "  fields:\n")
+		for _, f := range s.Fields {
+			f.Print(w)
+		}
+	}
+	for _, name := range s.MethodNames {
+		s.Methods[name].Print(w)
+	}
 }
 
 // Interface is a Go interface.
 type Interface struct {
-	Name    string
-	Doc     []string
-	Comment string
-	Methods []*Method
+	Name       string
+	Doc        []string
+	Comment    string
+	TypeParams []*TypeParam      // may be empty
+	Directives map[string]string // //implgen:key=value comments, may be nil
+	Embeds     []*NamedType      // embedded interfaces in source order, their methods are in Methods
+	Methods    []*Method
+	Constraint bool // only has type terms, e.g. ~int | ~float64, so can't be implemented
 }
 
 // Print writes the interface name and its methods.
 func (intf *Interface) Print(w io.Writer) {
 	_, _ = fmt.Fprintf(w, "interface %s\n", intf.Name)
+	for _, tp := range intf.TypeParams {
+		_, _ = fmt.Fprintf(w, "  - type param %s %s\n", tp.Name, tp.ConstraintString(nil, ""))
+	}
 	for _, m := range intf.Methods {
 		m.Print(w)
 	}
 }
 
 func (intf *Interface) addImports(im map[string]bool) {
+	for _, tp := range intf.TypeParams {
+		if tp.Constraint != nil {
+			tp.Constraint.addImports(im)
+		}
+	}
 	for _, m := range intf.Methods {
 		m.addImports(im)
 	}
 }
 
+// TypeParam is a type parameter of a generic interface.
+type TypeParam struct {
+	Name       string
+	Constraint Type   // nil if the constraint can't be modeled, e.g. ~int | ~string
+	Source     string // the constraint as written in the source, may be empty
+}
+
+// ConstraintString returns the constraint of the type parameter, falling
+// back to its source when it isn't modeled.
+func (tp *TypeParam) ConstraintString(pm map[string]string, pkgOverride string) string {
+	if tp.Constraint == nil {
+		return tp.Source
+	}
+	return tp.Constraint.String(pm, pkgOverride)
+}
+
 // Method is a single method of an interface.
 type Method struct {
-	Name     string
-	Doc      []string
-	Comment  string
-	In, Out  []*Parameter
-	Variadic *Parameter // may be nil
+	Name       string
+	Doc        []string
+	Comment    string
+	Directives map[string]string // //implgen:key=value comments, may be nil
+	In, Out    []*Parameter
+	Variadic   *Parameter // may be nil
+	File       string     // file declaring the method, may be empty, e.g. in reflect mode
+	Line       int        // line of the declaration in File
+}
+
+// HasContext returns whether the first parameter of the method is a
+// context.Context.
+func (m *Method) HasContext() bool {
+	if len(m.In) == 0 {
+		return false
+	}
+	nt, ok := m.In[0].Type.(*NamedType)
+	return ok && nt.Package == "context" && nt.Type == "Context"
 }
 
 // Print writes the method name and its signature.
@@ -124,6 +294,44 @@ func (m *Method) addImports(im map[string]bool) {
 	}
 }
 
+func (m *Method) walk(visitor func(Type) bool) {
+	walkParams(m.In, visitor)
+	if m.Variadic != nil {
+		m.Variadic.Type.walk(visitor)
+	}
+	walkParams(m.Out, visitor)
+}
+
+// Instantiate returns a copy of the method whose references to the type
+// parameters named in args are replaced with the corresponding types, e.g.
+// to embed an instantiation of a generic interface.
+func (m *Method) Instantiate(args map[string]Type) *Method {
+	im := *m
+	im.In = substParams(m.In, args)
+	im.Out = substParams(m.Out, args)
+	if m.Variadic != nil {
+		im.Variadic = &Parameter{Name: m.Variadic.Name, Type: m.Variadic.Type.subst(args)}
+	}
+	return &im
+}
+
+func substParams(params []*Parameter, args map[string]Type) []*Parameter {
+	if params == nil {
+		return nil
+	}
+	sp := make([]*Parameter, len(params))
+	for i, p := range params {
+		sp[i] = &Parameter{Name: p.Name, Type: p.Type.subst(args)}
+	}
+	return sp
+}
+
+func walkParams(params []*Parameter, visitor func(Type) bool) {
+	for _, p := range params {
+		p.Type.walk(visitor)
+	}
+}
+
 // Parameter is an argument or return parameter of a method.
 type Parameter struct {
 	Name string // may be empty
@@ -142,16 +350,53 @@ func (p *Parameter) Print(w io.Writer) {
 // Type is a Go type.
 type Type interface {
 	String(pm map[string]string, pkgOverride string) string
+	// ZeroValue returns the literal zero value of the type, or the empty
+	// string if it can't be expressed as a literal without more knowledge.
+	ZeroValue(pm map[string]string, pkgOverride string) string
 	addImports(im map[string]bool)
+	walk(visitor func(Type) bool)
+	// subst returns the type with the type parameters named in args
+	// replaced with the corresponding types.
+	subst(args map[string]Type) Type
+	// equal reports whether the type is identical to t, see TypesEqual.
+	equal(t Type) bool
+}
+
+// TypesEqual reports whether a and b are identical types, comparing them
+// structurally: named types by package, name and type arguments, the other
+// composite types by their elements. The parameter names of func types
+// don't matter, and the predeclared aliases, e.g. any, are the types they
+// stand for.
+func TypesEqual(a, b Type) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.equal(b)
+}
+
+// paramsEqual reports whether the parameters have identical types,
+// regardless of their names.
+func paramsEqual(ps1, ps2 []*Parameter) bool {
+	if len(ps1) != len(ps2) {
+		return false
+	}
+	for i := range ps1 {
+		if !TypesEqual(ps1[i].Type, ps2[i].Type) {
+			return false
+		}
+	}
+	return true
 }
 
 func init() {
 	gob.Register(&ArrayType{})
 	gob.Register(&ChanType{})
 	gob.Register(&FuncType{})
+	gob.Register(&InlineStructType{})
 	gob.Register(&MapType{})
 	gob.Register(&NamedType{})
 	gob.Register(&PointerType{})
+	gob.Register(&TypeParamRef{})
 
 	// Call gob.RegisterName to make sure it has the consistent name registered
 	// for both gob decoder and encoder.
@@ -177,8 +422,30 @@ func (at *ArrayType) String(pm map[string]string, pkgOverride string) string {
 	return s + at.Type.String(pm, pkgOverride)
 }
 
+func (at *ArrayType) ZeroValue(pm map[string]string, pkgOverride string) string {
+	if at.Len == -1 {
+		return "nil"
+	}
+	return at.String(pm, pkgOverride) + "{}"
+}
+
 func (at *ArrayType) addImports(im map[string]bool) { at.Type.addImports(im) }
 
+func (at *ArrayType) walk(visitor func(Type) bool) {
+	if visitor(at) {
+		at.Type.walk(visitor)
+	}
+}
+
+func (at *ArrayType) subst(args map[string]Type) Type {
+	return &ArrayType{Len: at.Len, Type: at.Type.subst(args)}
+}
+
+func (at *ArrayType) equal(t Type) bool {
+	at2, ok := t.(*ArrayType)
+	return ok && at.Len == at2.Len && TypesEqual(at.Type, at2.Type)
+}
+
 // ChanType is a channel type.
 type ChanType struct {
 	Dir  ChanDir // 0, 1 or 2
@@ -196,8 +463,25 @@ func (ct *ChanType) String(pm map[string]string, pkgOverride string) string {
 	return "chan " + s
 }
 
+func (ct *ChanType) ZeroValue(map[string]string, string) string { return "nil" }
+
 func (ct *ChanType) addImports(im map[string]bool) { ct.Type.addImports(im) }
 
+func (ct *ChanType) walk(visitor func(Type) bool) {
+	if visitor(ct) {
+		ct.Type.walk(visitor)
+	}
+}
+
+func (ct *ChanType) subst(args map[string]Type) Type {
+	return &ChanType{Dir: ct.Dir, Type: ct.Type.subst(args)}
+}
+
+func (ct *ChanType) equal(t Type) bool {
+	ct2, ok := t.(*ChanType)
+	return ok && ct.Dir == ct2.Dir && TypesEqual(ct.Type, ct2.Type)
+}
+
 // ChanDir is a channel direction.
 type ChanDir int
 
@@ -234,6 +518,8 @@ func (ft *FuncType) String(pm map[string]string, pkgOverride string) string {
 	return "func(" + strings.Join(args, ", ") + ")" + retString
 }
 
+func (ft *FuncType) ZeroValue(map[string]string, string) string { return "nil" }
+
 func (ft *FuncType) addImports(im map[string]bool) {
 	for _, p := range ft.In {
 		p.Type.addImports(im)
@@ -246,6 +532,33 @@ func (ft *FuncType) addImports(im map[string]bool) {
 	}
 }
 
+func (ft *FuncType) walk(visitor func(Type) bool) {
+	if !visitor(ft) {
+		return
+	}
+	walkParams(ft.In, visitor)
+	if ft.Variadic != nil {
+		ft.Variadic.Type.walk(visitor)
+	}
+	walkParams(ft.Out, visitor)
+}
+
+func (ft *FuncType) subst(args map[string]Type) Type {
+	sft := &FuncType{In: substParams(ft.In, args), Out: substParams(ft.Out, args)}
+	if ft.Variadic != nil {
+		sft.Variadic = &Parameter{Name: ft.Variadic.Name, Type: ft.Variadic.Type.subst(args)}
+	}
+	return sft
+}
+
+func (ft *FuncType) equal(t Type) bool {
+	ft2, ok := t.(*FuncType)
+	if !ok || !paramsEqual(ft.In, ft2.In) || !paramsEqual(ft.Out, ft2.Out) || (ft.Variadic == nil) != (ft2.Variadic == nil) {
+		return false
+	}
+	return ft.Variadic == nil || TypesEqual(ft.Variadic.Type, ft2.Variadic.Type)
+}
+
 // MapType is a map type.
 type MapType struct {
 	Key, Value Type
@@ -255,18 +568,111 @@ func (mt *MapType) String(pm map[string]string, pkgOverride string) string {
 	return "map[" + mt.Key.String(pm, pkgOverride) + "]" + mt.Value.String(pm, pkgOverride)
 }
 
+func (mt *MapType) ZeroValue(map[string]string, string) string { return "nil" }
+
 func (mt *MapType) addImports(im map[string]bool) {
 	mt.Key.addImports(im)
 	mt.Value.addImports(im)
 }
 
+func (mt *MapType) walk(visitor func(Type) bool) {
+	if visitor(mt) {
+		mt.Key.walk(visitor)
+		mt.Value.walk(visitor)
+	}
+}
+
+func (mt *MapType) subst(args map[string]Type) Type {
+	return &MapType{Key: mt.Key.subst(args), Value: mt.Value.subst(args)}
+}
+
+func (mt *MapType) equal(t Type) bool {
+	mt2, ok := t.(*MapType)
+	return ok && TypesEqual(mt.Key, mt2.Key) && TypesEqual(mt.Value, mt2.Value)
+}
+
+// InlineStructType is an unnamed struct type with fields, e.g. the type of
+// an options parameter struct{ Timeout int }. The empty struct is the
+// PredeclaredType "struct{}".
+type InlineStructType struct {
+	Fields []*Field
+}
+
+// Field is a field of an InlineStructType.
+type Field struct {
+	Name string // empty for an embedded field
+	Type Type
+	Tag  string // the raw tag literal, e.g. `json:"x"`, may be empty
+}
+
+func (st *InlineStructType) String(pm map[string]string, pkgOverride string) string {
+	fields := make([]string, len(st.Fields))
+	for i, f := range st.Fields {
+		field := f.Type.String(pm, pkgOverride)
+		if f.Name != "" {
+			field = f.Name + " " + field
+		}
+		if f.Tag != "" {
+			field += " " + f.Tag
+		}
+		fields[i] = field
+	}
+	return "struct{ " + strings.Join(fields, "; ") + " }"
+}
+
+func (st *InlineStructType) ZeroValue(pm map[string]string, pkgOverride string) string {
+	return st.String(pm, pkgOverride) + "{}"
+}
+
+func (st *InlineStructType) addImports(im map[string]bool) {
+	for _, f := range st.Fields {
+		f.Type.addImports(im)
+	}
+}
+
+func (st *InlineStructType) walk(visitor func(Type) bool) {
+	if !visitor(st) {
+		return
+	}
+	for _, f := range st.Fields {
+		f.Type.walk(visitor)
+	}
+}
+
+func (st *InlineStructType) subst(args map[string]Type) Type {
+	fields := make([]*Field, len(st.Fields))
+	for i, f := range st.Fields {
+		fields[i] = &Field{Name: f.Name, Type: f.Type.subst(args), Tag: f.Tag}
+	}
+	return &InlineStructType{Fields: fields}
+}
+
+func (st *InlineStructType) equal(t Type) bool {
+	st2, ok := t.(*InlineStructType)
+	if !ok || len(st.Fields) != len(st2.Fields) {
+		return false
+	}
+	for i, f := range st.Fields {
+		f2 := st2.Fields[i]
+		if f.Name != f2.Name || f.Tag != f2.Tag || !TypesEqual(f.Type, f2.Type) {
+			return false
+		}
+	}
+	return true
+}
+
 // NamedType is an exported type in a package.
 type NamedType struct {
-	Package string // may be empty
-	Type    string // TODO: should this be typed Type?
+	Package  string // may be empty
+	Type     string // TODO: should this be typed Type?
+	TypeArgs []Type // type arguments of an instantiated generic type, may be empty
 }
 
 func (nt *NamedType) String(pm map[string]string, pkgOverride string) string {
+	return nt.name(pm, pkgOverride) + nt.typeArgs(pm, pkgOverride)
+}
+
+func (nt *NamedType) name(pm map[string]string, pkgOverride string) string {
 	// TODO: is this right?
 	if pkgOverride == nt.Package {
 		return nt.Type
@@ -279,10 +685,71 @@ func (nt *NamedType) String(pm map[string]string, pkgOverride string) string {
 	return nt.Type
 }
 
+// typeArgs returns the type argument list of the type, e.g. "[int, V]", or
+// the empty string if it isn't instantiated.
+func (nt *NamedType) typeArgs(pm map[string]string, pkgOverride string) string {
+	if len(nt.TypeArgs) == 0 {
+		return ""
+	}
+	args := make([]string, len(nt.TypeArgs))
+	for i, t := range nt.TypeArgs {
+		args[i] = t.String(pm, pkgOverride)
+	}
+	return "[" + strings.Join(args, ", ") + "]"
+}
+
+// ZeroValue returns the empty string, since a named type may be backed by
+// anything from an interface to a struct.
+func (nt *NamedType) ZeroValue(map[string]string, string) string { return "" }
+
+// Imports returns the imports needed by the named type and its type
+// arguments as a set of import paths.
+func (nt *NamedType) Imports() map[string]bool {
+	im := make(map[string]bool)
+	nt.addImports(im)
+	return im
+}
+
 func (nt *NamedType) addImports(im map[string]bool) {
 	if nt.Package != "" {
 		im[nt.Package] = true
 	}
+	for _, t := range nt.TypeArgs {
+		t.addImports(im)
+	}
+}
+
+func (nt *NamedType) walk(visitor func(Type) bool) {
+	if !visitor(nt) {
+		return
+	}
+	for _, t := range nt.TypeArgs {
+		t.walk(visitor)
+	}
+}
+
+func (nt *NamedType) subst(args map[string]Type) Type {
+	if len(nt.TypeArgs) == 0 {
+		return nt
+	}
+	typeArgs := make([]Type, len(nt.TypeArgs))
+	for i, t := range nt.TypeArgs {
+		typeArgs[i] = t.subst(args)
+	}
+	return &NamedType{Package: nt.Package, Type: nt.Type, TypeArgs: typeArgs}
+}
+
+func (nt *NamedType) equal(t Type) bool {
+	nt2, ok := t.(*NamedType)
+	if !ok || nt.Package != nt2.Package || nt.Type != nt2.Type || len(nt.TypeArgs) != len(nt2.TypeArgs) {
+		return false
+	}
+	for i, arg := range nt.TypeArgs {
+		if !TypesEqual(arg, nt2.TypeArgs[i]) {
+			return false
+		}
+	}
+	return true
 }
 
 // PointerType is a pointer to another type.
@@ -293,13 +760,90 @@ type PointerType struct {
 func (pt *PointerType) String(pm map[string]string, pkgOverride string) string {
 	return "*" + pt.Type.String(pm, pkgOverride)
 }
-func (pt *PointerType) addImports(im map[string]bool) { pt.Type.addImports(im) }
+func (pt *PointerType) ZeroValue(map[string]string, string) string { return "nil" }
+func (pt *PointerType) addImports(im map[string]bool)              { pt.Type.addImports(im) }
+func (pt *PointerType) walk(visitor func(Type) bool) {
+	if visitor(pt) {
+		pt.Type.walk(visitor)
+	}
+}
+func (pt *PointerType) subst(args map[string]Type) Type {
+	return &PointerType{Type: pt.Type.subst(args)}
+}
+func (pt *PointerType) equal(t Type) bool {
+	pt2, ok := t.(*PointerType)
+	return ok && TypesEqual(pt.Type, pt2.Type)
+}
+
+// TypeParamRef is a reference to a type parameter of the enclosing interface.
+type TypeParamRef struct {
+	Name string
+}
+
+func (tp *TypeParamRef) String(map[string]string, string) string { return tp.Name }
+
+// ZeroValue returns the empty string, since a type parameter may be
+// instantiated with any type.
+func (tp *TypeParamRef) ZeroValue(map[string]string, string) string { return "" }
+func (tp *TypeParamRef) addImports(map[string]bool)                 {}
+func (tp *TypeParamRef) walk(visitor func(Type) bool)               { visitor(tp) }
+func (tp *TypeParamRef) subst(args map[string]Type) Type {
+	if t, ok := args[tp.Name]; ok {
+		return t
+	}
+	return tp
+}
+func (tp *TypeParamRef) equal(t Type) bool {
+	tp2, ok := t.(*TypeParamRef)
+	return ok && tp.Name == tp2.Name
+}
 
 // PredeclaredType is a predeclared type such as "int".
 type PredeclaredType string
 
 func (pt PredeclaredType) String(map[string]string, string) string { return string(pt) }
-func (pt PredeclaredType) addImports(map[string]bool)              {}
+
+func (pt PredeclaredType) ZeroValue(map[string]string, string) string {
+	switch pt {
+	case "bool":
+		return "false"
+	case "string":
+		return `""`
+	case "int", "int8", "int16", "int32", "int64",
+		"uint", "uint8", "uint16", "uint32", "uint64", "uintptr",
+		"float32", "float64", "complex64", "complex128", "byte", "rune":
+		return "0"
+	case "error", "interface{}", "any":
+		return "nil"
+	case "struct{}":
+		return "struct{}{}"
+	}
+	return ""
+}
+
+func (pt PredeclaredType) addImports(map[string]bool)   {}
+func (pt PredeclaredType) walk(visitor func(Type) bool) { visitor(pt) }
+func (pt PredeclaredType) subst(map[string]Type) Type   { return pt }
+func (pt PredeclaredType) equal(t Type) bool {
+	pt2, ok := t.(PredeclaredType)
+	return ok && pt.unalias() == pt2.unalias()
+}
+
+// predeclaredAliases maps the predeclared aliases to the types they stand for.
+var predeclaredAliases = map[PredeclaredType]PredeclaredType{
+	"any":  "interface{}",
+	"byte": "uint8",
+	"rune": "int32",
+}
+
+// unalias returns the type the predeclared alias pt stands for, or pt if it
+// isn't an alias.
+func (pt PredeclaredType) unalias() PredeclaredType {
+	if t, ok := predeclaredAliases[pt]; ok {
+		return t
+	}
+	return pt
+}
 
 // The following code is intended to be called by the program generated by ../reflect.go.
 
@@ -330,6 +874,46 @@ func InterfaceFromInterfaceType(it reflect.Type) (*Interface, error) {
 	return intf, nil
 }
 
+// StructFromStructType returns the struct of the named struct type st, with
+// its named fields of a type implgen understands and the exported methods of
+// *st.
+func StructFromStructType(st reflect.Type) (*Struct, error) {
+	if st.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%v is not a struct", st)
+	}
+	s := &Struct{Name: st.Name(), Methods: make(map[string]*Method)}
+
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		if f.Anonymous {
+			continue
+		}
+		t, err := typeFromType(f.Type)
+		if err != nil {
+			// Like in source mode, the fields are only used by
+			// -accessors, which skips the fields it doesn't know about.
+			continue
+		}
+		s.Fields = append(s.Fields, &Parameter{Name: f.Name, Type: t})
+	}
+
+	pt := reflect.PtrTo(st)
+	for i := 0; i < pt.NumMethod(); i++ {
+		mt := pt.Method(i)
+		m := &Method{Name: mt.Name}
+		var err error
+		m.In, m.Variadic, m.Out, err = funcArgsFromType(mt.Type)
+		if err != nil {
+			return nil, err
+		}
+		m.In = m.In[1:] // the receiver
+		s.Methods[m.Name] = m
+		s.MethodNames = append(s.MethodNames, m.Name)
+	}
+
+	return s, nil
+}
+
 // t's Kind must be a reflect.Func.
 func funcArgsFromType(t reflect.Type) (in []*Parameter, variadic *Parameter, out []*Parameter, err error) {
 	nin := t.NumIn()
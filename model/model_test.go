@@ -34,3 +34,263 @@ func TestImpPath(t *testing.T) {
 		})
 	}
 }
+
+func TestMethod_HasContext(t *testing.T) {
+	ctx := &Parameter{Name: "ctx", Type: &NamedType{Package: "context", Type: "Context"}}
+	id := &Parameter{Name: "id", Type: PredeclaredType("int")}
+	testCases := []struct {
+		name string
+		in   []*Parameter
+		want bool
+	}{
+		{"no parameters", nil, false},
+		{"context first", []*Parameter{ctx, id}, true},
+		{"context last", []*Parameter{id, ctx}, false},
+		{"other Context", []*Parameter{{Type: &NamedType{Package: "example.com/context", Type: "Context"}}}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := (&Method{In: tc.in}).HasContext(); got != tc.want {
+				t.Errorf("HasContext() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWalk(t *testing.T) {
+	ctx := &NamedType{Package: "context", Type: "Context"}
+	pkg := &Package{
+		Interfaces: []*Interface{{
+			Name: "Foo",
+			Methods: []*Method{{
+				Name: "Get",
+				In:   []*Parameter{{Type: ctx}, {Type: &MapType{Key: PredeclaredType("string"), Value: &PointerType{Type: &NamedType{Type: "Box", TypeArgs: []Type{&NamedType{Type: "Item"}}}}}}},
+				Out:  []*Parameter{{Type: &FuncType{Out: []*Parameter{{Type: &NamedType{Type: "Result"}}}}}},
+			}},
+		}},
+		StructNames: []*Struct{{
+			Name:        "Bar",
+			Fields:      []*Parameter{{Name: "ch", Type: &ChanType{Type: &NamedType{Type: "Event"}}}},
+			Methods:     map[string]*Method{"Close": {Name: "Close", Variadic: &Parameter{Type: ctx}}},
+			MethodNames: []string{"Close"},
+		}},
+	}
+
+	count := func(descendInto func(Type) bool) int {
+		n := 0
+		Walk(pkg, func(t Type) bool {
+			if _, ok := t.(*NamedType); ok {
+				n++
+			}
+			return descendInto(t)
+		})
+		return n
+	}
+	if got := count(func(Type) bool { return true }); got != 6 {
+		t.Errorf("got %d named types, want 6", got)
+	}
+	skipFuncs := func(t Type) bool {
+		_, ok := t.(*FuncType)
+		return !ok
+	}
+	if got := count(skipFuncs); got != 5 {
+		t.Errorf("got %d named types outside of func types, want 5", got)
+	}
+}
+
+func TestPredeclaredType_ZeroValue(t *testing.T) {
+	testCases := []struct {
+		types []PredeclaredType
+		want  string
+	}{
+		{[]PredeclaredType{"bool"}, "false"},
+		{[]PredeclaredType{"string"}, `""`},
+		{[]PredeclaredType{
+			"int", "int8", "int16", "int32", "int64",
+			"uint", "uint8", "uint16", "uint32", "uint64", "uintptr",
+			"float32", "float64", "complex64", "complex128", "byte", "rune",
+		}, "0"},
+		{[]PredeclaredType{"error", "any", "interface{}"}, "nil"},
+		{[]PredeclaredType{"struct{}"}, "struct{}{}"},
+		// unexported named types of the source package
+		{[]PredeclaredType{"config"}, ""},
+	}
+	for _, tc := range testCases {
+		for _, pt := range tc.types {
+			if got := pt.ZeroValue(nil, ""); got != tc.want {
+				t.Errorf("PredeclaredType(%q).ZeroValue() = %q, want %q", pt, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestType_ZeroValueComposite(t *testing.T) {
+	foo := &NamedType{Package: "example.com/bar", Type: "Foo"}
+	pm := map[string]string{"example.com/bar": "bar"}
+	testCases := []struct {
+		typ  Type
+		want string
+	}{
+		{&ArrayType{Len: 3, Type: &PointerType{Type: foo}}, "[3]*bar.Foo{}"},
+		{&ArrayType{Len: 0, Type: PredeclaredType("string")}, "[0]string{}"},
+		{&ArrayType{Len: 2, Type: &ArrayType{Len: 4, Type: foo}}, "[2][4]bar.Foo{}"},
+		{&ArrayType{Len: 2, Type: &ArrayType{Len: -1, Type: PredeclaredType("byte")}}, "[2][]byte{}"},
+		{&ArrayType{Len: -1, Type: &PointerType{Type: foo}}, "nil"},
+		{&ArrayType{Len: -1, Type: &ArrayType{Len: 3, Type: foo}}, "nil"},
+		{&MapType{Key: PredeclaredType("string"), Value: &ArrayType{Len: -1, Type: &PointerType{Type: foo}}}, "nil"},
+		{&PointerType{Type: &ArrayType{Len: 3, Type: foo}}, "nil"},
+	}
+	for _, tc := range testCases {
+		if got := tc.typ.ZeroValue(pm, ""); got != tc.want {
+			t.Errorf("%v.ZeroValue() = %q, want %q", tc.typ.String(pm, ""), got, tc.want)
+		}
+	}
+}
+
+func TestFuncType_String(t *testing.T) {
+	ft := &FuncType{
+		In:       []*Parameter{{Type: PredeclaredType("int")}},
+		Variadic: &Parameter{Type: &NamedType{Package: "example.com/bar", Type: "Option"}},
+		Out:      []*Parameter{{Type: PredeclaredType("error")}},
+	}
+	pm := map[string]string{"example.com/bar": "bar"}
+	if got, want := ft.String(pm, ""), "func(int, ...bar.Option) error"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got, want := ft.ZeroValue(pm, ""), "nil"; got != want {
+		t.Errorf("ZeroValue() = %q, want %q", got, want)
+	}
+}
+
+func TestTypesEqual(t *testing.T) {
+	foo := &NamedType{Package: "example.com/bar", Type: "Foo"}
+	str := PredeclaredType("string")
+	param := func(name string, typ Type) *Parameter { return &Parameter{Name: name, Type: typ} }
+	testCases := []struct {
+		a, b Type
+		want bool
+	}{
+		{nil, nil, true},
+		{str, nil, false},
+		{nil, str, false},
+
+		{str, PredeclaredType("string"), true},
+		{str, PredeclaredType("int"), false},
+		{PredeclaredType("any"), PredeclaredType("interface{}"), true},
+		{PredeclaredType("byte"), PredeclaredType("uint8"), true},
+		{PredeclaredType("rune"), PredeclaredType("int32"), true},
+		{PredeclaredType("rune"), PredeclaredType("uint8"), false},
+		{str, foo, false},
+
+		{foo, &NamedType{Package: "example.com/bar", Type: "Foo"}, true},
+		{foo, &NamedType{Package: "example.com/baz", Type: "Foo"}, false},
+		{foo, &NamedType{Package: "example.com/bar", Type: "Bar"}, false},
+		{foo, &PointerType{Type: foo}, false},
+
+		{&PointerType{Type: foo}, &PointerType{Type: foo}, true},
+		{&PointerType{Type: foo}, &PointerType{Type: str}, false},
+		{&PointerType{Type: &PointerType{Type: str}}, &PointerType{Type: &PointerType{Type: str}}, true},
+		{&PointerType{Type: &PointerType{Type: str}}, &PointerType{Type: str}, false},
+
+		{&ArrayType{Len: 3, Type: str}, &ArrayType{Len: 3, Type: str}, true},
+		{&ArrayType{Len: 3, Type: str}, &ArrayType{Len: 4, Type: str}, false},
+		{&ArrayType{Len: -1, Type: str}, &ArrayType{Len: 3, Type: str}, false},
+		{&ArrayType{Len: -1, Type: PredeclaredType("byte")}, &ArrayType{Len: -1, Type: PredeclaredType("uint8")}, true},
+		{&ArrayType{Len: -1, Type: foo}, &ArrayType{Len: -1, Type: &PointerType{Type: foo}}, false},
+
+		{&MapType{Key: str, Value: foo}, &MapType{Key: str, Value: foo}, true},
+		{&MapType{Key: str, Value: foo}, &MapType{Key: PredeclaredType("int"), Value: foo}, false},
+		{&MapType{Key: str, Value: foo}, &MapType{Key: str, Value: str}, false},
+		{&MapType{Key: str, Value: &ArrayType{Len: -1, Type: foo}}, &MapType{Key: str, Value: &ArrayType{Len: -1, Type: foo}}, true},
+
+		{&ChanType{Dir: RecvDir, Type: str}, &ChanType{Dir: RecvDir, Type: str}, true},
+		{&ChanType{Dir: RecvDir, Type: str}, &ChanType{Dir: SendDir, Type: str}, false},
+		{&ChanType{Type: str}, &ChanType{Type: foo}, false},
+		{&ChanType{Type: &ChanType{Dir: SendDir, Type: foo}}, &ChanType{Type: &ChanType{Dir: SendDir, Type: foo}}, true},
+
+		{
+			&FuncType{In: []*Parameter{param("a", str)}, Out: []*Parameter{param("", foo)}},
+			&FuncType{In: []*Parameter{param("b", str)}, Out: []*Parameter{param("err", foo)}},
+			true,
+		},
+		{
+			&FuncType{In: []*Parameter{param("", str)}},
+			&FuncType{In: []*Parameter{param("", str), param("", str)}},
+			false,
+		},
+		{
+			&FuncType{In: []*Parameter{param("", str)}},
+			&FuncType{Out: []*Parameter{param("", str)}},
+			false,
+		},
+		{
+			&FuncType{Variadic: param("xs", PredeclaredType("any"))},
+			&FuncType{Variadic: param("ys", PredeclaredType("interface{}"))},
+			true,
+		},
+		{
+			&FuncType{Variadic: param("", str)},
+			&FuncType{In: []*Parameter{param("", &ArrayType{Len: -1, Type: str})}},
+			false,
+		},
+		{
+			&FuncType{Out: []*Parameter{param("", &FuncType{In: []*Parameter{param("", foo)}})}},
+			&FuncType{Out: []*Parameter{param("", &FuncType{In: []*Parameter{param("", &PointerType{Type: foo})}})}},
+			false,
+		},
+
+		{
+			&NamedType{Package: "example.com/bar", Type: "List", TypeArgs: []Type{str}},
+			&NamedType{Package: "example.com/bar", Type: "List", TypeArgs: []Type{str}},
+			true,
+		},
+		{
+			&NamedType{Package: "example.com/bar", Type: "List", TypeArgs: []Type{str}},
+			&NamedType{Package: "example.com/bar", Type: "List", TypeArgs: []Type{foo}},
+			false,
+		},
+		{
+			&NamedType{Package: "example.com/bar", Type: "List", TypeArgs: []Type{str}},
+			&NamedType{Package: "example.com/bar", Type: "List"},
+			false,
+		},
+		{
+			&NamedType{Package: "example.com/bar", Type: "Map", TypeArgs: []Type{str, &MapType{Key: str, Value: &PointerType{Type: foo}}}},
+			&NamedType{Package: "example.com/bar", Type: "Map", TypeArgs: []Type{str, &MapType{Key: str, Value: &PointerType{Type: foo}}}},
+			true,
+		},
+		{&TypeParamRef{Name: "T"}, &TypeParamRef{Name: "T"}, true},
+		{&TypeParamRef{Name: "T"}, &TypeParamRef{Name: "K"}, false},
+
+		{
+			&InlineStructType{Fields: []*Field{{Name: "A", Type: str, Tag: `json:"a"`}}},
+			&InlineStructType{Fields: []*Field{{Name: "A", Type: str, Tag: `json:"a"`}}},
+			true,
+		},
+		{
+			&InlineStructType{Fields: []*Field{{Name: "A", Type: str}}},
+			&InlineStructType{Fields: []*Field{{Name: "B", Type: str}}},
+			false,
+		},
+		{
+			&InlineStructType{Fields: []*Field{{Name: "A", Type: str, Tag: `json:"a"`}}},
+			&InlineStructType{Fields: []*Field{{Name: "A", Type: str}}},
+			false,
+		},
+	}
+	for _, tc := range testCases {
+		if got := TypesEqual(tc.a, tc.b); got != tc.want {
+			t.Errorf("TypesEqual(%v, %v) = %v, want %v", typeString(tc.a), typeString(tc.b), got, tc.want)
+		}
+		if got := TypesEqual(tc.b, tc.a); got != tc.want {
+			t.Errorf("TypesEqual(%v, %v) = %v, want %v", typeString(tc.b), typeString(tc.a), got, tc.want)
+		}
+	}
+}
+
+func typeString(t Type) string {
+	if t == nil {
+		return "nil"
+	}
+	return t.String(nil, "")
+}
@@ -23,12 +23,15 @@ import (
 	"go/ast"
 	"go/build"
 	"go/parser"
+	"go/printer"
 	"go/token"
+	"go/types"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -37,15 +40,34 @@ import (
 )
 
 var (
-	imports  = flag.String("imports", "", "(source mode) Comma-separated name=path pairs of explicit imports to use.")
-	auxFiles = flag.String("aux_files", "", "(source mode) Comma-separated pkg=path pairs of auxiliary Go source files.")
+	imports     = flag.String("imports", "", "(source mode) Comma-separated name=path pairs of explicit imports to use.")
+	auxFiles    = flag.String("aux_files", "", "(source mode) Comma-separated pkg=path pairs of auxiliary Go source files, or of import paths of auxiliary packages.")
+	importsFrom = flag.String("imports_from", "", "(source mode) Comma-separated Go source files whose imports are used to resolve package names.")
+	strict      = flag.Bool("strict", false, "(source mode) Fail rather than guess the name of an imported package from its path, or ignore a dot import that can't be resolved.")
+
+	implement = flag.String("implement", "", "Comma-separated interfaces of one package to implement, as importpath.Interface, parsed from the source of the package.")
+
+	inline        = flag.String("inline", "", "Go declarations of the interfaces to implement, optionally preceded by imports, e.g. 'type Foo interface { Bar(int) error }'.")
+	inlinePackage = flag.String("inline_package", "inline", "Name of the package the -inline declarations belong to, and the default output package.")
+
+	includeTests     = flag.Bool("include_tests", false, "(source mode) Also parse the _test.go files of the package of a -source directory, so that the interfaces they declare can be embedded and implemented.")
+	respectBuildTags = flag.Bool("respect_build_tags", false, "(source mode) Skip the files of a -source directory whose build constraints don't match GOOS and GOARCH.")
 )
 
 // TODO: simplify error reporting
 
-// sourceMode generates mocks via source file.
+// sourceMode generates mocks via source file. If source is a directory, all
+// of its non-test Go files are parsed as a single file.
 func sourceMode(source string) (*model.Package, error) {
+	isDir := false
+	if fi, err := os.Stat(source); err == nil && fi.IsDir() {
+		isDir = true
+	}
+
 	srcDir, err := filepath.Abs(filepath.Dir(source))
+	if isDir {
+		srcDir, err = filepath.Abs(source)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed getting source directory: %v", err)
 	}
@@ -56,35 +78,29 @@ func sourceMode(source string) (*model.Package, error) {
 	}
 
 	fs := token.NewFileSet()
-	file, err := parser.ParseFile(fs, source, nil, parser.ParseComments)
+	var file *ast.File
+	if isDir {
+		var ctxt *build.Context
+		if *respectBuildTags {
+			ctxt = &build.Default
+		}
+		file, err = parseSourceDir(fs, source, ctxt, *includeTests)
+	} else {
+		file, err = parser.ParseFile(fs, source, nil, parser.ParseComments)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed parsing source file %v: %v", source, err)
 	}
 
-	p := &fileParser{
-		fileSet:            fs,
-		imports:            make(map[string]importedPackage),
-		auxStruct:          make(map[string]map[string]namedStruct),
-		importedStruct:     make(map[string]map[string]namedStruct),
-		importedInterfaces: make(map[string]map[string]namedInterface),
-		auxInterfaces:      make(map[string]map[string]namedInterface),
-		srcDir:             srcDir,
-	}
+	p := newFileParser(fs, srcDir)
+	p.strict = *strict
 
 	// Handle -imports.
-	dotImports := make(map[string]bool)
-	if *imports != "" {
-		for _, kv := range strings.Split(*imports, ",") {
-			eq := strings.Index(kv, "=")
-			k, v := kv[:eq], kv[eq+1:]
-			if k == "." {
-				// TODO: Catch dupes?
-				dotImports[v] = true
-			} else {
-				// TODO: Catch dupes?
-				p.imports[k] = importedPkg{path: v}
-			}
-		}
+	p.addExplicitImports(*imports)
+
+	// Handle -imports_from.
+	if err := p.parseImportsFrom(*importsFrom); err != nil {
+		return nil, err
 	}
 
 	// Handle -aux_files.
@@ -93,24 +109,214 @@ func sourceMode(source string) (*model.Package, error) {
 	}
 	p.addAuxInterfacesFromFile(packageImport, file) // this file
 
-	pkg, err := p.parseFile(packageImport, file)
+	// The types of the -imports dot imports are qualified, so the generated
+	// code doesn't dot import them.
+	return p.parseFile(packageImport, file)
+}
+
+// addExplicitImports adds the comma-separated name=path pairs of -imports.
+func (p *fileParser) addExplicitImports(spec string) {
+	if spec == "" {
+		return
+	}
+	for _, kv := range strings.Split(spec, ",") {
+		eq := strings.Index(kv, "=")
+		k, v := kv[:eq], kv[eq+1:]
+		if k == "." {
+			// TODO: Catch dupes?
+			p.dotImports = append(p.dotImports, v)
+		} else {
+			// TODO: Catch dupes?
+			p.imports[k] = importedPkg{path: v}
+		}
+	}
+}
+
+// inlineMode loads the interfaces declared by snippet, Go declarations
+// optionally preceded by imports, as the source of a package named pkgName
+// without an import path.
+func inlineMode(snippet, pkgName string) (*model.Package, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed getting current directory: %v", err)
+	}
+	// The line directive makes the errors point into the snippet.
+	src := "package " + pkgName + "\n/*line inline:1:1*/" + snippet + "\n"
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, "inline.go", src, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing -inline: %v", err)
+	}
+	// Drop the directive, which would otherwise start the doc comment of
+	// the first declaration when it has one.
+	directive := file.Comments[0]
+	if directive.List = directive.List[1:]; len(directive.List) == 0 {
+		file.Comments = file.Comments[1:]
+	}
+
+	p := newFileParser(fs, wd)
+	p.addExplicitImports(*imports)
+	p.addAuxInterfacesFromFile("", file)
+	pkg, err := p.parseFile("", file)
 	if err != nil {
 		return nil, err
 	}
-	for pkgPath := range dotImports {
-		pkg.DotImports = append(pkg.DotImports, pkgPath)
+	if len(pkg.Interfaces) == 0 {
+		return nil, fmt.Errorf("no interface in -inline: %q", snippet)
+	}
+	return pkg, nil
+}
+
+// implementMode loads the interfaces of spec, a comma-separated list of
+// importpath.Interface symbols of a single package, from the source of their
+// package.
+func implementMode(spec string) (*model.Package, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed getting current directory: %v", err)
+	}
+	p := newFileParser(token.NewFileSet(), wd)
+
+	pkg := &model.Package{}
+	for _, sym := range strings.Split(spec, ",") {
+		dot := strings.LastIndex(sym, ".")
+		if dot <= 0 {
+			return nil, fmt.Errorf("bad interface %v, want importpath.Interface", sym)
+		}
+		pkgPath, name := sym[:dot], sym[dot+1:]
+		if pkg.PkgPath != "" && pkgPath != pkg.PkgPath {
+			return nil, fmt.Errorf("interfaces of several packages: %v and %v", pkg.PkgPath, pkgPath)
+		}
+		pkg.PkgPath = pkgPath
+
+		ip, err := p.parsePackage(pkgPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing package %v: %v", pkgPath, err)
+		}
+		ni, ok := ip.importedInterfaces[pkgPath][name]
+		if !ok {
+			return nil, fmt.Errorf("no interface %v in package %v", name, pkgPath)
+		}
+		intf, err := ip.parseInterface(name, pkgPath, ni)
+		if err != nil {
+			return nil, err
+		}
+		pkg.Interfaces = append(pkg.Interfaces, intf)
 	}
+	// Like in reflect mode, the actual name is set by defaultPackageName.
+	pkg.Name = path.Base(pkg.PkgPath)
 	return pkg, nil
 }
 
+// methodBody is the body of a function of a -bodies file, which is spliced
+// into the generated method the function is named after.
+type methodBody struct {
+	params  []string        // parameter names, the variadic one included, may be nil
+	stmts   string          // source of the statements, without the braces
+	imports map[string]bool // import paths of the packages used by stmts
+}
+
+// parseBodies parses the functions of fileName into method bodies, keyed by
+// function name, i.e. <Interface>_<Method>.
+func parseBodies(fileName string) (map[string]*methodBody, error) {
+	src, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, fileName, src, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing bodies file %v: %v", fileName, err)
+	}
+	fileImports, _ := importsOfFile(file)
+
+	bodies := make(map[string]*methodBody)
+	for _, decl := range file.Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if !ok || fd.Recv != nil || fd.Body == nil {
+			continue
+		}
+		body := &methodBody{
+			stmts:   strings.TrimSpace(string(src[fs.Position(fd.Body.Lbrace).Offset+1 : fs.Position(fd.Body.Rbrace).Offset])),
+			imports: make(map[string]bool),
+		}
+		for _, f := range fd.Type.Params.List {
+			if len(f.Names) == 0 {
+				body.params = nil
+				break
+			}
+			for _, name := range f.Names {
+				body.params = append(body.params, name.Name)
+			}
+		}
+		for _, name := range body.params {
+			if name == "_" {
+				// Unusable as argument names, keep the ones of the method.
+				body.params = nil
+				break
+			}
+		}
+		ast.Inspect(fd.Body, func(n ast.Node) bool {
+			if sel, ok := n.(*ast.SelectorExpr); ok {
+				if id, ok := sel.X.(*ast.Ident); ok && id.Obj == nil {
+					if imp, ok := fileImports[id.Name].(importedPkg); ok {
+						body.imports[imp.path] = true
+					}
+				}
+			}
+			return true
+		})
+		bodies[fd.Name.Name] = body
+	}
+	return bodies, nil
+}
+
+// parseSourceDir parses the non-test Go files of dir, which must all belong
+// to the same package, and merges them into a single file. If ctxt is not
+// nil, the files whose build constraints don't match it are skipped. With
+// tests, the _test.go files of the package are parsed too, but not those of
+// its external _test package.
+func parseSourceDir(fs *token.FileSet, dir string, ctxt *build.Context, tests bool) (*ast.File, error) {
+	pkgs, err := parser.ParseDir(fs, dir, func(fi os.FileInfo) bool {
+		if strings.HasSuffix(fi.Name(), "_test.go") && !tests {
+			return false
+		}
+		if ctxt != nil {
+			match, err := ctxt.MatchFile(dir, fi.Name())
+			return err == nil && match
+		}
+		return true
+	}, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range pkgs {
+		if tests && strings.HasSuffix(name, "_test") && pkgs[strings.TrimSuffix(name, "_test")] != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	switch len(names) {
+	case 0:
+		return nil, fmt.Errorf("no Go source files in %v", dir)
+	case 1:
+		return ast.MergePackageFiles(pkgs[names[0]], ast.FilterImportDuplicates), nil
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("found multiple packages in %v: %v", dir, strings.Join(names, ", "))
+}
+
 type importedPackage interface {
 	Path() string
 	Parser() *fileParser
 }
 
 type importedPkg struct {
-	path   string
-	parser *fileParser
+	path    string
+	parser  *fileParser
+	guessed bool // the name of the package is guessed from its path
 }
 
 func (i importedPkg) Path() string        { return i.path }
@@ -130,8 +336,44 @@ func (d duplicateImport) Error() string {
 	return fmt.Sprintf("%q is ambigous because of duplicate imports: %v", d.name, d.duplicates)
 }
 
-func (d duplicateImport) Path() string        { log.Fatal(d.Error()); return "" }
-func (d duplicateImport) Parser() *fileParser { log.Fatal(d.Error()); return nil }
+// Path and Parser are never used: callers report a duplicateImport as an
+// error with checkImport first.
+func (d duplicateImport) Path() string        { return "" }
+func (d duplicateImport) Parser() *fileParser { return nil }
+
+// resolveDuplicate returns the only one of the duplicate imports of d that
+// declares the type name, which the source must mean, with its parser. The
+// imports which can't be parsed are left out.
+func (p *fileParser) resolveDuplicate(d duplicateImport, name string) (importedPkg, bool) {
+	var found []importedPkg
+	for _, path := range d.duplicates {
+		ip, err := p.parsePackage(path)
+		if err != nil {
+			continue
+		}
+		if ip.typeNames[name] {
+			found = append(found, importedPkg{path: path, parser: ip})
+		}
+	}
+	if len(found) != 1 {
+		return importedPkg{}, false
+	}
+	return found[0], true
+}
+
+// checkImport returns a positioned error if imp is a duplicateImport, or
+// with -strict if the name of imp is guessed.
+func (p *fileParser) checkImport(pos token.Pos, imp importedPackage) error {
+	switch imp := imp.(type) {
+	case duplicateImport:
+		return p.errorf(pos, "%v", imp.Error())
+	case importedPkg:
+		if p.strict && imp.guessed {
+			return p.errorf(pos, "the name of package %v is guessed from its path, name the import or give it with -imports", imp.path)
+		}
+	}
+	return nil
+}
 
 type fileParser struct {
 	fileSet            *token.FileSet
@@ -143,9 +385,34 @@ type fileParser struct {
 	auxStruct     map[string]map[string]namedStruct    // package (or "") => name => struct
 	auxInterfaces map[string]map[string]namedInterface // package (or "") => name => interface
 
+	importFiles []*ast.File           // files whose imports are borrowed, see -imports_from
+	dotImports  []string              // import paths dot-imported by -imports, whose types resolve unqualified
+	fileDots    []string              // import paths dot-imported by the source file, whose interfaces it may embed unqualified
+	typeNames   map[string]bool       // exported type names of a package parsed by parsePackage
+	aliases     map[string]model.Type // exported type aliases of a package parsed by parsePackage => aliased type
+
+	packages   map[string]*fileParser // import path => parsed package, shared with the parsers of packages
+	typeParams map[string]bool        // type parameters of the interface being parsed, may be nil
+	strict     bool                   // fail rather than guess, see -strict
+	structs    map[string]bool        // "pkg.Name" of the structs being parsed, may be nil
+	interfaces map[string]bool        // "pkg.Name" of the interfaces being parsed, may be nil
+
 	srcDir string
 }
 
+func newFileParser(fs *token.FileSet, srcDir string) *fileParser {
+	return &fileParser{
+		fileSet:            fs,
+		imports:            make(map[string]importedPackage),
+		auxStruct:          make(map[string]map[string]namedStruct),
+		importedStruct:     make(map[string]map[string]namedStruct),
+		importedInterfaces: make(map[string]map[string]namedInterface),
+		auxInterfaces:      make(map[string]map[string]namedInterface),
+		packages:           make(map[string]*fileParser),
+		srcDir:             srcDir,
+	}
+}
+
 func (p *fileParser) errorf(pos token.Pos, format string, args ...interface{}) error {
 	ps := p.fileSet.Position(pos)
 	format = "%s:%d:%d: " + format
@@ -164,6 +431,15 @@ func (p *fileParser) parseAuxFiles(auxFiles string) error {
 			return fmt.Errorf("bad aux file spec: %v", kv)
 		}
 		pkg, fpath := parts[0], parts[1]
+		if !strings.HasSuffix(fpath, ".go") {
+			// An import path, whose whole package is the aux source.
+			ip, err := p.parsePackage(fpath)
+			if err != nil {
+				return fmt.Errorf("failed parsing aux package %v: %v", fpath, err)
+			}
+			p.imports[pkg] = importedPkg{path: fpath, parser: ip}
+			continue
+		}
 
 		file, err := parser.ParseFile(p.fileSet, fpath, nil, parser.ParseComments)
 		if err != nil {
@@ -175,6 +451,21 @@ func (p *fileParser) parseAuxFiles(auxFiles string) error {
 	return nil
 }
 
+func (p *fileParser) parseImportsFrom(files string) error {
+	files = strings.TrimSpace(files)
+	if files == "" {
+		return nil
+	}
+	for _, fpath := range strings.Split(files, ",") {
+		file, err := parser.ParseFile(p.fileSet, fpath, nil, parser.ImportsOnly)
+		if err != nil {
+			return err
+		}
+		p.importFiles = append(p.importFiles, file)
+	}
+	return nil
+}
+
 func (p *fileParser) addAuxInterfacesFromFile(pkg string, file *ast.File) {
 	if _, ok := p.auxStruct[pkg]; !ok {
 		p.auxStruct[pkg] = make(map[string]namedStruct)
@@ -195,15 +486,23 @@ func (p *fileParser) addAuxInterfacesFromFile(pkg string, file *ast.File) {
 // fileParser, parses all file interfaces and returns package model.
 func (p *fileParser) parseFile(importPath string, file *ast.File) (*model.Package, error) {
 	allImports, dotImports := importsOfFile(file)
+	p.fileDots = dotImports
+	if p.strict {
+		for _, path := range append(append([]string(nil), dotImports...), p.dotImports...) {
+			if _, err := p.parsePackage(path); err != nil {
+				return nil, fmt.Errorf("can't resolve dot import %v: %v", path, err)
+			}
+		}
+	}
 	// Don't stomp imports provided by -imports. Those should take precedence.
 	for pkg, pkgI := range allImports {
 		if _, ok := p.imports[pkg]; !ok {
 			p.imports[pkg] = pkgI
 		}
 	}
-	// Add imports from auxiliary files, which might be needed for embedded interfaces.
-	// Don't stomp any other imports.
-	for _, f := range p.auxFiles {
+	// Add imports from auxiliary files, which might be needed for embedded interfaces,
+	// and from the files given by -imports_from. Don't stomp any other imports.
+	for _, f := range append(p.auxFiles, p.importFiles...) {
 		auxImports, _ := importsOfFile(f)
 		for pkg, pkgI := range auxImports {
 			if _, ok := p.imports[pkg]; !ok {
@@ -229,32 +528,55 @@ func (p *fileParser) parseFile(importPath string, file *ast.File) (*model.Packag
 		}
 		ss = append(ss, i)
 	}
+
+	var fts []*model.FuncTypeDecl
+	for _, nf := range iterFuncTypes(file) {
+		f, err := p.parseFuncType(importPath, nf)
+		if err != nil {
+			return nil, err
+		}
+		fts = append(fts, f)
+	}
 	return &model.Package{
 		Name:        file.Name.String(),
 		PkgPath:     importPath,
 		Interfaces:  is,
 		StructNames: ss,
+		FuncTypes:   fts,
 		DotImports:  dotImports,
 	}, nil
 }
 
 // parsePackage loads package specified by path, parses it and returns
-// a new fileParser with the parsed imports and interfaces.
+// a new fileParser with the parsed imports and interfaces. A package is
+// parsed at most once, no matter how many parsers embed its interfaces.
 func (p *fileParser) parsePackage(path string) (*fileParser, error) {
-	newP := &fileParser{
-		fileSet:            token.NewFileSet(),
-		imports:            make(map[string]importedPackage),
-		auxStruct:          make(map[string]map[string]namedStruct),
-		importedStruct:     make(map[string]map[string]namedStruct),
-		importedInterfaces: make(map[string]map[string]namedInterface),
-		auxInterfaces:      make(map[string]map[string]namedInterface),
-		srcDir:             p.srcDir,
+	if p.packages == nil {
+		p.packages = make(map[string]*fileParser)
+	}
+	if newP, ok := p.packages[path]; ok {
+		return newP, nil
 	}
 
-	var pkgs map[string]*ast.Package
-	if imp, err := build.Import(path, newP.srcDir, build.FindOnly); err != nil {
-		return nil, err
-	} else if pkgs, err = parser.ParseDir(newP.fileSet, imp.Dir, nil, 0); err != nil {
+	newP := newFileParser(token.NewFileSet(), p.srcDir)
+	newP.packages = p.packages
+	newP.strict = p.strict
+	newP.typeNames = make(map[string]bool)
+	newP.aliases = make(map[string]model.Type)
+
+	// A vendored package, or one replaced by a local directory in go.mod,
+	// is looked up there, which build.Import fails to do for modules not
+	// required yet, or not downloadable, or with GOFLAGS=-mod=mod.
+	dir := localPackageDir(path, newP.srcDir)
+	if dir == "" {
+		imp, err := build.Import(path, newP.srcDir, build.FindOnly)
+		if err != nil {
+			return nil, err
+		}
+		dir = imp.Dir
+	}
+	pkgs, err := parser.ParseDir(newP.fileSet, dir, nil, 0)
+	if err != nil {
 		return nil, err
 	}
 
@@ -266,14 +588,69 @@ func (p *fileParser) parsePackage(path string) (*fileParser, error) {
 		for ni := range iterInterfaces(file) {
 			newP.importedInterfaces[path][ni.name.Name] = ni
 		}
+		if _, ok := newP.importedStruct[path]; !ok {
+			newP.importedStruct[path] = make(map[string]namedStruct)
+		}
+		for ns := range iterStruct(file) {
+			newP.importedStruct[path][ns.name.Name] = ns
+		}
+		for _, decl := range file.Decls {
+			if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.TYPE {
+				for _, spec := range gd.Specs {
+					if ts := spec.(*ast.TypeSpec); ts.Name.IsExported() {
+						newP.typeNames[ts.Name.Name] = true
+					}
+				}
+			}
+		}
 		imports, _ := importsOfFile(file)
 		for pkgName, pkgI := range imports {
 			newP.imports[pkgName] = pkgI
 		}
+		for _, decl := range file.Decls {
+			if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.TYPE {
+				for _, spec := range gd.Specs {
+					ts := spec.(*ast.TypeSpec)
+					if !ts.Assign.IsValid() || !ts.Name.IsExported() {
+						continue
+					}
+					// Aliases implgen can't parse are left out.
+					if t, err := newP.parseType(path, ts.Type); err == nil {
+						newP.aliases[ts.Name.Name] = t
+					}
+				}
+			}
+		}
 	}
+	p.packages[path] = newP
 	return newP, nil
 }
 
+// resolveAlias returns the type aliased by the named type, following the
+// aliases through the packages, e.g. to internal.Foo for a package
+// re-exporting it with type Foo = internal.Foo. It returns nt itself if it
+// isn't an alias.
+func (p *fileParser) resolveAlias(nt *model.NamedType) model.Type {
+	var t model.Type = nt
+	seen := make(map[string]bool)
+	for {
+		nt, ok := t.(*model.NamedType)
+		if !ok || nt.Package == "" || seen[nt.Package+"."+nt.Type] {
+			return t
+		}
+		seen[nt.Package+"."+nt.Type] = true
+		ip, err := p.parsePackage(nt.Package)
+		if err != nil {
+			return t
+		}
+		target, ok := ip.aliases[nt.Type]
+		if !ok {
+			return t
+		}
+		t = target
+	}
+}
+
 func (p *fileParser) parseStruct(name, pkg string, it namedStruct) (*model.Struct, error) {
 	intf := &model.Struct{Name: name, Methods: make(map[string]*model.Method)}
 
@@ -290,6 +667,40 @@ func (p *fileParser) parseStruct(name, pkg string, it namedStruct) (*model.Struc
 		// }
 	}
 
+	if p.structs == nil {
+		p.structs = make(map[string]bool)
+	}
+	p.structs[pkg+"."+name] = true
+	defer delete(p.structs, pkg+"."+name)
+
+	var embedded []*model.Struct
+	for _, field := range it.it.Fields.List {
+		if len(field.Names) == 0 {
+			if es := p.parseEmbeddedStruct(pkg, field.Type); es != nil {
+				embedded = append(embedded, es)
+			} else if ei, err := p.parseEmbeddedInterface(pkg, field.Type); err == nil {
+				// The methods of an embedded interface are promoted too,
+				// delegated to its value.
+				es := &model.Struct{Name: ei.Name, Methods: make(map[string]*model.Method)}
+				for _, m := range ei.Methods {
+					es.Methods[m.Name] = m
+					es.MethodNames = append(es.MethodNames, m.Name)
+				}
+				embedded = append(embedded, es)
+			}
+			continue
+		}
+		t, err := p.parseType(pkg, field.Type)
+		if err != nil {
+			// The fields are only used by -accessors, which skips the
+			// fields it doesn't know about rather than failing.
+			continue
+		}
+		for _, name := range field.Names {
+			intf.Fields = append(intf.Fields, &model.Parameter{Name: name.Name, Type: t})
+		}
+	}
+
 	for _, field := range it.methods {
 		m := &model.Method{
 			Name: field.Name.String(),
@@ -302,11 +713,98 @@ func (p *fileParser) parseStruct(name, pkg string, it namedStruct) (*model.Struc
 		}
 
 		intf.Methods[m.Name] = m
+		intf.MethodNames = append(intf.MethodNames, m.Name)
+	}
+
+	// Promote the methods of the embedded structs and interfaces, unless
+	// shadowed.
+	for _, es := range embedded {
+		for _, name := range es.MethodNames {
+			if _, ok := intf.Methods[name]; !ok {
+				intf.Methods[name] = es.Methods[name]
+				intf.MethodNames = append(intf.MethodNames, name)
+			}
+		}
 	}
 	return intf, nil
 }
 
+// parseEmbeddedStruct parses the struct embedded as typ, T or *T, in a struct
+// of package pkg. It returns nil if typ isn't a struct implgen can find.
+func (p *fileParser) parseEmbeddedStruct(pkg string, typ ast.Expr) *model.Struct {
+	if star, ok := typ.(*ast.StarExpr); ok {
+		typ = star.X
+	}
+	switch v := typ.(type) {
+	case *ast.Ident:
+		ns, ok := p.auxStruct[pkg][v.Name]
+		if !ok {
+			ns, ok = p.importedStruct[pkg][v.Name]
+		}
+		if !ok || p.structs[pkg+"."+v.Name] {
+			return nil
+		}
+		es, err := p.parseStruct(v.Name, pkg, ns)
+		if err != nil {
+			return nil
+		}
+		return es
+	case *ast.SelectorExpr:
+		fpkg, ok := v.X.(*ast.Ident)
+		if !ok {
+			return nil
+		}
+		epkg, ok := p.imports[fpkg.Name]
+		if !ok || p.checkImport(v.Pos(), epkg) != nil {
+			return nil
+		}
+		path, parser := epkg.Path(), epkg.Parser()
+		if parser == nil {
+			ip, err := p.parsePackage(path)
+			if err != nil {
+				return nil
+			}
+			parser = ip
+			p.imports[fpkg.Name] = importedPkg{path: path, parser: parser}
+		}
+		name := v.Sel.Name
+		ns, ok := parser.importedStruct[path][name]
+		if !ok {
+			// a struct re-exported by an alias, e.g. type Store = internal.Store
+			nt, isNamed := p.resolveAlias(&model.NamedType{Package: path, Type: name}).(*model.NamedType)
+			if !isNamed || nt.Package == path && nt.Type == name {
+				return nil
+			}
+			ip, err := p.parsePackage(nt.Package)
+			if err != nil {
+				return nil
+			}
+			parser, path, name = ip, nt.Package, nt.Type
+			if ns, ok = parser.importedStruct[path][name]; !ok {
+				return nil
+			}
+		}
+		es, err := parser.parseStruct(name, path, ns)
+		if err != nil {
+			return nil
+		}
+		return es
+	}
+	return nil
+}
+
 func (p *fileParser) parseInterface(name, pkg string, it namedInterface) (*model.Interface, error) {
+	// An interface embedding itself, directly or through the interfaces it
+	// embeds, isn't valid Go and must not be expanded forever.
+	if p.interfaces[pkg+"."+name] {
+		return nil, p.errorf(it.name.Pos(), "invalid recursive interface %v embeds itself", name)
+	}
+	if p.interfaces == nil {
+		p.interfaces = make(map[string]bool)
+	}
+	p.interfaces[pkg+"."+name] = true
+	defer delete(p.interfaces, pkg+"."+name)
+
 	intf := &model.Interface{Name: name}
 
 	if nil != it.doc {
@@ -322,14 +820,34 @@ func (p *fileParser) parseInterface(name, pkg string, it namedInterface) (*model
 		// }
 	}
 
+	intf.Directives = parseDirectives(it.doc, it.comment)
+
+	// The type parameters are only in scope within this interface.
+	defer func(typeParams map[string]bool) { p.typeParams = typeParams }(p.typeParams)
+	var err error
+	if intf.TypeParams, err = p.parseTypeParams(pkg, it.typeParams); err != nil {
+		return nil, err
+	}
+
+	var positions []token.Pos // positions of the fields declaring intf.Methods
+	var term ast.Expr         // first type term, e.g. ~int, may be nil
 	for _, field := range it.it.Methods.List {
+		if isTypeTerm(field) {
+			if term == nil {
+				term = field.Type
+			}
+			continue
+		}
 		switch v := field.Type.(type) {
 		case *ast.FuncType:
 			if nn := len(field.Names); nn != 1 {
-				return nil, fmt.Errorf("expected one name for interface %v, got %d", intf.Name, nn)
+				return nil, p.errorf(field.Pos(), "expected one name for interface %v, got %d", intf.Name, nn)
 			}
+			pos := p.fileSet.Position(field.Pos())
 			m := &model.Method{
 				Name: field.Names[0].String(),
+				File: pos.Filename,
+				Line: pos.Line,
 			}
 
 			if nil != field.Doc {
@@ -344,6 +862,7 @@ func (p *fileParser) parseInterface(name, pkg string, it namedInterface) (*model
 				// 	m.Comment = append(m.Comment, comment.Text)
 				// }
 			}
+			m.Directives = parseDirectives(field.Doc, field.Comment)
 
 			var err error
 			m.In, m.Variadic, m.Out, err = p.parseFunc(pkg, v)
@@ -351,67 +870,233 @@ func (p *fileParser) parseInterface(name, pkg string, it namedInterface) (*model
 				return nil, err
 			}
 			intf.Methods = append(intf.Methods, m)
-		case *ast.Ident:
-			// Embedded interface in this package.
-			ei := p.auxInterfaces[pkg][v.String()]
-			if ei.it == nil {
-				if ei = p.importedInterfaces[pkg][v.String()]; ei.it == nil {
-					return nil, p.errorf(v.Pos(), "unknown embedded interface %s", v.String())
-				}
-			}
-			eintf, err := p.parseInterface(v.String(), pkg, ei)
+		case *ast.Ident, *ast.SelectorExpr:
+			eintf, err := p.parseEmbeddedInterface(pkg, v)
 			if err != nil {
 				return nil, err
 			}
 			// Copy the methods.
-			// TODO: apply shadowing rules.
 			intf.Methods = append(intf.Methods, eintf.Methods...)
-		case *ast.SelectorExpr:
-			// Embedded interface in another package.
-			fpkg, sel := v.X.(*ast.Ident).String(), v.Sel.String()
-			epkg, ok := p.imports[fpkg]
-			if !ok {
-				return nil, p.errorf(v.X.Pos(), "unknown package %s", fpkg)
+			intf.Embeds = append(intf.Embeds, p.embeddedName(pkg, v))
+			if eintf.Constraint && term == nil {
+				term = v
+			}
+		case *ast.IndexExpr:
+			methods, err := p.parseEmbeddedInstance(pkg, v.X, []ast.Expr{v.Index})
+			if err != nil {
+				return nil, err
+			}
+			intf.Methods = append(intf.Methods, methods...)
+			name, err := p.embeddedInstanceName(pkg, v.X, []ast.Expr{v.Index})
+			if err != nil {
+				return nil, err
 			}
+			intf.Embeds = append(intf.Embeds, name)
+		case *ast.IndexListExpr:
+			methods, err := p.parseEmbeddedInstance(pkg, v.X, v.Indices)
+			if err != nil {
+				return nil, err
+			}
+			intf.Methods = append(intf.Methods, methods...)
+			name, err := p.embeddedInstanceName(pkg, v.X, v.Indices)
+			if err != nil {
+				return nil, err
+			}
+			intf.Embeds = append(intf.Embeds, name)
+		case *ast.InterfaceType:
+			// Embedded interface literal.
+			if v.Methods != nil && len(v.Methods.List) > 0 {
+				return nil, p.errorf(v.Pos(), "can't handle non-empty embedded interface literals")
+			}
+		default:
+			return nil, p.errorf(field.Pos(), "don't know how to mock method of type %T", field.Type)
+		}
+		for len(positions) < len(intf.Methods) {
+			positions = append(positions, field.Pos())
+		}
+	}
+	if term != nil {
+		if len(intf.Methods) == 0 {
+			intf.Constraint = true
+			return intf, nil
+		}
+		// A constraint with methods can't be implemented either.
+		if err := p.approximationError(term); err != nil {
+			return nil, err
+		}
+		return nil, p.errorf(term.Pos(), "type terms are only valid in type constraints, can't implement %v", intf.Name)
+	}
+	if err := p.dedupMethods(intf, positions); err != nil {
+		return nil, err
+	}
+	return intf, nil
+}
 
-			var eintf *model.Interface
-			var err error
-			ei := p.auxInterfaces[fpkg][sel]
-			if ei.it != nil {
-				eintf, err = p.parseInterface(sel, fpkg, ei)
-				if err != nil {
-					return nil, err
-				}
-			} else {
-				path := epkg.Path()
-				parser := epkg.Parser()
-				if parser == nil {
-					ip, err := p.parsePackage(path)
-					if err != nil {
-						return nil, p.errorf(v.Pos(), "could not parse package %s: %v", path, err)
-					}
-					parser = ip
-					p.imports[fpkg] = importedPkg{
-						path:   epkg.Path(),
-						parser: parser,
-					}
+// dedupMethods drops the methods of intf declared again with the same
+// signature, e.g. by two embedded interfaces, and reports the ones declared
+// again with another signature, which wouldn't compile. positions holds the
+// position of the interface field declaring every method.
+func (p *fileParser) dedupMethods(intf *model.Interface, positions []token.Pos) error {
+	first := make(map[string]int) // method name => index of its first declaration
+	methods := make([]*model.Method, 0, len(intf.Methods))
+	for i, m := range intf.Methods {
+		j, ok := first[m.Name]
+		if !ok {
+			first[m.Name] = i
+			methods = append(methods, m)
+			continue
+		}
+		if !sameSignature(intf.Methods[j], m) {
+			ps := p.fileSet.Position(positions[j])
+			return p.errorf(positions[i], "duplicate method %v of interface %v with another signature than at %s:%d:%d",
+				m.Name, intf.Name, ps.Filename, ps.Line, ps.Column)
+		}
+	}
+	intf.Methods = methods
+	return nil
+}
+
+// sameSignature reports whether the methods have the same parameter and
+// result types, regardless of their names.
+func sameSignature(m1, m2 *model.Method) bool {
+	return model.TypesEqual(
+		&model.FuncType{In: m1.In, Variadic: m1.Variadic, Out: m1.Out},
+		&model.FuncType{In: m2.In, Variadic: m2.Variadic, Out: m2.Out})
+}
+
+// parseEmbeddedInterface parses the interface embedded as expr, an
+// identifier or a qualified identifier, in an interface of package pkg.
+func (p *fileParser) parseEmbeddedInterface(pkg string, expr ast.Expr) (*model.Interface, error) {
+	switch v := expr.(type) {
+	case *ast.Ident:
+		// Embedded interface in this package.
+		ei := p.auxInterfaces[pkg][v.String()]
+		if ei.it == nil {
+			if ei = p.importedInterfaces[pkg][v.String()]; ei.it == nil {
+				if parser, path, ei, ok := p.dotImportedInterface(v.Name); ok {
+					return parser.parseInterface(v.Name, path, ei)
 				}
-				if ei = parser.importedInterfaces[path][sel]; ei.it == nil {
-					return nil, p.errorf(v.Pos(), "unknown embedded interface %s.%s", path, sel)
+				methods, ok := predeclaredInterfaces[v.String()]
+				if !ok {
+					return nil, p.errorf(v.Pos(), "unknown embedded interface %s", v.String())
 				}
-				eintf, err = parser.parseInterface(sel, path, ei)
-				if err != nil {
-					return nil, err
+				return &model.Interface{Name: v.String(), Methods: methods}, nil
+			}
+		}
+		return p.parseInterface(v.String(), pkg, ei)
+	case *ast.SelectorExpr:
+		// Embedded interface in another package.
+		fpkg, sel := v.X.(*ast.Ident).String(), v.Sel.String()
+		// The aux files go first, as aux interfaces may embed the ones of
+		// other aux packages the source doesn't import.
+		if ei := p.auxInterfaces[fpkg][sel]; ei.it != nil {
+			return p.parseInterface(sel, fpkg, ei)
+		}
+		epkg, ok := p.imports[fpkg]
+		if !ok {
+			return nil, p.errorf(v.X.Pos(), "unknown package %s", fpkg)
+		}
+		if d, ok := epkg.(duplicateImport); ok {
+			if imp, ok := p.resolveDuplicate(d, sel); ok {
+				epkg = imp
+			}
+		}
+		if err := p.checkImport(v.X.Pos(), epkg); err != nil {
+			return nil, err
+		}
+		path := epkg.Path()
+		parser := epkg.Parser()
+		if parser == nil {
+			ip, err := p.parsePackage(path)
+			if err != nil {
+				return nil, p.errorf(v.Pos(), "could not parse package %s: %v", path, err)
+			}
+			parser = ip
+			p.imports[fpkg] = importedPkg{
+				path:   epkg.Path(),
+				parser: parser,
+			}
+		}
+		ei := parser.importedInterfaces[path][sel]
+		if ei.it == nil {
+			return nil, p.errorf(v.Pos(), "unknown embedded interface %s.%s", path, sel)
+		}
+		return parser.parseInterface(sel, path, ei)
+	}
+	return nil, p.errorf(expr.Pos(), "don't know how to embed %T", expr)
+}
+
+// embeddedName returns the name of the interface embedded as expr, already
+// resolved by parseEmbeddedInterface, in an interface of package pkg.
+func (p *fileParser) embeddedName(pkg string, expr ast.Expr) *model.NamedType {
+	switch v := expr.(type) {
+	case *ast.Ident:
+		if _, ok := predeclaredInterfaces[v.Name]; ok && p.auxInterfaces[pkg][v.Name].it == nil && p.importedInterfaces[pkg][v.Name].it == nil {
+			return &model.NamedType{Type: v.Name}
+		}
+		if p.auxInterfaces[pkg][v.Name].it == nil && p.importedInterfaces[pkg][v.Name].it == nil {
+			if _, path, _, ok := p.dotImportedInterface(v.Name); ok {
+				return &model.NamedType{Package: path, Type: v.Name}
+			}
+		}
+		return &model.NamedType{Package: pkg, Type: v.Name}
+	case *ast.SelectorExpr:
+		fpkg := v.X.(*ast.Ident).Name
+		if ip, ok := p.imports[fpkg]; ok {
+			if d, ok := ip.(duplicateImport); ok {
+				if imp, ok := p.resolveDuplicate(d, v.Sel.Name); ok {
+					ip = imp
 				}
 			}
-			// Copy the methods.
-			// TODO: apply shadowing rules.
-			intf.Methods = append(intf.Methods, eintf.Methods...)
-		default:
-			return nil, fmt.Errorf("don't know how to mock method of type %T", field.Type)
+			return &model.NamedType{Package: ip.Path(), Type: v.Sel.Name}
 		}
+		// An aux package the source doesn't import.
+		return &model.NamedType{Package: fpkg, Type: v.Sel.Name}
 	}
-	return intf, nil
+	return nil
+}
+
+// embeddedInstanceName returns the name of the instantiation of the generic
+// interface expr with the type arguments indices, embedded in an interface
+// of package pkg.
+func (p *fileParser) embeddedInstanceName(pkg string, expr ast.Expr, indices []ast.Expr) (*model.NamedType, error) {
+	name := p.embeddedName(pkg, expr)
+	for _, index := range indices {
+		arg, err := p.parseType(pkg, index)
+		if err != nil {
+			return nil, err
+		}
+		name.TypeArgs = append(name.TypeArgs, arg)
+	}
+	return name, nil
+}
+
+// parseEmbeddedInstance returns the methods of the instantiation of the
+// generic interface expr with the type arguments indices, embedded in an
+// interface of package pkg.
+func (p *fileParser) parseEmbeddedInstance(pkg string, expr ast.Expr, indices []ast.Expr) ([]*model.Method, error) {
+	eintf, err := p.parseEmbeddedInterface(pkg, expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(indices) != len(eintf.TypeParams) {
+		return nil, p.errorf(expr.Pos(), "%v has %d type parameters, got %d type arguments",
+			eintf.Name, len(eintf.TypeParams), len(indices))
+	}
+	args := make(map[string]model.Type, len(indices))
+	for i, index := range indices {
+		arg, err := p.parseType(pkg, index)
+		if err != nil {
+			return nil, err
+		}
+		args[eintf.TypeParams[i].Name] = arg
+	}
+
+	methods := make([]*model.Method, len(eintf.Methods))
+	for i, m := range eintf.Methods {
+		methods[i] = m.Instantiate(args)
+	}
+	return methods, nil
 }
 
 func (p *fileParser) parseFunc(pkg string, f *ast.FuncType) (in []*model.Parameter, variadic *model.Parameter, out []*model.Parameter, err error) {
@@ -514,11 +1199,20 @@ func (p *fileParser) parseType(pkg string, typ ast.Expr) (model.Type, error) {
 		}
 		return &model.FuncType{In: in, Out: out, Variadic: variadic}, nil
 	case *ast.Ident:
+		if p.typeParams[v.Name] {
+			return &model.TypeParamRef{Name: v.Name}, nil
+		}
 		if v.IsExported() {
+			if path, ok := p.dotImportedType(v.Name); ok {
+				return &model.NamedType{Package: path, Type: v.Name}, nil
+			}
 			// `pkg` may be an aliased imported pkg
 			// if so, patch the import w/ the fully qualified import
 			maybeImportedPkg, ok := p.imports[pkg]
 			if ok {
+				if err := p.checkImport(v.Pos(), maybeImportedPkg); err != nil {
+					return nil, err
+				}
 				pkg = maybeImportedPkg.Path()
 			}
 			// assume type in this package
@@ -548,6 +1242,14 @@ func (p *fileParser) parseType(pkg string, typ ast.Expr) (model.Type, error) {
 		if !ok {
 			return nil, p.errorf(v.Pos(), "unknown package %q", pkgName)
 		}
+		if d, ok := pkg.(duplicateImport); ok {
+			if imp, ok := p.resolveDuplicate(d, v.Sel.Name); ok {
+				return &model.NamedType{Package: imp.path, Type: v.Sel.String()}, nil
+			}
+		}
+		if err := p.checkImport(v.Pos(), pkg); err != nil {
+			return nil, err
+		}
 		return &model.NamedType{Package: pkg.Path(), Type: v.Sel.String()}, nil
 	case *ast.StarExpr:
 		t, err := p.parseType(pkg, v.X)
@@ -556,15 +1258,170 @@ func (p *fileParser) parseType(pkg string, typ ast.Expr) (model.Type, error) {
 		}
 		return &model.PointerType{Type: t}, nil
 	case *ast.StructType:
-		if v.Fields != nil && len(v.Fields.List) > 0 {
-			return nil, p.errorf(v.Pos(), "can't handle non-empty unnamed struct types")
+		if v.Fields == nil || len(v.Fields.List) == 0 {
+			return model.PredeclaredType("struct{}"), nil
+		}
+		st := &model.InlineStructType{}
+		for _, field := range v.Fields.List {
+			t, err := p.parseType(pkg, field.Type)
+			if err != nil {
+				return nil, err
+			}
+			var tag string
+			if field.Tag != nil {
+				tag = field.Tag.Value
+			}
+			if len(field.Names) == 0 {
+				// embedded field
+				st.Fields = append(st.Fields, &model.Field{Type: t, Tag: tag})
+			}
+			for _, name := range field.Names {
+				st.Fields = append(st.Fields, &model.Field{Name: name.Name, Type: t, Tag: tag})
+			}
 		}
-		return model.PredeclaredType("struct{}"), nil
+		return st, nil
 	case *ast.ParenExpr:
 		return p.parseType(pkg, v.X)
+	case *ast.IndexExpr:
+		return p.parseInstance(pkg, v.X, []ast.Expr{v.Index})
+	case *ast.IndexListExpr:
+		return p.parseInstance(pkg, v.X, v.Indices)
+	case *ast.UnaryExpr:
+		if v.Op == token.TILDE {
+			return nil, p.approximationError(v)
+		}
 	}
 
-	return nil, fmt.Errorf("don't know how to parse type %T", typ)
+	return nil, p.errorf(typ.Pos(), "don't know how to parse type %T", typ)
+}
+
+// dotImportedType returns the import path of the package dot imported by
+// -imports that declares the type name, if any.
+func (p *fileParser) dotImportedType(name string) (string, bool) {
+	for _, path := range p.dotImports {
+		ip, err := p.parsePackage(path)
+		if err != nil {
+			continue
+		}
+		if ip.typeNames[name] {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// dotImportedInterface returns the interface name declared by a package dot
+// imported by the source file or by -imports, along with the parser of the
+// package and its import path.
+func (p *fileParser) dotImportedInterface(name string) (*fileParser, string, namedInterface, bool) {
+	if !ast.IsExported(name) {
+		return nil, "", namedInterface{}, false
+	}
+	for _, path := range append(append([]string(nil), p.fileDots...), p.dotImports...) {
+		ip, err := p.parsePackage(path)
+		if err != nil {
+			continue
+		}
+		if ei := ip.importedInterfaces[path][name]; ei.it != nil {
+			return ip, path, ei, true
+		}
+	}
+	return nil, "", namedInterface{}, false
+}
+
+// parseInstance parses the instantiation of the generic type typ with the
+// type arguments indices, e.g. Box[int].
+func (p *fileParser) parseInstance(pkg string, typ ast.Expr, indices []ast.Expr) (model.Type, error) {
+	t, err := p.parseType(pkg, typ)
+	if err != nil {
+		return nil, err
+	}
+	var inst *model.NamedType
+	switch t := t.(type) {
+	case *model.NamedType:
+		inst = &model.NamedType{Package: t.Package, Type: t.Type}
+	case model.PredeclaredType:
+		// an unexported type of this package
+		inst = &model.NamedType{Type: string(t)}
+	default:
+		return nil, p.errorf(typ.Pos(), "can't instantiate non-generic type %v", t.String(nil, ""))
+	}
+	for _, index := range indices {
+		arg, err := p.parseType(pkg, index)
+		if err != nil {
+			return nil, err
+		}
+		inst.TypeArgs = append(inst.TypeArgs, arg)
+	}
+	return inst, nil
+}
+
+// predeclaredInterfaces holds the methods of the predeclared interfaces,
+// which may be embedded without being declared in any package.
+var predeclaredInterfaces = map[string][]*model.Method{
+	"any": nil,
+	"error": {
+		{Name: "Error", Out: []*model.Parameter{{Type: model.PredeclaredType("string")}}},
+	},
+}
+
+// isTypeTerm reports whether the interface element is a type term, only
+// valid in type constraints, e.g. ~int, int | string, []byte or int.
+func isTypeTerm(field *ast.Field) bool {
+	if len(field.Names) > 0 {
+		return false
+	}
+	switch v := field.Type.(type) {
+	case *ast.UnaryExpr, *ast.BinaryExpr, *ast.ParenExpr, *ast.StarExpr, *ast.ArrayType, *ast.MapType, *ast.ChanType, *ast.FuncType, *ast.StructType:
+		return true
+	case *ast.Ident:
+		// A predeclared type other than any, error and comparable.
+		tn, ok := types.Universe.Lookup(v.Name).(*types.TypeName)
+		return ok && !types.IsInterface(tn.Type())
+	}
+	return false
+}
+
+// approximationError reports the first ~T element of the expression, or nil
+// if there is none.
+func (p *fileParser) approximationError(expr ast.Expr) error {
+	var err error
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if v, ok := n.(*ast.UnaryExpr); ok && v.Op == token.TILDE {
+			err = p.errorf(v.Pos(), "approximation elements (~T) are only valid in type constraints")
+		}
+		return err == nil
+	})
+	return err
+}
+
+// directivePrefix starts an inline directive comment, e.g. //implgen:body=panic.
+const directivePrefix = "//implgen:"
+
+// parseDirectives collects the //implgen:key=value directives of the comment
+// groups. A directive without a value maps to the empty string.
+func parseDirectives(groups ...*ast.CommentGroup) map[string]string {
+	var directives map[string]string
+	for _, group := range groups {
+		if group == nil {
+			continue
+		}
+		for _, comment := range group.List {
+			if !strings.HasPrefix(comment.Text, directivePrefix) {
+				continue
+			}
+			kv := strings.SplitN(strings.TrimSpace(comment.Text[len(directivePrefix):]), "=", 2)
+			if directives == nil {
+				directives = make(map[string]string)
+			}
+			if len(kv) == 2 {
+				directives[kv[0]] = kv[1]
+			} else {
+				directives[kv[0]] = ""
+			}
+		}
+	}
+	return directives
 }
 
 // importsOfFile returns a map of package name to import path
@@ -583,6 +1440,7 @@ func importsOfFile(file *ast.File) (normalImports map[string]importedPackage, do
 	dotImports = make([]string, 0)
 	for _, is := range file.Imports {
 		var pkgName string
+		var guessed bool
 		importPath := is.Path.Value[1 : len(is.Path.Value)-1] // remove quotes
 
 		if is.Name != nil {
@@ -595,10 +1453,7 @@ func importsOfFile(file *ast.File) (normalImports map[string]importedPackage, do
 			pkg, ok := packagesName[importPath]
 			if !ok {
 				// Fallback to import path suffix. Note that this is uncertain.
-				_, last := path.Split(importPath)
-				// If the last path component has dots, the first dot-delimited
-				// field is used as the name.
-				pkgName = strings.SplitN(last, ".", 2)[0]
+				pkgName, guessed = guessPackageName(importPath), true
 			} else {
 				pkgName = pkg
 			}
@@ -621,18 +1476,51 @@ func importsOfFile(file *ast.File) (normalImports map[string]importedPackage, do
 					}
 				}
 			} else {
-				normalImports[pkgName] = importedPkg{path: importPath}
+				normalImports[pkgName] = importedPkg{path: importPath, guessed: guessed}
 			}
 		}
 	}
 	return
 }
 
+// versionElem matches the major version element ending a module path.
+var versionElem = regexp.MustCompile(`^v[0-9]+$`)
+
+// guessPackageName guesses the name of the package of importPath, when go
+// list can't tell it, from the usual naming conventions: the name is the
+// last path element, but a major version like /v2, up to its first dot,
+// e.g. yaml for gopkg.in/yaml.v2, without a go- prefix or a -go suffix,
+// e.g. bar for github.com/foo/go-bar. Packages named otherwise, e.g. foo
+// in github.com/foo/foo-lib, are guessed wrong, and their types must be
+// qualified by a named import, or their path given with -imports.
+func guessPackageName(importPath string) string {
+	elems := strings.Split(importPath, "/")
+	last := elems[len(elems)-1]
+	if len(elems) > 1 && versionElem.MatchString(last) {
+		last = elems[len(elems)-2]
+	}
+	last = strings.SplitN(last, ".", 2)[0]
+	if name := strings.TrimPrefix(last, "go-"); name != "" {
+		last = name
+	}
+	if name := strings.TrimSuffix(last, "-go"); name != "" {
+		last = name
+	}
+	return last
+}
+
 type namedInterface struct {
-	name    *ast.Ident
-	doc     *ast.CommentGroup
-	comment *ast.CommentGroup
-	it      *ast.InterfaceType
+	name       *ast.Ident
+	doc        *ast.CommentGroup
+	comment    *ast.CommentGroup
+	it         *ast.InterfaceType
+	typeParams *ast.FieldList // may be nil
+}
+type namedFuncType struct {
+	name       *ast.Ident
+	doc        *ast.CommentGroup
+	ft         *ast.FuncType
+	typeParams *ast.FieldList // may be nil
 }
 type namedStruct struct {
 	name    *ast.Ident
@@ -642,10 +1530,20 @@ type namedStruct struct {
 	methods []*ast.FuncDecl
 }
 
-// Create an iterator over all interfaces in file.
+// specDoc returns the doc comment of the type spec ts of gd. The doc comment
+// of a grouped declaration, type ( ... ), documents the group, not its specs.
+func specDoc(gd *ast.GenDecl, ts *ast.TypeSpec) *ast.CommentGroup {
+	if ts.Doc != nil || gd.Lparen.IsValid() {
+		return ts.Doc
+	}
+	return gd.Doc
+}
+
+// Create an iterator over all structs in file, in declaration order.
 func iterStruct(file *ast.File) <-chan namedStruct {
 	ch := make(chan namedStruct)
 	go func() {
+		var structs []*namedStruct // in declaration order
 		structMap := make(map[string]*namedStruct)
 		for _, decl := range file.Decls {
 			gd, ok := decl.(*ast.GenDecl)
@@ -662,7 +1560,9 @@ func iterStruct(file *ast.File) <-chan namedStruct {
 					continue
 				}
 
-				structMap[ts.Name.String()] = &namedStruct{ts.Name, gd.Doc, ts.Comment, it, []*ast.FuncDecl{}}
+				ns := &namedStruct{ts.Name, specDoc(gd, ts), ts.Comment, it, []*ast.FuncDecl{}}
+				structs = append(structs, ns)
+				structMap[ts.Name.String()] = ns
 			}
 		}
 
@@ -672,30 +1572,95 @@ func iterStruct(file *ast.File) <-chan namedStruct {
 				continue
 			}
 			if gd.Recv != nil && gd.Recv.List != nil && len(gd.Recv.List) > 0 {
-				field := gd.Recv.List[0]
-
-				typ := ""
-				switch v := field.Type.(type) {
-				case *ast.StarExpr:
-					typ = v.X.(*ast.Ident).Name
-				case *ast.Ident:
-					typ = v.Name
-				}
-
-				nameStruct := structMap[typ]
+				nameStruct := structMap[receiverTypeName(gd.Recv.List[0].Type)]
 				if nameStruct != nil {
 					nameStruct.methods = append(nameStruct.methods, gd)
 				}
 			}
-			for _, s := range structMap {
-				ch <- *s
-			}
+		}
+		for _, s := range structs {
+			ch <- *s
 		}
 		close(ch)
 	}()
 	return ch
 }
 
+// parseTypeParams parses the type parameter list fl, which may be nil, and
+// brings the type parameters in scope. The caller restores p.typeParams once
+// they are out of scope.
+func (p *fileParser) parseTypeParams(pkg string, fl *ast.FieldList) ([]*model.TypeParam, error) {
+	p.typeParams = nil
+	if fl == nil {
+		return nil, nil
+	}
+	p.typeParams = make(map[string]bool)
+	for _, field := range fl.List {
+		for _, name := range field.Names {
+			p.typeParams[name.Name] = true
+		}
+	}
+	var tps []*model.TypeParam
+	for _, field := range fl.List {
+		var source strings.Builder
+		if err := printer.Fprint(&source, p.fileSet, field.Type); err != nil {
+			return nil, err
+		}
+		// A constraint that can't be modeled, such as a union of
+		// approximation elements, is reproduced verbatim.
+		constraint, _ := p.parseType(pkg, field.Type)
+		for _, name := range field.Names {
+			tps = append(tps, &model.TypeParam{
+				Name:       name.Name,
+				Constraint: constraint,
+				Source:     source.String(),
+			})
+		}
+	}
+	return tps, nil
+}
+
+// parseFuncType parses the named function type nf.
+func (p *fileParser) parseFuncType(pkg string, nf namedFuncType) (*model.FuncTypeDecl, error) {
+	f := &model.FuncTypeDecl{Name: nf.name.Name}
+	if nf.doc != nil {
+		for _, comment := range nf.doc.List {
+			f.Doc = append(f.Doc, comment.Text)
+		}
+	}
+
+	// The type parameters are only in scope within this type.
+	defer func(typeParams map[string]bool) { p.typeParams = typeParams }(p.typeParams)
+	var err error
+	if f.TypeParams, err = p.parseTypeParams(pkg, nf.typeParams); err != nil {
+		return nil, err
+	}
+	pos := p.fileSet.Position(nf.name.Pos())
+	f.Signature = &model.Method{Name: f.Name, File: pos.Filename, Line: pos.Line}
+	if f.Signature.In, f.Signature.Variadic, f.Signature.Out, err = p.parseFunc(pkg, nf.ft); err != nil {
+		return nil, fmt.Errorf("function type %v: %v", f.Name, err)
+	}
+	return f, nil
+}
+
+// receiverTypeName returns the name of the type of the method receiver typ,
+// e.g. Box for *Box[T], or the empty string if it isn't a named type.
+func receiverTypeName(typ ast.Expr) string {
+	switch v := typ.(type) {
+	case *ast.Ident:
+		return v.Name
+	case *ast.StarExpr:
+		return receiverTypeName(v.X)
+	case *ast.ParenExpr:
+		return receiverTypeName(v.X)
+	case *ast.IndexExpr:
+		return receiverTypeName(v.X)
+	case *ast.IndexListExpr:
+		return receiverTypeName(v.X)
+	}
+	return ""
+}
+
 // Create an iterator over all interfaces in file.
 func iterInterfaces(file *ast.File) <-chan namedInterface {
 	ch := make(chan namedInterface)
@@ -715,7 +1680,7 @@ func iterInterfaces(file *ast.File) <-chan namedInterface {
 					continue
 				}
 
-				ch <- namedInterface{ts.Name, gd.Doc, ts.Comment, it}
+				ch <- namedInterface{ts.Name, specDoc(gd, ts), ts.Comment, it, ts.TypeParams}
 			}
 		}
 		close(ch)
@@ -723,6 +1688,28 @@ func iterInterfaces(file *ast.File) <-chan namedInterface {
 	return ch
 }
 
+// iterFuncTypes returns the named function types of file, in declaration
+// order.
+func iterFuncTypes(file *ast.File) []namedFuncType {
+	var fts []namedFuncType
+	for _, decl := range file.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts, ok := spec.(*ast.TypeSpec)
+			if !ok || ts.Assign.IsValid() {
+				continue
+			}
+			if ft, ok := ts.Type.(*ast.FuncType); ok {
+				fts = append(fts, namedFuncType{ts.Name, specDoc(gd, ts), ft, ts.TypeParams})
+			}
+		}
+	}
+	return fts
+}
+
 // isVariadic returns whether the function is variadic.
 func isVariadic(f *ast.FuncType) bool {
 	nargs := len(f.Params.List)
@@ -737,7 +1724,7 @@ func isVariadic(f *ast.FuncType) bool {
 func packageNameOfDir(srcDir string) (string, error) {
 	files, err := ioutil.ReadDir(srcDir)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
 	var goFilePath string
@@ -758,6 +1745,84 @@ func packageNameOfDir(srcDir string) (string, error) {
 	return packageImport, nil
 }
 
+// localPackageDir returns the directory of the package path if the module
+// containing srcDir contains it, vendors it, or replaces its module with a
+// local directory in go.mod, else the empty string.
+func localPackageDir(path, srcDir string) string {
+	if os.Getenv("GO111MODULE") == "off" {
+		return ""
+	}
+	for dir := srcDir; ; dir = filepath.Dir(dir) {
+		gomod := filepath.Join(dir, "go.mod")
+		data, err := ioutil.ReadFile(gomod)
+		if os.IsNotExist(err) {
+			if dir == filepath.Dir(dir) {
+				return ""
+			}
+			continue
+		} else if err != nil {
+			return ""
+		}
+		if mod := modfile.ModulePath(data); mod != "" && (path == mod || strings.HasPrefix(path, mod+"/")) {
+			pkgDir := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(path, mod)))
+			if fi, err := os.Stat(pkgDir); err == nil && fi.IsDir() {
+				return pkgDir
+			}
+		}
+		if vendored := vendoredDir(path, dir); vendored != "" {
+			return vendored
+		}
+		return replacedDir(path, dir, gomod, data)
+	}
+}
+
+// vendoredDir returns the directory of the package path in the vendor
+// directory of the module in modDir if vendor/modules.txt lists it, else the
+// empty string. build.Import bypasses the vendor directory whenever the go
+// command doesn't default to -mod=vendor, e.g. with GOFLAGS=-mod=mod.
+func vendoredDir(path, modDir string) string {
+	data, err := ioutil.ReadFile(filepath.Join(modDir, "vendor", "modules.txt"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// The packages are listed after the # lines of their modules.
+		if strings.TrimSpace(line) == path {
+			return filepath.Join(modDir, "vendor", filepath.FromSlash(path))
+		}
+	}
+	return ""
+}
+
+// replacedDir returns the directory of the package path if data, the go.mod
+// file gomod of the module in modDir, replaces its module with a local
+// directory, else the empty string.
+func replacedDir(path, modDir, gomod string, data []byte) string {
+	// Unlike Parse, ParseLax ignores replace directives.
+	f, err := modfile.Parse(gomod, data, nil)
+	if err != nil {
+		return ""
+	}
+	// The longest replaced module path containing the package wins.
+	var replace *modfile.Replace
+	for _, r := range f.Replace {
+		if !modfile.IsDirectoryPath(r.New.Path) || path != r.Old.Path && !strings.HasPrefix(path, r.Old.Path+"/") {
+			continue
+		}
+		if replace == nil || len(r.Old.Path) > len(replace.Old.Path) {
+			replace = r
+		}
+	}
+	if replace == nil {
+		return ""
+	}
+	dir := replace.New.Path
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(modDir, dir)
+	}
+	return filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(path, replace.Old.Path)))
+}
+
 var errOutsideGoPath = errors.New("Source directory is outside GOPATH")
 
 // parseImportPackage get package import path via source file
@@ -1,16 +1,35 @@
 package main
 
 import (
-	"go/ast"
+	"bytes"
+	"go/build"
 	"go/parser"
 	"go/token"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
+
+	"github.com/ssoor/implgen/model"
 )
 
+// parseSource parses src as a file of the package example.com/foo.
+func parseSource(t *testing.T, src string) (*model.Package, error) {
+	t.Helper()
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, "input.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	p := newFileParser(fs, ".")
+	p.addAuxInterfacesFromFile("example.com/foo", file)
+	return p.parseFile("example.com/foo", file)
+}
+
 func TestFileParser_ParseFile(t *testing.T) {
 	fs := token.NewFileSet()
 	file, err := parser.ParseFile(fs, "internal/tests/custom_package_name/greeter/greeter.go", nil, 0)
@@ -21,7 +40,7 @@ func TestFileParser_ParseFile(t *testing.T) {
 	p := fileParser{
 		fileSet:            fs,
 		imports:            make(map[string]importedPackage),
-		importedInterfaces: make(map[string]map[string]*ast.InterfaceType),
+		importedInterfaces: make(map[string]map[string]namedInterface),
 	}
 
 	pkg, err := p.parseFile("", file)
@@ -52,7 +71,7 @@ func TestFileParser_ParsePackage(t *testing.T) {
 	p := fileParser{
 		fileSet:            fs,
 		imports:            make(map[string]importedPackage),
-		importedInterfaces: make(map[string]map[string]*ast.InterfaceType),
+		importedInterfaces: make(map[string]map[string]namedInterface),
 	}
 
 	newP, err := p.parsePackage("github.com/ssoor/implgen/internal/tests/custom_package_name/greeter")
@@ -118,6 +137,94 @@ func Benchmark_parseFile(b *testing.B) {
 	}
 }
 
+func Benchmark_parseFileManyEmbeds(b *testing.B) {
+	source := "internal/tests/performance/many_embeds/many_embeds.go"
+	for n := 0; n < b.N; n++ {
+		if _, err := sourceMode(source); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// setEnv sets the environment variable key and returns a function restoring
+// its previous value.
+func setEnv(key, value string) func() {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestPackageNameOfDir_BadDir(t *testing.T) {
+	if _, err := packageNameOfDir(filepath.Join("testdata", "does-not-exist")); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
+
+func TestParseFile_DuplicateImport(t *testing.T) {
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, "input.go", `package foo
+
+type Foo interface {
+	Bar() client.Client
+}
+`, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	p := newFileParser(fs, ".")
+	p.imports["client"] = duplicateImport{name: "client", duplicates: []string{"a/client", "b/client"}}
+	_, err = p.parseFile("example.com/foo", file)
+	want := `input.go:4:8: "client" is ambigous because of duplicate imports: [a/client b/client]`
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v, want it to contain %q", err, want)
+	}
+}
+
+func TestSourceMode_DuplicateImportResolved(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "duplicate_import")
+	if err != nil {
+		t.Fatal("cannot create tempdir")
+	}
+	defer os.RemoveAll(srcDir)
+	for name, content := range map[string]string{
+		"go.mod":       "module example.com/api",
+		"a/store/a.go": "package store\n\ntype Item struct{}\n\ntype Closer interface { Close() error }",
+		"b/store/b.go": "package store\n\ntype Other struct{}",
+		"api/api.go":   "package api\n\nimport (\n\t\"example.com/api/a/store\"\n\t\"example.com/api/b/store\"\n)\n\ntype Getter interface {\n\tstore.Closer\n\tGet() store.Item\n}",
+	} {
+		path := filepath.Join(srcDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("error creating %s: %v", name, err)
+		}
+	}
+
+	pkg, err := sourceMode(filepath.Join(srcDir, "api", "api.go"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	intf := pkg.Interfaces[0]
+	if len(intf.Methods) != 2 {
+		t.Fatalf("got %v methods, want Close and Get", len(intf.Methods))
+	}
+	get := intf.Methods[1]
+	if nt, ok := get.Out[0].Type.(*model.NamedType); !ok || nt.Package != "example.com/api/a/store" || nt.Type != "Item" {
+		t.Errorf("got result type %#v, want example.com/api/a/store.Item", get.Out[0].Type)
+	}
+	if len(intf.Embeds) != 1 || intf.Embeds[0].Package != "example.com/api/a/store" {
+		t.Errorf("got embeds %v, want example.com/api/a/store.Closer", intf.Embeds)
+	}
+}
+
 func TestParsePackageImport(t *testing.T) {
 	testRoot, err := ioutil.TempDir("", "test_root")
 	if err != nil {
@@ -167,7 +274,7 @@ func TestParsePackageImport(t *testing.T) {
 	} {
 		t.Run(testCase.name, func(t *testing.T) {
 			for key, value := range testCase.envs {
-				os.Setenv(key, value)
+				defer setEnv(key, value)()
 			}
 			pkgPath, err := parsePackageImport(filepath.Clean(testCase.dir))
 			if err != testCase.err {
@@ -195,8 +302,8 @@ func TestParsePackageImport_FallbackGoPath(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	os.Setenv("GOPATH", goPath)
-	os.Setenv("GO111MODULE", "on")
+	defer setEnv("GOPATH", goPath)()
+	defer setEnv("GO111MODULE", "on")()
 	pkgPath, err := parsePackageImport(srcDir)
 	expected := "example.com/foo"
 	if pkgPath != expected {
@@ -237,11 +344,1316 @@ func TestParsePackageImport_FallbackMultiGoPath(t *testing.T) {
 	}()
 
 	goPaths := strings.Join(goPathList, string(os.PathListSeparator))
-	os.Setenv("GOPATH", goPaths)
-	os.Setenv("GO111MODULE", "on")
+	defer setEnv("GOPATH", goPaths)()
+	defer setEnv("GO111MODULE", "on")()
 	pkgPath, err := parsePackageImport(srcDir)
 	expected := "example.com/foo"
 	if pkgPath != expected {
 		t.Errorf("expect %s, got %s", expected, pkgPath)
 	}
 }
+
+func TestParseDirectives(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+type Foo interface {
+	// Bar does things.
+	//implgen:body=panic
+	Bar()
+	Baz() //implgen:body=zero
+	Qux()
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := map[string]map[string]string{
+		"Bar": {"body": "panic"},
+		"Baz": {"body": "zero"},
+		"Qux": nil,
+	}
+	for _, m := range pkg.Interfaces[0].Methods {
+		if !reflect.DeepEqual(m.Directives, want[m.Name]) {
+			t.Errorf("%s directives = %v, want %v", m.Name, m.Directives, want[m.Name])
+		}
+	}
+}
+
+func TestParseInterface_Approximation(t *testing.T) {
+	for _, test := range []struct {
+		name, elem, pos string
+	}{
+		{"single", "~int", "input.go:5:2"},
+		{"union", "int | ~string", "input.go:5:8"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseSource(t, "package foo\n\ntype Number interface {\n\tString() string\n\t"+test.elem+"\n}\n")
+			want := test.pos + ": approximation elements (~T) are only valid in type constraints"
+			if err == nil || err.Error() != want {
+				t.Errorf("got error %v, want %q", err, want)
+			}
+		})
+	}
+}
+
+func TestParseInterface_Constraint(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+type Number interface {
+	~int | ~float64
+}
+
+type Integer interface {
+	Number
+	int | int64
+}
+
+type Stringer interface {
+	String() string
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := map[string]bool{"Number": true, "Integer": true, "Stringer": false}
+	for _, intf := range pkg.Interfaces {
+		if intf.Constraint != want[intf.Name] {
+			t.Errorf("%v.Constraint = %v, want %v", intf.Name, intf.Constraint, want[intf.Name])
+		}
+	}
+
+	_, err = parseSource(t, "package foo\n\ntype Number interface {\n\tString() string\n\tint | int64\n}\n")
+	want2 := "input.go:5:2: type terms are only valid in type constraints, can't implement Number"
+	if err == nil || err.Error() != want2 {
+		t.Errorf("got error %v, want %q", err, want2)
+	}
+}
+
+func TestParseInterface_MixedConstraint(t *testing.T) {
+	for _, test := range []struct {
+		elems, want string
+	}{
+		{"~int\n\tFoo()", "input.go:4:2: approximation elements (~T) are only valid in type constraints"},
+		{"Foo()\n\t[]byte", "input.go:5:2: type terms are only valid in type constraints, can't implement Mixed"},
+		{"*int\n\tFoo()", "input.go:4:2: type terms are only valid in type constraints, can't implement Mixed"},
+		{"int\n\tFoo()", "input.go:4:2: type terms are only valid in type constraints, can't implement Mixed"},
+	} {
+		_, err := parseSource(t, "package foo\n\ntype Mixed interface {\n\t"+test.elems+"\n}\n")
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%q: got error %v, want %q", test.elems, err, test.want)
+		}
+	}
+
+	pkg, err := parseSource(t, `package foo
+
+type Bytes interface {
+	[]byte | string
+}
+
+type Pointer interface {
+	*int
+}
+
+type Int interface {
+	int
+}
+
+type Chan interface {
+	chan int | func()
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, intf := range pkg.Interfaces {
+		if !intf.Constraint {
+			t.Errorf("%v.Constraint = false, want true", intf.Name)
+		}
+	}
+}
+
+func TestParseInterface_RecursiveEmbedding(t *testing.T) {
+	for _, test := range []struct {
+		name, src, want string
+	}{
+		{
+			"direct",
+			"package foo\n\ntype A interface {\n\tB\n}\n\ntype B interface {\n\tA\n}\n",
+			"input.go:3:6: invalid recursive interface A embeds itself",
+		},
+		{
+			"through a type argument",
+			"package foo\n\ntype Node interface {\n\tCloner[Node]\n}\n\ntype Cloner[T any] interface {\n\tNode\n\tClone() T\n}\n",
+			"input.go:3:6: invalid recursive interface Node embeds itself",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseSource(t, test.src)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestParseInterface_EmbedPredeclared(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+type Foo interface {
+	any
+	interface{}
+	error
+	Bar()
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var names []string
+	for _, m := range pkg.Interfaces[0].Methods {
+		names = append(names, m.Name)
+	}
+	if want := []string{"Error", "Bar"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("methods = %v, want %v", names, want)
+	}
+}
+
+func TestParseInterface_DuplicateMethods(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+type Reader interface {
+	Read(p []byte) (int, error)
+	Close() error
+}
+
+type Closer interface {
+	Close() error
+}
+
+type ReadCloser interface {
+	Reader
+	Closer
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var names []string
+	for _, m := range pkg.Interfaces[2].Methods {
+		names = append(names, m.Name)
+	}
+	if want := []string{"Read", "Close"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("methods = %v, want %v", names, want)
+	}
+
+	_, err = parseSource(t, `package foo
+
+type Getter interface {
+	Get(key string) string
+}
+
+type IntGetter interface {
+	Get(key string) int
+}
+
+type Store interface {
+	Getter
+	IntGetter
+}
+`)
+	want := "input.go:13:2: duplicate method Get of interface Store with another signature than at input.go:12:2"
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %v", err, want)
+	}
+}
+
+func TestParseInterface_DuplicateMethodsStructural(t *testing.T) {
+	// The same signatures, spelled differently.
+	pkg, err := parseSource(t, `package foo
+
+type Visitor interface {
+	Visit(fn func(key string, value []byte) error, opts ...any) map[string]struct{ N int }
+}
+
+type OtherVisitor interface {
+	Visit(func(string, []uint8) error, ...interface{}) (counts map[string]struct{ N int })
+}
+
+type Both interface {
+	Visitor
+	OtherVisitor
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if methods := pkg.Interfaces[2].Methods; len(methods) != 1 {
+		t.Errorf("got %v methods, want the one Visit", len(methods))
+	}
+
+	// Signatures differing deep inside their types.
+	for _, test := range []struct{ a, b string }{
+		{"Do(ch <-chan int)", "Do(ch chan int)"},
+		{"Do(fn func(int) error)", "Do(fn func(int, ...int) error)"},
+		{"Do(fn func(int) error)", "Do(fn func(int) (int, error))"},
+		{"Do(m map[string][]int)", "Do(m map[string][2]int)"},
+		{"Do(s struct{ N int })", "Do(s struct{ M int })"},
+		{"Do(s struct{ N int `json:\"n\"` })", "Do(s struct{ N int })"},
+		{"Do(args ...int)", "Do(args []int)"},
+		{"Do(r rune)", "Do(b byte)"},
+	} {
+		_, err := parseSource(t, `package foo
+
+type A interface {
+	`+test.a+`
+}
+
+type B interface {
+	`+test.b+`
+}
+
+type Both interface {
+	A
+	B
+}
+`)
+		if err == nil || !strings.Contains(err.Error(), "duplicate method Do of interface Both with another signature") {
+			t.Errorf("%v and %v: got error %v, want a duplicate method", test.a, test.b, err)
+		}
+	}
+}
+
+func TestPackage_PrintDot(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+import "time"
+
+type Reader interface {
+	Read(p []byte) (int, error)
+}
+
+type Closer interface {
+	Close() error
+}
+
+type Store[T any] interface {
+	Get() T
+}
+
+type ReadCloser interface {
+	Reader
+	Closer
+	Store[Item]
+	error
+	Deadline() time.Time
+}
+
+type Item struct {
+	Next *Item
+	At   time.Time
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pkg.PkgPath = "example.com/foo"
+
+	var buf bytes.Buffer
+	pkg.PrintDot(&buf)
+	dot := buf.String()
+	for _, want := range []string{
+		"digraph \"foo\" {\n",
+		"\t\"Reader\" [shape=box];\n",
+		"\t\"Closer\" [shape=box];\n",
+		"\t\"Store\" [shape=box];\n",
+		"\t\"ReadCloser\" [shape=box];\n",
+		"\t\"Item\" [shape=ellipse];\n",
+		"\t\"ReadCloser\" -> \"Reader\" [label=\"embeds\"];\n",
+		"\t\"ReadCloser\" -> \"Closer\" [label=\"embeds\"];\n",
+		"\t\"ReadCloser\" -> \"Store\" [label=\"embeds\"];\n",
+		"\t\"ReadCloser\" -> \"error\" [label=\"embeds\"];\n",
+		"\t\"ReadCloser\" -> \"Item\" [style=dashed];\n",
+		"\t\"ReadCloser\" -> \"time.Time\" [style=dashed];\n",
+		"\t\"Item\" -> \"time.Time\" [style=dashed];\n",
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("graph doesn't contain %q:\n%s", want, dot)
+		}
+	}
+	if n := strings.Count(dot, "embeds"); n != 4 {
+		t.Errorf("graph has %d embed edges, want 4:\n%s", n, dot)
+	}
+}
+
+func TestParseStruct_MethodOrder(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+type Foo struct{}
+
+func (f *Foo) Zed()   {}
+func (f *Foo) Alpha() {}
+
+type Empty struct{}
+
+func (f Foo) Mid() {}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var names []string
+	for _, s := range pkg.StructNames {
+		names = append(names, s.Name)
+	}
+	if want := []string{"Foo", "Empty"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("structs = %v, want %v", names, want)
+	}
+	if want := []string{"Zed", "Alpha", "Mid"}; !reflect.DeepEqual(pkg.StructNames[0].MethodNames, want) {
+		t.Errorf("methods = %v, want %v", pkg.StructNames[0].MethodNames, want)
+	}
+}
+
+func TestParseStruct_GenericReceivers(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+type Box[T any] struct{ v T }
+
+func (b *Box[T]) Get() T   { return b.v }
+func (b Box[_]) Len() int { return 1 }
+
+type Pair[K comparable, V any] struct{}
+
+func (p *Pair[K, V]) Key() (k K) { return }
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	methods := make(map[string][]string)
+	for _, s := range pkg.StructNames {
+		methods[s.Name] = s.MethodNames
+	}
+	want := map[string][]string{
+		"Box":  {"Get", "Len"},
+		"Pair": {"Key"},
+	}
+	if !reflect.DeepEqual(methods, want) {
+		t.Errorf("methods = %v, want %v", methods, want)
+	}
+}
+
+func TestParseInterface_TypeParams(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+type Store[K comparable, V any] interface {
+	Get(key K) V
+	Keys() []K
+	Backend() Backend
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	intf := pkg.Interfaces[0]
+	wantParams := []*model.TypeParam{
+		{Name: "K", Constraint: model.PredeclaredType("comparable"), Source: "comparable"},
+		{Name: "V", Constraint: model.PredeclaredType("any"), Source: "any"},
+	}
+	if !reflect.DeepEqual(intf.TypeParams, wantParams) {
+		t.Errorf("type params = %v, want %v", intf.TypeParams, wantParams)
+	}
+
+	for _, test := range []struct {
+		typ  model.Type
+		want model.Type
+	}{
+		{intf.Methods[0].In[0].Type, &model.TypeParamRef{Name: "K"}},
+		{intf.Methods[0].Out[0].Type, &model.TypeParamRef{Name: "V"}},
+		{intf.Methods[1].Out[0].Type, &model.ArrayType{Len: -1, Type: &model.TypeParamRef{Name: "K"}}},
+		{intf.Methods[2].Out[0].Type, &model.NamedType{Package: "example.com/foo", Type: "Backend"}},
+	} {
+		if !reflect.DeepEqual(test.typ, test.want) {
+			t.Errorf("got type %#v, want %#v", test.typ, test.want)
+		}
+		if got, want := test.typ.String(nil, "example.com/foo"), test.want.String(nil, "example.com/foo"); got != want {
+			t.Errorf("type renders as %q, want %q", got, want)
+		}
+	}
+}
+
+func TestParseInterface_ConstraintSource(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+type Number[T any] interface {
+	Value() T
+}
+
+type Counter[T Number[int], N ~int | ~int64] interface {
+	Add(T, N)
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := []*model.TypeParam{
+		{
+			Name:       "T",
+			Constraint: &model.NamedType{Package: "example.com/foo", Type: "Number", TypeArgs: []model.Type{model.PredeclaredType("int")}},
+			Source:     "Number[int]",
+		},
+		// not modeled, reproduced verbatim
+		{Name: "N", Source: "~int | ~int64"},
+	}
+	if got := pkg.Interfaces[1].TypeParams; !reflect.DeepEqual(got, want) {
+		t.Errorf("type params = %v, want %v", got, want)
+	}
+	for i, wantString := range []string{"Number[int]", "~int | ~int64"} {
+		if got := pkg.Interfaces[1].TypeParams[i].ConstraintString(nil, "example.com/foo"); got != wantString {
+			t.Errorf("constraint %d renders as %q, want %q", i, got, wantString)
+		}
+	}
+}
+
+func TestParseInterface_EmbeddedInstance(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+type Store[K comparable, V any] interface {
+	Get(key K) (V, bool)
+	Range(f func(K, V) bool)
+}
+
+type IntStore interface {
+	Store[string, int]
+}
+
+type Named[V any] interface {
+	Store[string, []V]
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, test := range []struct {
+		intf string
+		want []string
+	}{
+		{"IntStore", []string{"Get(string) (int, bool)", "Range(func(string, int) bool)"}},
+		{"Named", []string{"Get(string) ([]V, bool)", "Range(func(string, []V) bool)"}},
+	} {
+		var intf *model.Interface
+		for _, it := range pkg.Interfaces {
+			if it.Name == test.intf {
+				intf = it
+			}
+		}
+		if intf == nil {
+			t.Fatalf("interface %v not found", test.intf)
+		}
+		var got []string
+		for _, m := range intf.Methods {
+			ft := &model.FuncType{In: m.In, Out: m.Out, Variadic: m.Variadic}
+			got = append(got, m.Name+strings.TrimPrefix(ft.String(nil, "example.com/foo"), "func"))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v methods = %q, want %q", test.intf, got, test.want)
+		}
+	}
+
+	// The generic interface itself is left alone.
+	if got := pkg.Interfaces[0].Methods[0].In[0].Type; !reflect.DeepEqual(got, &model.TypeParamRef{Name: "K"}) {
+		t.Errorf("Store.Get parameter = %#v, want K", got)
+	}
+}
+
+func TestParseInterface_EmbeddedInstanceArity(t *testing.T) {
+	_, err := parseSource(t, `package foo
+
+type Store[K comparable, V any] interface {
+	Get(key K) V
+}
+
+type IntStore interface {
+	Store[int]
+}
+`)
+	if err == nil || !strings.Contains(err.Error(), "Store has 2 type parameters, got 1 type arguments") {
+		t.Errorf("got error %v, want a type argument count error", err)
+	}
+}
+
+func TestParseInterface_GroupedDoc(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+// Storage interfaces.
+type (
+	// Reader reads.
+	Reader interface {
+		Read()
+	}
+
+	Writer interface{ Write() } // Writer writes.
+)
+
+// Closer closes.
+type Closer interface {
+	Close()
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := map[string]struct {
+		doc     []string
+		comment string
+	}{
+		"Reader": {doc: []string{"// Reader reads."}},
+		"Writer": {comment: "Writer writes.\n"},
+		"Closer": {doc: []string{"// Closer closes."}},
+	}
+	for _, intf := range pkg.Interfaces {
+		if !reflect.DeepEqual(intf.Doc, want[intf.Name].doc) || intf.Comment != want[intf.Name].comment {
+			t.Errorf("%v has doc %q and comment %q, want %q and %q",
+				intf.Name, intf.Doc, intf.Comment, want[intf.Name].doc, want[intf.Name].comment)
+		}
+	}
+}
+
+func TestParseType_UnknownType(t *testing.T) {
+	fs := token.NewFileSet()
+	expr, err := parser.ParseExprFrom(fs, "input.go", "List[1 + 2]", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	p := newFileParser(fs, ".")
+	_, err = p.parseType("example.com/foo", expr)
+	want := "input.go:1:6: don't know how to parse type *ast.BinaryExpr"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v, want it to contain %q", err, want)
+	}
+}
+
+func TestSourceMode_Directory(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "source_dir")
+	if err != nil {
+		t.Fatal("cannot create tempdir")
+	}
+	defer os.RemoveAll(srcDir)
+
+	for name, content := range map[string]string{
+		"go.mod":      "module example.com/api",
+		"foo.go":      "package api\n\n// Foo is documented.\ntype Foo interface { Foo() }",
+		"bar.go":      "package api\n\ntype Bar interface { Bar() }",
+		"foo_test.go": "package api_test\n\ntype Baz interface { Baz() }",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(srcDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("error creating %s: %v", name, err)
+		}
+	}
+
+	pkg, err := sourceMode(srcDir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if pkg.Name != "api" || pkg.PkgPath != "example.com/api" {
+		t.Errorf("got package %s (%s), want api (example.com/api)", pkg.Name, pkg.PkgPath)
+	}
+	var names []string
+	for _, intf := range pkg.Interfaces {
+		names = append(names, intf.Name)
+		if intf.Name == "Foo" && !reflect.DeepEqual(intf.Doc, []string{"// Foo is documented."}) {
+			t.Errorf("Foo doc = %q, want it preserved", intf.Doc)
+		}
+	}
+	if want := []string{"Bar", "Foo"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got interfaces %v, want %v", names, want)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(srcDir, "other.go"), []byte("package other"), 0644); err != nil {
+		t.Fatalf("error creating other.go: %v", err)
+	}
+	if _, err := sourceMode(srcDir); err == nil || !strings.Contains(err.Error(), "multiple packages") {
+		t.Errorf("expected multiple packages error, got %v", err)
+	}
+}
+
+func TestSourceMode_IncludeTests(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "include_tests")
+	if err != nil {
+		t.Fatal("cannot create tempdir")
+	}
+	defer os.RemoveAll(srcDir)
+
+	for name, content := range map[string]string{
+		"go.mod":           "module example.com/api",
+		"store.go":         "package api\n\ntype Store interface {\n\tResetter\n\tGet(key string) string\n}",
+		"store_test.go":    "package api\n\ntype Resetter interface { Reset() }",
+		"external_test.go": "package api_test\n\ntype Other interface { Other() }",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(srcDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("error creating %s: %v", name, err)
+		}
+	}
+	defer func(old bool) { *includeTests = old }(*includeTests)
+
+	*includeTests = false
+	if _, err := sourceMode(srcDir); err == nil || !strings.Contains(err.Error(), "unknown embedded interface Resetter") {
+		t.Errorf("expected Resetter to be unknown without -include_tests, got %v", err)
+	}
+
+	*includeTests = true
+	pkg, err := sourceMode(srcDir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var store *model.Interface
+	var names []string
+	for _, intf := range pkg.Interfaces {
+		names = append(names, intf.Name)
+		if intf.Name == "Store" {
+			store = intf
+		}
+	}
+	if want := []string{"Store", "Resetter"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("got interfaces %v, want %v", names, want)
+	}
+	var methods []string
+	for _, m := range store.Methods {
+		methods = append(methods, m.Name)
+	}
+	if want := []string{"Reset", "Get"}; !reflect.DeepEqual(methods, want) {
+		t.Errorf("got Store methods %v, want %v", methods, want)
+	}
+}
+
+func TestParseSourceDir_BuildTags(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "build_tags")
+	if err != nil {
+		t.Fatal("cannot create tempdir")
+	}
+	defer os.RemoveAll(srcDir)
+
+	for name, content := range map[string]string{
+		"api.go":         "package api\n\ntype API interface { Get() }",
+		"api_linux.go":   "package api\n\ntype Linux interface { Epoll() }",
+		"api_windows.go": "package api\n\ntype Windows interface { IOCP() }",
+		"tools.go":       "//go:build ignore\n\npackage main\n\ntype Tool interface { Run() }",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(srcDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctxt := build.Default
+	ctxt.GOOS, ctxt.GOARCH = "linux", "amd64"
+	file, err := parseSourceDir(token.NewFileSet(), srcDir, &ctxt, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var names []string
+	for ni := range iterInterfaces(file) {
+		names = append(names, ni.name.Name)
+	}
+	sort.Strings(names)
+	if want := []string{"API", "Linux"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("interfaces = %v, want %v", names, want)
+	}
+
+	if _, err := parseSourceDir(token.NewFileSet(), srcDir, nil, false); err == nil || !strings.Contains(err.Error(), "found multiple packages") {
+		t.Errorf("expected the ignored file to be parsed without build constraints, got %v", err)
+	}
+}
+
+func TestFileParser_ImportsFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imports_from")
+	if err != nil {
+		t.Fatal("cannot create tempdir")
+	}
+	defer os.RemoveAll(dir)
+	importsFile := filepath.Join(dir, "imports.go")
+	if err := ioutil.WriteFile(importsFile, []byte("package foo\n\nimport (\n\t\"io\"\n\tctx \"context\"\n)\n"), 0644); err != nil {
+		t.Fatalf("error creating imports.go: %v", err)
+	}
+
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, "input.go", `package foo
+
+type Foo interface {
+	Bar(c ctx.Context, r io.Reader)
+}
+`, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	p := newFileParser(fs, dir)
+	p.imports["io"] = importedPkg{path: "example.com/io"} // as given by -imports
+	if err := p.parseImportsFrom(importsFile); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pkg, err := p.parseFile("example.com/foo", file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	in := pkg.Interfaces[0].Methods[0].In
+	if got := in[0].Type.(*model.NamedType).Package; got != "context" {
+		t.Errorf("ctx resolved to %q, want context", got)
+	}
+	if got := in[1].Type.(*model.NamedType).Package; got != "example.com/io" {
+		t.Errorf("io resolved to %q, want the explicit import example.com/io", got)
+	}
+}
+
+func TestParseAuxFiles_ImportPath(t *testing.T) {
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, "input.go", `package foo
+
+type Foo interface {
+	ext.Foreign
+}
+`, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	p := newFileParser(fs, ".")
+	if err := p.parseAuxFiles("ext=github.com/ssoor/implgen/internal/tests/import_embedded_interface/faux"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pkg, err := p.parseFile("example.com/foo", file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if methods := pkg.Interfaces[0].Methods; len(methods) != 1 || methods[0].Name != "OtherErsatz" {
+		t.Errorf("expected the method OtherErsatz from ext.Foreign, got %v", methods)
+	}
+}
+
+func TestParseAuxFiles_NestedEmbeds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aux_files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A embeds B, which embeds C, each in an aux file of its own. B of the
+	// aux package base, which the source doesn't import, embeds base.D.
+	aux := []struct{ pkg, name, src string }{
+		{"ext", "a.go", "package ext\n\ntype A interface {\n\tB\n\tDo()\n}\n"},
+		{"ext", "b.go", "package ext\n\ntype B interface {\n\tC\n\tUndo()\n}\n"},
+		{"ext", "c.go", "package ext\n\ntype C interface {\n\tbase.D\n\tRedo()\n}\n"},
+		{"base", "d.go", "package base\n\ntype D interface {\n\tReset()\n}\n"},
+	}
+	var specs []string
+	for _, f := range aux {
+		path := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(path, []byte(f.src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		specs = append(specs, f.pkg+"="+path)
+	}
+
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, "input.go", `package foo
+
+import "unknown.invalid/ext"
+
+type Foo interface {
+	ext.A
+	Close()
+}
+`, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	p := newFileParser(fs, ".")
+	if err := p.parseAuxFiles(strings.Join(specs, ",")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pkg, err := p.parseFile("example.com/foo", file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var names []string
+	for _, m := range pkg.Interfaces[0].Methods {
+		names = append(names, m.Name)
+	}
+	if want := []string{"Reset", "Redo", "Undo", "Do", "Close"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("methods = %v, want %v", names, want)
+	}
+}
+
+func TestParseAuxFiles_NamedImports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aux_files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	auxFile := filepath.Join(dir, "ext.go")
+	if err := ioutil.WriteFile(auxFile, []byte(`package ext
+
+import (
+	tm "time"
+	_ "unsafe"
+)
+
+type Waiter interface {
+	Wait(d tm.Duration) tm.Time
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, "input.go", `package foo
+
+import "unknown.invalid/ext"
+
+type Foo interface {
+	ext.Waiter
+}
+`, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	p := newFileParser(fs, ".")
+	if err := p.parseAuxFiles("ext=" + auxFile); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pkg, err := p.parseFile("example.com/foo", file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	m := pkg.Interfaces[0].Methods[0]
+	duration := &model.NamedType{Package: "time", Type: "Duration"}
+	if len(m.In) != 1 || !reflect.DeepEqual(m.In[0].Type, duration) {
+		t.Errorf("Wait parameters = %v, want a %v", m.In, duration)
+	}
+
+	g := generator{}
+	if err := g.Generate(pkg, "foo", "example.com/foo"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out := g.buf.String()
+	for _, want := range []string{`"time"`, "Wait(d time.Duration) time.Time {"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestParsePackage_Aliases(t *testing.T) {
+	const (
+		storePath = "github.com/ssoor/implgen/internal/tests/alias_reexport/store"
+		implPath  = storePath + "/internal/impl"
+	)
+	p := newFileParser(token.NewFileSet(), ".")
+	ip, err := p.parsePackage(storePath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	wantAliases := map[string]model.Type{
+		"Store":   &model.NamedType{Package: implPath, Type: "Store"},
+		"Default": &model.NamedType{Package: storePath, Type: "Store"},
+		"Keys":    &model.ArrayType{Len: -1, Type: model.PredeclaredType("string")},
+	}
+	if !reflect.DeepEqual(ip.aliases, wantAliases) {
+		t.Errorf("aliases = %v, want %v", ip.aliases, wantAliases)
+	}
+
+	for _, test := range []struct {
+		name string
+		want model.Type
+	}{
+		{"Default", &model.NamedType{Package: implPath, Type: "Store"}},
+		{"Keys", &model.ArrayType{Len: -1, Type: model.PredeclaredType("string")}},
+		{"Missing", &model.NamedType{Package: storePath, Type: "Missing"}},
+	} {
+		if got := p.resolveAlias(&model.NamedType{Package: storePath, Type: test.name}); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("resolveAlias(%v) = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// The methods of an embedded re-exported struct are promoted.
+	pkg, err := parseSource(t, `package foo
+
+import "github.com/ssoor/implgen/internal/tests/alias_reexport/store"
+
+type cachedStore struct {
+	*store.Default
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := pkg.StructNames[0].Methods["Get"]; !ok {
+		t.Errorf("expected the method Get promoted from store.Default, got %v", pkg.StructNames[0].MethodNames)
+	}
+}
+
+func TestParseFile_LocalTypes(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+type store struct {
+	name string
+}
+
+func (s *store) Get() string { return s.name }
+
+func newStore() *store {
+	type store struct {
+		id int
+	}
+	type Getter interface {
+		Get() string
+	}
+	_ = store{}
+	return nil
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(pkg.Interfaces) != 0 {
+		t.Errorf("expected the local interface to be ignored, got %v interfaces", len(pkg.Interfaces))
+	}
+	if len(pkg.StructNames) != 1 {
+		t.Fatalf("expected only the package level struct, got %v structs", len(pkg.StructNames))
+	}
+	s := pkg.StructNames[0]
+	if len(s.Fields) != 1 || s.Fields[0].Name != "name" {
+		t.Errorf("expected the field name of the package level struct, got %v fields", len(s.Fields))
+	}
+	if !reflect.DeepEqual(s.MethodNames, []string{"Get"}) {
+		t.Errorf("got methods %v, want [Get]", s.MethodNames)
+	}
+}
+
+func TestParseFile_Cgo(t *testing.T) {
+	pkg, err := parseSource(t, `package foo
+
+// #include <stdlib.h>
+import "C"
+
+type Allocator interface {
+	Alloc(n C.size_t) *C.char
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	m := pkg.Interfaces[0].Methods[0]
+	pm := map[string]string{"C": "C"}
+	if got := m.In[0].Type.String(pm, ""); got != "C.size_t" {
+		t.Errorf("got parameter type %v, want C.size_t", got)
+	}
+	if got := m.Out[0].Type.String(pm, ""); got != "*C.char" {
+		t.Errorf("got result type %v, want *C.char", got)
+	}
+}
+
+func TestSourceMode_DotImportsFlag(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "dot_imports")
+	if err != nil {
+		t.Fatal("cannot create tempdir")
+	}
+	defer os.RemoveAll(srcDir)
+	for name, content := range map[string]string{
+		"go.mod": "module example.com/api",
+		// A snippet relying on the -imports flag, without imports.
+		"api.go": "package api\n\ntype Timer interface {\n\tAfter(d Duration) Time\n\tStop(t Token)\n}",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(srcDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("error creating %s: %v", name, err)
+		}
+	}
+	defer func(old string) { *imports = old }(*imports)
+	*imports = ".=time"
+
+	pkg, err := sourceMode(filepath.Join(srcDir, "api.go"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	after, stop := pkg.Interfaces[0].Methods[0], pkg.Interfaces[0].Methods[1]
+	pm := map[string]string{"time": "time", "example.com/api": "api"}
+	if got := after.In[0].Type.String(pm, ""); got != "time.Duration" {
+		t.Errorf("got parameter type %v, want time.Duration", got)
+	}
+	if got := after.Out[0].Type.String(pm, ""); got != "time.Time" {
+		t.Errorf("got result type %v, want time.Time", got)
+	}
+	if got := stop.In[0].Type.String(pm, ""); got != "api.Token" {
+		t.Errorf("got parameter type %v, want api.Token", got)
+	}
+	if len(pkg.DotImports) != 0 {
+		t.Errorf("expected the types to be qualified rather than dot imported, got dot imports %v", pkg.DotImports)
+	}
+}
+
+func TestSourceMode_Strict(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "strict")
+	if err != nil {
+		t.Fatal("cannot create tempdir")
+	}
+	defer os.RemoveAll(srcDir)
+	for name, content := range map[string]string{
+		"go.mod": "module example.com/api",
+		// go list can't tell the name of the package, which is guessed.
+		"api.go": "package api\n\nimport \"unknown.invalid/go-widget\"\n\ntype Maker interface {\n\tMake() widget.Widget\n}",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(srcDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("error creating %s: %v", name, err)
+		}
+	}
+	defer func(old bool) { *strict = old }(*strict)
+
+	*strict = false
+	pkg, err := sourceMode(filepath.Join(srcDir, "api.go"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if nt, ok := pkg.Interfaces[0].Methods[0].Out[0].Type.(*model.NamedType); !ok || nt.Package != "unknown.invalid/go-widget" {
+		t.Errorf("got result type %#v, want a type of unknown.invalid/go-widget", pkg.Interfaces[0].Methods[0].Out[0].Type)
+	}
+
+	*strict = true
+	_, err = sourceMode(filepath.Join(srcDir, "api.go"))
+	if err == nil || !strings.Contains(err.Error(), "api.go:6:9: the name of package unknown.invalid/go-widget is guessed") {
+		t.Errorf("expected an error for the guessed package name, got %v", err)
+	}
+}
+
+func TestSourceMode_DotImportedEmbed(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "dot_imported_embed")
+	if err != nil {
+		t.Fatal("cannot create tempdir")
+	}
+	defer os.RemoveAll(srcDir)
+	for name, content := range map[string]string{
+		"go.mod": "module example.com/api",
+		"api.go": "package api\n\nimport . \"io\"\n\ntype Source interface {\n\tReader\n\tName() string\n}",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(srcDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("error creating %s: %v", name, err)
+		}
+	}
+
+	pkg, err := sourceMode(filepath.Join(srcDir, "api.go"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	intf := pkg.Interfaces[0]
+	var names []string
+	for _, m := range intf.Methods {
+		names = append(names, m.Name)
+	}
+	if want := []string{"Read", "Name"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("got methods %v, want %v", names, want)
+	}
+	if got := intf.Methods[0].In[0].Type.String(nil, ""); got != "[]byte" {
+		t.Errorf("got Read parameter type %v, want []byte", got)
+	}
+	if len(intf.Embeds) != 1 || intf.Embeds[0].Package != "io" || intf.Embeds[0].Type != "Reader" {
+		t.Errorf("got embeds %v, want io.Reader", intf.Embeds)
+	}
+}
+
+func TestSourceMode_ReplacedModule(t *testing.T) {
+	root, err := ioutil.TempDir("", "replaced_module")
+	if err != nil {
+		t.Fatal("cannot create tempdir")
+	}
+	defer os.RemoveAll(root)
+	for name, content := range map[string]string{
+		// The dependency isn't required, which build.Import can't resolve.
+		"api/go.mod":   "module example.com/api\n\nreplace unknown.invalid/dep => ../dep\n",
+		"api/api.go":   "package api\n\nimport \"unknown.invalid/dep/io\"\n\ntype ReadCloser interface {\n\tio.Closer\n\tRead(p []byte) (int, error)\n}",
+		"dep/go.mod":   "module unknown.invalid/dep",
+		"dep/io/io.go": "package io\n\ntype Closer interface {\n\tClose() error\n}",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("error creating %s: %v", name, err)
+		}
+	}
+
+	pkg, err := sourceMode(filepath.Join(root, "api", "api.go"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var names []string
+	for _, m := range pkg.Interfaces[0].Methods {
+		names = append(names, m.Name)
+	}
+	if want := []string{"Close", "Read"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got methods %v, want %v", names, want)
+	}
+}
+
+func TestSourceMode_VendoredModule(t *testing.T) {
+	root, err := ioutil.TempDir("", "vendored_module")
+	if err != nil {
+		t.Fatal("cannot create tempdir")
+	}
+	defer os.RemoveAll(root)
+	for name, content := range map[string]string{
+		"go.mod":                              "module example.com/api\n\ngo 1.20\n\nrequire unknown.invalid/dep v1.0.0\n",
+		"api.go":                              "package api\n\nimport \"unknown.invalid/dep/io\"\n\ntype ReadCloser interface {\n\tio.ReadCloser\n\tPeek(n int) ([]byte, error)\n}",
+		"vendor/modules.txt":                  "# unknown.invalid/dep v1.0.0\n## explicit; go 1.20\nunknown.invalid/dep/io\n",
+		"vendor/unknown.invalid/dep/io/io.go": "package io\n\ntype Reader interface {\n\tRead(p []byte) (int, error)\n}\n\ntype ReadCloser interface {\n\tReader\n\tClose() error\n}",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("error creating %s: %v", name, err)
+		}
+	}
+
+	pkg, err := sourceMode(filepath.Join(root, "api.go"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var names []string
+	for _, m := range pkg.Interfaces[0].Methods {
+		names = append(names, m.Name)
+	}
+	if want := []string{"Read", "Close", "Peek"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got methods %v, want %v", names, want)
+	}
+}
+
+func TestImplementMode(t *testing.T) {
+	pkg, err := implementMode("io.Reader")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	g := generator{}
+	if err := g.Generate(pkg, "impl", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out := g.buf.String()
+	for _, want := range []string{
+		"package impl",
+		"type Reader struct",
+		"func (m *Reader) Read(p []byte) (n int, err error) {",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	if _, err := implementMode("io.Reader,fmt.Stringer"); err == nil || !strings.Contains(err.Error(), "several packages") {
+		t.Errorf("expected an error for interfaces of several packages, got %v", err)
+	}
+	if _, err := implementMode("io.Nope"); err == nil || !strings.Contains(err.Error(), "no interface Nope in package io") {
+		t.Errorf("expected an error for an unknown interface, got %v", err)
+	}
+}
+
+func TestInlineMode(t *testing.T) {
+	pkg, err := inlineMode(`import "context"
+
+type Foo interface {
+	Bar(ctx context.Context, n int) error
+}`, "foo")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	g := generator{srcPackage: "-inline"}
+	if err := g.Generate(pkg, "foo", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out := g.buf.String()
+	for _, want := range []string{
+		"package foo",
+		"type Foo struct",
+		"func (m *Foo) Bar(ctx context.Context, n int) error {",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	pkg, err = inlineMode("// Foo is documented.\ntype Foo interface { Bar() }", "foo")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := []string{"// Foo is documented."}; !reflect.DeepEqual(pkg.Interfaces[0].Doc, want) {
+		t.Errorf("got doc %q, want %q", pkg.Interfaces[0].Doc, want)
+	}
+
+	for _, test := range []struct {
+		snippet, err string
+	}{
+		{"type Foo interface { Bar( }", "failed parsing -inline: inline:1:"},
+		{"type Foo struct{}", "no interface in -inline"},
+	} {
+		if _, err := inlineMode(test.snippet, "foo"); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("inlineMode(%q) error = %v, want it to contain %q", test.snippet, err, test.err)
+		}
+	}
+}
+
+func TestGuessPackageName(t *testing.T) {
+	for _, test := range []struct {
+		importPath, want string
+	}{
+		{"context", "context"},
+		{"github.com/foo/bar", "bar"},
+		{"gopkg.in/yaml.v2", "yaml"},
+		{"github.com/foo/go-bar", "bar"},
+		{"github.com/foo/bar-go", "bar"},
+		{"github.com/foo/bar/v3", "bar"},
+		{"github.com/foo/go-bar.v2/v4", "bar"},
+		{"v2", "v2"},
+		// limits of the guess: the package is foo, go list would tell it
+		{"github.com/foo/foo-lib", "foo-lib"},
+	} {
+		if got := guessPackageName(test.importPath); got != test.want {
+			t.Errorf("guessPackageName(%q) = %q, want %q", test.importPath, got, test.want)
+		}
+	}
+}
+
+func TestImportsOfFile_Guess(t *testing.T) {
+	file, err := parser.ParseFile(token.NewFileSet(), "input.go", `package foo
+
+import (
+	"unknown.invalid/go-bar"
+	"unknown.invalid/yaml.v2"
+	"github.com/ssoor/implgen/internal/tests/custom_package_name/client/v1"
+)
+`, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	imports, _ := importsOfFile(file)
+	for name, want := range map[string]string{
+		"bar":    "unknown.invalid/go-bar",
+		"yaml":   "unknown.invalid/yaml.v2",
+		"client": "github.com/ssoor/implgen/internal/tests/custom_package_name/client/v1",
+	} {
+		if imp, ok := imports[name]; !ok || imp.Path() != want {
+			t.Errorf("import %v = %v, want %v", name, imp, want)
+		}
+	}
+}
@@ -18,32 +18,43 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"flag"
+	"fmt"
 	"go/build"
+	"go/token"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
+	"unicode"
 
 	"github.com/ssoor/implgen/model"
+	"golang.org/x/mod/modfile"
 )
 
 var (
-	progOnly   = flag.Bool("prog_only", false, "(reflect mode) Only generate the reflection program; write it to stdout and exit.")
-	execOnly   = flag.String("exec_only", "", "(reflect mode) If set, execute this reflection program.")
-	buildFlags = flag.String("build_flags", "", "(reflect mode) Additional flags for go build.")
+	progOnly       = flag.Bool("prog_only", false, "(reflect mode) Only generate the reflection program; write it to stdout and exit.")
+	progIgnore     = flag.Bool("prog_build_ignore", false, "(reflect mode) With -prog_only, give the reflection program a //go:build ignore constraint, so saving it into a package doesn't add it to the build.")
+	execOnly       = flag.String("exec_only", "", "(reflect mode) If set, execute this reflection program.")
+	buildFlags     = flag.String("build_flags", "", "(reflect mode) Additional flags for go build.")
+	reflectTimeout = flag.Duration("reflect_timeout", 2*time.Minute, "(reflect mode) Time limit for building and running the reflection program, 0 for none.")
 )
 
-func writeProgram(importPath string, symbols []string) ([]byte, error) {
+// writeProgram returns the reflection program of the symbols of the
+// package, with a //go:build ignore constraint if buildIgnore is set.
+func writeProgram(importPath string, symbols []string, buildIgnore bool) ([]byte, error) {
 	var program bytes.Buffer
 	data := reflectData{
-		ImportPath: importPath,
-		Symbols:    symbols,
+		ImportPath:  importPath,
+		Symbols:     symbols,
+		BuildIgnore: buildIgnore,
 	}
 	if err := reflectProgram.Execute(&program, &data); err != nil {
 		return nil, err
@@ -51,8 +62,20 @@ func writeProgram(importPath string, symbols []string) ([]byte, error) {
 	return program.Bytes(), nil
 }
 
+// runCommand runs cmd, created with ctx, with a clear error if ctx expires
+// first and the command is killed.
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%v timed out, see -reflect_timeout", strings.Join(cmd.Args, " "))
+		}
+		return err
+	}
+	return nil
+}
+
 // run the given program and parse the output as a model.Package.
-func run(program string) (*model.Package, error) {
+func run(ctx context.Context, program string) (*model.Package, error) {
 	f, err := ioutil.TempFile("", "")
 	if err != nil {
 		return nil, err
@@ -65,10 +88,10 @@ func run(program string) (*model.Package, error) {
 	}
 
 	// Run the program.
-	cmd := exec.Command(program, "-output", filename)
+	cmd := exec.CommandContext(ctx, program, "-output", filename)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+	if err := runCommand(ctx, cmd); err != nil {
 		return nil, err
 	}
 
@@ -92,7 +115,7 @@ func run(program string) (*model.Package, error) {
 
 // runInDir writes the given program into the given dir, runs it there, and
 // parses the output as a model.Package.
-func runInDir(program []byte, dir string) (*model.Package, error) {
+func runInDir(ctx context.Context, program []byte, dir string) (*model.Package, error) {
 	// We use TempDir instead of TempFile so we can control the filename.
 	tmpDir, err := ioutil.TempDir(dir, "gomock_reflect_")
 	if err != nil {
@@ -100,7 +123,7 @@ func runInDir(program []byte, dir string) (*model.Package, error) {
 	}
 	defer func() {
 		if err := os.RemoveAll(tmpDir); err != nil {
-			log.Printf("failed to remove temp directory: %s", err)
+			logf("failed to remove temp directory: %s", err)
 		}
 	}()
 	const progSource = "prog.go"
@@ -114,34 +137,102 @@ func runInDir(program []byte, dir string) (*model.Package, error) {
 		return nil, err
 	}
 
-	cmdArgs := []string{}
-	cmdArgs = append(cmdArgs, "build")
-	if *buildFlags != "" {
-		cmdArgs = append(cmdArgs, strings.Split(*buildFlags, " ")...)
-	}
-	cmdArgs = append(cmdArgs, "-o", progBinary, progSource)
-
 	// Build the program.
-	cmd := exec.Command("go", cmdArgs...)
+	cmd, err := buildCommand(ctx, *buildFlags, progBinary, progSource)
+	if err != nil {
+		return nil, err
+	}
 	cmd.Dir = tmpDir
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+	if err := runCommand(ctx, cmd); err != nil {
 		return nil, err
 	}
 
-	return run(filepath.Join(tmpDir, progBinary))
+	return run(ctx, filepath.Join(tmpDir, progBinary))
+}
+
+// buildCommand returns the go build command building the source into the
+// binary with the given -build_flags.
+func buildCommand(ctx context.Context, flags, binary, source string) (*exec.Cmd, error) {
+	cmdArgs := []string{"build"}
+	extra, err := splitFlags(flags)
+	if err != nil {
+		return nil, fmt.Errorf("bad -build_flags: %v", err)
+	}
+	cmdArgs = append(cmdArgs, extra...)
+	cmdArgs = append(cmdArgs, "-o", binary, source)
+	return exec.CommandContext(ctx, "go", cmdArgs...), nil
+}
+
+// splitFlags splits the flags at white space, like a shell: single or
+// double quotes group words, e.g. -ldflags='-s -w', and a backslash escapes
+// the next character outside of single quotes.
+func splitFlags(flags string) ([]string, error) {
+	var (
+		args    []string
+		arg     strings.Builder
+		inArg   bool
+		quote   rune // the open quote, or 0
+		escaped bool
+	)
+	for _, r := range flags {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", flags)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
 }
 
 // reflectMode generates mocks via reflection on an interface.
 func reflectMode(importPath string, symbols []string) (*model.Package, error) {
-	// TODO: sanity check arguments
+	// The reflection program is built outside of the package, so it can
+	// only refer to exported symbols.
+	for _, sym := range symbols {
+		if !token.IsExported(sym) {
+			return nil, fmt.Errorf("reflect mode can't access unexported interface %v of %v, use source mode instead: -source=<file declaring %v>", sym, importPath, sym)
+		}
+	}
+
+	ctx := context.Background()
+	if *reflectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *reflectTimeout)
+		defer cancel()
+	}
 
 	if *execOnly != "" {
-		return run(*execOnly)
+		return run(ctx, *execOnly)
 	}
 
-	program, err := writeProgram(importPath, symbols)
+	program, err := writeProgram(importPath, symbols, *progOnly && *progIgnore)
 	if err != nil {
 		return nil, err
 	}
@@ -154,34 +245,129 @@ func reflectMode(importPath string, symbols []string) (*model.Package, error) {
 	}
 
 	wd, _ := os.Getwd()
+	var pkgDir string
+	if p, err := build.Import(importPath, wd, build.FindOnly); err == nil {
+		pkgDir = p.Dir
+		if toolchain, err := goVersion(ctx); err == nil {
+			if warning := goVersionMismatch(pkgDir, toolchain); warning != "" {
+				logf("warning: %v", warning)
+			}
+		}
+	}
 
 	// Try to run the reflection program  in the current working directory.
-	if p, err := runInDir(program, wd); err == nil {
-		return p, nil
+	p, err := runInDir(ctx, program, wd)
+	if err == nil || ctx.Err() != nil {
+		return p, err
 	}
 
 	// Try to run the program in the same directory as the input package.
-	if p, err := build.Import(importPath, wd, build.FindOnly); err == nil {
-		dir := p.Dir
-		if p, err := runInDir(program, dir); err == nil {
-			return p, nil
+	if pkgDir != "" {
+		p, err := runInDir(ctx, program, pkgDir)
+		if err == nil || ctx.Err() != nil {
+			return p, err
 		}
 	}
 
 	// Try to run it in a standard temp directory.
-	return runInDir(program, "")
+	return runInDir(ctx, program, "")
+}
+
+// goVersion returns the version of the go on PATH, e.g. go1.21.3, as
+// reported by go version.
+func goVersion(ctx context.Context) (string, error) {
+	out, err := exec.CommandContext(ctx, "go", "version").Output()
+	if err != nil {
+		return "", err
+	}
+	// go version go1.21.3 linux/amd64
+	fields := strings.Fields(string(out))
+	if len(fields) < 3 {
+		return "", fmt.Errorf("unexpected go version output %q", out)
+	}
+	return fields[2], nil
+}
+
+// goVersionMismatch returns why the reflection program of the package in
+// dir may not build with the toolchain, the version reported by go version,
+// if the go directive of the module of the package requires a newer go, or
+// the empty string.
+func goVersionMismatch(dir, toolchain string) string {
+	required, gomod := moduleGoVersion(dir)
+	if required == "" || !strings.HasPrefix(toolchain, "go") {
+		// No module, or a development toolchain, e.g. devel go1.23-abc.
+		return ""
+	}
+	if compareGoVersions(required, strings.TrimPrefix(toolchain, "go")) <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%v requires go %v, but go version is %v: the reflection program may fail to build, install a newer go or use source mode", gomod, required, toolchain)
+}
+
+// moduleGoVersion returns the go directive of the go.mod of the module
+// containing dir, and the go.mod file, or empty strings if there's none.
+func moduleGoVersion(dir string) (version, gomod string) {
+	for {
+		gomod = filepath.Join(dir, "go.mod")
+		if data, err := ioutil.ReadFile(gomod); err == nil {
+			f, err := modfile.ParseLax(gomod, data, nil)
+			if err != nil || f.Go == nil {
+				return "", ""
+			}
+			return f.Go.Version, gomod
+		}
+		if dir == filepath.Dir(dir) {
+			return "", ""
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// compareGoVersions compares the go versions, e.g. 1.21 and 1.21.3, by
+// their numbers, ignoring any prerelease suffix, e.g. rc1, and returns -1,
+// 0 or 1 like strings.Compare. A missing number counts as 0.
+func compareGoVersions(v1, v2 string) int {
+	n1, n2 := strings.Split(v1, "."), strings.Split(v2, ".")
+	for i := 0; i < len(n1) || i < len(n2); i++ {
+		var x1, x2 int
+		if i < len(n1) {
+			x1 = leadingNumber(n1[i])
+		}
+		if i < len(n2) {
+			x2 = leadingNumber(n2[i])
+		}
+		if x1 < x2 {
+			return -1
+		} else if x1 > x2 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// leadingNumber returns the number s starts with, e.g. 22 for 22rc1.
+func leadingNumber(s string) int {
+	end := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if end < 0 {
+		end = len(s)
+	}
+	n, _ := strconv.Atoi(s[:end])
+	return n
 }
 
 type reflectData struct {
-	ImportPath string
-	Symbols    []string
+	ImportPath  string
+	Symbols     []string
+	BuildIgnore bool
 }
 
 // This program reflects on an interface value, and prints the
 // gob encoding of a model.Package to standard output.
 // JSON doesn't work because of the model.Type interface.
 var reflectProgram = template.Must(template.New("program").Parse(`
-package main
+{{if .BuildIgnore}}//go:build ignore
+
+{{end}}package main
 
 import (
 	"encoding/gob"
@@ -213,17 +399,32 @@ func main() {
 		// NOTE: This behaves contrary to documented behaviour if the
 		// package name is not the final component of the import path.
 		// The reflect package doesn't expose the package name, though.
-		Name: path.Base({{printf "%q" .ImportPath}}),
+		Name:    path.Base({{printf "%q" .ImportPath}}),
+		PkgPath: {{printf "%q" .ImportPath}},
 	}
 
 	for _, it := range its {
-		intf, err := model.InterfaceFromInterfaceType(it.typ)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Reflection: %v\n", err)
+		switch it.typ.Kind() {
+		case reflect.Interface:
+			intf, err := model.InterfaceFromInterfaceType(it.typ)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Reflection: %v\n", err)
+				os.Exit(1)
+			}
+			intf.Name = it.sym
+			pkg.Interfaces = append(pkg.Interfaces, intf)
+		case reflect.Struct:
+			s, err := model.StructFromStructType(it.typ)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Reflection: %v\n", err)
+				os.Exit(1)
+			}
+			s.Name = it.sym
+			pkg.StructNames = append(pkg.StructNames, s)
+		default:
+			fmt.Fprintf(os.Stderr, "Reflection: %v is neither an interface nor a struct\n", it.sym)
 			os.Exit(1)
 		}
-		intf.Name = it.sym
-		pkg.Interfaces = append(pkg.Interfaces, intf)
 	}
 
 	outfile := os.Stdout
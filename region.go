@@ -0,0 +1,146 @@
+package main
+
+// This file contains the splicing of the output into the marked region of
+// an existing file with -region.
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+const (
+	regionStart = "// implgen:start" // line starting the region replaced by the output
+	regionEnd   = "// implgen:end"   // line ending it
+)
+
+// spliceRegion returns old with the lines between its regionStart and
+// regionEnd lines replaced by the declarations of the generated file src,
+// and with the imports of src it lacks. The rest of old is left alone.
+func spliceRegion(old, src []byte) ([]byte, error) {
+	lines := splitLines(string(old))
+	start, end := -1, -1
+	for i, l := range lines {
+		switch strings.TrimSpace(l) {
+		case regionStart:
+			if start >= 0 {
+				return nil, fmt.Errorf("more than one %v line, at lines %d and %d", regionStart, start+1, i+1)
+			}
+			start = i
+		case regionEnd:
+			if end >= 0 {
+				return nil, fmt.Errorf("more than one %v line, at lines %d and %d", regionEnd, end+1, i+1)
+			}
+			end = i
+		}
+	}
+	switch {
+	case start < 0:
+		return nil, fmt.Errorf("no %v line", regionStart)
+	case end < 0:
+		return nil, fmt.Errorf("no %v line", regionEnd)
+	case end < start:
+		return nil, fmt.Errorf("the %v line %d comes before the %v line %d", regionEnd, end+1, regionStart, start+1)
+	}
+	startOff := len(strings.Join(lines[:start], ""))
+	endOff := len(strings.Join(lines[:end], ""))
+
+	fs := token.NewFileSet()
+	dst, err := parser.ParseFile(fs, "", old, parser.ImportsOnly)
+	if err != nil {
+		return nil, err
+	}
+	gen, err := parser.ParseFile(fs, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing the output: %v", err)
+	}
+
+	// The imports the region lacks go after the ones of old.
+	importOff := fs.Position(dst.Name.End()).Offset
+	for _, decl := range dst.Decls {
+		if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+			importOff = fs.Position(gd.End()).Offset
+		}
+	}
+	if importOff > startOff {
+		return nil, fmt.Errorf("the %v line %d comes before the imports", regionStart, start+1)
+	}
+	missing, err := missingImports(dst.Imports, gen.Imports)
+	if err != nil {
+		return nil, err
+	}
+
+	// The declarations of src follow its imports, or its package clause.
+	declOff := fs.Position(gen.Name.End()).Offset
+	for _, decl := range gen.Decls {
+		if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+			declOff = fs.Position(gd.End()).Offset
+		}
+	}
+	decls := strings.TrimSpace(string(src[declOff:]))
+
+	var out strings.Builder
+	out.Write(old[:importOff])
+	if len(missing) > 0 {
+		out.WriteString("\n\nimport (\n")
+		for _, spec := range missing {
+			out.WriteString("\t" + spec + "\n")
+		}
+		out.WriteString(")")
+	}
+	out.Write(old[importOff:startOff])
+	out.WriteString(lines[start])
+	if decls != "" {
+		out.WriteString("\n" + decls + "\n\n")
+	}
+	out.Write(old[endOff:])
+	return []byte(out.String()), nil
+}
+
+// missingImports returns the specs of the imports of gen missing from have,
+// with the names gen gives them. An import of have without a name is taken
+// to have the name of its package, guessed from its path. It fails if a name
+// gen needs is taken by another import of have.
+func missingImports(have, gen []*ast.ImportSpec) ([]string, error) {
+	names := make(map[string]string) // name => path of the imports of have
+	for _, is := range have {
+		pth, err := strconv.Unquote(is.Path.Value)
+		if err != nil {
+			return nil, err
+		}
+		name := guessPackageName(pth)
+		if is.Name != nil {
+			name = is.Name.Name
+		}
+		names[importKey(name, pth)] = pth
+	}
+	var missing []string
+	for _, is := range gen {
+		pth, err := strconv.Unquote(is.Path.Value)
+		if err != nil {
+			return nil, err
+		}
+		name := is.Name.Name
+		if other, ok := names[importKey(name, pth)]; ok {
+			if other != pth {
+				return nil, fmt.Errorf("the output imports %v as %v, which the file uses for %v", pth, name, other)
+			}
+			continue
+		}
+		names[importKey(name, pth)] = pth
+		missing = append(missing, fmt.Sprintf("%v %q", name, pth))
+	}
+	return missing, nil
+}
+
+// importKey returns the key of the import of pth as name in the names of
+// missingImports: the name, but for dot imports, which don't take one.
+func importKey(name, pth string) string {
+	if name == "." {
+		return name + " " + pth
+	}
+	return name
+}
@@ -0,0 +1,89 @@
+package main
+
+// This file contains the summary of the generation printed by -report.
+
+import (
+	"fmt"
+	"io"
+)
+
+// genReport collects what the generators did for the -report summary. The
+// generators of the -impl_packages outputs share one. A nil *genReport
+// collects nothing.
+type genReport struct {
+	implemented map[string]bool   // names of the implemented interfaces
+	methods     int               // number of generated methods
+	files       []string          // written files, in order
+	skipped     map[string]string // interface name => reason it was skipped
+	skipOrder   []string          // skipped interface names, in order
+	empty       []string          // implemented interfaces without methods
+}
+
+func newGenReport() *genReport {
+	return &genReport{implemented: make(map[string]bool), skipped: make(map[string]string)}
+}
+
+// implement records that the interface is implemented.
+func (r *genReport) implement(name string) {
+	if r != nil {
+		r.implemented[name] = true
+	}
+}
+
+// skip records that the interface isn't implemented, keeping the first
+// reason given.
+func (r *genReport) skip(name, reason string) {
+	if r == nil {
+		return
+	}
+	if _, ok := r.skipped[name]; !ok {
+		r.skipped[name] = reason
+		r.skipOrder = append(r.skipOrder, name)
+	}
+}
+
+// method records a generated method.
+func (r *genReport) method() {
+	if r != nil {
+		r.methods++
+	}
+}
+
+// wrote records a written file.
+func (r *genReport) wrote(name string) {
+	if r != nil {
+		r.files = append(r.files, name)
+	}
+}
+
+// emptyInterface records an implemented interface without methods.
+func (r *genReport) emptyInterface(name string) {
+	if r != nil {
+		r.empty = append(r.empty, name)
+	}
+}
+
+// print writes the summary to w. An interface skipped by one output but
+// implemented by another, e.g. with -impl_packages, isn't reported skipped.
+func (r *genReport) print(w io.Writer) {
+	fmt.Fprintf(w, "implgen: %v, %v, %v written\n", plural(len(r.implemented), "interface"), plural(r.methods, "method"), plural(len(r.files), "file"))
+	for _, name := range r.files {
+		fmt.Fprintf(w, "implgen: wrote %v\n", name)
+	}
+	for _, name := range r.skipOrder {
+		if !r.implemented[name] {
+			fmt.Fprintf(w, "implgen: skipped %v: %v\n", name, r.skipped[name])
+		}
+	}
+	for _, name := range r.empty {
+		fmt.Fprintf(w, "implgen: empty %v: implemented without methods\n", name)
+	}
+}
+
+// plural returns n followed by noun, with an s unless n is 1.
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%v %v", n, noun)
+	}
+	return fmt.Sprintf("%v %vs", n, noun)
+}